@@ -3,7 +3,7 @@ package api
 import (
     "time"
 
-    "github.com/SangBejoo/service-parking/models"
+    "github.com/SangBejoo/service-parking/Models"
 )
 
 func GetDummyVehicles() []*models.Vehicle {
@@ -0,0 +1,96 @@
+package services
+
+import "math"
+
+// WGS84 ellipsoid parameters
+const (
+    earthRadius     = 6371008.8 // mean radius in metres, used by haversine
+    wgs84SemiMajor  = 6378137.0
+    wgs84Flattening = 1 / 298.257223563
+    wgs84SemiMinor  = wgs84SemiMajor * (1 - wgs84Flattening)
+)
+
+// DistanceFunc returns the distance in metres between two points given in degrees
+type DistanceFunc func(lat1, lon1, lat2, lon2 float64) float64
+
+// Haversine returns the great-circle distance in metres on a spherical earth.
+// It is fast and accurate to about 0.5%.
+func Haversine(lat1, lon1, lat2, lon2 float64) float64 {
+    phi1, phi2 := toRadians(lat1), toRadians(lat2)
+    dPhi := phi2 - phi1
+    dLambda := toRadians(lon2 - lon1)
+
+    a := math.Sin(dPhi/2)*math.Sin(dPhi/2) +
+        math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+    return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Vincenty returns the geodesic distance in metres on the WGS84 ellipsoid
+// using Vincenty's inverse formula, accurate to within a millimetre. Nearly
+// antipodal points, where the iteration does not converge, fall back to
+// Haversine.
+func Vincenty(lat1, lon1, lat2, lon2 float64) float64 {
+    if lat1 == lat2 && lon1 == lon2 {
+        return 0
+    }
+
+    f := wgs84Flattening
+    L := toRadians(lon2 - lon1)
+    U1 := math.Atan((1 - f) * math.Tan(toRadians(lat1)))
+    U2 := math.Atan((1 - f) * math.Tan(toRadians(lat2)))
+    sinU1, cosU1 := math.Sincos(U1)
+    sinU2, cosU2 := math.Sincos(U2)
+
+    lambda := L
+    for i := 0; i < 200; i++ {
+        sinLambda, cosLambda := math.Sincos(lambda)
+        sinSigma := math.Sqrt(math.Pow(cosU2*sinLambda, 2) +
+            math.Pow(cosU1*sinU2-sinU1*cosU2*cosLambda, 2))
+        if sinSigma == 0 {
+            return 0 // coincident points
+        }
+        cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+        sigma := math.Atan2(sinSigma, cosSigma)
+        sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+        cosSqAlpha := 1 - sinAlpha*sinAlpha
+        cos2SigmaM := 0.0
+        if cosSqAlpha != 0 {
+            cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha // equatorial lines have cosSqAlpha = 0
+        }
+        C := f / 16 * cosSqAlpha * (4 + f*(4-3*cosSqAlpha))
+
+        previous := lambda
+        lambda = L + (1-C)*f*sinAlpha*
+            (sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+        if math.Abs(lambda-previous) < 1e-12 {
+            uSq := cosSqAlpha * (wgs84SemiMajor*wgs84SemiMajor - wgs84SemiMinor*wgs84SemiMinor) /
+                (wgs84SemiMinor * wgs84SemiMinor)
+            A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+            B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+            deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+                B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+            return wgs84SemiMinor * A * (sigma - deltaSigma)
+        }
+    }
+    return Haversine(lat1, lon1, lat2, lon2)
+}
+
+// MetersPerDegreeLat returns the length of one degree of latitude at a latitude
+func MetersPerDegreeLat(lat float64) float64 {
+    phi := toRadians(lat)
+    return 111132.92 - 559.82*math.Cos(2*phi) + 1.175*math.Cos(4*phi) - 0.0023*math.Cos(6*phi)
+}
+
+// MetersPerDegreeLon returns the length of one degree of longitude at a latitude
+func MetersPerDegreeLon(lat float64) float64 {
+    phi := toRadians(lat)
+    return 111412.84*math.Cos(phi) - 93.5*math.Cos(3*phi) + 0.118*math.Cos(5*phi)
+}
+
+func toRadians(deg float64) float64 {
+    return deg * math.Pi / 180
+}
+
+func toDegrees(rad float64) float64 {
+    return rad * 180 / math.Pi
+}
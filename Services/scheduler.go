@@ -4,8 +4,8 @@ import (
     "time"
 
     gron "github.com/roylee0704/gron"
-    "github.com/SangBejoo/service-parking/models"
-    "github.com/SangBejoo/service-parking/api"
+    "github.com/SangBejoo/service-parking/Models"
+    "github.com/SangBejoo/service-parking/Api"
 )
 
 type Scheduler struct {
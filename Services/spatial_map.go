@@ -1,29 +1,262 @@
 package services
 
 import (
+    "errors"
     "fmt"
     "math"
+    "sort"
     "sync"
 
-    "github.com/SangBejoo/service-parking/models"
+    "github.com/SangBejoo/service-parking/Models"
 )
 
+// Projection controls how cell sizes in metres are turned into degrees
+type Projection int
+
+const (
+    // ProjectionLatitudeBands keeps cells roughly square in metres: every row
+    // of cells is a latitude band whose cell width in degrees is derived from
+    // the band's own latitude
+    ProjectionLatitudeBands Projection = iota
+    // ProjectionEquirectangular uses the same size in degrees everywhere,
+    // converted from metres at the equator. Cells narrow towards the poles.
+    ProjectionEquirectangular
+)
+
+// ErrCellFull is returned when a cell already holds the maximum number of vehicles
+var ErrCellFull = errors.New("spatial map cell is full")
+
+// Option configures a SpatialMap
+type Option func(*SpatialMap)
+
+// WithCellSize sets the cell size in metres
+func WithCellSize(meters float64) Option {
+    return func(sm *SpatialMap) {
+        if meters > 0 {
+            sm.cellSize = meters
+        }
+    }
+}
+
+// WithProjection sets how the grid is laid out
+func WithProjection(projection Projection) Option {
+    return func(sm *SpatialMap) {
+        sm.projection = projection
+    }
+}
+
+// WithMaxVehiclesPerCell caps how many vehicles a cell may hold; 0 means no limit
+func WithMaxVehiclesPerCell(max int) Option {
+    return func(sm *SpatialMap) {
+        sm.maxPerCell = max
+    }
+}
+
+// WithDistance sets the distance function used by queries, Haversine by default
+func WithDistance(distance DistanceFunc) Option {
+    return func(sm *SpatialMap) {
+        if distance != nil {
+            sm.distance = distance
+        }
+    }
+}
+
 type SpatialMap struct {
-    cells    map[string]map[string]*models.Vehicle
-    gridSize float64
-    mutex    *sync.RWMutex
+    cells      map[string]map[string]*models.Vehicle
+    vehicles   map[string]string // vehicle ID -> cell key
+    cellSize   float64           // metres
+    latStep    float64           // degrees of latitude per row
+    projection Projection
+    maxPerCell int
+    distance   DistanceFunc
+    mutex      *sync.RWMutex
+}
+
+// NewSpatialMap creates a spatial index. Without options cells are about
+// 1.1 km, matching the former fixed 0.01° grid at the equator.
+func NewSpatialMap(opts ...Option) *SpatialMap {
+    sm := &SpatialMap{
+        cells:      make(map[string]map[string]*models.Vehicle),
+        vehicles:   make(map[string]string),
+        cellSize:   0.01 * MetersPerDegreeLat(0),
+        projection: ProjectionLatitudeBands,
+        distance:   Haversine,
+        mutex:      &sync.RWMutex{},
+    }
+    for _, opt := range opts {
+        opt(sm)
+    }
+    sm.latStep = sm.cellSize / MetersPerDegreeLat(0)
+    return sm
 }
 
-func NewSpatialMap() *SpatialMap {
-    return &SpatialMap{
-        cells:    make(map[string]map[string]*models.Vehicle),
-        gridSize: 0.01,
-        mutex:    &sync.RWMutex{},
+// lonStep returns the width in degrees of the cells in a row
+func (sm *SpatialMap) lonStep(row int) float64 {
+    if sm.projection == ProjectionEquirectangular {
+        return sm.cellSize / MetersPerDegreeLon(0)
     }
+    // Size the band by its edge nearest the equator so no cell is narrower than cellSize
+    lat := math.Min(math.Abs(float64(row)*sm.latStep), math.Abs(float64(row+1)*sm.latStep))
+    perDegree := MetersPerDegreeLon(math.Min(lat, 89.9))
+    return math.Min(sm.cellSize/perDegree, 360)
+}
+
+func (sm *SpatialMap) cellOf(lat, lon float64) (int, int) {
+    row := int(math.Floor(lat / sm.latStep))
+    return row, int(math.Floor(normalizeLon(lon) / sm.lonStep(row)))
+}
+
+// normalizeLon wraps a longitude into [-180, 180)
+func normalizeLon(lon float64) float64 {
+    return lon - 360*math.Floor((lon+180)/360)
 }
 
 func (sm *SpatialMap) hashKey(lat, lon float64) string {
-    return fmt.Sprintf("%d:%d",
-        int(math.Floor(lat/sm.gridSize)),
-        int(math.Floor(lon/sm.gridSize)))
+    row, col := sm.cellOf(lat, lon)
+    return cellKey(row, col)
+}
+
+func cellKey(row, col int) string {
+    return fmt.Sprintf("%d:%d", row, col)
+}
+
+// Upsert adds a vehicle or moves it to the cell of its current position.
+// When that cell is full the vehicle is dropped from the map, so it is never
+// found at a position it has left, and ErrCellFull is returned.
+func (sm *SpatialMap) Upsert(v *models.Vehicle) error {
+    sm.mutex.Lock()
+    defer sm.mutex.Unlock()
+
+    key := sm.hashKey(v.Latitude, v.Longitude)
+    previous, known := sm.vehicles[v.ID]
+    if !known || previous != key {
+        if known {
+            sm.removeLocked(v.ID)
+        }
+        if sm.maxPerCell > 0 && len(sm.cells[key]) >= sm.maxPerCell {
+            return ErrCellFull
+        }
+    }
+
+    if sm.cells[key] == nil {
+        sm.cells[key] = make(map[string]*models.Vehicle)
+    }
+    sm.cells[key][v.ID] = v
+    sm.vehicles[v.ID] = key
+    return nil
+}
+
+// Remove deletes a vehicle from the map
+func (sm *SpatialMap) Remove(id string) {
+    sm.mutex.Lock()
+    defer sm.mutex.Unlock()
+    sm.removeLocked(id)
+}
+
+func (sm *SpatialMap) removeLocked(id string) {
+    key, ok := sm.vehicles[id]
+    if !ok {
+        return
+    }
+    delete(sm.cells[key], id)
+    if len(sm.cells[key]) == 0 {
+        delete(sm.cells, key)
+    }
+    delete(sm.vehicles, id)
+}
+
+// searchMargin widens the spherical search window so that ellipsoidal
+// distance functions cannot miss vehicles at its edge
+const searchMargin = 1.01
+
+// Nearby returns the vehicles within radius metres of a point, nearest first.
+// Searches wrap across the antimeridian and cover every longitude when the
+// circle contains a pole.
+func (sm *SpatialMap) Nearby(lat, lon, radius float64) []*models.Vehicle {
+    sm.mutex.RLock()
+    defer sm.mutex.RUnlock()
+
+    type candidate struct {
+        vehicle  *models.Vehicle
+        distance float64
+    }
+    var found []candidate
+
+    // Visit every cell that can intersect the circle, then filter by true
+    // distance. The circle's bounds follow from its angular radius on a sphere.
+    delta := radius * searchMargin / earthRadius
+    dLat := toDegrees(delta)
+    dLon := 180.0
+    if lat+dLat < 90 && lat-dLat > -90 {
+        if ratio := math.Sin(delta) / math.Cos(toRadians(lat)); delta < math.Pi/2 && ratio < 1 {
+            dLon = toDegrees(math.Asin(ratio))
+        }
+    }
+    lon = normalizeLon(lon)
+    spans := [][2]float64{{math.Max(lon-dLon, -180), math.Min(lon+dLon, 180)}}
+    if dLon < 180 && lon+dLon > 180 {
+        spans = append(spans, [2]float64{-180, lon + dLon - 360})
+    }
+    if dLon < 180 && lon-dLon < -180 {
+        spans = append(spans, [2]float64{lon - dLon + 360, 180})
+    }
+
+    collect := func(cell map[string]*models.Vehicle) {
+        for _, v := range cell {
+            if d := sm.distance(lat, lon, v.Latitude, v.Longitude); d <= radius {
+                found = append(found, candidate{v, d})
+            }
+        }
+    }
+
+    minRow := int(math.Floor(math.Max(lat-dLat, -90) / sm.latStep))
+    maxRow := int(math.Floor(math.Min(lat+dLat, 90) / sm.latStep))
+    window := 0.0
+    for row := minRow; row <= maxRow; row++ {
+        for _, span := range spans {
+            window += (span[1]-span[0])/sm.lonStep(row) + 1
+        }
+    }
+    if window > float64(len(sm.cells)) {
+        // Wide windows, such as whole rings of cells around a pole, hold more
+        // cells than are occupied; filtering the occupied ones is cheaper
+        for _, cell := range sm.cells {
+            collect(cell)
+        }
+    } else {
+        for row := minRow; row <= maxRow; row++ {
+            step := sm.lonStep(row)
+            visited := make(map[int]bool)
+            for _, span := range spans {
+                for col := int(math.Floor(span[0] / step)); col <= int(math.Floor(span[1]/step)); col++ {
+                    if !visited[col] {
+                        visited[col] = true
+                        collect(sm.cells[cellKey(row, col)])
+                    }
+                }
+            }
+        }
+    }
+
+    sort.Slice(found, func(i, j int) bool { return found[i].distance < found[j].distance })
+    vehicles := make([]*models.Vehicle, len(found))
+    for i, c := range found {
+        vehicles[i] = c.vehicle
+    }
+    return vehicles
+}
+
+// Nearest returns up to k vehicles closest to a point within maxRadius metres
+func (sm *SpatialMap) Nearest(lat, lon float64, k int, maxRadius float64) []*models.Vehicle {
+    vehicles := sm.Nearby(lat, lon, maxRadius)
+    if len(vehicles) > k {
+        vehicles = vehicles[:k]
+    }
+    return vehicles
+}
+
+// Distance returns the distance in metres between two vehicles using the
+// map's distance function
+func (sm *SpatialMap) Distance(a, b *models.Vehicle) float64 {
+    return sm.distance(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
 }
@@ -0,0 +1,159 @@
+package services
+
+import (
+    "fmt"
+    "math/rand"
+    "testing"
+
+    "github.com/SangBejoo/service-parking/Models"
+)
+
+func vehicleIDs(vehicles []*models.Vehicle) []string {
+    ids := make([]string, len(vehicles))
+    for i, v := range vehicles {
+        ids[i] = v.ID
+    }
+    return ids
+}
+
+func TestNearby(t *testing.T) {
+    tests := []struct {
+        name     string
+        vehicles []models.Vehicle
+        lat, lon float64
+        radius   float64
+        want     []string
+    }{
+        {
+            name:     "nearest first",
+            vehicles: []models.Vehicle{{ID: "far", Latitude: 1.2355, Longitude: 103.8775}, {ID: "near", Latitude: 1.2346, Longitude: 103.8766}},
+            lat:      1.2345, lon: 103.8765, radius: 500,
+            want: []string{"near", "far"},
+        },
+        {
+            name:     "outside the radius",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: 1.2445, Longitude: 103.8765}},
+            lat:      1.2345, lon: 103.8765, radius: 500,
+            want: []string{},
+        },
+        {
+            name:     "antimeridian east to west",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: 0, Longitude: 179.999}},
+            lat:      0, lon: -179.999, radius: 500,
+            want: []string{"v1"},
+        },
+        {
+            name:     "antimeridian west to east",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: -16.5, Longitude: -179.9995}},
+            lat:      -16.5, lon: 179.9995, radius: 500,
+            want: []string{"v1"},
+        },
+        {
+            name:     "longitudes outside -180..180",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: 0, Longitude: 180.0005}, {ID: "v2", Latitude: 0, Longitude: -540.001}},
+            lat:      0, lon: 539.9995, radius: 500,
+            want: []string{"v2", "v1"},
+        },
+        {
+            name:     "high latitude across the antimeridian",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: 89, Longitude: 179.99}},
+            lat:      89, lon: -179.99, radius: 500,
+            want: []string{"v1"},
+        },
+        {
+            name:     "across the north pole",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: 89.9995, Longitude: 0}, {ID: "v2", Latitude: 89.99, Longitude: 90}},
+            lat:      89.9995, lon: 180, radius: 200,
+            want: []string{"v1"},
+        },
+        {
+            name:     "at the south pole",
+            vehicles: []models.Vehicle{{ID: "v1", Latitude: -90, Longitude: 0}, {ID: "v2", Latitude: -89.999, Longitude: -135}},
+            lat:      -89.999, lon: 45, radius: 250,
+            want: []string{"v1", "v2"},
+        },
+    }
+
+    projections := map[string]Projection{"bands": ProjectionLatitudeBands, "equirectangular": ProjectionEquirectangular}
+    distances := map[string]DistanceFunc{"haversine": Haversine, "vincenty": Vincenty}
+    for _, test := range tests {
+        for projectionName, projection := range projections {
+            for distanceName, distance := range distances {
+                t.Run(fmt.Sprintf("%s/%s/%s", test.name, projectionName, distanceName), func(t *testing.T) {
+                    sm := NewSpatialMap(WithCellSize(100), WithProjection(projection), WithDistance(distance))
+                    for i := range test.vehicles {
+                        if err := sm.Upsert(&test.vehicles[i]); err != nil {
+                            t.Fatal(err)
+                        }
+                    }
+                    got := vehicleIDs(sm.Nearby(test.lat, test.lon, test.radius))
+                    if fmt.Sprint(got) != fmt.Sprint(test.want) {
+                        t.Fatalf("got %v, want %v", got, test.want)
+                    }
+                })
+            }
+        }
+    }
+}
+
+func TestNearbyMatchesBruteForce(t *testing.T) {
+    // Dense enough that queries walk the grid rather than every occupied cell
+    random := rand.New(rand.NewSource(1))
+    var vehicles []*models.Vehicle
+    sm := NewSpatialMap(WithCellSize(100))
+    for i := 0; i < 5000; i++ {
+        v := &models.Vehicle{ID: fmt.Sprint(i), Latitude: random.Float64()*2 - 1, Longitude: 179 + random.Float64()*2}
+        vehicles = append(vehicles, v)
+        sm.Upsert(v)
+    }
+
+    for i := 0; i < 200; i++ {
+        lat, lon := random.Float64()*2-1, 179+random.Float64()*2
+        want := 0
+        for _, v := range vehicles {
+            if Haversine(lat, lon, v.Latitude, v.Longitude) <= 1000 {
+                want++
+            }
+        }
+        if got := len(sm.Nearby(lat, lon, 1000)); got != want {
+            t.Fatalf("found %d vehicles around (%f, %f), want %d", got, lat, lon, want)
+        }
+    }
+}
+
+func TestNearest(t *testing.T) {
+    sm := NewSpatialMap()
+    for i, lon := range []float64{179.9995, -179.999, 179.998, -179.9} {
+        sm.Upsert(&models.Vehicle{ID: fmt.Sprintf("v%d", i), Latitude: 10, Longitude: lon})
+    }
+
+    got := vehicleIDs(sm.Nearest(10, 179.9999, 2, 1000))
+    if fmt.Sprint(got) != "[v0 v1]" {
+        t.Fatalf("got %v, want [v0 v1]", got)
+    }
+}
+
+func TestUpsertIntoFullCell(t *testing.T) {
+    sm := NewSpatialMap(WithMaxVehiclesPerCell(1))
+    if err := sm.Upsert(&models.Vehicle{ID: "a", Latitude: 1, Longitude: 1}); err != nil {
+        t.Fatal(err)
+    }
+    if err := sm.Upsert(&models.Vehicle{ID: "b", Latitude: 2, Longitude: 2}); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := sm.Upsert(&models.Vehicle{ID: "b", Latitude: 1, Longitude: 1}); err != ErrCellFull {
+        t.Fatalf("got %v, want ErrCellFull", err)
+    }
+    if got := vehicleIDs(sm.Nearby(2, 2, 1000)); len(got) != 0 {
+        t.Fatalf("b is still found at the position it left: %v", got)
+    }
+    if got := vehicleIDs(sm.Nearby(1, 1, 1000)); fmt.Sprint(got) != "[a]" {
+        t.Fatalf("got %v, want [a]", got)
+    }
+
+    // Moving within its own cell never fails
+    if err := sm.Upsert(&models.Vehicle{ID: "a", Latitude: 1.0001, Longitude: 1}); err != nil {
+        t.Fatal(err)
+    }
+}
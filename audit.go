@@ -0,0 +1,176 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+const (
+    // defaultAuditLimit and maxAuditLimit bound the entries returned per query
+    defaultAuditLimit = 100
+    maxAuditLimit     = 1000
+)
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID assigned to a request by withRequestID
+func requestIDFrom(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// withRequestID is router middleware that tags every request with an ID,
+// reusing a well-formed X-Request-ID from a proxy, and echoes it back
+func withRequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            var err error
+            id, err = newRequestID()
+            if err != nil {
+                log.Println("Failed to generate request ID:", err)
+                writeError(w, r, http.StatusInternalServerError, "Failed to generate request ID")
+                return
+            }
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+    })
+}
+
+// validRequestID reports whether a proxy's request ID is safe to echo and
+// store: 1 to 64 letters, digits, '-', '_', '.' or ':', enough for UUIDs and
+// hex trace IDs. Anything else is replaced rather than written to logs.
+func validRequestID(id string) bool {
+    if len(id) == 0 || len(id) > 64 {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '-', c == '_', c == '.', c == ':':
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() (string, error) {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(buf), nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordAudit appends an audit entry for a change made by a request. before
+// and after are JSON snapshots of the target, nil when it did not exist.
+// Callers pass their transaction so the entry commits with the change.
+func recordAudit(exec execer, r *http.Request, tenant, action, targetType, targetID string, before, after []byte) error {
+    actor := "anonymous"
+    if principal := principalFrom(r.Context()); principal != nil {
+        actor = principal.Subject
+    }
+    _, err := exec.Exec(`INSERT INTO audit_log (tenant, actor, action, target_type, target_id, before, after, request_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+        tenant, actor, action, targetType, targetID, nullJSON(before), nullJSON(after), requestIDFrom(r.Context()))
+    if err != nil {
+        log.Printf("Failed to record audit entry %s %s/%s: %v\n", action, targetType, targetID, err)
+    }
+    return err
+}
+
+// nullJSON stores a missing snapshot as SQL NULL
+func nullJSON(data []byte) interface{} {
+    if data == nil {
+        return nil
+    }
+    return string(data)
+}
+
+// AuditEntry is one recorded administrative change
+type AuditEntry struct {
+    AuditID    int64           `json:"audit_id"`
+    Tenant     string          `json:"tenant"`
+    Actor      string          `json:"actor"`
+    Action     string          `json:"action"`
+    TargetType string          `json:"target_type"`
+    TargetID   string          `json:"target_id"`
+    Before     json.RawMessage `json:"before"`
+    After      json.RawMessage `json:"after"`
+    RequestID  string          `json:"request_id"`
+    CreatedAt  time.Time       `json:"created_at"`
+}
+
+// getAuditLog handles GET /audit, newest entries first. ?actor=, ?action=,
+// ?target_type= and ?target_id= filter by exact match, ?from= and ?to= bound
+// the time of the change and ?limit= caps the number of entries.
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    limit := defaultAuditLimit
+    if value := query.Get("limit"); value != "" {
+        limit, err = strconv.Atoi(value)
+        if err != nil || limit <= 0 || limit > maxAuditLimit {
+            writeError(w, r, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditLimit))
+            return
+        }
+    }
+
+    rows, err := db.Query(`SELECT audit_id, tenant, actor, action, target_type, target_id,
+            COALESCE(before, 'null'), COALESCE(after, 'null'), request_id, created_at
+        FROM audit_log
+        WHERE `+tenantClause("tenant", 1)+`
+        AND ($2::text = '' OR actor = $2::text)
+        AND ($3::text = '' OR action = $3::text)
+        AND ($4::text = '' OR target_type = $4::text)
+        AND ($5::text = '' OR target_id = $5::text)
+        AND created_at >= $6 AND created_at < $7
+        ORDER BY audit_id DESC LIMIT $8`,
+        requestTenant(r), query.Get("actor"), query.Get("action"), query.Get("target_type"), query.Get("target_id"),
+        from, to, limit)
+    if err != nil {
+        log.Println("Error querying audit log:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query audit log")
+        return
+    }
+    defer rows.Close()
+
+    entries := []AuditEntry{}
+    for rows.Next() {
+        var entry AuditEntry
+        var before, after []byte
+        if err := rows.Scan(&entry.AuditID, &entry.Tenant, &entry.Actor, &entry.Action, &entry.TargetType, &entry.TargetID,
+            &before, &after, &entry.RequestID, &entry.CreatedAt); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan audit entry")
+            return
+        }
+        entry.Before, entry.After = before, after
+        entries = append(entries, entry)
+    }
+    if err = rows.Err(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to read audit log")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+func TestWithRequestID(t *testing.T) {
+    tests := []struct {
+        name   string
+        header string
+        reused bool
+    }{
+        {"uuid", "3f2c8a4e-9b1d-4c6e-8f00-5a7b2c1d9e3f", true},
+        {"key-value trace header", "Root=1-67891233-abcdef012345678912345678", false},
+        {"dotted and colons", "req.42:retry_1", true},
+        {"missing", "", false},
+        {"too long", strings.Repeat("a", 65), false},
+        {"log injection", "abc\r\nX-Admin: true", false},
+        {"html", "<script>", false},
+        {"spaces", "a b", false},
+        {"non-ASCII", "réq", false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            var seen string
+            handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                seen = requestIDFrom(r.Context())
+            }))
+            r := httptest.NewRequest(http.MethodGet, "/v1/places", nil)
+            r.Header["X-Request-Id"] = []string{test.header}
+            w := httptest.NewRecorder()
+            handler.ServeHTTP(w, r)
+
+            if echoed := w.Header().Get("X-Request-ID"); echoed != seen || !validRequestID(seen) {
+                t.Fatalf("handler saw %q and the response echoed %q", seen, echoed)
+            }
+            if (seen == test.header) != test.reused {
+                t.Fatalf("got request ID %q for header %q, want reused %v", seen, test.header, test.reused)
+            }
+        })
+    }
+}
+
+func TestTriggerMappingRequiresAudit(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    mock.ExpectExec("INSERT INTO audit_log").WithArgs(defaultTenant, "anonymous", "mapping.trigger", "mapping", "",
+        nil, nil, "").
+        WillReturnError(errors.New("connection refused"))
+
+    // The run is neither started nor reported as triggered
+    w := httptest.NewRecorder()
+    triggerMapping(w, httptest.NewRequest(http.MethodGet, "/v1/triggerMapping", nil))
+    if w.Code != http.StatusInternalServerError {
+        t.Fatalf("got status %d, want 500: %s", w.Code, w.Body)
+    }
+}
+
+// placeRequest calls handler for place 5 with method and path
+func placeRequest(handler http.HandlerFunc, method, path string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    r := mux.SetURLVars(httptest.NewRequest(method, path, nil), map[string]string{"id": "5"})
+    handler(w, r)
+    return w
+}
+
+func TestPlaceSoftDeleteAndRestore(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    live := []byte(`{"place_id":5,"deleted_at":null}`)
+    deleted := []byte(`{"place_id":5,"deleted_at":"2026-03-01T08:00:00"}`)
+
+    // A soft delete marks the place, releases the vehicles inside it and is
+    // audited with both snapshots
+    mock.ExpectBegin()
+    mock.ExpectQuery(`FROM places WHERE place_id = \$1 AND \(deleted_at IS NULL OR \$3\)`).WithArgs(5, "", false).
+        WillReturnRows(sqlmock.NewRows([]string{"tenant", "before"}).AddRow("acme", live))
+    mock.ExpectQuery("UPDATE places SET deleted_at = CURRENT_TIMESTAMP").WithArgs(5).
+        WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(deleted))
+    mock.ExpectExec("UPDATE mapping_state SET place_id = NULL").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectExec("UPDATE place_visits SET left_at = CURRENT_TIMESTAMP").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectExec("INSERT INTO audit_log").
+        WithArgs("acme", "anonymous", "place.delete", "place", "5", string(live), string(deleted), "").
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectCommit()
+    mock.ExpectQuery("FROM mapping_state s").WillReturnRows(sqlmock.NewRows([]string{"place_id", "tenant", "count"}))
+    if w := placeRequest(deletePlace, http.MethodDelete, "/v1/place/5"); w.Code != http.StatusOK {
+        t.Fatalf("got status %d deleting: %s", w.Code, w.Body)
+    }
+
+    // Deleting it again finds no live place
+    mock.ExpectBegin()
+    mock.ExpectQuery(`FROM places WHERE place_id = \$1 AND \(deleted_at IS NULL OR \$3\)`).WithArgs(5, "", false).
+        WillReturnError(sql.ErrNoRows)
+    mock.ExpectRollback()
+    if w := placeRequest(deletePlace, http.MethodDelete, "/v1/place/5"); w.Code != http.StatusNotFound {
+        t.Fatalf("got status %d deleting twice, want 404", w.Code)
+    }
+
+    // Restoring clears the mark and is audited
+    mock.ExpectBegin()
+    mock.ExpectQuery(`FROM places WHERE place_id = \$1 AND deleted_at IS NOT NULL`).WithArgs(5, "").
+        WillReturnRows(sqlmock.NewRows([]string{"tenant", "before"}).AddRow("acme", deleted))
+    mock.ExpectQuery("UPDATE places SET deleted_at = NULL").WithArgs(5).
+        WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(live))
+    mock.ExpectExec("INSERT INTO audit_log").
+        WithArgs("acme", "anonymous", "place.restore", "place", "5", string(deleted), string(live), "").
+        WillReturnResult(sqlmock.NewResult(2, 1))
+    mock.ExpectCommit()
+    if w := placeRequest(restorePlace, http.MethodPost, "/v1/place/5/restore"); w.Code != http.StatusOK {
+        t.Fatalf("got status %d restoring: %s", w.Code, w.Body)
+    }
+
+    // A live place cannot be restored
+    mock.ExpectBegin()
+    mock.ExpectQuery(`FROM places WHERE place_id = \$1 AND deleted_at IS NOT NULL`).WithArgs(5, "").
+        WillReturnError(sql.ErrNoRows)
+    mock.ExpectRollback()
+    if w := placeRequest(restorePlace, http.MethodPost, "/v1/place/5/restore"); w.Code != http.StatusNotFound {
+        t.Fatalf("got status %d restoring a live place, want 404", w.Code)
+    }
+}
+
+func TestPlacePurgeAfterSoftDelete(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    deleted := []byte(`{"place_id":5,"deleted_at":"2026-03-01T08:00:00"}`)
+
+    // ?hard=true also finds soft-deleted places and removes them for good
+    mock.ExpectBegin()
+    mock.ExpectQuery(`FROM places WHERE place_id = \$1 AND \(deleted_at IS NULL OR \$3\)`).WithArgs(5, "", true).
+        WillReturnRows(sqlmock.NewRows([]string{"tenant", "before"}).AddRow("acme", deleted))
+    mock.ExpectExec("DELETE FROM places WHERE place_id = \\$1").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO audit_log").
+        WithArgs("acme", "anonymous", "place.purge", "place", "5", string(deleted), nil, "").
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectCommit()
+    mock.ExpectQuery("FROM mapping_state s").WillReturnRows(sqlmock.NewRows([]string{"place_id", "tenant", "count"}))
+    if w := placeRequest(deletePlace, http.MethodDelete, "/v1/place/5?hard=true"); w.Code != http.StatusOK {
+        t.Fatalf("got status %d purging: %s", w.Code, w.Body)
+    }
+}
+
+// TestAuditLogIsAppendOnly needs a scratch PostgreSQL database, e.g.
+// TEST_DATABASE_URL="postgres://postgres@localhost/parking_test?sslmode=disable"
+func TestAuditLogIsAppendOnly(t *testing.T) {
+    url := os.Getenv("TEST_DATABASE_URL")
+    if url == "" {
+        t.Skip("TEST_DATABASE_URL is not set")
+    }
+    conn, err := sql.Open("postgres", url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := db
+    db = conn
+    t.Cleanup(func() {
+        db = previous
+        conn.Close()
+    })
+    initTables()
+
+    r := httptest.NewRequest(http.MethodGet, "/v1/triggerMapping", nil)
+    if err := recordAudit(db, r, defaultTenant, "mapping.trigger", "mapping", "", nil, nil); err != nil {
+        t.Fatal(err)
+    }
+    for _, statement := range []string{
+        "UPDATE audit_log SET actor = 'someone else'",
+        "DELETE FROM audit_log",
+        "TRUNCATE audit_log",
+    } {
+        if _, err := db.Exec(statement); err == nil || !strings.Contains(err.Error(), "audit_log is append-only") {
+            t.Errorf("%s: got %v, want the append-only error", statement, err)
+        }
+    }
+}
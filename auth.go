@@ -0,0 +1,479 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// API key scopes
+const (
+    ScopeRead           = "read"
+    ScopeLocationsWrite = "locations:write"
+    ScopeTaxisAdmin     = "taxis:admin"
+    ScopePlacesAdmin    = "places:admin"
+    ScopeMappingAdmin   = "mapping:admin"
+    ScopeKeysAdmin      = "keys:admin"
+    ScopeAuditRead      = "audit:read"
+    ScopeAdmin          = "admin" // grants every scope
+)
+
+// knownScopes lists the scopes a key may be given
+var knownScopes = map[string]bool{
+    ScopeRead: true, ScopeLocationsWrite: true, ScopeTaxisAdmin: true, ScopePlacesAdmin: true,
+    ScopeMappingAdmin: true, ScopeKeysAdmin: true, ScopeAuditRead: true, ScopeAdmin: true, ScopeAllTenants: true,
+}
+
+// routeScopes names the scope each non-default route requires, keyed by
+// "METHOD /path/template". Other GET routes require ScopeRead and every other
+// method requires ScopeAdmin.
+var routeScopes = map[string]string{
+    "POST /updateLocation":     ScopeLocationsWrite,
+    "POST /locations/batch":    ScopeLocationsWrite,
+    "POST /taxi":               ScopeTaxisAdmin,
+    "PUT /taxi/{id}":           ScopeTaxisAdmin,
+    "DELETE /taxi/{id}":        ScopeTaxisAdmin,
+    "POST /place":              ScopePlacesAdmin,
+    "PUT /place/{id}":          ScopePlacesAdmin,
+    "DELETE /place/{id}":       ScopePlacesAdmin,
+    "POST /place/{id}/restore": ScopePlacesAdmin,
+    "GET /triggerMapping":      ScopeMappingAdmin,
+    "POST /keys":               ScopeKeysAdmin,
+    "GET /keys":                ScopeKeysAdmin,
+    "POST /keys/{id}/rotate":   ScopeKeysAdmin,
+    "DELETE /keys/{id}":        ScopeKeysAdmin,
+    "GET /audit":               ScopeAuditRead,
+}
+
+// Authentication settings. API_AUTH=off disables enforcement for local
+// development; BOOTSTRAP_API_KEY installs an admin key at startup so the
+// first real keys can be created.
+var (
+    authEnabled      = os.Getenv("API_AUTH") != "off"
+    bootstrapAPIKey  = os.Getenv("BOOTSTRAP_API_KEY")
+    keyRotationGrace = envDuration("KEY_ROTATION_GRACE", 24*time.Hour)
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+    Subject string
+    Tenant  string
+    KeyID   int      // set for API keys
+    Roles   []string // set for bearer tokens
+    Scopes  []string
+}
+
+// HasScope reports whether the principal was granted a scope
+func (p *Principal) HasScope(scope string) bool {
+    for _, s := range p.Scopes {
+        if s == scope || (s == ScopeAdmin && scope != ScopeAllTenants) {
+            return true
+        }
+    }
+    return false
+}
+
+type principalKey struct{}
+
+// principalFrom returns the authenticated caller stored in a request context
+func principalFrom(ctx context.Context) *Principal {
+    principal, _ := ctx.Value(principalKey{}).(*Principal)
+    return principal
+}
+
+// publicRoutes lists the routes anyone may call without credentials, keyed like routeScopes
+var publicRoutes = map[string]bool{
+    "GET /openapi.json": true,
+}
+
+// requiredScope returns the scope needed for the matched route. Versioned and
+// legacy paths of the same endpoint share their scope.
+func requiredScope(r *http.Request) string {
+    return scopeForRoute(routeKey(r), r.Method)
+}
+
+// scopeForRoute returns the scope a route key requires
+func scopeForRoute(key, method string) string {
+    if scope, ok := routeScopes[key]; ok {
+        return scope
+    }
+    if method == http.MethodGet {
+        return ScopeRead
+    }
+    return ScopeAdmin
+}
+
+// authenticate is router middleware that resolves the caller from a bearer
+// token in the Authorization header (or ?access_token= for browser streams
+// that cannot set headers) or an API key in the X-API-Key header and rejects requests lacking the scope their route requires
+func authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !authEnabled || publicRoutes[routeKey(r)] {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        principal, status, err := resolvePrincipal(r)
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="service-parking"`)
+            writeError(w, r, status, err.Error())
+            return
+        }
+
+        if scope := requiredScope(r); !principal.HasScope(scope) {
+            writeErrorDetails(w, r, http.StatusForbidden, "Credentials lack scope "+scope, map[string]string{"required_scope": scope})
+            return
+        }
+
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+    })
+}
+
+// resolvePrincipal authenticates a request, returning the HTTP status to
+// answer with when it fails
+func resolvePrincipal(r *http.Request) (*Principal, int, error) {
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if token == r.Header.Get("Authorization") {
+        token = r.URL.Query().Get("access_token")
+    }
+    // API keys are long-lived, so they are never taken from the query string
+    // where proxies and access logs would record them
+    return resolveCredentials(token, r.Header.Get("X-API-Key"))
+}
+
+// resolveCredentials authenticates a bearer token or, without one, an API
+// key, returning the HTTP status to answer with when it fails
+func resolveCredentials(token, key string) (*Principal, int, error) {
+    if token != "" {
+        principal, err := bearerPrincipal(token)
+        if err != nil {
+            // The reason stays in the log; telling the caller which check
+            // failed would help forge a token that passes
+            log.Println("Rejected bearer token:", err)
+            return nil, http.StatusUnauthorized, errors.New("Invalid bearer token")
+        }
+        return principal, http.StatusOK, nil
+    }
+    if key == "" {
+        return nil, http.StatusUnauthorized, errors.New("Missing credentials")
+    }
+
+    principal, err := lookupAPIKey(key)
+    if err == sql.ErrNoRows {
+        return nil, http.StatusUnauthorized, errors.New("Invalid API key")
+    } else if err != nil {
+        log.Println("API key lookup failed:", err)
+        return nil, http.StatusInternalServerError, errors.New("Failed to verify API key")
+    }
+    return principal, http.StatusOK, nil
+}
+
+// hashAPIKey returns the stored form of an API key. Keys are 256 random bits,
+// so a plain SHA-256 is enough to make a leaked table useless.
+func hashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey generates a random API key
+func newAPIKey() (string, error) {
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return "pk_" + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// lookupAPIKey finds the active key matching a presented secret. A key's
+// previous secret keeps working until its rotation grace period ends.
+func lookupAPIKey(key string) (*Principal, error) {
+    principal := &Principal{}
+    var name string
+    err := db.QueryRow(`SELECT key_id, name, tenant, scopes FROM api_keys
+        WHERE revoked_at IS NULL
+        AND (key_hash = $1 OR (previous_hash = $1 AND previous_expires_at > CURRENT_TIMESTAMP))`,
+        hashAPIKey(key)).Scan(&principal.KeyID, &name, &principal.Tenant, pq.Array(&principal.Scopes))
+    if err != nil {
+        return nil, err
+    }
+    principal.Subject = "key:" + name
+    return principal, nil
+}
+
+// installBootstrapKey stores BOOTSTRAP_API_KEY as a cross-tenant admin key if it is set
+func installBootstrapKey() {
+    if bootstrapAPIKey == "" {
+        return
+    }
+    _, err := db.Exec(`INSERT INTO api_keys (name, tenant, scopes, key_hash) VALUES ('bootstrap', $1, $2, $3)
+        ON CONFLICT (key_hash) DO UPDATE SET scopes = EXCLUDED.scopes`,
+        defaultTenant, pq.Array([]string{ScopeAdmin, ScopeAllTenants}), hashAPIKey(bootstrapAPIKey))
+    if err != nil {
+        log.Fatal("Failed to install bootstrap API key:", err)
+    }
+}
+
+// APIKey describes a stored key. Secret is only filled in when a key is
+// created or rotated and is never stored.
+type APIKey struct {
+    KeyID     int        `json:"key_id"`
+    Name      string     `json:"name"`
+    Tenant    string     `json:"tenant"`
+    Scopes    []string   `json:"scopes"`
+    Secret    string     `json:"key,omitempty"`
+    CreatedAt time.Time  `json:"created_at"`
+    RotatedAt *time.Time `json:"rotated_at,omitempty"`
+    RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// apiKeySnapshotSQL selects an API key row for the audit log without its hashes
+const apiKeySnapshotSQL = "to_jsonb(api_keys.*) - 'key_hash' - 'previous_hash'"
+
+// createAPIKey handles POST /keys with a body of {"name": ..., "scopes": [...]}
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Name   string   `json:"name"`
+        Scopes []string `json:"scopes"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if strings.TrimSpace(request.Name) == "" || len(request.Scopes) == 0 {
+        writeError(w, r, http.StatusBadRequest, "name and scopes are required")
+        return
+    }
+    for _, scope := range request.Scopes {
+        if !knownScopes[scope] {
+            writeError(w, r, http.StatusBadRequest, "Unknown scope "+scope)
+            return
+        }
+    }
+    // A key may not grant more than its creator holds
+    if scope := missingScope(principalFrom(r.Context()), request.Scopes); scope != "" {
+        writeErrorDetails(w, r, http.StatusForbidden, "Cannot grant scope "+scope+" the caller does not hold",
+            map[string]string{"scope": scope})
+        return
+    }
+
+    secret, err := newAPIKey()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to generate API key")
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create API key")
+        return
+    }
+    defer tx.Rollback()
+
+    key := APIKey{Name: request.Name, Tenant: writeTenant(r), Scopes: request.Scopes, Secret: secret}
+    var after []byte
+    err = tx.QueryRow(`INSERT INTO api_keys (name, tenant, scopes, key_hash) VALUES ($1, $2, $3, $4)
+        RETURNING key_id, created_at, `+apiKeySnapshotSQL,
+        key.Name, key.Tenant, pq.Array(key.Scopes), hashAPIKey(secret)).Scan(&key.KeyID, &key.CreatedAt, &after)
+    if err == nil {
+        err = recordAudit(tx, r, key.Tenant, "key.create", "api_key", strconv.Itoa(key.KeyID), nil, after)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create API key")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(key)
+}
+
+// missingScope returns the first of scopes the principal does not hold, or ""
+// when it holds them all. Without authentication nothing is missing.
+func missingScope(principal *Principal, scopes []string) string {
+    if principal == nil {
+        return ""
+    }
+    for _, scope := range scopes {
+        if !principal.HasScope(scope) {
+            return scope
+        }
+    }
+    return ""
+}
+
+// authorizeKeyChange answers and returns false unless the caller may rotate or
+// revoke a key of tenant holding scopes. Like creating a key, changing one
+// requires holding every scope it grants: rotating hands out its new secret,
+// so a keys:admin key could otherwise take over the bootstrap key. Keys of
+// other tenants are reported as missing to callers confined to their own.
+func authorizeKeyChange(w http.ResponseWriter, r *http.Request, tenant string, scopes []string) bool {
+    principal := principalFrom(r.Context())
+    if principal != nil && !principal.CrossTenant() && tenant != principal.Tenant {
+        writeError(w, r, http.StatusNotFound, "API key not found")
+        return false
+    }
+    if scope := missingScope(principal, scopes); scope != "" {
+        writeErrorDetails(w, r, http.StatusForbidden, "Cannot change a key with scope "+scope+" the caller does not hold",
+            map[string]string{"scope": scope})
+        return false
+    }
+    return true
+}
+
+// getAPIKeys lists every key without its secret
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+    rows, err := db.Query(`SELECT key_id, name, tenant, scopes, created_at, rotated_at, revoked_at
+        FROM api_keys WHERE `+tenantClause("tenant", 1)+` ORDER BY key_id`, requestTenant(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to query API keys")
+        return
+    }
+    defer rows.Close()
+
+    keys := []APIKey{}
+    for rows.Next() {
+        var key APIKey
+        var rotatedAt, revokedAt sql.NullTime
+        if err := rows.Scan(&key.KeyID, &key.Name, &key.Tenant, pq.Array(&key.Scopes), &key.CreatedAt, &rotatedAt, &revokedAt); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan API key")
+            return
+        }
+        if rotatedAt.Valid {
+            key.RotatedAt = &rotatedAt.Time
+        }
+        if revokedAt.Valid {
+            key.RevokedAt = &revokedAt.Time
+        }
+        keys = append(keys, key)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(keys)
+}
+
+// rotateAPIKey issues a new secret for a key. The old secret stays valid for
+// KEY_ROTATION_GRACE so devices can be updated without downtime.
+func rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+    keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid key ID")
+        return
+    }
+
+    secret, err := newAPIKey()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to generate API key")
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to rotate API key")
+        return
+    }
+    defer tx.Rollback()
+
+    var tenant string
+    var scopes []string
+    var before, after []byte
+    err = tx.QueryRow("SELECT tenant, scopes, "+apiKeySnapshotSQL+" FROM api_keys WHERE key_id = $1 AND revoked_at IS NULL AND "+
+        tenantClause("tenant", 2)+" FOR UPDATE", keyID, requestTenant(r)).Scan(&tenant, pq.Array(&scopes), &before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "API key not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to rotate API key")
+        return
+    }
+    if !authorizeKeyChange(w, r, tenant, scopes) {
+        return
+    }
+
+    key := APIKey{KeyID: keyID, Secret: secret}
+    var rotatedAt time.Time
+    err = tx.QueryRow(`UPDATE api_keys
+        SET previous_hash = key_hash,
+            previous_expires_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second',
+            key_hash = $3, rotated_at = CURRENT_TIMESTAMP
+        WHERE key_id = $1
+        RETURNING name, tenant, scopes, created_at, rotated_at, `+apiKeySnapshotSQL,
+        keyID, keyRotationGrace.Seconds(), hashAPIKey(secret)).
+        Scan(&key.Name, &key.Tenant, pq.Array(&key.Scopes), &key.CreatedAt, &rotatedAt, &after)
+    if err == nil {
+        err = recordAudit(tx, r, key.Tenant, "key.rotate", "api_key", strconv.Itoa(keyID), before, after)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to rotate API key")
+        return
+    }
+    key.RotatedAt = &rotatedAt
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(key)
+}
+
+// revokeAPIKey disables a key immediately, including any secret still in its grace period
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid key ID")
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to revoke API key")
+        return
+    }
+    defer tx.Rollback()
+
+    var tenant string
+    var scopes []string
+    var before, after []byte
+    err = tx.QueryRow("SELECT tenant, scopes, "+apiKeySnapshotSQL+" FROM api_keys WHERE key_id = $1 AND revoked_at IS NULL AND "+
+        tenantClause("tenant", 2)+" FOR UPDATE", keyID, requestTenant(r)).Scan(&tenant, pq.Array(&scopes), &before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "API key not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to revoke API key")
+        return
+    }
+    if !authorizeKeyChange(w, r, tenant, scopes) {
+        return
+    }
+
+    err = tx.QueryRow("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE key_id = $1 RETURNING "+apiKeySnapshotSQL,
+        keyID).Scan(&after)
+    if err == nil {
+        err = recordAudit(tx, r, tenant, "key.revoke", "api_key", strconv.Itoa(keyID), before, after)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to revoke API key")
+        return
+    }
+
+    writeMessage(w, r, http.StatusOK, "API key revoked.")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+// bootstrapScopes are the scopes of the key installed from BOOTSTRAP_API_KEY
+const bootstrapScopes = "{admin,tenants:all}"
+
+// withPrincipal returns a request authenticated as principal
+func withPrincipal(r *http.Request, principal *Principal) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+func TestHasScope(t *testing.T) {
+    admin := &Principal{Scopes: []string{ScopeAdmin}}
+    if !admin.HasScope(ScopeKeysAdmin) || admin.HasScope(ScopeAllTenants) || admin.CrossTenant() {
+        t.Fatal("admin must imply every scope but tenants:all")
+    }
+    keys := &Principal{Scopes: []string{ScopeKeysAdmin}}
+    if keys.HasScope(ScopeAdmin) || keys.HasScope(ScopeRead) {
+        t.Fatal("keys:admin must not imply other scopes")
+    }
+    if scope := missingScope(keys, []string{ScopeKeysAdmin, ScopeRead}); scope != ScopeRead {
+        t.Fatalf("got missing scope %q, want read", scope)
+    }
+    if scope := missingScope(nil, []string{ScopeAdmin}); scope != "" {
+        t.Fatalf("got missing scope %q without authentication", scope)
+    }
+}
+
+func TestCreateAPIKeyCannotGrantMoreThanCaller(t *testing.T) {
+    mockDB(t)
+    principal := &Principal{Tenant: defaultTenant, Scopes: []string{ScopeKeysAdmin}}
+    for _, scopes := range []string{`["admin"]`, `["tenants:all"]`, `["keys:admin","read"]`} {
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPost, "/v1/keys", strings.NewReader(`{"name":"device","scopes":`+scopes+`}`))
+        createAPIKey(w, withPrincipal(r, principal))
+        if w.Code != http.StatusForbidden {
+            t.Fatalf("granting %s: got status %d, want 403", scopes, w.Code)
+        }
+    }
+}
+
+func TestKeyChangesRequireTargetScopes(t *testing.T) {
+    now := time.Now()
+    snapshot := []byte(`{"key_id":1}`)
+    handlers := []struct {
+        name    string
+        handler http.HandlerFunc
+        method  string
+        expect  func(mock sqlmock.Sqlmock)
+    }{
+        {"rotate", rotateAPIKey, http.MethodPost, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("UPDATE api_keys").WillReturnRows(sqlmock.NewRows([]string{"name", "tenant", "scopes",
+                "created_at", "rotated_at", "after"}).AddRow("device", defaultTenant, "{read}", now, now, snapshot))
+        }},
+        {"revoke", revokeAPIKey, http.MethodDelete, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("UPDATE api_keys SET revoked_at").WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+        }},
+    }
+    tests := []struct {
+        name      string
+        principal *Principal
+        tenant    string // of the target key
+        scopes    string // of the target key
+        status    int
+    }{
+        {"keys admin takes over the bootstrap key", &Principal{Tenant: defaultTenant, Scopes: []string{ScopeKeysAdmin}},
+            defaultTenant, bootstrapScopes, http.StatusForbidden},
+        {"tenant admin takes over the bootstrap key", &Principal{Tenant: defaultTenant, Scopes: []string{ScopeAdmin}},
+            defaultTenant, bootstrapScopes, http.StatusForbidden},
+        {"keys admin changes a stronger key", &Principal{Tenant: "acme", Scopes: []string{ScopeKeysAdmin, ScopeRead}},
+            "acme", "{read,taxis:admin}", http.StatusForbidden},
+        {"key of another tenant", &Principal{Tenant: "acme", Scopes: []string{ScopeAdmin}},
+            "globex", "{read}", http.StatusNotFound},
+        {"keys admin changes a weaker key", &Principal{Tenant: "acme", Scopes: []string{ScopeKeysAdmin, ScopeRead}},
+            "acme", "{read}", http.StatusOK},
+        {"tenant admin changes its own admin key", &Principal{Tenant: "acme", Scopes: []string{ScopeAdmin}},
+            "acme", "{admin}", http.StatusOK},
+        {"cross-tenant admin changes the bootstrap key", &Principal{Tenant: defaultTenant, Scopes: []string{ScopeAdmin, ScopeAllTenants}},
+            defaultTenant, bootstrapScopes, http.StatusOK},
+        {"cross-tenant admin changes a key of any tenant", &Principal{Tenant: defaultTenant, Scopes: []string{ScopeAdmin, ScopeAllTenants}},
+            "globex", "{admin}", http.StatusOK},
+    }
+    for _, h := range handlers {
+        for _, test := range tests {
+            t.Run(h.name+"/"+test.name, func(t *testing.T) {
+                mock := mockDB(t)
+                mock.ExpectBegin()
+                mock.ExpectQuery("FROM api_keys WHERE key_id").
+                    WillReturnRows(sqlmock.NewRows([]string{"tenant", "scopes", "before"}).AddRow(test.tenant, test.scopes, snapshot))
+                if test.status == http.StatusOK {
+                    h.expect(mock)
+                    mock.ExpectExec("INSERT INTO audit_log").WillReturnResult(sqlmock.NewResult(1, 1))
+                    mock.ExpectCommit()
+                } else {
+                    mock.ExpectRollback()
+                }
+
+                w := httptest.NewRecorder()
+                r := mux.SetURLVars(httptest.NewRequest(h.method, "/v1/keys/1", nil), map[string]string{"id": "1"})
+                h.handler(w, withPrincipal(r, test.principal))
+                if w.Code != test.status {
+                    t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+                }
+                if test.status != http.StatusOK && strings.Contains(w.Body.String(), "pk_") {
+                    t.Fatalf("a refused change leaked a secret: %s", w.Body)
+                }
+            })
+        }
+    }
+}
+
+func TestKeyRoutesRequireKeysAdmin(t *testing.T) {
+    setAuth(t, true)
+    setRateLimits(t)
+    mock := mockDB(t)
+    expectAPIKey(mock, 2, defaultTenant, ScopeRead, ScopeLocationsWrite)
+
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodPost, "/v1/keys/1/rotate", nil)
+    r.Header.Set("X-API-Key", "pk_device")
+    newRouter().ServeHTTP(w, r)
+    if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ScopeKeysAdmin) {
+        t.Fatalf("got status %d: %s, want 403 naming keys:admin", w.Code, w.Body)
+    }
+}
@@ -0,0 +1,401 @@
+// Package client is a Go client for the service-parking API. Client talks to
+// a running service over its /v1 HTTP API, retrying throttled and unavailable
+// requests with exponential backoff; Fake implements the same API interface
+// in memory for the unit tests of code that depends on the service.
+package client
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// API is the interface shared by Client and Fake. Every method stops when
+// its context is cancelled.
+type API interface {
+    CreateTaxi(ctx context.Context, taxi TaxiLocation) error
+    ListTaxis(ctx context.Context, options *ListOptions) (*TaxiPage, error)
+    GetTaxi(ctx context.Context, taxiID string) (*TaxiLocation, error)
+    UpdateTaxi(ctx context.Context, taxiID string, taxi TaxiLocation) error
+    DeleteTaxi(ctx context.Context, taxiID string) error
+
+    ReportLocation(ctx context.Context, location TaxiLocation) (*LocationDecision, error)
+    ReportLocations(ctx context.Context, locations []TaxiLocation) (*BatchResponse, error)
+
+    CreatePlace(ctx context.Context, place Place) (*Place, error)
+    ListPlaces(ctx context.Context, options *ListOptions) (*PlacePage, error)
+    GetPlace(ctx context.Context, placeID int) (*Place, error)
+    UpdatePlace(ctx context.Context, placeID int, place Place) error
+    DeletePlace(ctx context.Context, placeID int) error
+    RestorePlace(ctx context.Context, placeID int) error
+
+    ListMappings(ctx context.Context, options *ListOptions) (*MappingPage, error)
+    TriggerMapping(ctx context.Context) error
+
+    // WatchVehicles calls handle for every live event matching subscription
+    // until ctx is cancelled or handle returns an error
+    WatchVehicles(ctx context.Context, subscription Subscription, handle func(Event) error) error
+    // WatchOccupancy calls handle for every occupancy change until ctx is
+    // cancelled or handle returns an error
+    WatchOccupancy(ctx context.Context, handle func(OccupancyUpdate) error) error
+}
+
+var (
+    _ API = (*Client)(nil)
+    _ API = (*Fake)(nil)
+)
+
+// Client calls the service over HTTP
+type Client struct {
+    baseURL    string
+    httpClient *http.Client
+    apiKey     string
+    token      string
+    tenant     string
+    maxRetries int
+    minBackoff time.Duration
+    maxBackoff time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIKey authenticates with an API key
+func WithAPIKey(key string) Option {
+    return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken authenticates with an identity provider token
+func WithBearerToken(token string) Option {
+    return func(c *Client) { c.token = token }
+}
+
+// WithTenant acts on one tenant; only honoured for cross-tenant credentials
+func WithTenant(tenant string) Option {
+    return func(c *Client) { c.tenant = tenant }
+}
+
+// WithHTTPClient replaces http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+    return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithRetries sets how often a failed request is retried; 0 disables retries
+func WithRetries(retries int) Option {
+    return func(c *Client) { c.maxRetries = retries }
+}
+
+// WithBackoff sets the first and the longest wait between retries
+func WithBackoff(min, max time.Duration) Option {
+    return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// New returns a client for the service at baseURL, e.g. "http://parking:8080"
+func New(baseURL string, options ...Option) *Client {
+    c := &Client{
+        baseURL:    strings.TrimRight(baseURL, "/"),
+        httpClient: http.DefaultClient,
+        maxRetries: 3,
+        minBackoff: 100 * time.Millisecond,
+        maxBackoff: 5 * time.Second,
+    }
+    for _, option := range options {
+        option(c)
+    }
+    return c
+}
+
+// IsNotFound reports whether err is the service answering 404
+func IsNotFound(err error) bool {
+    var apiErr *Error
+    return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is the service answering 409
+func IsConflict(err error) bool {
+    var apiErr *Error
+    return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// CreateTaxi registers a taxi. A taken taxi ID is left untouched and fails
+// with a 409 Error, see IsConflict.
+func (c *Client) CreateTaxi(ctx context.Context, taxi TaxiLocation) error {
+    return c.do(ctx, http.MethodPost, "/taxi", nil, taxi, nil, true)
+}
+
+// ListTaxis returns a page of taxis
+func (c *Client) ListTaxis(ctx context.Context, options *ListOptions) (*TaxiPage, error) {
+    var page TaxiPage
+    if err := c.do(ctx, http.MethodGet, "/taxi", options.query(), nil, &page, true); err != nil {
+        return nil, err
+    }
+    return &page, nil
+}
+
+// GetTaxi returns a taxi
+func (c *Client) GetTaxi(ctx context.Context, taxiID string) (*TaxiLocation, error) {
+    var taxi TaxiLocation
+    if err := c.do(ctx, http.MethodGet, "/taxi/"+url.PathEscape(taxiID), nil, nil, &taxi, true); err != nil {
+        return nil, err
+    }
+    return &taxi, nil
+}
+
+// UpdateTaxi moves a taxi
+func (c *Client) UpdateTaxi(ctx context.Context, taxiID string, taxi TaxiLocation) error {
+    return c.do(ctx, http.MethodPut, "/taxi/"+url.PathEscape(taxiID), nil, taxi, nil, true)
+}
+
+// DeleteTaxi deletes a taxi
+func (c *Client) DeleteTaxi(ctx context.Context, taxiID string) error {
+    return c.do(ctx, http.MethodDelete, "/taxi/"+url.PathEscape(taxiID), nil, nil, nil, true)
+}
+
+// ReportLocation reports a position. Resending a location is safe: the
+// service answers duplicates with DecisionDuplicate.
+func (c *Client) ReportLocation(ctx context.Context, location TaxiLocation) (*LocationDecision, error) {
+    var decision LocationDecision
+    if err := c.do(ctx, http.MethodPost, "/updateLocation", nil, location, &decision, true); err != nil {
+        return nil, err
+    }
+    return &decision, nil
+}
+
+// ReportLocations reports many positions in one request
+func (c *Client) ReportLocations(ctx context.Context, locations []TaxiLocation) (*BatchResponse, error) {
+    var response BatchResponse
+    if err := c.do(ctx, http.MethodPost, "/locations/batch", nil, locations, &response, true); err != nil {
+        return nil, err
+    }
+    return &response, nil
+}
+
+// CreatePlace creates a place and returns it with its ID. It is not retried
+// after a failure the request may have survived, which would create it twice.
+func (c *Client) CreatePlace(ctx context.Context, place Place) (*Place, error) {
+    var created Place
+    if err := c.do(ctx, http.MethodPost, "/place", nil, place, &created, false); err != nil {
+        return nil, err
+    }
+    return &created, nil
+}
+
+// ListPlaces returns a page of places
+func (c *Client) ListPlaces(ctx context.Context, options *ListOptions) (*PlacePage, error) {
+    var page PlacePage
+    if err := c.do(ctx, http.MethodGet, "/places", options.query(), nil, &page, true); err != nil {
+        return nil, err
+    }
+    return &page, nil
+}
+
+// GetPlace returns a place
+func (c *Client) GetPlace(ctx context.Context, placeID int) (*Place, error) {
+    var place Place
+    if err := c.do(ctx, http.MethodGet, "/place/"+strconv.Itoa(placeID), nil, nil, &place, true); err != nil {
+        return nil, err
+    }
+    return &place, nil
+}
+
+// UpdatePlace replaces a place's name and polygon
+func (c *Client) UpdatePlace(ctx context.Context, placeID int, place Place) error {
+    return c.do(ctx, http.MethodPut, "/place/"+strconv.Itoa(placeID), nil, place, nil, true)
+}
+
+// DeletePlace soft-deletes a place
+func (c *Client) DeletePlace(ctx context.Context, placeID int) error {
+    return c.do(ctx, http.MethodDelete, "/place/"+strconv.Itoa(placeID), nil, nil, nil, true)
+}
+
+// RestorePlace undoes DeletePlace
+func (c *Client) RestorePlace(ctx context.Context, placeID int) error {
+    return c.do(ctx, http.MethodPost, "/place/"+strconv.Itoa(placeID)+"/restore", nil, nil, nil, true)
+}
+
+// ListMappings returns a page of mappings
+func (c *Client) ListMappings(ctx context.Context, options *ListOptions) (*MappingPage, error) {
+    var page MappingPage
+    if err := c.do(ctx, http.MethodGet, "/getMapping", options.query(), nil, &page, true); err != nil {
+        return nil, err
+    }
+    return &page, nil
+}
+
+// TriggerMapping starts the mapping job; it runs in the background
+func (c *Client) TriggerMapping(ctx context.Context) error {
+    return c.do(ctx, http.MethodGet, "/triggerMapping", nil, nil, nil, true)
+}
+
+// query encodes list options as query parameters
+func (o *ListOptions) query() url.Values {
+    query := url.Values{}
+    if o == nil {
+        return query
+    }
+    if o.Limit > 0 {
+        query.Set("limit", strconv.Itoa(o.Limit))
+    }
+    if o.Cursor != "" {
+        query.Set("cursor", o.Cursor)
+    }
+    if o.Sort != "" {
+        query.Set("sort", o.Sort)
+    }
+    if o.BBox != nil {
+        query.Set("bbox", o.BBox.String())
+    }
+    if len(o.TaxiIDs) > 0 {
+        query.Set("taxi_id", strings.Join(o.TaxiIDs, ","))
+    }
+    if len(o.PlaceIDs) > 0 {
+        query.Set("place_id", joinInts(o.PlaceIDs))
+    }
+    if !o.UpdatedSince.IsZero() {
+        query.Set("updated_since", o.UpdatedSince.Format(time.RFC3339))
+    }
+    if o.Query != "" {
+        query.Set("q", o.Query)
+    }
+    if o.Deleted {
+        query.Set("deleted", "true")
+    }
+    return query
+}
+
+// joinInts formats IDs as a comma separated list
+func joinInts(ids []int) string {
+    parts := make([]string, len(ids))
+    for i, id := range ids {
+        parts[i] = strconv.Itoa(id)
+    }
+    return strings.Join(parts, ",")
+}
+
+// newRequest builds a request to a /v1 path carrying the client's credentials
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+    if c.tenant != "" {
+        if query == nil {
+            query = url.Values{}
+        }
+        query.Set("tenant", c.tenant)
+    }
+    target := c.baseURL + "/v1" + path
+    if len(query) > 0 {
+        target += "?" + query.Encode()
+    }
+    req, err := http.NewRequestWithContext(ctx, method, target, body)
+    if err != nil {
+        return nil, err
+    }
+    if c.token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.token)
+    } else if c.apiKey != "" {
+        req.Header.Set("X-API-Key", c.apiKey)
+    }
+    return req, nil
+}
+
+// do sends a JSON request and decodes the response into out. Throttled
+// requests are always retried, after the Retry-After the service asks for;
+// connection failures and unavailable gateways only for idempotent requests.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}, idempotent bool) error {
+    var payload []byte
+    if body != nil {
+        var err error
+        if payload, err = json.Marshal(body); err != nil {
+            return err
+        }
+    }
+
+    for attempt := 0; ; attempt++ {
+        req, err := c.newRequest(ctx, method, path, query, bytes.NewReader(payload))
+        if err != nil {
+            return err
+        }
+        if body != nil {
+            req.Header.Set("Content-Type", "application/json")
+        }
+
+        var wait time.Duration
+        resp, err := c.httpClient.Do(req)
+        if err != nil {
+            if ctx.Err() != nil {
+                return ctx.Err()
+            }
+            if !idempotent || attempt >= c.maxRetries {
+                return err
+            }
+        } else {
+            if resp.StatusCode < 300 {
+                defer resp.Body.Close()
+                if out == nil {
+                    return nil
+                }
+                return json.NewDecoder(resp.Body).Decode(out)
+            }
+            apiErr := readError(resp)
+            if !retryable(resp.StatusCode, idempotent) || attempt >= c.maxRetries {
+                return apiErr
+            }
+            if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+                wait = time.Duration(seconds) * time.Second
+            }
+        }
+
+        if wait == 0 {
+            wait = c.backoff(attempt)
+        }
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return ctx.Err()
+        case <-timer.C:
+        }
+    }
+}
+
+// retryable reports whether a failed status may succeed when sent again
+func retryable(status int, idempotent bool) bool {
+    switch status {
+    case http.StatusTooManyRequests:
+        return true
+    case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return idempotent
+    }
+    return false
+}
+
+// backoff returns a random wait of up to minBackoff doubled per attempt,
+// capped at maxBackoff
+func (c *Client) backoff(attempt int) time.Duration {
+    wait := c.minBackoff << uint(attempt)
+    if wait <= 0 || wait > c.maxBackoff {
+        wait = c.maxBackoff
+    }
+    if wait <= 0 {
+        return 0
+    }
+    return time.Duration(rand.Int63n(int64(wait))) + 1
+}
+
+// readError decodes the service's error envelope and closes the body
+func readError(resp *http.Response) error {
+    defer resp.Body.Close()
+    apiErr := &Error{StatusCode: resp.StatusCode}
+    data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+        apiErr.Code = http.StatusText(resp.StatusCode)
+        apiErr.Message = strings.TrimSpace(string(data))
+    }
+    return apiErr
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// fakeServer serves the taxi and place endpoints of the /v1 API from a Fake,
+// answering throttled requests with 429 like the service's rate limiter
+type fakeServer struct {
+    *httptest.Server
+    fake       *Fake
+    throttled  atomic.Int32
+    retryAfter atomic.Value // string
+    requests   atomic.Int32
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+    t.Helper()
+    s := &fakeServer{fake: NewFake()}
+    s.retryAfter.Store("0")
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("POST /v1/taxi", func(w http.ResponseWriter, r *http.Request) {
+        var taxi TaxiLocation
+        json.NewDecoder(r.Body).Decode(&taxi)
+        s.respond(w, http.StatusCreated, map[string]string{"message": "Taxi created"}, s.fake.CreateTaxi(r.Context(), taxi))
+    })
+    mux.HandleFunc("GET /v1/taxi", func(w http.ResponseWriter, r *http.Request) {
+        page, err := s.fake.ListTaxis(r.Context(), listOptions(r))
+        s.respond(w, http.StatusOK, page, err)
+    })
+    mux.HandleFunc("GET /v1/taxi/{id}", func(w http.ResponseWriter, r *http.Request) {
+        taxi, err := s.fake.GetTaxi(r.Context(), r.PathValue("id"))
+        s.respond(w, http.StatusOK, taxi, err)
+    })
+    mux.HandleFunc("DELETE /v1/taxi/{id}", func(w http.ResponseWriter, r *http.Request) {
+        s.respond(w, http.StatusOK, map[string]string{"message": "Taxi deleted"}, s.fake.DeleteTaxi(r.Context(), r.PathValue("id")))
+    })
+    mux.HandleFunc("POST /v1/place", func(w http.ResponseWriter, r *http.Request) {
+        var place Place
+        json.NewDecoder(r.Body).Decode(&place)
+        created, err := s.fake.CreatePlace(r.Context(), place)
+        s.respond(w, http.StatusCreated, created, err)
+    })
+    mux.HandleFunc("GET /v1/places", func(w http.ResponseWriter, r *http.Request) {
+        page, err := s.fake.ListPlaces(r.Context(), listOptions(r))
+        s.respond(w, http.StatusOK, page, err)
+    })
+    mux.HandleFunc("GET /v1/place/{id}", func(w http.ResponseWriter, r *http.Request) {
+        id, _ := strconv.Atoi(r.PathValue("id"))
+        place, err := s.fake.GetPlace(r.Context(), id)
+        s.respond(w, http.StatusOK, place, err)
+    })
+
+    s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        s.requests.Add(1)
+        if s.throttled.Add(-1) >= 0 {
+            w.Header().Set("Retry-After", s.retryAfter.Load().(string))
+            s.respond(w, 0, nil, &Error{StatusCode: http.StatusTooManyRequests, Code: "rate_limited", Message: "Rate limit exceeded"})
+            return
+        }
+        s.throttled.Store(0)
+        mux.ServeHTTP(w, r)
+    }))
+    t.Cleanup(s.Close)
+    return s
+}
+
+// throttle answers the next n requests with 429 and Retry-After
+func (s *fakeServer) throttle(n int, retryAfter string) {
+    s.retryAfter.Store(retryAfter)
+    s.throttled.Store(int32(n))
+}
+
+// respond writes v, or err in the service's error envelope
+func (s *fakeServer) respond(w http.ResponseWriter, status int, v interface{}, err error) {
+    w.Header().Set("Content-Type", "application/json")
+    var apiErr *Error
+    if errors.As(err, &apiErr) {
+        apiErr.RequestID = "req-1"
+        w.WriteHeader(apiErr.StatusCode)
+        json.NewEncoder(w).Encode(apiErr)
+        return
+    }
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// listOptions parses the paging parameters the Client sends
+func listOptions(r *http.Request) *ListOptions {
+    limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+    return &ListOptions{Limit: limit, Cursor: r.URL.Query().Get("cursor")}
+}
+
+// backend is an API under test
+type backend struct {
+    api API
+    // retries is how often the API resends a throttled call itself
+    retries int
+    // throttle makes the next n calls that reach the service fail with 429
+    throttle func(n int)
+}
+
+// backends returns a Client talking to a fake server and a Fake
+func backends() map[string]func(t *testing.T) backend {
+    return map[string]func(t *testing.T) backend{
+        "client": func(t *testing.T) backend {
+            server := newFakeServer(t)
+            c := New(server.URL, WithRetries(1), WithBackoff(time.Millisecond, time.Millisecond))
+            return backend{api: c, retries: 1, throttle: func(n int) { server.throttle(n, "0") }}
+        },
+        "fake": func(t *testing.T) backend {
+            fake := NewFake()
+            return backend{api: fake, throttle: func(n int) {
+                for i := 0; i < n; i++ {
+                    fake.FailNext(&Error{StatusCode: http.StatusTooManyRequests, Code: "rate_limited", Message: "Rate limit exceeded"})
+                }
+            }}
+        },
+    }
+}
+
+// forEachBackend runs a scenario against every backend
+func forEachBackend(t *testing.T, scenario func(t *testing.T, ctx context.Context, b backend)) {
+    for name, newBackend := range backends() {
+        t.Run(name, func(t *testing.T) {
+            ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            defer cancel()
+            scenario(t, ctx, newBackend(t))
+        })
+    }
+}
+
+func TestPagination(t *testing.T) {
+    forEachBackend(t, func(t *testing.T, ctx context.Context, b backend) {
+        for _, id := range []string{"t3", "t1", "t5", "t2", "t4"} {
+            if err := b.api.CreateTaxi(ctx, TaxiLocation{TaxiID: id, Longitude: 106.8, Latitude: -6.2}); err != nil {
+                t.Fatal(err)
+            }
+        }
+
+        var pages [][]string
+        options := &ListOptions{Limit: 2}
+        for {
+            page, err := b.api.ListTaxis(ctx, options)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var ids []string
+            for _, taxi := range page.Items {
+                ids = append(ids, taxi.TaxiID)
+            }
+            pages = append(pages, ids)
+            if page.NextCursor == "" {
+                break
+            }
+            options.Cursor = page.NextCursor
+        }
+        if got, want := jsonString(pages), `[["t1","t2"],["t3","t4"],["t5"]]`; got != want {
+            t.Fatalf("got pages %s, want %s", got, want)
+        }
+
+        // A page past the end is empty rather than an error
+        page, err := b.api.ListTaxis(ctx, &ListOptions{Limit: 2, Cursor: "10"})
+        if err != nil || len(page.Items) != 0 || page.NextCursor != "" {
+            t.Fatalf("got %+v, %v past the end", page, err)
+        }
+    })
+}
+
+func TestNotFound(t *testing.T) {
+    forEachBackend(t, func(t *testing.T, ctx context.Context, b backend) {
+        _, err := b.api.GetTaxi(ctx, "missing")
+        if !IsNotFound(err) {
+            t.Fatalf("GetTaxi: got %v, want 404", err)
+        }
+        var apiErr *Error
+        if !errors.As(err, &apiErr) || apiErr.Code != "not_found" || apiErr.Message != "Taxi not found" {
+            t.Fatalf("GetTaxi: got %#v", err)
+        }
+        if err := b.api.DeleteTaxi(ctx, "missing"); !IsNotFound(err) {
+            t.Fatalf("DeleteTaxi: got %v, want 404", err)
+        }
+        if _, err := b.api.GetPlace(ctx, 42); !IsNotFound(err) {
+            t.Fatalf("GetPlace: got %v, want 404", err)
+        }
+        if IsConflict(err) {
+            t.Fatal("a 404 is reported as a conflict")
+        }
+    })
+}
+
+func TestRateLimited(t *testing.T) {
+    forEachBackend(t, func(t *testing.T, ctx context.Context, b backend) {
+        // Throttled more often than the API retries, the 429 surfaces
+        b.throttle(b.retries + 1)
+        _, err := b.api.ListPlaces(ctx, nil)
+        var apiErr *Error
+        if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Code != "rate_limited" {
+            t.Fatalf("got %v, want 429", err)
+        }
+        if IsNotFound(err) || IsConflict(err) {
+            t.Fatalf("429 reported as %v", err)
+        }
+
+        // The next call is not throttled
+        if _, err := b.api.ListPlaces(ctx, nil); err != nil {
+            t.Fatal(err)
+        }
+
+        // Within its retries a throttled call succeeds
+        if b.retries > 0 {
+            b.throttle(b.retries)
+            if _, err := b.api.ListPlaces(ctx, nil); err != nil {
+                t.Fatalf("got %v after %d throttled attempts", err, b.retries)
+            }
+        }
+    })
+}
+
+func TestRetryAfter(t *testing.T) {
+    server := newFakeServer(t)
+    server.throttle(1, "1")
+    // Were Retry-After ignored, the client would back off for an hour
+    c := New(server.URL, WithBackoff(time.Hour, time.Hour))
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    start := time.Now()
+    if err := c.CreateTaxi(ctx, TaxiLocation{TaxiID: "t1"}); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < time.Second {
+        t.Fatalf("retried after %v, want the 1s Retry-After", elapsed)
+    }
+    if requests := server.requests.Load(); requests != 2 {
+        t.Fatalf("sent %d requests, want 2", requests)
+    }
+    if _, err := server.fake.GetTaxi(ctx, "t1"); err != nil {
+        t.Fatalf("the retried request was not applied: %v", err)
+    }
+
+    // Throttled calls are retried even when resending is otherwise unsafe
+    server.throttle(1, "0")
+    quick := New(server.URL, WithBackoff(time.Millisecond, time.Millisecond))
+    if _, err := quick.CreatePlace(ctx, Place{PlaceName: "Depot", Polygon: NewPolygon([2]float64{0, 0}, [2]float64{1, 0}, [2]float64{1, 1}, [2]float64{0, 0})}); err != nil {
+        t.Fatal(err)
+    }
+
+    // Without retries the 429 is returned at once
+    server.throttle(1, "1")
+    noRetries := New(server.URL, WithRetries(0))
+    start = time.Now()
+    if _, err := noRetries.GetTaxi(ctx, "t1"); err == nil || time.Since(start) >= time.Second {
+        t.Fatalf("got %v after %v, want an immediate 429", err, time.Since(start))
+    }
+}
+
+// jsonString encodes v for comparisons
+func jsonString(v interface{}) string {
+    data, _ := json.Marshal(v)
+    return string(data)
+}
@@ -0,0 +1,705 @@
+package client
+
+import (
+    "context"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// fakeWatcherBuffer is how many events a Fake queues per watcher before
+// dropping them, like the service does for slow clients
+const fakeWatcherBuffer = 256
+
+// Fake is an in-memory API for the unit tests of code that depends on the
+// service. It stores taxis, places and mappings, maps taxis to the places
+// containing them when TriggerMapping is called and delivers the resulting
+// events to watchers. Lists are sorted by ID and ignore ListOptions.Sort.
+// The zero value is not usable; create one with NewFake.
+type Fake struct {
+    mutex       sync.Mutex
+    taxis       map[string]TaxiLocation
+    places      map[int]Place
+    nextPlaceID int
+    mappings    []Mapping
+    current     map[string]int // place each taxi is mapped to
+    counters    map[string]int // entries per "taxi/place"
+    nextEventID uint64
+    failures    []error
+    vehicles    map[chan Event]Subscription
+    occupancy   map[chan OccupancyUpdate]struct{}
+
+    // Now returns the time used for timestamps the fake sets itself
+    Now func() time.Time
+}
+
+// NewFake returns an empty Fake
+func NewFake() *Fake {
+    return &Fake{
+        taxis:       make(map[string]TaxiLocation),
+        places:      make(map[int]Place),
+        nextPlaceID: 1,
+        current:     make(map[string]int),
+        counters:    make(map[string]int),
+        vehicles:    make(map[chan Event]Subscription),
+        occupancy:   make(map[chan OccupancyUpdate]struct{}),
+        Now:         time.Now,
+    }
+}
+
+// FailNext makes the next call return err, e.g. an *Error with StatusCode 503.
+// Several calls queue failures for as many calls.
+func (f *Fake) FailNext(err error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    f.failures = append(f.failures, err)
+}
+
+// begin locks the fake and returns the queued failure or context error for a
+// call, if any. The caller must unlock.
+func (f *Fake) begin(ctx context.Context) error {
+    f.mutex.Lock()
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if len(f.failures) > 0 {
+        err := f.failures[0]
+        f.failures = f.failures[1:]
+        return err
+    }
+    return nil
+}
+
+// fakeError builds the error the service answers with for a status
+func fakeError(status int, message string) *Error {
+    codes := map[int]string{
+        http.StatusBadRequest: "invalid_argument",
+        http.StatusNotFound:   "not_found",
+        http.StatusConflict:   "conflict",
+    }
+    return &Error{StatusCode: status, Code: codes[status], Message: message}
+}
+
+// CreateTaxi implements API
+func (f *Fake) CreateTaxi(ctx context.Context, taxi TaxiLocation) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    if strings.TrimSpace(taxi.TaxiID) == "" {
+        return fakeError(http.StatusBadRequest, "taxi_id is required")
+    }
+    if _, ok := f.taxis[taxi.TaxiID]; ok {
+        return fakeError(http.StatusConflict, "taxi_id is not available")
+    }
+    f.storeTaxi(taxi)
+    return nil
+}
+
+// storeTaxi saves a taxi as just updated
+func (f *Fake) storeTaxi(taxi TaxiLocation) {
+    if taxi.Timestamp == nil {
+        now := f.Now()
+        taxi.Timestamp = &now
+    }
+    taxi.Status = "online"
+    f.taxis[taxi.TaxiID] = taxi
+}
+
+// ListTaxis implements API
+func (f *Fake) ListTaxis(ctx context.Context, options *ListOptions) (*TaxiPage, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    if options == nil {
+        options = &ListOptions{}
+    }
+
+    ids := make([]string, 0, len(f.taxis))
+    for id := range f.taxis {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    var taxis []TaxiLocation
+    for _, id := range ids {
+        taxi := f.taxis[id]
+        if options.BBox != nil && !options.BBox.contains(taxi.Longitude, taxi.Latitude) ||
+            len(options.TaxiIDs) > 0 && !containsString(options.TaxiIDs, id) ||
+            len(options.PlaceIDs) > 0 && !containsInt(options.PlaceIDs, f.current[id]) ||
+            !options.UpdatedSince.IsZero() && taxi.Timestamp.Before(options.UpdatedSince) {
+            continue
+        }
+        taxis = append(taxis, taxi)
+    }
+
+    start, end, next, err := paginate(len(taxis), options)
+    if err != nil {
+        return nil, err
+    }
+    return &TaxiPage{Items: append([]TaxiLocation{}, taxis[start:end]...), NextCursor: next}, nil
+}
+
+// GetTaxi implements API
+func (f *Fake) GetTaxi(ctx context.Context, taxiID string) (*TaxiLocation, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    taxi, ok := f.taxis[taxiID]
+    if !ok {
+        return nil, fakeError(http.StatusNotFound, "Taxi not found")
+    }
+    return &taxi, nil
+}
+
+// UpdateTaxi implements API
+func (f *Fake) UpdateTaxi(ctx context.Context, taxiID string, taxi TaxiLocation) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    if _, ok := f.taxis[taxiID]; !ok {
+        return fakeError(http.StatusNotFound, "Taxi not found")
+    }
+    taxi.TaxiID, taxi.Timestamp = taxiID, nil
+    f.storeTaxi(taxi)
+    return nil
+}
+
+// DeleteTaxi implements API
+func (f *Fake) DeleteTaxi(ctx context.Context, taxiID string) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    if _, ok := f.taxis[taxiID]; !ok {
+        return fakeError(http.StatusNotFound, "Taxi not found")
+    }
+    delete(f.taxis, taxiID)
+    placeID := f.current[taxiID]
+    delete(f.current, taxiID)
+    f.publishOccupancy(placeID)
+    return nil
+}
+
+// ReportLocation implements API. Locations older than the stored one are
+// archived and resent ones are duplicates, as in the service.
+func (f *Fake) ReportLocation(ctx context.Context, location TaxiLocation) (*LocationDecision, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    if strings.TrimSpace(location.TaxiID) == "" {
+        return nil, fakeError(http.StatusBadRequest, "taxi_id is required")
+    }
+    decision := f.report(location)
+    return &decision, nil
+}
+
+// report stores a location unless an equal or newer one is stored
+func (f *Fake) report(location TaxiLocation) LocationDecision {
+    if location.Timestamp == nil {
+        now := f.Now()
+        location.Timestamp = &now
+    }
+    decision := LocationDecision{TaxiID: location.TaxiID, Decision: DecisionApplied, Timestamp: *location.Timestamp}
+    if stored, ok := f.taxis[location.TaxiID]; ok {
+        switch {
+        case stored.Timestamp.Equal(*location.Timestamp):
+            decision.Decision, decision.Reason = DecisionDuplicate, "already stored"
+            return decision
+        case stored.Timestamp.After(*location.Timestamp):
+            decision.Decision, decision.Reason = DecisionArchived, "older than the stored location"
+            return decision
+        }
+        if location.Fleet == "" {
+            location.Fleet = stored.Fleet
+        }
+    }
+
+    f.storeTaxi(location)
+    f.publishVehicle(Event{
+        Type:      EventVehiclePosition,
+        TaxiID:    location.TaxiID,
+        Longitude: location.Longitude,
+        Latitude:  location.Latitude,
+        Timestamp: decision.Timestamp,
+    })
+    return decision
+}
+
+// ReportLocations implements API
+func (f *Fake) ReportLocations(ctx context.Context, locations []TaxiLocation) (*BatchResponse, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    response := &BatchResponse{Results: []BatchItemResult{}}
+    for i, location := range locations {
+        result := BatchItemResult{Index: i, TaxiID: location.TaxiID, Status: BatchRejected}
+        if strings.TrimSpace(location.TaxiID) == "" {
+            result.Reason = "taxi_id is required"
+        } else {
+            decision := f.report(location)
+            result.Decision, result.Reason = decision.Decision, decision.Reason
+            if decision.Decision == DecisionApplied {
+                result.Status = BatchAccepted
+            }
+        }
+        if result.Status == BatchAccepted {
+            response.Accepted++
+        } else {
+            response.Rejected++
+        }
+        response.Results = append(response.Results, result)
+    }
+    return response, nil
+}
+
+// CreatePlace implements API
+func (f *Fake) CreatePlace(ctx context.Context, place Place) (*Place, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    if place.PlaceName == "" || place.Polygon == nil {
+        return nil, fakeError(http.StatusBadRequest, "place_name and polygon are required")
+    }
+    place.PlaceID, place.DeletedAt = f.nextPlaceID, nil
+    f.nextPlaceID++
+    f.places[place.PlaceID] = place
+    return &place, nil
+}
+
+// ListPlaces implements API
+func (f *Fake) ListPlaces(ctx context.Context, options *ListOptions) (*PlacePage, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    if options == nil {
+        options = &ListOptions{}
+    }
+
+    var places []Place
+    for _, id := range f.placeIDs() {
+        place := f.places[id]
+        if (place.DeletedAt != nil) != options.Deleted ||
+            len(options.PlaceIDs) > 0 && !containsInt(options.PlaceIDs, id) ||
+            options.BBox != nil && !options.BBox.intersects(place.Polygon) ||
+            options.Query != "" && !strings.Contains(strings.ToLower(place.PlaceName), strings.ToLower(options.Query)) {
+            continue
+        }
+        places = append(places, place)
+    }
+
+    start, end, next, err := paginate(len(places), options)
+    if err != nil {
+        return nil, err
+    }
+    return &PlacePage{Items: append([]Place{}, places[start:end]...), NextCursor: next}, nil
+}
+
+// placeIDs returns the IDs of every place, deleted or not, in order
+func (f *Fake) placeIDs() []int {
+    ids := make([]int, 0, len(f.places))
+    for id := range f.places {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    return ids
+}
+
+// GetPlace implements API
+func (f *Fake) GetPlace(ctx context.Context, placeID int) (*Place, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    place, ok := f.places[placeID]
+    if !ok || place.DeletedAt != nil {
+        return nil, fakeError(http.StatusNotFound, "Place not found")
+    }
+    return &place, nil
+}
+
+// UpdatePlace implements API
+func (f *Fake) UpdatePlace(ctx context.Context, placeID int, place Place) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    stored, ok := f.places[placeID]
+    if !ok || stored.DeletedAt != nil {
+        return fakeError(http.StatusNotFound, "Place not found")
+    }
+    stored.PlaceName, stored.Polygon = place.PlaceName, place.Polygon
+    f.places[placeID] = stored
+    return nil
+}
+
+// DeletePlace implements API. Like the service, it soft-deletes the place
+// and releases the taxis mapped to it.
+func (f *Fake) DeletePlace(ctx context.Context, placeID int) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    place, ok := f.places[placeID]
+    if !ok || place.DeletedAt != nil {
+        return fakeError(http.StatusNotFound, "Place not found")
+    }
+    now := f.Now()
+    place.DeletedAt = &now
+    f.places[placeID] = place
+    for taxiID, current := range f.current {
+        if current == placeID {
+            delete(f.current, taxiID)
+        }
+    }
+    f.publishOccupancy(placeID)
+    return nil
+}
+
+// RestorePlace implements API
+func (f *Fake) RestorePlace(ctx context.Context, placeID int) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    place, ok := f.places[placeID]
+    if !ok || place.DeletedAt == nil {
+        return fakeError(http.StatusNotFound, "Deleted place not found")
+    }
+    place.DeletedAt = nil
+    f.places[placeID] = place
+    return nil
+}
+
+// ListMappings implements API
+func (f *Fake) ListMappings(ctx context.Context, options *ListOptions) (*MappingPage, error) {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    if options == nil {
+        options = &ListOptions{}
+    }
+
+    var mappings []Mapping
+    for _, mapping := range f.mappings {
+        taxi, ok := f.taxis[mapping.TaxiID]
+        if options.BBox != nil && (!ok || !options.BBox.contains(taxi.Longitude, taxi.Latitude)) ||
+            len(options.TaxiIDs) > 0 && !containsString(options.TaxiIDs, mapping.TaxiID) ||
+            len(options.PlaceIDs) > 0 && !containsInt(options.PlaceIDs, mapping.PlaceID) ||
+            !options.UpdatedSince.IsZero() && mapping.Timestamp.Before(options.UpdatedSince) ||
+            options.Query != "" && !strings.Contains(strings.ToLower(mapping.Place), strings.ToLower(options.Query)) {
+            continue
+        }
+        mapping.Counter = f.counters[mapping.TaxiID+"/"+strconv.Itoa(mapping.PlaceID)]
+        mappings = append(mappings, mapping)
+    }
+
+    start, end, next, err := paginate(len(mappings), options)
+    if err != nil {
+        return nil, err
+    }
+    return &MappingPage{Items: append([]Mapping{}, mappings[start:end]...), NextCursor: next}, nil
+}
+
+// TriggerMapping implements API. Unlike the service it maps synchronously:
+// every taxi is assigned to the first place whose polygon contains it, and
+// entering a place records a mapping and increments its counter.
+func (f *Fake) TriggerMapping(ctx context.Context) error {
+    err := f.begin(ctx)
+    defer f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+
+    taxiIDs := make([]string, 0, len(f.taxis))
+    for id := range f.taxis {
+        taxiIDs = append(taxiIDs, id)
+    }
+    sort.Strings(taxiIDs)
+    placeIDs := f.placeIDs()
+
+    changed := make(map[int]bool)
+    for _, taxiID := range taxiIDs {
+        taxi := f.taxis[taxiID]
+        placeID := 0
+        for _, id := range placeIDs {
+            if place := f.places[id]; place.DeletedAt == nil && polygonContains(place.Polygon, taxi.Longitude, taxi.Latitude) {
+                placeID = id
+                break
+            }
+        }
+        if placeID == f.current[taxiID] {
+            continue
+        }
+        changed[f.current[taxiID]], changed[placeID] = true, true
+        if placeID == 0 {
+            delete(f.current, taxiID)
+            continue
+        }
+
+        f.current[taxiID] = placeID
+        f.counters[taxiID+"/"+strconv.Itoa(placeID)]++
+        now := f.Now()
+        f.mappings = append(f.mappings, Mapping{TaxiID: taxiID, PlaceID: placeID, Place: f.places[placeID].PlaceName, Timestamp: &now})
+        f.publishVehicle(Event{
+            Type:      EventPlaceAssigned,
+            TaxiID:    taxiID,
+            PlaceID:   placeID,
+            Longitude: taxi.Longitude,
+            Latitude:  taxi.Latitude,
+            Timestamp: now,
+        })
+    }
+
+    delete(changed, 0)
+    for _, id := range placeIDs {
+        if changed[id] {
+            f.publishOccupancy(id)
+        }
+    }
+    return nil
+}
+
+// WatchVehicles implements API
+func (f *Fake) WatchVehicles(ctx context.Context, subscription Subscription, handle func(Event) error) error {
+    events := make(chan Event, fakeWatcherBuffer)
+    err := f.begin(ctx)
+    if err == nil {
+        f.vehicles[events] = subscription
+    }
+    f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    defer func() {
+        f.mutex.Lock()
+        delete(f.vehicles, events)
+        f.mutex.Unlock()
+    }()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case event := <-events:
+            if err := handle(event); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// WatchOccupancy implements API
+func (f *Fake) WatchOccupancy(ctx context.Context, handle func(OccupancyUpdate) error) error {
+    updates := make(chan OccupancyUpdate, fakeWatcherBuffer)
+    err := f.begin(ctx)
+    if err == nil {
+        f.occupancy[updates] = struct{}{}
+    }
+    f.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+    defer func() {
+        f.mutex.Lock()
+        delete(f.occupancy, updates)
+        f.mutex.Unlock()
+    }()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case update := <-updates:
+            if err := handle(update); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// publishVehicle delivers an event to the watchers it matches
+func (f *Fake) publishVehicle(event Event) {
+    for events, subscription := range f.vehicles {
+        if !subscription.matches(event) {
+            continue
+        }
+        select {
+        case events <- event:
+        default:
+        }
+    }
+}
+
+// publishOccupancy delivers the current occupancy of a place to every watcher
+func (f *Fake) publishOccupancy(placeID int) {
+    if placeID == 0 {
+        return
+    }
+    occupancy := 0
+    for _, current := range f.current {
+        if current == placeID {
+            occupancy++
+        }
+    }
+    f.nextEventID++
+    update := OccupancyUpdate{ID: f.nextEventID, PlaceID: placeID, Occupancy: occupancy, Timestamp: f.Now()}
+    for updates := range f.occupancy {
+        select {
+        case updates <- update:
+        default:
+        }
+    }
+}
+
+// matches applies the service's subscription rules to an event
+func (s Subscription) matches(event Event) bool {
+    if s.BBox == nil && len(s.PlaceIDs) == 0 && len(s.TaxiIDs) == 0 {
+        return true
+    }
+    if containsString(s.TaxiIDs, event.TaxiID) || event.PlaceID != 0 && containsInt(s.PlaceIDs, event.PlaceID) {
+        return true
+    }
+    return s.BBox != nil && event.Type != EventVehicleOffline && s.BBox.contains(event.Longitude, event.Latitude)
+}
+
+// paginate returns the slice bounds of the page options selects from n items
+// and the cursor of the following page. Fake cursors are offsets.
+func paginate(n int, options *ListOptions) (int, int, string, error) {
+    start := 0
+    if options.Cursor != "" {
+        offset, err := strconv.Atoi(options.Cursor)
+        if err != nil || offset < 0 {
+            return 0, 0, "", fakeError(http.StatusBadRequest, "invalid cursor")
+        }
+        start = offset
+    }
+    if start > n {
+        start = n
+    }
+    limit := options.Limit
+    if limit <= 0 {
+        limit = 100
+    }
+    if start+limit >= n {
+        return start, n, "", nil
+    }
+    return start, start + limit, strconv.Itoa(start + limit), nil
+}
+
+// polygonContains reports whether a point lies inside a polygon's outer ring
+func polygonContains(polygon *Geometry, lon, lat float64) bool {
+    if polygon == nil || len(polygon.Coordinates) == 0 {
+        return false
+    }
+    ring := polygon.Coordinates[0]
+    inside := false
+    for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+        if len(ring[i]) < 2 || len(ring[j]) < 2 {
+            continue
+        }
+        xi, yi, xj, yj := ring[i][0], ring[i][1], ring[j][0], ring[j][1]
+        if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+            inside = !inside
+        }
+    }
+    return inside
+}
+
+// intersects reports whether a polygon's outer ring shares a point with the box
+func (b *BoundingBox) intersects(polygon *Geometry) bool {
+    if polygon == nil || len(polygon.Coordinates) == 0 {
+        return false
+    }
+    corners := [][2]float64{{b.MinLon, b.MinLat}, {b.MaxLon, b.MinLat}, {b.MaxLon, b.MaxLat}, {b.MinLon, b.MaxLat}}
+    for _, corner := range corners {
+        if polygonContains(polygon, corner[0], corner[1]) {
+            return true
+        }
+    }
+    ring := polygon.Coordinates[0]
+    for i, point := range ring {
+        if len(point) < 2 {
+            continue
+        }
+        if b.contains(point[0], point[1]) {
+            return true
+        }
+        next := ring[(i+1)%len(ring)]
+        if len(next) < 2 {
+            continue
+        }
+        for j, corner := range corners {
+            other := corners[(j+1)%len(corners)]
+            if segmentsIntersect([2]float64{point[0], point[1]}, [2]float64{next[0], next[1]}, corner, other) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// segmentsIntersect reports whether the segments ab and cd cross or touch
+func segmentsIntersect(a, b, c, d [2]float64) bool {
+    orientation := func(o, p, q [2]float64) int {
+        cross := (p[0]-o[0])*(q[1]-o[1]) - (p[1]-o[1])*(q[0]-o[0])
+        switch {
+        case cross > 0:
+            return 1
+        case cross < 0:
+            return -1
+        }
+        return 0
+    }
+    o1, o2 := orientation(a, b, c), orientation(a, b, d)
+    o3, o4 := orientation(c, d, a), orientation(c, d, b)
+    if o1 != 0 || o2 != 0 {
+        return o1 != o2 && o3 != o4
+    }
+    // Collinear: the segments meet when their extents overlap
+    return math.Max(a[0], b[0]) >= math.Min(c[0], d[0]) && math.Max(c[0], d[0]) >= math.Min(a[0], b[0]) &&
+        math.Max(a[1], b[1]) >= math.Min(c[1], d[1]) && math.Max(c[1], d[1]) >= math.Min(a[1], b[1])
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+func containsInt(values []int, value int) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
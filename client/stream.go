@@ -0,0 +1,168 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// handlerError carries an error returned by a watch callback, which ends the
+// watch instead of causing a reconnect
+type handlerError struct {
+    err error
+}
+
+func (e *handlerError) Error() string {
+    return e.err.Error()
+}
+
+// watch runs connect until the context is cancelled, the callback fails or
+// connecting fails more than maxRetries times in a row. connect reports
+// whether it got as far as receiving the stream, which resets the count.
+func (c *Client) watch(ctx context.Context, connect func() (bool, error)) error {
+    failures := 0
+    for {
+        connected, err := connect()
+        var callbackErr *handlerError
+        if errors.As(err, &callbackErr) {
+            return callbackErr.err
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        var apiErr *Error
+        if errors.As(err, &apiErr) && !retryable(apiErr.StatusCode, true) {
+            return err
+        }
+        if connected {
+            failures = 0
+        } else if failures++; failures > c.maxRetries {
+            return err
+        }
+
+        timer := time.NewTimer(c.backoff(failures))
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return ctx.Err()
+        case <-timer.C:
+        }
+    }
+}
+
+// WatchOccupancy follows the occupancy Server-Sent Events stream. After a
+// dropped connection it reconnects with Last-Event-ID, so changes the service
+// still holds in its replay buffer are not missed.
+func (c *Client) WatchOccupancy(ctx context.Context, handle func(OccupancyUpdate) error) error {
+    var lastID uint64
+    return c.watch(ctx, func() (bool, error) {
+        req, err := c.newRequest(ctx, http.MethodGet, "/events/occupancy", nil, nil)
+        if err != nil {
+            return false, err
+        }
+        req.Header.Set("Accept", "text/event-stream")
+        if lastID > 0 {
+            req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+        }
+        resp, err := c.httpClient.Do(req)
+        if err != nil {
+            return false, err
+        }
+        if resp.StatusCode != http.StatusOK {
+            return false, readError(resp)
+        }
+        defer resp.Body.Close()
+
+        var data strings.Builder
+        scanner := bufio.NewScanner(resp.Body)
+        for scanner.Scan() {
+            line := scanner.Text()
+            switch {
+            case line == "":
+                // A blank line ends an event
+                if data.Len() == 0 {
+                    continue
+                }
+                var update OccupancyUpdate
+                if err := json.Unmarshal([]byte(data.String()), &update); err != nil {
+                    return true, err
+                }
+                data.Reset()
+                if err := handle(update); err != nil {
+                    return true, &handlerError{err}
+                }
+            case strings.HasPrefix(line, "id:"):
+                if id, err := strconv.ParseUint(strings.TrimSpace(line[3:]), 10, 64); err == nil {
+                    lastID = id
+                }
+            case strings.HasPrefix(line, "data:"):
+                data.WriteString(strings.TrimSpace(line[5:]))
+            }
+        }
+        if err := scanner.Err(); err != nil {
+            return true, err
+        }
+        return true, errors.New("occupancy stream closed")
+    })
+}
+
+// WatchVehicles follows the live WebSocket feed. Events published while the
+// connection is being re-established are not replayed.
+func (c *Client) WatchVehicles(ctx context.Context, subscription Subscription, handle func(Event) error) error {
+    query := url.Values{}
+    if subscription.BBox != nil {
+        query.Set("bbox", subscription.BBox.String())
+    }
+    if len(subscription.PlaceIDs) > 0 {
+        query.Set("place_id", joinInts(subscription.PlaceIDs))
+    }
+    if len(subscription.TaxiIDs) > 0 {
+        query.Set("taxi_id", strings.Join(subscription.TaxiIDs, ","))
+    }
+
+    return c.watch(ctx, func() (bool, error) {
+        req, err := c.newRequest(ctx, http.MethodGet, "/ws/live", query, nil)
+        if err != nil {
+            return false, err
+        }
+        target := *req.URL
+        target.Scheme = strings.Replace(target.Scheme, "http", "ws", 1)
+        conn, resp, err := websocket.DefaultDialer.DialContext(ctx, target.String(), req.Header)
+        if err != nil {
+            if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+                return false, readError(resp)
+            }
+            return false, err
+        }
+        defer conn.Close()
+
+        // Unblock ReadJSON when the watch is cancelled
+        done := make(chan struct{})
+        defer close(done)
+        go func() {
+            select {
+            case <-ctx.Done():
+                conn.Close()
+            case <-done:
+            }
+        }()
+
+        for {
+            var event Event
+            if err := conn.ReadJSON(&event); err != nil {
+                return true, err
+            }
+            if err := handle(event); err != nil {
+                return true, &handlerError{err}
+            }
+        }
+    })
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// Location decisions reported by ReportLocation and ReportLocations
+const (
+    DecisionApplied     = "applied"
+    DecisionDuplicate   = "duplicate"
+    DecisionArchived    = "archived"
+    DecisionQuarantined = "quarantined"
+    DecisionRejected    = "rejected"
+)
+
+// Batch item statuses
+const (
+    BatchAccepted = "accepted"
+    BatchRejected = "rejected"
+)
+
+// Event types delivered by WatchVehicles
+const (
+    EventVehiclePosition = "vehicle.position"
+    EventPlaceAssigned   = "place.assigned"
+    EventVehicleOffline  = "vehicle.offline"
+)
+
+// TaxiLocation is a taxi and its last known position
+type TaxiLocation struct {
+    TaxiID    string     `json:"taxi_id"`
+    Longitude float64    `json:"longitude"`
+    Latitude  float64    `json:"latitude"`
+    Timestamp *time.Time `json:"timestamp,omitempty"` // Device-reported fix time
+    Accuracy  float64    `json:"accuracy,omitempty"`  // Device-reported accuracy in metres
+    Fleet     string     `json:"fleet,omitempty"`
+    Tenant    string     `json:"tenant,omitempty"` // Set by the service from the credentials
+    Status    string     `json:"status,omitempty"` // online, stale or offline; set on reads only
+}
+
+// Geometry is a GeoJSON polygon
+type Geometry struct {
+    Type        string        `json:"type"`
+    Coordinates [][][]float64 `json:"coordinates"`
+}
+
+// NewPolygon returns a polygon with a single ring of lon/lat points
+func NewPolygon(ring ...[2]float64) *Geometry {
+    coordinates := make([][]float64, len(ring))
+    for i, point := range ring {
+        coordinates[i] = []float64{point[0], point[1]}
+    }
+    return &Geometry{Type: "Polygon", Coordinates: [][][]float64{coordinates}}
+}
+
+// Place is an area taxis are mapped to
+type Place struct {
+    PlaceID   int        `json:"place_id,omitempty"`
+    PlaceName string     `json:"place_name"`
+    Tenant    string     `json:"tenant,omitempty"`
+    Polygon   *Geometry  `json:"polygon"`
+    DeletedAt *time.Time `json:"deleted_at,omitempty"` // Set on soft-deleted places
+}
+
+// Mapping records a taxi entering a place, with the number of times it did so
+type Mapping struct {
+    TaxiID    string     `json:"taxi_id"`
+    PlaceID   int        `json:"place_id"`
+    Place     string     `json:"place"`
+    Counter   int        `json:"counter"`
+    Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// LocationDecision tells what happened to a reported location
+type LocationDecision struct {
+    TaxiID    string    `json:"taxi_id"`
+    Decision  string    `json:"decision"`
+    Reason    string    `json:"reason,omitempty"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// BatchItemResult reports what happened to one location of a batch
+type BatchItemResult struct {
+    Index    int    `json:"index"`
+    TaxiID   string `json:"taxi_id,omitempty"`
+    Status   string `json:"status"`
+    Decision string `json:"decision,omitempty"`
+    Reason   string `json:"reason,omitempty"`
+}
+
+// BatchResponse is the result of ReportLocations
+type BatchResponse struct {
+    Accepted int               `json:"accepted"`
+    Rejected int               `json:"rejected"`
+    Results  []BatchItemResult `json:"results"`
+}
+
+// TaxiPage is one page of ListTaxis
+type TaxiPage struct {
+    Items      []TaxiLocation `json:"items"`
+    NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// PlacePage is one page of ListPlaces
+type PlacePage struct {
+    Items      []Place `json:"items"`
+    NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// MappingPage is one page of ListMappings
+type MappingPage struct {
+    Items      []Mapping `json:"items"`
+    NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// BoundingBox selects positions by longitude and latitude
+type BoundingBox struct {
+    MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// contains reports whether a point lies inside the box
+func (b *BoundingBox) contains(lon, lat float64) bool {
+    return lon >= b.MinLon && lat >= b.MinLat && lon <= b.MaxLon && lat <= b.MaxLat
+}
+
+// String formats the box as the bbox query parameter
+func (b *BoundingBox) String() string {
+    return fmt.Sprintf("%g,%g,%g,%g", b.MinLon, b.MinLat, b.MaxLon, b.MaxLat)
+}
+
+// ListOptions pages, filters and sorts the List methods. Filters an endpoint
+// does not support are ignored by it: BBox applies to taxi positions, to
+// place polygons and to the current position of a mapped taxi, Query to place
+// names and Deleted to places.
+type ListOptions struct {
+    Limit        int    // page size; the service defaults to 100
+    Cursor       string // NextCursor of the previous page
+    Sort         string // e.g. "updated_at" or "-updated_at"
+    BBox         *BoundingBox
+    TaxiIDs      []string
+    PlaceIDs     []int
+    UpdatedSince time.Time
+    Query        string
+    Deleted      bool // list soft-deleted places instead
+}
+
+// Subscription selects the events WatchVehicles delivers. An empty
+// subscription receives everything; otherwise an event is delivered when it
+// matches any of the vehicles, places or the bounding box.
+type Subscription struct {
+    BBox     *BoundingBox
+    PlaceIDs []int
+    TaxiIDs  []string
+}
+
+// Event is a vehicle position, place assignment or vehicle going offline
+type Event struct {
+    Type      string    `json:"type"`
+    Tenant    string    `json:"tenant,omitempty"`
+    TaxiID    string    `json:"taxi_id,omitempty"`
+    PlaceID   int       `json:"place_id,omitempty"`
+    Longitude float64   `json:"longitude,omitempty"`
+    Latitude  float64   `json:"latitude,omitempty"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// OccupancyUpdate reports the number of vehicles inside a place
+type OccupancyUpdate struct {
+    ID        uint64    `json:"id"`
+    Tenant    string    `json:"tenant"`
+    PlaceID   int       `json:"place_id"`
+    Occupancy int       `json:"occupancy"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// Error is an error answered by the service
+type Error struct {
+    StatusCode int             `json:"-"`
+    Code       string          `json:"code"`
+    Message    string          `json:"message"`
+    Details    json.RawMessage `json:"details,omitempty"`
+    RequestID  string          `json:"request_id"`
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+    if e.RequestID != "" {
+        return fmt.Sprintf("service-parking: %d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+    }
+    return fmt.Sprintf("service-parking: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Vehicle freshness thresholds. A taxi is "online" while its last update is
+// younger than staleAfter, "stale" until offlineAfter and "offline" after that.
+var (
+    staleAfter   = envDuration("STALE_AFTER", 10*time.Minute)
+    offlineAfter = envDuration("OFFLINE_AFTER", time.Hour)
+)
+
+// checkStatusConfig refuses freshness thresholds that would skip the stale
+// state or report taxis offline before they are stale
+func checkStatusConfig() error {
+    if staleAfter >= offlineAfter {
+        return fmt.Errorf("STALE_AFTER (%s) must be shorter than OFFLINE_AFTER (%s)", staleAfter, offlineAfter)
+    }
+    return nil
+}
+
+// envString reads a string from the environment, falling back to def
+func envString(key, def string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return def
+}
+
+// envDuration reads a duration such as "15m" from the environment, falling back to def
+func envDuration(key string, def time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d <= 0 {
+        log.Printf("Invalid %s %q, using default %s\n", key, value, def)
+        return def
+    }
+    return d
+}
+
+// envFloat reads a positive number from the environment, falling back to def
+func envFloat(key string, def float64) float64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil || f <= 0 {
+        log.Printf("Invalid %s %q, using default %g\n", key, value, def)
+        return def
+    }
+    return f
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+func envInt(key string, def int64) int64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    n, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || n <= 0 {
+        log.Printf("Invalid %s %q, using default %d\n", key, value, def)
+        return def
+    }
+    return n
+}
+
+// envList reads a comma separated list from the environment
+func envList(key string) []string {
+    var items []string
+    for _, item := range strings.Split(os.Getenv(key), ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
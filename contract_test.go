@@ -0,0 +1,343 @@
+//go:build cgo
+
+// The contract covers the H3 endpoints, which need cgo.
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/websocket"
+    "github.com/uber/h3-go/v4"
+)
+
+// contractCase drives one documented response of an operation through the router
+type contractCase struct {
+    operation string // "METHOD /path" as keyed in openapi.json
+    method    string
+    path      string // below /v1
+    body      string
+    status    int
+    expect    func(mock sqlmock.Sqlmock)
+}
+
+// Fixtures shared by the contract cases
+const (
+    contractPolygon = `{"type":"Polygon","coordinates":[[[106.8,-6.2],[106.81,-6.2],[106.81,-6.21],[106.8,-6.21],[106.8,-6.2]]]}`
+    contractPlace   = `{"place_name":"Gambir","polygon":` + contractPolygon + `}`
+    contractTaxi    = `{"taxi_id":"t1","longitude":106.805,"latitude":-6.205}`
+)
+
+// contractCases returns a case for every documented status of every operation
+func contractCases() []contractCase {
+    now := time.Now().UTC()
+    snapshot := []byte(`{}`)
+    cell, _ := h3.LatLngToCell(h3.NewLatLng(-6.205, 106.805), hexStorageResolution)
+
+    expectAudit := func(mock sqlmock.Sqlmock) {
+        mock.ExpectExec("INSERT INTO audit_log").WillReturnResult(sqlmock.NewResult(1, 1))
+    }
+    expectCover := func(mock sqlmock.Sqlmock) {
+        mock.ExpectBegin()
+        mock.ExpectExec("DELETE FROM place_cells").WillReturnResult(sqlmock.NewResult(0, 0))
+        mock.ExpectExec("INSERT INTO place_cells").WillReturnResult(sqlmock.NewResult(1, 1))
+        mock.ExpectCommit()
+    }
+    expectExists := func(mock sqlmock.Sqlmock, table string) {
+        mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM ` + table).
+            WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+    }
+    expectOccupancy := func(mock sqlmock.Sqlmock) {
+        mock.ExpectQuery("FROM mapping_state s").
+            WillReturnRows(sqlmock.NewRows([]string{"place_id", "tenant", "count"}).AddRow(1, defaultTenant, 1))
+    }
+    expectIngest := func(mock sqlmock.Sqlmock) {
+        mock.ExpectQuery("WHERE t.taxi_id = ANY").WillReturnRows(sqlmock.NewRows(previousFixColumns))
+        mock.ExpectQuery("WITH incoming").WillReturnRows(sqlmock.NewRows([]string{"item"}).AddRow(0))
+    }
+
+    return []contractCase{
+        {"GET /openapi.json", "GET", "/openapi.json", "", 200, nil},
+
+        {"POST /taxi", "POST", "/taxi", contractTaxi, 201, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("INSERT INTO taxi_location").WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+        {"POST /taxi", "POST", "/taxi", contractTaxi, 409, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("INSERT INTO taxi_location").WillReturnRows(sqlmock.NewRows([]string{"after"}))
+            mock.ExpectRollback()
+        }},
+        {"GET /taxi", "GET", "/taxi?bbox=106.7,-6.3,106.9,-6.1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM taxi_location").WillReturnRows(sqlmock.NewRows(
+                []string{"taxi_id", "longitude", "latitude", "fleet", "tenant", "age", "key", "tiebreak"}).
+                AddRow("t1", 106.805, -6.205, "blue", defaultTenant, 12.5, "t1", "t1"))
+        }},
+        {"GET /taxi/{id}", "GET", "/taxi/t1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM taxi_location WHERE taxi_id").WillReturnRows(sqlmock.NewRows(
+                []string{"taxi_id", "longitude", "latitude", "fleet", "tenant", "age"}).
+                AddRow("t1", 106.805, -6.205, "", defaultTenant, nil))
+        }},
+        {"GET /taxi/{id}", "GET", "/taxi/missing", "", 404, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM taxi_location WHERE taxi_id").WillReturnRows(sqlmock.NewRows(
+                []string{"taxi_id", "longitude", "latitude", "fleet", "tenant", "age"}))
+        }},
+        {"PUT /taxi/{id}", "PUT", "/taxi/t1", contractTaxi, 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("FROM taxi_location WHERE taxi_id").
+                WillReturnRows(sqlmock.NewRows([]string{"before"}).AddRow(snapshot))
+            mock.ExpectQuery("UPDATE taxi_location").WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+        {"DELETE /taxi/{id}", "DELETE", "/taxi/t1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("DELETE FROM taxi_location").
+                WillReturnRows(sqlmock.NewRows([]string{"before"}).AddRow(snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+        {"GET /taxi/{id}/trips", "GET", "/taxi/t1/trips?kind=all", "", 200, func(mock sqlmock.Sqlmock) {
+            expectExists(mock, "taxi_location")
+            mock.ExpectQuery("FROM segments").WillReturnRows(sqlmock.NewRows([]string{"segment_id", "taxi_id", "kind",
+                "start_time", "end_time", "start_longitude", "start_latitude", "end_longitude", "end_latitude",
+                "start_place_id", "end_place_id", "distance_meters", "duration_seconds", "key", "tiebreak"}).
+                AddRow(1, "t1", SegmentTrip, now.Add(-time.Hour), now, 106.8, -6.2, 106.81, -6.21, 1, nil, 1500.0, 3600.0,
+                    now.Add(-time.Hour).Format(time.RFC3339), "1"))
+        }},
+
+        {"POST /place", "POST", "/place", contractPlace, 201, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("INSERT INTO places").
+                WillReturnRows(sqlmock.NewRows([]string{"place_id", "after"}).AddRow(1, snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+            expectCover(mock)
+        }},
+        {"GET /places", "GET", "/places?bbox=106.7,-6.3,106.9,-6.1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM places").WillReturnRows(sqlmock.NewRows(
+                []string{"place_id", "place_name", "tenant", "polygon", "deleted_at", "key", "tiebreak"}).
+                AddRow(1, "Gambir", defaultTenant, []byte(contractPolygon), nil, "1", "1"))
+        }},
+        {"GET /place/{id}", "GET", "/place/1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM places WHERE place_id").WillReturnRows(sqlmock.NewRows(
+                []string{"place_id", "place_name", "tenant", "polygon"}).
+                AddRow(1, "Gambir", defaultTenant, []byte(contractPolygon)))
+        }},
+        {"PUT /place/{id}", "PUT", "/place/1", contractPlace, 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("FROM places WHERE place_id").
+                WillReturnRows(sqlmock.NewRows([]string{"tenant", "before"}).AddRow(defaultTenant, snapshot))
+            mock.ExpectQuery("UPDATE places").WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+            expectCover(mock)
+        }},
+        {"DELETE /place/{id}", "DELETE", "/place/1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("FROM places WHERE place_id").
+                WillReturnRows(sqlmock.NewRows([]string{"tenant", "before"}).AddRow(defaultTenant, snapshot))
+            mock.ExpectQuery("UPDATE places SET deleted_at").WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+            mock.ExpectExec("UPDATE mapping_state").WillReturnResult(sqlmock.NewResult(0, 1))
+            mock.ExpectExec("UPDATE place_visits").WillReturnResult(sqlmock.NewResult(0, 1))
+            expectAudit(mock)
+            mock.ExpectCommit()
+            expectOccupancy(mock)
+        }},
+        {"POST /place/{id}/restore", "POST", "/place/1/restore", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("FROM places WHERE place_id").
+                WillReturnRows(sqlmock.NewRows([]string{"tenant", "before"}).AddRow(defaultTenant, snapshot))
+            mock.ExpectQuery("UPDATE places SET deleted_at = NULL").
+                WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+        {"GET /place/{id}/cells", "GET", "/place/1/cells", "", 200, func(mock sqlmock.Sqlmock) {
+            expectExists(mock, "places")
+            mock.ExpectQuery("FROM place_cells").WillReturnRows(sqlmock.NewRows([]string{"cell"}).AddRow(int64(cell)))
+        }},
+        {"GET /cells/{cell}/vehicles", "GET", "/cells/" + cell.String() + "/vehicles?k=1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("WHERE h3_cell = ANY").WillReturnRows(sqlmock.NewRows(
+                []string{"taxi_id", "longitude", "latitude", "fleet", "tenant", "age"}).
+                AddRow("t1", 106.805, -6.205, "", defaultTenant, 5.0))
+        }},
+
+        {"POST /updateLocation", "POST", "/updateLocation", contractTaxi, 200, expectIngest},
+        {"POST /locations/batch", "POST", "/locations/batch", "[" + contractTaxi + `,{"taxi_id":""}]`, 200, expectIngest},
+        {"GET /locations/quarantine", "GET", "/locations/quarantine", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM location_quarantine").WillReturnRows(sqlmock.NewRows([]string{"quarantine_id", "taxi_id",
+                "longitude", "latitude", "device_time", "reason", "received_at"}).
+                AddRow(1, "t1", 106.805, 95.0, now, "invalid coordinates", now))
+        }},
+        {"GET /getMapping", "GET", "/getMapping", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM mapping m").WillReturnRows(sqlmock.NewRows(
+                []string{"taxi_id", "place_id", "place_name", "counter", "timestamp", "key", "tiebreak"}).
+                AddRow("t1", 1, "Gambir", 3, now, "1", "1"))
+        }},
+        {"GET /triggerMapping", "GET", "/triggerMapping", "", 200, func(mock sqlmock.Sqlmock) {
+            expectAudit(mock)
+            // The mapping run itself happens after the response
+            mock.ExpectQuery("FROM taxi_location t").WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "tenant",
+                "longitude", "latitude", "updated_at", "fixed_at", "place_id", "last_history_id"}))
+            expectOccupancy(mock)
+        }},
+
+        {"GET /ws/live", "GET", "/ws/live?bbox=106.7,-6.3,106.9,-6.1", "", 101, nil},
+        {"GET /events/occupancy", "GET", "/events/occupancy", "", 200, nil},
+
+        {"GET /analytics/places/{id}/dwell", "GET", "/analytics/places/1/dwell?bucket=day", "", 200, func(mock sqlmock.Sqlmock) {
+            expectExists(mock, "places")
+            mock.ExpectQuery("GROUP BY taxi_id").
+                WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "count", "seconds"}).AddRow("t1", 2, 900.0))
+            mock.ExpectQuery("GROUP BY bucket").WillReturnRows(sqlmock.NewRows(
+                []string{"bucket", "count", "avg", "median", "p95"}).AddRow(now.Truncate(time.Hour), 2, 450.0, 450.0, 600.0))
+        }},
+        {"GET /analytics/places/{id}/occupancy", "GET", "/analytics/places/1/occupancy", "", 200, func(mock sqlmock.Sqlmock) {
+            expectExists(mock, "places")
+            mock.ExpectQuery("FROM occupancy_rollups").WillReturnRows(sqlmock.NewRows(
+                []string{"bucket_start", "min", "avg", "max", "samples"}).AddRow(now.Truncate(time.Hour), 0, 1.5, 3, 12))
+        }},
+        {"GET /analytics/od", "GET", "/analytics/od?bucket=hour", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM place_visits").WillReturnRows(sqlmock.NewRows([]string{"origin", "origin_name",
+                "place_id", "place_name", "bucket", "trips", "vehicles"}).
+                AddRow(1, "Gambir", 2, "Senen", now.Truncate(time.Hour), 4, 3))
+        }},
+        {"GET /analytics/heatmap", "GET", "/analytics/heatmap?bbox=106.7,-6.3,106.9,-6.1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM taxi_location").
+                WillReturnRows(sqlmock.NewRows([]string{"row", "col", "count"}).AddRow(-621, 10680, 2))
+        }},
+
+        {"POST /keys", "POST", "/keys", `{"name":"device","scopes":["read"]}`, 201, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("INSERT INTO api_keys").
+                WillReturnRows(sqlmock.NewRows([]string{"key_id", "created_at", "after"}).AddRow(1, now, snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+        {"GET /keys", "GET", "/keys", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM api_keys").WillReturnRows(sqlmock.NewRows([]string{"key_id", "name", "tenant",
+                "scopes", "created_at", "rotated_at", "revoked_at"}).
+                AddRow(1, "device", defaultTenant, "{read}", now, now, nil))
+        }},
+        {"POST /keys/{id}/rotate", "POST", "/keys/1/rotate", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("FROM api_keys WHERE key_id").
+                WillReturnRows(sqlmock.NewRows([]string{"tenant", "scopes", "before"}).AddRow(defaultTenant, "{read}", snapshot))
+            mock.ExpectQuery("UPDATE api_keys").WillReturnRows(sqlmock.NewRows([]string{"name", "tenant", "scopes",
+                "created_at", "rotated_at", "after"}).AddRow("device", defaultTenant, "{read}", now, now, snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+        {"DELETE /keys/{id}", "DELETE", "/keys/1", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectBegin()
+            mock.ExpectQuery("FROM api_keys WHERE key_id").
+                WillReturnRows(sqlmock.NewRows([]string{"tenant", "scopes", "before"}).AddRow(defaultTenant, "{read}", snapshot))
+            mock.ExpectQuery("UPDATE api_keys SET revoked_at").WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+            expectAudit(mock)
+            mock.ExpectCommit()
+        }},
+
+        {"GET /audit", "GET", "/audit?action=taxi.create", "", 200, func(mock sqlmock.Sqlmock) {
+            mock.ExpectQuery("FROM audit_log").WillReturnRows(sqlmock.NewRows([]string{"audit_id", "tenant", "actor",
+                "action", "target_type", "target_id", "before", "after", "request_id", "created_at"}).
+                AddRow(1, defaultTenant, "anonymous", "taxi.create", "taxi", "t1", "null", snapshot, "abc", now))
+        }},
+    }
+}
+
+// TestOpenAPIContract drives every documented response of every operation
+// through the router and checks the status and body against openapi.json
+func TestOpenAPIContract(t *testing.T) {
+    setAuth(t, false)
+    setRateLimits(t)
+    server := httptest.NewServer(newRouter())
+    defer server.Close()
+
+    covered := make(map[string]bool)
+    for _, test := range contractCases() {
+        covered[test.operation+" "+strconv.Itoa(test.status)] = true
+        t.Run(test.operation+" "+strconv.Itoa(test.status), func(t *testing.T) {
+            operation := apiSpec.operations[test.operation]
+            if operation == nil {
+                t.Fatalf("%s is not documented", test.operation)
+            }
+            mock := mockDB(t)
+            if test.expect != nil {
+                test.expect(mock)
+            }
+
+            response, body := contractRequest(t, server.URL+apiV1Prefix+test.path, test)
+            if response.StatusCode != test.status {
+                t.Fatalf("got status %d, want %d: %s", response.StatusCode, test.status, body)
+            }
+            recorder := &specRecorder{ResponseWriter: httptest.NewRecorder(), status: response.StatusCode}
+            for name, values := range response.Header {
+                recorder.Header()[name] = values
+            }
+            if body != nil {
+                recorder.body = bytes.NewBuffer(body)
+            }
+            for _, violation := range apiSpec.checkResponse(operation, recorder) {
+                t.Error(violation)
+            }
+            waitForQueries(t, mock)
+        })
+    }
+
+    for key, operation := range apiSpec.operations {
+        for status := range operation.Responses {
+            if status != "default" && !covered[key+" "+status] {
+                t.Errorf("no contract case for %s %s", key, status)
+            }
+        }
+    }
+}
+
+// contractRequest sends a case's request. Streams are only opened: it
+// returns the upgrade or the headers of the event stream without a body.
+func contractRequest(t *testing.T, url string, test contractCase) (*http.Response, []byte) {
+    t.Helper()
+    if test.status == http.StatusSwitchingProtocols {
+        conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn.Close()
+        return response, nil
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    request, err := http.NewRequestWithContext(ctx, test.method, url, strings.NewReader(test.body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if test.body != "" {
+        request.Header.Set("Content-Type", "application/json")
+    }
+    response, err := http.DefaultClient.Do(request)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer response.Body.Close()
+    if strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+        return response, nil
+    }
+    body, err := io.ReadAll(response.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return response, body
+}
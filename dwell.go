@@ -0,0 +1,161 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// recordPlaceTransition closes the taxi's open visit when it leaves a place and
+// opens a new one when it enters a place. at is the device time of the
+// history point that crossed the boundary.
+func recordPlaceTransition(tenant, taxiID string, from, to sql.NullInt64, at time.Time) {
+    if from == to {
+        return
+    }
+    if from.Valid {
+        _, err := db.Exec(`UPDATE place_visits SET left_at = $4
+            WHERE tenant = $1 AND taxi_id = $2 AND place_id = $3 AND left_at IS NULL`,
+            tenant, taxiID, from, at)
+        if err != nil {
+            log.Printf("Failed to close visit of Taxi ID %s to Place ID %d: %v\n", taxiID, from.Int64, err)
+        }
+    }
+    if to.Valid {
+        _, err := db.Exec(`INSERT INTO place_visits (tenant, taxi_id, place_id, entered_at) VALUES ($1, $2, $3, $4)`,
+            tenant, taxiID, to, at)
+        if err != nil {
+            log.Printf("Failed to open visit of Taxi ID %s to Place ID %d: %v\n", taxiID, to.Int64, err)
+        }
+    }
+}
+
+// closeOpenVisits ends every open visit of a taxi at the device time of its
+// last fix, used when the taxi goes offline
+func closeOpenVisits(tenant, taxiID string) {
+    _, err := db.Exec(`UPDATE place_visits
+        SET left_at = (SELECT COALESCE(device_time, updated_at::timestamptz) FROM taxi_location
+            WHERE tenant = $1 AND taxi_id = $2)
+        WHERE tenant = $1 AND taxi_id = $2 AND left_at IS NULL`, tenant, taxiID)
+    if err != nil {
+        log.Printf("Failed to close visits of Taxi ID %s: %v\n", taxiID, err)
+    }
+}
+
+// VehicleDwell is the time one vehicle spent inside a place
+type VehicleDwell struct {
+    TaxiID       string  `json:"taxi_id"`
+    Visits       int     `json:"visits"`
+    TotalSeconds float64 `json:"total_seconds"`
+}
+
+// DwellBucket summarises the completed stays that started in one hour or day
+type DwellBucket struct {
+    Start          time.Time `json:"start"`
+    Visits         int       `json:"visits"`
+    AverageSeconds float64   `json:"avg_seconds"`
+    MedianSeconds  float64   `json:"median_seconds"`
+    P95Seconds     float64   `json:"p95_seconds"`
+}
+
+// DwellReport is returned by the dwell analytics endpoint
+type DwellReport struct {
+    PlaceID  int            `json:"place_id"`
+    From     time.Time      `json:"from"`
+    To       time.Time      `json:"to"`
+    Bucket   string         `json:"bucket"`
+    Vehicles []VehicleDwell `json:"vehicles"`
+    Buckets  []DwellBucket  `json:"buckets"`
+}
+
+// getPlaceDwell handles GET /analytics/places/{id}/dwell. Per-vehicle totals
+// add up every interval spent inside the place, clipped to ?from= and ?to=
+// and counting ongoing visits up to now. Buckets (?bucket=hour or day) report
+// the average, median and 95th percentile of completed stays.
+func getPlaceDwell(w http.ResponseWriter, r *http.Request) {
+    placeID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
+        return
+    }
+
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    if r.URL.Query().Get("from") == "" {
+        from = to.Add(-24 * time.Hour)
+    }
+
+    bucket := r.URL.Query().Get("bucket")
+    if bucket == "" {
+        bucket = "hour"
+    }
+    if bucket != "hour" && bucket != "day" {
+        writeError(w, r, http.StatusBadRequest, "Invalid bucket")
+        return
+    }
+    if !requirePlace(w, r, placeID) {
+        return
+    }
+
+    report := DwellReport{PlaceID: placeID, From: from, To: to, Bucket: bucket,
+        Vehicles: []VehicleDwell{}, Buckets: []DwellBucket{}}
+
+    rows, err := db.Query(`SELECT taxi_id, COUNT(*),
+            SUM(EXTRACT(EPOCH FROM LEAST(COALESCE(left_at, CURRENT_TIMESTAMP), $3) - GREATEST(entered_at, $2)))
+        FROM place_visits
+        WHERE place_id = $1 AND entered_at < $3 AND COALESCE(left_at, CURRENT_TIMESTAMP) > $2
+        GROUP BY taxi_id
+        ORDER BY 3 DESC`,
+        placeID, from, to)
+    if err != nil {
+        log.Println("Error querying dwell per vehicle:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query dwell time")
+        return
+    }
+    for rows.Next() {
+        var vehicle VehicleDwell
+        if err := rows.Scan(&vehicle.TaxiID, &vehicle.Visits, &vehicle.TotalSeconds); err != nil {
+            rows.Close()
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan dwell time")
+            return
+        }
+        report.Vehicles = append(report.Vehicles, vehicle)
+    }
+    rows.Close()
+
+    rows, err = db.Query(`SELECT date_trunc($4, entered_at) AS bucket, COUNT(*),
+            AVG(seconds),
+            percentile_cont(0.5) WITHIN GROUP (ORDER BY seconds),
+            percentile_cont(0.95) WITHIN GROUP (ORDER BY seconds)
+        FROM (SELECT entered_at, EXTRACT(EPOCH FROM left_at - entered_at) AS seconds
+            FROM place_visits
+            WHERE place_id = $1 AND left_at IS NOT NULL AND entered_at >= $2 AND entered_at < $3) stays
+        GROUP BY bucket
+        ORDER BY bucket`,
+        placeID, from, to, bucket)
+    if err != nil {
+        log.Println("Error querying dwell buckets:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query dwell time")
+        return
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var b DwellBucket
+        if err := rows.Scan(&b.Start, &b.Visits, &b.AverageSeconds, &b.MedianSeconds, &b.P95Seconds); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan dwell time")
+            return
+        }
+        report.Buckets = append(report.Buckets, b)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+// dwellRequest calls the dwell endpoint of place 5 with query
+func dwellRequest(query string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/analytics/places/5/dwell?"+query, nil),
+        map[string]string{"id": "5"})
+    getPlaceDwell(w, r)
+    return w
+}
+
+// expectPlace answers the existence check of place 5
+func expectPlace(mock sqlmock.Sqlmock) {
+    mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM places").WithArgs(5, "").
+        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+}
+
+func TestPlaceDwellPerVehicle(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+    to := from.Add(24 * time.Hour)
+
+    expectPlace(mock)
+    // Every visit overlapping the window counts, clipped to the window, with
+    // ongoing visits running up to now, summed per vehicle, longest first
+    mock.ExpectQuery(`SELECT taxi_id, COUNT\(\*\), `+
+        `SUM\(EXTRACT\(EPOCH FROM LEAST\(COALESCE\(left_at, CURRENT_TIMESTAMP\), \$3\) - GREATEST\(entered_at, \$2\)\)\) `+
+        `FROM place_visits `+
+        `WHERE place_id = \$1 AND entered_at < \$3 AND COALESCE\(left_at, CURRENT_TIMESTAMP\) > \$2 `+
+        `GROUP BY taxi_id ORDER BY 3 DESC`).
+        WithArgs(5, from, to).
+        WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "visits", "total_seconds"}).
+            AddRow("t2", 3, 5400.0).
+            AddRow("t1", 1, 600.0))
+    mock.ExpectQuery("FROM \\(SELECT entered_at").WillReturnRows(sqlmock.NewRows([]string{"bucket", "visits", "avg", "median", "p95"}))
+
+    w := dwellRequest("from=" + from.Format(time.RFC3339) + "&to=" + to.Format(time.RFC3339))
+    if w.Code != http.StatusOK {
+        t.Fatalf("got status %d: %s", w.Code, w.Body)
+    }
+    var report DwellReport
+    if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+        t.Fatal(err)
+    }
+    want := []VehicleDwell{{TaxiID: "t2", Visits: 3, TotalSeconds: 5400}, {TaxiID: "t1", Visits: 1, TotalSeconds: 600}}
+    if len(report.Vehicles) != len(want) || report.Vehicles[0] != want[0] || report.Vehicles[1] != want[1] {
+        t.Fatalf("got vehicles %+v, want %+v", report.Vehicles, want)
+    }
+    if len(report.Buckets) != 0 || report.Buckets == nil {
+        t.Fatalf("got buckets %+v, want an empty list", report.Buckets)
+    }
+}
+
+func TestPlaceDwellBuckets(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    to := time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)
+    day := to.Add(-24 * time.Hour)
+
+    expectPlace(mock)
+    mock.ExpectQuery("SELECT taxi_id").WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "visits", "total_seconds"}))
+    // Only completed stays that started within the window are summarised,
+    // per bucket, by their mean, median and 95th percentile
+    mock.ExpectQuery(`SELECT date_trunc\(\$4, entered_at\) AS bucket, COUNT\(\*\), AVG\(seconds\), `+
+        `percentile_cont\(0.5\) WITHIN GROUP \(ORDER BY seconds\), `+
+        `percentile_cont\(0.95\) WITHIN GROUP \(ORDER BY seconds\) `+
+        `FROM \(SELECT entered_at, EXTRACT\(EPOCH FROM left_at - entered_at\) AS seconds FROM place_visits `+
+        `WHERE place_id = \$1 AND left_at IS NOT NULL AND entered_at >= \$2 AND entered_at < \$3\) stays `+
+        `GROUP BY bucket ORDER BY bucket`).
+        WithArgs(5, day, to, "day").
+        WillReturnRows(sqlmock.NewRows([]string{"bucket", "visits", "avg", "median", "p95"}).
+            AddRow(day, 4, 750.0, 450.0, 1935.0))
+
+    // Without ?from= the report covers the last day
+    w := dwellRequest("bucket=day&to=" + to.Format(time.RFC3339))
+    if w.Code != http.StatusOK {
+        t.Fatalf("got status %d: %s", w.Code, w.Body)
+    }
+    var report DwellReport
+    if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+        t.Fatal(err)
+    }
+    want := DwellBucket{Start: day, Visits: 4, AverageSeconds: 750, MedianSeconds: 450, P95Seconds: 1935}
+    if len(report.Buckets) != 1 || report.Buckets[0] != want {
+        t.Fatalf("got buckets %+v, want %+v", report.Buckets, want)
+    }
+    if !report.From.Equal(day) || report.Bucket != "day" {
+        t.Fatalf("got a %s report from %s, want a day report from %s", report.Bucket, report.From, day)
+    }
+}
+
+func TestPlaceDwellRejectsBadParameters(t *testing.T) {
+    setAuth(t, false)
+    for _, query := range []string{"bucket=week", "from=yesterday"} {
+        // Both are refused before the database is queried
+        mockDB(t)
+        if w := dwellRequest(query); w.Code != http.StatusBadRequest {
+            t.Errorf("%s: got status %d, want 400", query, w.Code)
+        }
+    }
+}
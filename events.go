@@ -0,0 +1,72 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// Event types published on the event bus
+const (
+    EventVehiclePosition = "vehicle.position"
+    EventPlaceAssigned   = "place.assigned"
+    EventVehicleOffline  = "vehicle.offline"
+)
+
+// Event is a notification about a vehicle or place published inside the service
+type Event struct {
+    Type      string    `json:"type"`
+    Tenant    string    `json:"tenant,omitempty"`
+    TaxiID    string    `json:"taxi_id,omitempty"`
+    PlaceID   int       `json:"place_id,omitempty"`
+    Longitude float64   `json:"longitude,omitempty"`
+    Latitude  float64   `json:"latitude,omitempty"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// eventBus fans events out to in-process subscribers
+type eventBus struct {
+    mutex       sync.RWMutex
+    subscribers map[chan Event]struct{}
+}
+
+// events is the process-wide event bus
+var events = &eventBus{subscribers: make(map[chan Event]struct{})}
+
+// Publish delivers an event to every subscriber. Subscribers whose buffer is
+// full miss the event rather than blocking the publisher.
+func (b *eventBus) Publish(event Event) {
+    if event.Timestamp.IsZero() {
+        event.Timestamp = time.Now()
+    }
+
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    for ch := range b.subscribers {
+        select {
+        case ch <- event:
+        default:
+            log.Printf("Dropping %s event for a slow subscriber\n", event.Type)
+        }
+    }
+}
+
+// Subscribe registers a new subscriber and returns its channel together with a
+// function that unregisters it
+func (b *eventBus) Subscribe(buffer int) (<-chan Event, func()) {
+    ch := make(chan Event, buffer)
+
+    b.mutex.Lock()
+    b.subscribers[ch] = struct{}{}
+    b.mutex.Unlock()
+
+    var once sync.Once
+    return ch, func() {
+        once.Do(func() {
+            b.mutex.Lock()
+            delete(b.subscribers, ch)
+            b.mutex.Unlock()
+            close(ch)
+        })
+    }
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/lib/pq"
+    "github.com/paulmach/orb"
+    "github.com/paulmach/orb/geo"
+)
+
+// DecisionQuarantined is reported for locations held back by the plausibility filter
+const DecisionQuarantined = "quarantined"
+
+// maxSpeedKmh is the highest implied speed between two fixes that is believed
+var maxSpeedKmh = envFloat("MAX_SPEED_KMH", 250)
+
+// reanchorAfter is how many fixes in a row the speed check must quarantine
+// before a fix that is consistent with all of them is accepted anyway. It
+// keeps one bogus stored fix from blocking every later fix of the taxi.
+var reanchorAfter = int(envInt("REANCHOR_AFTER", 3))
+
+// speedReason starts the reason given for fixes quarantined by the speed check
+const speedReason = "implied speed"
+
+// previousFix is the last stored position of a taxi
+type previousFix struct {
+    Longitude float64
+    Latitude  float64
+    Time      sql.NullTime
+    Fleet     sql.NullString
+    Smoothed  nullSmoothedFix
+    // Suspects are the latest fixes the speed check quarantined since the
+    // stored fix, oldest first
+    Suspects []suspectFix
+}
+
+// suspectFix is a fix the speed check quarantined
+type suspectFix struct {
+    Longitude float64
+    Latitude  float64
+    Time      time.Time
+}
+
+// noteQuarantined remembers a fix the speed check quarantined, so that later
+// fixes consistent with it can re-anchor the check
+func (p *previousFix) noteQuarantined(location TaxiLocation, timestamp time.Time, reason string) {
+    if p == nil || !strings.HasPrefix(reason, speedReason) {
+        return
+    }
+    p.Suspects = append(p.Suspects, suspectFix{Longitude: location.Longitude, Latitude: location.Latitude, Time: timestamp})
+    if len(p.Suspects) > reanchorAfter {
+        p.Suspects = p.Suspects[len(p.Suspects)-reanchorAfter:]
+    }
+}
+
+// plausibilityCheck inspects an incoming fix and returns a reason when it
+// looks wrong. previous is nil for taxis without a stored position.
+type plausibilityCheck func(location TaxiLocation, timestamp time.Time, previous *previousFix) string
+
+// plausibilityChecks run in order; the first reason returned quarantines the fix
+var plausibilityChecks = []plausibilityCheck{
+    checkSwappedAxes,
+    checkCoordinateRange,
+    checkNullIsland,
+    checkImpliedSpeed,
+}
+
+// checkCoordinateRange rejects latitudes and longitudes outside the globe
+func checkCoordinateRange(location TaxiLocation, timestamp time.Time, previous *previousFix) string {
+    if location.Latitude < -90 || location.Latitude > 90 || location.Longitude < -180 || location.Longitude > 180 {
+        return "coordinates out of range"
+    }
+    return ""
+}
+
+// checkNullIsland rejects (0,0), which receivers report when they have no fix
+func checkNullIsland(location TaxiLocation, timestamp time.Time, previous *previousFix) string {
+    if location.Latitude == 0 && location.Longitude == 0 {
+        return "null island (0,0)"
+    }
+    return ""
+}
+
+// checkSwappedAxes flags fixes whose latitude and longitude appear to have been
+// exchanged: either only the swapped point is on the globe, or only the swapped
+// point is reachable from the previous fix
+func checkSwappedAxes(location TaxiLocation, timestamp time.Time, previous *previousFix) string {
+    swapped := TaxiLocation{TaxiID: location.TaxiID, Longitude: location.Latitude, Latitude: location.Longitude}
+    if checkCoordinateRange(location, timestamp, previous) != "" {
+        if checkCoordinateRange(swapped, timestamp, previous) == "" {
+            return "latitude and longitude swapped"
+        }
+        return ""
+    }
+    if location.Latitude == location.Longitude || previous == nil {
+        return ""
+    }
+    if checkImpliedSpeed(location, timestamp, previous) != "" && checkImpliedSpeed(swapped, timestamp, previous) == "" {
+        return "latitude and longitude swapped"
+    }
+    return ""
+}
+
+// checkImpliedSpeed rejects jumps from the previous fix faster than
+// maxSpeedKmh, unless the fix re-anchors the taxi: the last reanchorAfter
+// fixes were all quarantined by this check and, together with the new fix,
+// form a track driven within the speed limit. The stored fix is then taken
+// to be the bogus one.
+func checkImpliedSpeed(location TaxiLocation, timestamp time.Time, previous *previousFix) string {
+    if previous == nil || !previous.Time.Valid {
+        return ""
+    }
+    speed, ok := impliedSpeed(previous.Longitude, previous.Latitude, previous.Time.Time,
+        location.Longitude, location.Latitude, timestamp)
+    if !ok || speed <= maxSpeedKmh {
+        return ""
+    }
+    if reanchorAfter > 0 && len(previous.Suspects) >= reanchorAfter {
+        track := append([]suspectFix{}, previous.Suspects[len(previous.Suspects)-reanchorAfter:]...)
+        track = append(track, suspectFix{Longitude: location.Longitude, Latitude: location.Latitude, Time: timestamp})
+        consistent := true
+        for i := 1; i < len(track) && consistent; i++ {
+            leg, ok := impliedSpeed(track[i-1].Longitude, track[i-1].Latitude, track[i-1].Time,
+                track[i].Longitude, track[i].Latitude, track[i].Time)
+            consistent = ok && leg <= maxSpeedKmh
+        }
+        if consistent {
+            return ""
+        }
+    }
+    return fmt.Sprintf("%s %.0f km/h exceeds %.0f km/h", speedReason, speed, maxSpeedKmh)
+}
+
+// impliedSpeed returns the speed in km/h needed to get from one fix to the
+// next, and false unless the second fix is later
+func impliedSpeed(fromLongitude, fromLatitude float64, from time.Time, toLongitude, toLatitude float64, to time.Time) (float64, bool) {
+    elapsed := to.Sub(from)
+    if elapsed <= 0 {
+        return 0, false
+    }
+    meters := geo.DistanceHaversine(orb.Point{fromLongitude, fromLatitude}, orb.Point{toLongitude, toLatitude})
+    return meters / 1000 / elapsed.Hours(), true
+}
+
+// screenLocation runs the plausibility checks against a fix and returns the
+// reason it is suspect, or an empty string when it may be stored
+func screenLocation(location TaxiLocation, timestamp time.Time, previous *previousFix) string {
+    for _, check := range plausibilityChecks {
+        if reason := check(location, timestamp, previous); reason != "" {
+            return reason
+        }
+    }
+    return ""
+}
+
+// loadPreviousFixes returns the stored positions of the given taxis of a
+// tenant, with the fixes the speed check quarantined since
+func loadPreviousFixes(tenant string, taxiIDs []string) (map[string]*previousFix, error) {
+    rows, err := db.Query(`SELECT taxi_id, longitude, latitude, device_time, fleet,
+        smoothed_longitude, smoothed_latitude, smoothed_variance,
+        s.longitudes, s.latitudes, s.times
+        FROM taxi_location t
+        LEFT JOIN LATERAL (SELECT array_agg(q.longitude ORDER BY q.device_time) AS longitudes,
+                array_agg(q.latitude ORDER BY q.device_time) AS latitudes,
+                array_agg(EXTRACT(EPOCH FROM q.device_time)::float8 ORDER BY q.device_time) AS times
+            FROM (SELECT longitude, latitude, device_time FROM location_quarantine
+                WHERE tenant = t.tenant AND taxi_id = t.taxi_id AND reason LIKE $3 || '%'
+                AND device_time > t.device_time
+                ORDER BY device_time DESC LIMIT $4) q) s ON true
+        WHERE t.taxi_id = ANY($1) AND t.tenant = $2`, pq.Array(taxiIDs), tenant, speedReason, reanchorAfter)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    fixes := make(map[string]*previousFix)
+    for rows.Next() {
+        var taxiID string
+        var smoothedLongitude, smoothedLatitude, smoothedVariance sql.NullFloat64
+        var suspectLongitudes, suspectLatitudes, suspectTimes []float64
+        fix := &previousFix{}
+        if err := rows.Scan(&taxiID, &fix.Longitude, &fix.Latitude, &fix.Time, &fix.Fleet,
+            &smoothedLongitude, &smoothedLatitude, &smoothedVariance,
+            pq.Array(&suspectLongitudes), pq.Array(&suspectLatitudes), pq.Array(&suspectTimes)); err != nil {
+            return nil, err
+        }
+        fix.Smoothed.scan(smoothedLongitude, smoothedLatitude, smoothedVariance)
+        for i := range suspectTimes {
+            fix.Suspects = append(fix.Suspects, suspectFix{Longitude: suspectLongitudes[i], Latitude: suspectLatitudes[i],
+                Time: time.Unix(0, int64(suspectTimes[i]*1e9)).UTC()})
+        }
+        fixes[taxiID] = fix
+    }
+    return fixes, rows.Err()
+}
+
+// quarantineLocation stores a suspect fix for review instead of applying it
+func quarantineLocation(location TaxiLocation, timestamp time.Time, reason string) error {
+    _, err := db.Exec(`INSERT INTO location_quarantine (taxi_id, longitude, latitude, device_time, reason, tenant)
+        VALUES ($1, $2, $3, $4, $5, $6)`,
+        location.TaxiID, location.Longitude, location.Latitude, timestamp, reason, location.Tenant)
+    if err != nil {
+        log.Printf("Failed to quarantine location for Taxi ID %s: %v\n", location.TaxiID, err)
+    }
+    return err
+}
+
+// QuarantinedLocation is a suspect fix awaiting review
+type QuarantinedLocation struct {
+    QuarantineID int       `json:"quarantine_id"`
+    TaxiID       string    `json:"taxi_id"`
+    Longitude    float64   `json:"longitude"`
+    Latitude     float64   `json:"latitude"`
+    Timestamp    time.Time `json:"timestamp"`
+    Reason       string    `json:"reason"`
+    ReceivedAt   time.Time `json:"received_at"`
+}
+
+// getQuarantinedLocations lists the most recent quarantined fixes for review
+func getQuarantinedLocations(w http.ResponseWriter, r *http.Request) {
+    rows, err := db.Query(`SELECT quarantine_id, taxi_id, longitude, latitude, device_time, reason, received_at
+        FROM location_quarantine WHERE `+tenantClause("tenant", 1)+`
+        ORDER BY quarantine_id DESC LIMIT 500`, requestTenant(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to query quarantined locations")
+        return
+    }
+    defer rows.Close()
+
+    quarantined := []QuarantinedLocation{}
+    for rows.Next() {
+        var q QuarantinedLocation
+        if err := rows.Scan(&q.QuarantineID, &q.TaxiID, &q.Longitude, &q.Latitude, &q.Timestamp, &q.Reason, &q.ReceivedAt); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan quarantined location")
+            return
+        }
+        quarantined = append(quarantined, q)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(quarantined)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestScreenLocation(t *testing.T) {
+    at := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    // Jakarta, a minute before the fixes under test
+    stored := &previousFix{Longitude: 106.8, Latitude: -6.2, Time: sql.NullTime{Time: at.Add(-time.Minute), Valid: true}}
+    // Suspects quarantined after a bogus stored fix in Singapore, a minute apart
+    bogus := &previousFix{Longitude: 103.8, Latitude: 1.3, Time: sql.NullTime{Time: at.Add(-4 * time.Minute), Valid: true},
+        Suspects: []suspectFix{
+            {Longitude: 106.8, Latitude: -6.2, Time: at.Add(-3 * time.Minute)},
+            {Longitude: 106.801, Latitude: -6.2, Time: at.Add(-2 * time.Minute)},
+            {Longitude: 106.802, Latitude: -6.2, Time: at.Add(-time.Minute)},
+        }}
+    tooFew := &previousFix{Longitude: bogus.Longitude, Latitude: bogus.Latitude, Time: bogus.Time, Suspects: bogus.Suspects[1:]}
+    scattered := &previousFix{Longitude: bogus.Longitude, Latitude: bogus.Latitude, Time: bogus.Time,
+        Suspects: []suspectFix{bogus.Suspects[0], {Longitude: 110, Latitude: -7, Time: at.Add(-2 * time.Minute)}, bogus.Suspects[2]}}
+
+    tests := []struct {
+        name      string
+        longitude float64
+        latitude  float64
+        previous  *previousFix
+        reason    string // prefix of the expected reason, empty to accept
+    }{
+        {"plausible first fix", 106.8, -6.2, nil, ""},
+        {"plausible move", 106.801, -6.2, stored, ""},
+        {"latitude out of range", 100, 95, nil, "coordinates out of range"},
+        {"longitude out of range", 200, 10, nil, "coordinates out of range"},
+        {"both out of range", 200, 95, nil, "coordinates out of range"},
+        {"swapped out of range", -6.2, 106.8, nil, "latitude and longitude swapped"},
+        {"swapped within range", -6.2, 16.8, &previousFix{Longitude: 16.8, Latitude: -6.2,
+            Time: sql.NullTime{Time: at.Add(-time.Minute), Valid: true}}, "latitude and longitude swapped"},
+        {"equal axes are never swapped", 5, 5, stored, speedReason},
+        {"null island", 0, 0, nil, "null island"},
+        {"null island after a fix", 0, 0, stored, "null island"},
+        {"too fast", 107.8, -6.2, stored, speedReason},
+        {"fast but slow enough", 106.83, -6.2, stored, ""},
+        {"previous without time", 107.8, -6.2, &previousFix{Longitude: 106.8, Latitude: -6.2}, ""},
+        {"not after the previous fix", 107.8, -6.2, &previousFix{Longitude: 106.8, Latitude: -6.2,
+            Time: sql.NullTime{Time: at, Valid: true}}, ""},
+        {"re-anchors after consistent suspects", 106.803, -6.2, bogus, ""},
+        {"too few suspects to re-anchor", 106.803, -6.2, tooFew, speedReason},
+        {"inconsistent suspects do not re-anchor", 106.803, -6.2, scattered, speedReason},
+        {"jump from the suspects does not re-anchor", 110, -7, bogus, speedReason},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            location := TaxiLocation{TaxiID: "t1", Longitude: test.longitude, Latitude: test.latitude}
+            reason := screenLocation(location, at, test.previous)
+            if test.reason == "" && reason != "" || !strings.HasPrefix(reason, test.reason) {
+                t.Fatalf("got reason %q, want %q", reason, test.reason)
+            }
+        })
+    }
+}
+
+func TestNoteQuarantined(t *testing.T) {
+    at := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    fix := &previousFix{}
+    fix.noteQuarantined(TaxiLocation{}, at, "null island (0,0)")
+    if len(fix.Suspects) != 0 {
+        t.Fatal("a fix quarantined for another reason became a suspect")
+    }
+    for i := 0; i < reanchorAfter+2; i++ {
+        fix.noteQuarantined(TaxiLocation{Longitude: float64(i)}, at.Add(time.Duration(i)*time.Minute), speedReason+" 900 km/h")
+    }
+    if len(fix.Suspects) != reanchorAfter || fix.Suspects[0].Longitude != 2 {
+        t.Fatalf("got suspects %+v, want the last %d", fix.Suspects, reanchorAfter)
+    }
+    var none *previousFix
+    none.noteQuarantined(TaxiLocation{}, at, speedReason)
+}
+
+func TestIngestReanchorsAfterBogusFix(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+    // The stored fix is in Singapore, but the taxi keeps reporting Jakarta.
+    // The first reanchorAfter fixes are quarantined, the next one is applied.
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").
+        WillReturnRows(sqlmock.NewRows(previousFixColumns).
+            AddRow("t1", 103.8, 1.3, start.Add(-time.Minute), nil, nil, nil, nil, nil, nil, nil))
+    var body []string
+    for i := 0; i <= reanchorAfter; i++ {
+        body = append(body, fmt.Sprintf(`{"taxi_id":"t1","longitude":%g,"latitude":-6.2,"timestamp":"%s"}`,
+            106.8+float64(i)/1000, start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339)))
+        if i < reanchorAfter {
+            mock.ExpectExec("INSERT INTO location_quarantine").WillReturnResult(sqlmock.NewResult(1, 1))
+        }
+    }
+    mock.ExpectQuery("WITH incoming").WithArgs(upsertArgs(reanchorAfter, "t1", start.Add(time.Duration(reanchorAfter)*time.Minute))...).
+        WillReturnRows(sqlmock.NewRows([]string{"item"}).AddRow(reanchorAfter))
+
+    w := httptest.NewRecorder()
+    ingestLocationBatch(w, httptest.NewRequest(http.MethodPost, "/v1/locations/batch", strings.NewReader(strings.Join(body, "\n"))))
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"accepted":1,"rejected":3`) {
+        t.Fatalf("got status %d: %s", w.Code, w.Body)
+    }
+}
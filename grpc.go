@@ -0,0 +1,357 @@
+package main
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=github.com/SangBejoo/service-parking --go-grpc_out=. --go-grpc_opt=module=github.com/SangBejoo/service-parking parking.proto
+
+import (
+    "context"
+    "io"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/SangBejoo/service-parking/parkingpb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcAddr is where the gRPC API listens next to REST; GRPC_ADDR=off disables it
+var grpcAddr = envString("GRPC_ADDR", ":9090")
+
+// grpcFlushInterval bounds how long a streamed location waits before its
+// micro-batch is stored
+var grpcFlushInterval = time.Second
+
+// maxStreamRejections caps the rejections listed in a ReportLocations response
+const maxStreamRejections = 10000
+
+// grpcMethodScopes names the scope each RPC requires
+var grpcMethodScopes = map[string]string{
+    parkingpb.Parking_ReportLocations_FullMethodName: ScopeLocationsWrite,
+    parkingpb.Parking_WatchPlace_FullMethodName:      ScopeRead,
+    parkingpb.Parking_WatchVehicles_FullMethodName:   ScopeRead,
+}
+
+// parkingServer implements the gRPC API on top of the same storage, filters,
+// event bus and occupancy tracker as the REST handlers
+type parkingServer struct {
+    parkingpb.UnimplementedParkingServer
+}
+
+// newGRPCServer returns the gRPC server. It serves on any net.Listener, e.g.
+// a bufconn listener in tests.
+func newGRPCServer() *grpc.Server {
+    server := grpc.NewServer(grpc.ChainStreamInterceptor(grpcAuthenticate))
+    parkingpb.RegisterParkingServer(server, &parkingServer{})
+    return server
+}
+
+// serveGRPC listens on addr and serves the gRPC API until it fails
+func serveGRPC(addr string) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        log.Fatal("Failed to listen for gRPC:", err)
+    }
+    log.Printf("gRPC server started at %s\n", addr)
+    log.Fatal(newGRPCServer().Serve(listener))
+}
+
+// grpcStream replaces the context of a server stream
+type grpcStream struct {
+    grpc.ServerStream
+    ctx context.Context
+}
+
+// Context returns the replaced context
+func (s *grpcStream) Context() context.Context {
+    return s.ctx
+}
+
+// grpcAuthenticate is the gRPC counterpart of the limitAddress, authenticate
+// and rateLimit middleware. Credentials come from the "authorization"
+// (Bearer) or "x-api-key" metadata and are checked against the RPC's scope.
+func grpcAuthenticate(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    ctx := stream.Context()
+    if allowed, wait := ipLimiter.Allow(grpcPeerIP(ctx), time.Now()); !allowed {
+        return grpcRateLimited(wait)
+    }
+
+    if authEnabled {
+        token := strings.TrimPrefix(metadataValue(ctx, "authorization"), "Bearer ")
+        principal, code, err := resolveCredentials(token, metadataValue(ctx, "x-api-key"))
+        if err != nil {
+            if code == http.StatusUnauthorized {
+                return status.Error(codes.Unauthenticated, err.Error())
+            }
+            log.Println("Failed to authenticate gRPC call:", err)
+            return status.Error(codes.Internal, "Failed to verify credentials")
+        }
+        scope, ok := grpcMethodScopes[info.FullMethod]
+        if !ok {
+            scope = ScopeAdmin
+        }
+        if !principal.HasScope(scope) {
+            return status.Error(codes.PermissionDenied, "Credentials lack scope "+scope)
+        }
+        ctx = context.WithValue(ctx, principalKey{}, principal)
+    }
+
+    if allowed, wait := grpcAllow(ctx); !allowed {
+        return grpcRateLimited(wait)
+    }
+    return handler(srv, &grpcStream{ServerStream: stream, ctx: ctx})
+}
+
+// grpcPeerIP returns the address of the client of a call
+func grpcPeerIP(ctx context.Context) string {
+    p, ok := peer.FromContext(ctx)
+    if !ok {
+        return ""
+    }
+    ip, _, err := net.SplitHostPort(p.Addr.String())
+    if err != nil {
+        return p.Addr.String()
+    }
+    return ip
+}
+
+// grpcAllow is allowClient for the caller of a gRPC call
+func grpcAllow(ctx context.Context) (bool, time.Duration) {
+    return allowClient(principalFrom(ctx), grpcPeerIP(ctx), metadataValue(ctx, "x-device-id"), time.Now())
+}
+
+// grpcRateLimited is the status for a caller that used up its bucket
+func grpcRateLimited(wait time.Duration) error {
+    return status.Errorf(codes.ResourceExhausted, "Rate limit exceeded; retry in %d s", int(math.Ceil(wait.Seconds())))
+}
+
+// grpcWaitForToken blocks until the caller's bucket has a token, so a
+// stream is held back rather than failed once it exceeds its rate
+func grpcWaitForToken(ctx context.Context) error {
+    for {
+        allowed, wait := grpcAllow(ctx)
+        if allowed {
+            return nil
+        }
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return status.FromContextError(ctx.Err()).Err()
+        case <-timer.C:
+        }
+    }
+}
+
+// metadataValue returns the first value of an incoming metadata key
+func metadataValue(ctx context.Context, key string) string {
+    if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+        return values[0]
+    }
+    return ""
+}
+
+// grpcTenant is requestTenant for gRPC; cross-tenant callers pick a tenant
+// with the "x-tenant" metadata
+func grpcTenant(ctx context.Context) string {
+    return principalTenant(principalFrom(ctx), metadataValue(ctx, "x-tenant"))
+}
+
+// ReportLocations stores streamed locations in micro-batches of up to
+// batchChunkSize, flushed at least every grpcFlushInterval, through the same
+// ingestLocations path as POST /locations/batch. Like a batch request every
+// micro-batch costs a rate limit token; a stream that runs out is not read
+// from until its bucket refills.
+func (s *parkingServer) ReportLocations(stream parkingpb.Parking_ReportLocationsServer) error {
+    ctx := stream.Context()
+    tenant := grpcTenant(ctx)
+    if tenant == "" {
+        tenant = defaultTenant
+    }
+
+    received := make(chan *parkingpb.Location)
+    receiveErr := make(chan error, 1)
+    go func() {
+        for {
+            location, err := stream.Recv()
+            if err != nil {
+                receiveErr <- err
+                return
+            }
+            select {
+            case received <- location:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+
+    response := &parkingpb.ReportLocationsResponse{}
+    var pending []TaxiLocation
+    var offset int64 // stream index of pending[0]
+    flush := func() error {
+        if len(pending) == 0 {
+            return nil
+        }
+        if err := grpcWaitForToken(ctx); err != nil {
+            return err
+        }
+        result, err := ingestLocations(tenant, pending, nil)
+        if err != nil {
+            log.Println("Failed to load previous fixes:", err)
+            return status.Error(codes.Unavailable, "Failed to load previous locations")
+        }
+        response.Accepted += int64(result.Accepted)
+        response.Rejected += int64(result.Rejected)
+        for _, item := range result.Results {
+            if item.Status == BatchRejected && len(response.Rejections) < maxStreamRejections {
+                response.Rejections = append(response.Rejections, &parkingpb.LocationResult{
+                    Index:    offset + int64(item.Index),
+                    TaxiId:   item.TaxiID,
+                    Decision: item.Decision,
+                    Reason:   item.Reason,
+                })
+            }
+        }
+        offset += int64(len(pending))
+        pending = pending[:0]
+        return nil
+    }
+
+    ticker := time.NewTicker(grpcFlushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case location := <-received:
+            pending = append(pending, locationFromProto(location))
+            if len(pending) >= batchChunkSize {
+                if err := flush(); err != nil {
+                    return err
+                }
+            }
+        case <-ticker.C:
+            if err := flush(); err != nil {
+                return err
+            }
+        case err := <-receiveErr:
+            if err != io.EOF {
+                return err
+            }
+            if err := flush(); err != nil {
+                return err
+            }
+            return stream.SendAndClose(response)
+        }
+    }
+}
+
+// locationFromProto converts a streamed location
+func locationFromProto(location *parkingpb.Location) TaxiLocation {
+    taxi := TaxiLocation{
+        TaxiID:    location.GetTaxiId(),
+        Longitude: location.GetLongitude(),
+        Latitude:  location.GetLatitude(),
+        Accuracy:  location.GetAccuracy(),
+        Fleet:     location.GetFleet(),
+    }
+    if location.Timestamp != nil {
+        timestamp := location.Timestamp.AsTime()
+        taxi.Timestamp = &timestamp
+    }
+    return taxi
+}
+
+// WatchPlace streams a place's occupancy from the occupancy tracker, replaying
+// missed changes like the Last-Event-ID of GET /events/occupancy
+func (s *parkingServer) WatchPlace(request *parkingpb.WatchPlaceRequest, stream parkingpb.Parking_WatchPlaceServer) error {
+    ctx := stream.Context()
+    placeID := int(request.GetPlaceId())
+    exists, err := placeExists(grpcTenant(ctx), placeID)
+    if err != nil {
+        log.Println("Failed to look up place:", err)
+        return status.Error(codes.Internal, "Failed to look up place")
+    }
+    if !exists {
+        return status.Error(codes.NotFound, "Place not found")
+    }
+
+    replay, updates, unsubscribe := occupancy.Subscribe(request.GetLastEventId())
+    defer unsubscribe()
+    send := func(update OccupancyUpdate) error {
+        if update.PlaceID != placeID {
+            return nil
+        }
+        return stream.Send(&parkingpb.OccupancyUpdate{
+            Id:        update.ID,
+            PlaceId:   int32(update.PlaceID),
+            Occupancy: int32(update.Occupancy),
+            Timestamp: timestamppb.New(update.Timestamp),
+        })
+    }
+    for _, update := range replay {
+        if err := send(update); err != nil {
+            return err
+        }
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case update, ok := <-updates:
+            if !ok {
+                return nil
+            }
+            if err := send(update); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// WatchVehicles streams events from the event bus, filtered by tenant and
+// subscription like /ws/live
+func (s *parkingServer) WatchVehicles(request *parkingpb.WatchVehiclesRequest, stream parkingpb.Parking_WatchVehiclesServer) error {
+    ctx := stream.Context()
+    tenant := grpcTenant(ctx)
+    sub := &liveSubscription{TaxiIDs: request.GetTaxiIds()}
+    for _, id := range request.GetPlaceIds() {
+        sub.PlaceIDs = append(sub.PlaceIDs, int(id))
+    }
+    if bbox := request.GetBbox(); bbox != nil {
+        sub.BBox = []float64{bbox.GetMinLon(), bbox.GetMinLat(), bbox.GetMaxLon(), bbox.GetMaxLat()}
+    }
+
+    feed, unsubscribe := events.Subscribe(liveBufferSize)
+    defer unsubscribe()
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case event, ok := <-feed:
+            if !ok {
+                return nil
+            }
+            if tenant != "" && event.Tenant != tenant || !sub.matches(event) {
+                continue
+            }
+            err := stream.Send(&parkingpb.VehicleEvent{
+                Type:      event.Type,
+                TaxiId:    event.TaxiID,
+                PlaceId:   int32(event.PlaceID),
+                Longitude: event.Longitude,
+                Latitude:  event.Latitude,
+                Timestamp: timestamppb.New(event.Timestamp),
+            })
+            if err != nil {
+                return err
+            }
+        }
+    }
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/SangBejoo/service-parking/parkingpb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/grpc/test/bufconn"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// dialParking serves the gRPC API on an in-memory listener and returns a
+// client for it. Call it after mockDB so the server stops before the
+// database is restored.
+func dialParking(t *testing.T) parkingpb.ParkingClient {
+    t.Helper()
+    listener := bufconn.Listen(1 << 20)
+    server := newGRPCServer()
+    go server.Serve(listener)
+
+    conn, err := grpc.NewClient("passthrough:///bufconn",
+        grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+            return listener.DialContext(ctx)
+        }),
+        grpc.WithTransportCredentials(insecure.NewCredentials()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        conn.Close()
+        server.Stop()
+    })
+    return parkingpb.NewParkingClient(conn)
+}
+
+// withAPIKey returns a context that sends an API key with gRPC calls
+func withAPIKey(ctx context.Context) context.Context {
+    return metadata.AppendToOutgoingContext(ctx, "x-api-key", "pk_test")
+}
+
+// setFlushInterval changes grpcFlushInterval for the duration of a test
+func setFlushInterval(t *testing.T, interval time.Duration) {
+    previous := grpcFlushInterval
+    grpcFlushInterval = interval
+    t.Cleanup(func() { grpcFlushInterval = previous })
+}
+
+// waitForQueries waits until every expected query has run
+func waitForQueries(t *testing.T, mock sqlmock.Sqlmock) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for mock.ExpectationsWereMet() != nil {
+        if time.Now().After(deadline) {
+            t.Fatal(mock.ExpectationsWereMet())
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// previousFixColumns are the columns loadPreviousFixes reads
+var previousFixColumns = []string{"taxi_id", "longitude", "latitude", "device_time", "fleet",
+    "smoothed_longitude", "smoothed_latitude", "smoothed_variance", "longitudes", "latitudes", "times"}
+
+func TestReportLocations(t *testing.T) {
+    setAuth(t, false)
+    setFlushInterval(t, time.Hour)
+    mock := mockDB(t)
+    client := dialParking(t)
+
+    stream, err := client.ReportLocations(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    timestamp := timestamppb.New(time.Now().Add(-time.Minute))
+
+    // A full chunk is stored without waiting for the stream to end. The
+    // upsert applies every taxi but t007, whose stored fix is newer.
+    applied := sqlmock.NewRows([]string{"item"})
+    for i := 0; i < batchChunkSize; i++ {
+        if i != 7 {
+            applied.AddRow(i)
+        }
+    }
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").WillReturnRows(sqlmock.NewRows(previousFixColumns))
+    mock.ExpectQuery("WITH incoming").WillReturnRows(applied)
+    mock.ExpectQuery("SELECT device_time, longitude, latitude FROM taxi_location").
+        WillReturnRows(sqlmock.NewRows([]string{"device_time", "longitude", "latitude"}).AddRow(time.Now(), 106.9, -6.1))
+    mock.ExpectExec("INSERT INTO location_archive").WillReturnResult(sqlmock.NewResult(1, 1))
+    for i := 0; i < batchChunkSize; i++ {
+        err := stream.Send(&parkingpb.Location{
+            TaxiId:    fmt.Sprintf("t%03d", i),
+            Longitude: 106.8 + float64(i)/10000,
+            Latitude:  -6.2,
+            Timestamp: timestamp,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    waitForQueries(t, mock)
+
+    // The rest is stored when the stream ends
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").WillReturnRows(sqlmock.NewRows(previousFixColumns))
+    mock.ExpectExec("INSERT INTO location_quarantine").WillReturnResult(sqlmock.NewResult(1, 1))
+    if err := stream.Send(&parkingpb.Location{TaxiId: "q", Longitude: 106.8, Latitude: 95, Timestamp: timestamp}); err != nil {
+        t.Fatal(err)
+    }
+    if err := stream.Send(&parkingpb.Location{Longitude: 106.8, Latitude: -6.2}); err != nil {
+        t.Fatal(err)
+    }
+    response, err := stream.CloseAndRecv()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if response.Accepted != batchChunkSize-1 || response.Rejected != 3 {
+        t.Fatalf("got %d accepted and %d rejected, want %d and 3", response.Accepted, response.Rejected, batchChunkSize-1)
+    }
+    want := []struct {
+        index    int64
+        decision string
+    }{
+        {7, DecisionArchived},
+        {batchChunkSize, DecisionQuarantined},
+        {batchChunkSize + 1, ""},
+    }
+    if len(response.Rejections) != len(want) {
+        t.Fatalf("got %d rejections, want %d", len(response.Rejections), len(want))
+    }
+    for i, rejection := range response.Rejections {
+        if rejection.Index != want[i].index || rejection.Decision != want[i].decision {
+            t.Errorf("rejection %d: got index %d decision %q, want %d %q",
+                i, rejection.Index, rejection.Decision, want[i].index, want[i].decision)
+        }
+    }
+}
+
+func TestReportLocationsFlushesOnInterval(t *testing.T) {
+    setAuth(t, false)
+    setFlushInterval(t, 50*time.Millisecond)
+    mock := mockDB(t)
+    client := dialParking(t)
+
+    stream, err := client.ReportLocations(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").WillReturnRows(sqlmock.NewRows(previousFixColumns))
+    mock.ExpectQuery("WITH incoming").WillReturnRows(sqlmock.NewRows([]string{"item"}).AddRow(0))
+    if err := stream.Send(&parkingpb.Location{TaxiId: "t1", Longitude: 106.8, Latitude: -6.2}); err != nil {
+        t.Fatal(err)
+    }
+    waitForQueries(t, mock)
+
+    response, err := stream.CloseAndRecv()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if response.Accepted != 1 || response.Rejected != 0 {
+        t.Fatalf("got %d accepted and %d rejected, want 1 and 0", response.Accepted, response.Rejected)
+    }
+}
+
+func TestWatchPlaceOfAnotherTenant(t *testing.T) {
+    setAuth(t, true)
+    mock := mockDB(t)
+    client := dialParking(t)
+
+    expectAPIKey(mock, 9001, "acme", ScopeRead)
+    mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM places`).WithArgs(7, "acme").
+        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+    stream, err := client.WatchPlace(withAPIKey(context.Background()), &parkingpb.WatchPlaceRequest{PlaceId: 7})
+    if err == nil {
+        _, err = stream.Recv()
+    }
+    if status.Code(err) != codes.NotFound {
+        t.Fatalf("got %v, want NotFound", err)
+    }
+}
+
+func TestWatchPlaceReplay(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    client := dialParking(t)
+
+    occupancy.Record(map[int]int{7: 1}, map[int]string{7: "acme"})
+    occupancy.mutex.Lock()
+    lastID := occupancy.nextID - 1
+    occupancy.mutex.Unlock()
+    // Missed changes: one for another place, then one for place 7
+    occupancy.Record(map[int]int{7: 1, 8: 2}, map[int]string{8: "acme"})
+    occupancy.Record(map[int]int{7: 3, 8: 2}, nil)
+
+    mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM places`).WithArgs(7, "").
+        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    stream, err := client.WatchPlace(ctx, &parkingpb.WatchPlaceRequest{PlaceId: 7, LastEventId: lastID})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    update, err := stream.Recv()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if update.PlaceId != 7 || update.Occupancy != 3 || update.Id != lastID+2 {
+        t.Fatalf("replayed %v, want place 7 at occupancy 3 with ID %d", update, lastID+2)
+    }
+
+    // Live changes follow the replay
+    occupancy.Record(map[int]int{7: 4, 8: 2}, nil)
+    update, err = stream.Recv()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if update.PlaceId != 7 || update.Occupancy != 4 {
+        t.Fatalf("got %v, want place 7 at occupancy 4", update)
+    }
+}
+
+func TestWatchVehiclesFiltersTenant(t *testing.T) {
+    setAuth(t, true)
+    mock := mockDB(t)
+    client := dialParking(t)
+
+    expectAPIKey(mock, 9002, "acme", ScopeRead)
+    ctx, cancel := context.WithTimeout(withAPIKey(context.Background()), 5*time.Second)
+    defer cancel()
+    stream, err := client.WatchVehicles(ctx, &parkingpb.WatchVehiclesRequest{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Publish until the server has subscribed; another tenant's event always
+    // goes out first, so it would arrive first if it were not filtered
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        ticker := time.NewTicker(10 * time.Millisecond)
+        defer ticker.Stop()
+        for {
+            events.Publish(Event{Type: EventVehiclePosition, Tenant: "other", TaxiID: "o1", Longitude: 1, Latitude: 1})
+            events.Publish(Event{Type: EventVehiclePosition, Tenant: "acme", TaxiID: "a1", Longitude: 2, Latitude: 2})
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+
+    event, err := stream.Recv()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if event.TaxiId != "a1" || event.Longitude != 2 {
+        t.Fatalf("got %v, want the acme taxi a1", event)
+    }
+}
+
+func TestGRPCRequiresCredentials(t *testing.T) {
+    setAuth(t, true)
+    mockDB(t)
+    client := dialParking(t)
+
+    stream, err := client.WatchVehicles(context.Background(), &parkingpb.WatchVehiclesRequest{})
+    if err == nil {
+        _, err = stream.Recv()
+    }
+    if status.Code(err) != codes.Unauthenticated {
+        t.Fatalf("got %v, want Unauthenticated", err)
+    }
+}
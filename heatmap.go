@@ -0,0 +1,147 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+
+    "github.com/paulmach/orb"
+)
+
+const (
+    // defaultHeatmapResolution is about the size of the default ~1.1 km cell of services.SpatialMap at the equator
+    defaultHeatmapResolution = 0.01
+    // maxHeatmapCells bounds the grid a single request may ask for
+    maxHeatmapCells = 250000
+)
+
+// GeoJSONFeature is a GeoJSON Feature with a polygon geometry
+type GeoJSONFeature struct {
+    Type       string                 `json:"type"`
+    Geometry   GeoJSONGeometry        `json:"geometry"`
+    Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONFeatureCollection is a GeoJSON FeatureCollection
+type GeoJSONFeatureCollection struct {
+    Type     string           `json:"type"`
+    Features []GeoJSONFeature `json:"features"`
+}
+
+// newPolygonFeature wraps a polygon and its properties in a GeoJSON Feature
+func newPolygonFeature(polygon orb.Polygon, properties map[string]interface{}) GeoJSONFeature {
+    geometry := GeoJSONGeometry{Type: "Polygon"}
+    for _, ring := range polygon {
+        var coordinates [][]float64
+        for _, point := range ring {
+            coordinates = append(coordinates, []float64{point[0], point[1]})
+        }
+        geometry.Coordinates = append(geometry.Coordinates, coordinates)
+    }
+    return GeoJSONFeature{Type: "Feature", Geometry: geometry, Properties: properties}
+}
+
+// cellPolygon returns the outline of the grid cell at row floor(lat/size) and
+// column floor(lon/size). The heatmap grid is square in degrees, so its cells
+// do not line up with SpatialMap's, whose width depends on the projection.
+func cellPolygon(row, col int, size float64) orb.Polygon {
+    minLat, minLon := float64(row)*size, float64(col)*size
+    maxLat, maxLon := minLat+size, minLon+size
+    return orb.Polygon{orb.Ring{
+        {minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat},
+    }}
+}
+
+// getHeatmap handles GET /analytics/heatmap?bbox=minLon,minLat,maxLon,maxLat.
+// It counts vehicles per grid cell of ?resolution= degrees and returns the
+// non-empty cells as a GeoJSON FeatureCollection. Without ?from= and ?to= the
+// counts are a snapshot of vehicles that are not offline; with them, the
+// number of distinct vehicles seen in each cell during that window.
+// ?grid=h3 switches to hexagonal H3 cells, with ?resolution= an H3 resolution.
+func getHeatmap(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+
+    bbox, err := parseFloatList(query.Get("bbox"))
+    if err != nil || len(bbox) != 4 || bbox[0] >= bbox[2] || bbox[1] >= bbox[3] {
+        writeError(w, r, http.StatusBadRequest, errInvalidBBox.Error())
+        return
+    }
+
+    switch query.Get("grid") {
+    case "", "square":
+    case "h3":
+        getHexHeatmap(w, r, bbox)
+        return
+    default:
+        writeError(w, r, http.StatusBadRequest, "Invalid grid")
+        return
+    }
+
+    resolution := defaultHeatmapResolution
+    if value := query.Get("resolution"); value != "" {
+        resolution, err = parseFiniteFloat(value)
+        if err != nil || resolution <= 0 {
+            writeError(w, r, http.StatusBadRequest, "Invalid resolution")
+            return
+        }
+    }
+    if (bbox[2]-bbox[0])/resolution*(bbox[3]-bbox[1])/resolution > maxHeatmapCells {
+        writeError(w, r, http.StatusBadRequest, "Too many cells; use a coarser resolution or a smaller bbox")
+        return
+    }
+
+    historical := query.Get("from") != "" || query.Get("to") != ""
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    var sqlQuery string
+    args := []interface{}{resolution, bbox[0], bbox[1], bbox[2], bbox[3]}
+    if historical {
+        sqlQuery = `SELECT FLOOR(latitude / $1)::BIGINT AS row, FLOOR(longitude / $1)::BIGINT AS col, COUNT(DISTINCT (tenant, taxi_id))
+            FROM location_history
+            WHERE longitude >= $2 AND latitude >= $3 AND longitude <= $4 AND latitude <= $5
+            AND device_time >= $6 AND device_time < $7 AND ` + tenantClause("tenant", 8) + `
+            GROUP BY row, col`
+        args = append(args, from, to, requestTenant(r))
+    } else {
+        sqlQuery = `SELECT FLOOR(latitude / $1)::BIGINT AS row, FLOOR(longitude / $1)::BIGINT AS col, COUNT(*)
+            FROM taxi_location
+            WHERE longitude >= $2 AND latitude >= $3 AND longitude <= $4 AND latitude <= $5
+            AND updated_at >= CURRENT_TIMESTAMP - $6 * INTERVAL '1 second' AND ` + tenantClause("tenant", 7) + `
+            GROUP BY row, col`
+        args = append(args, offlineAfter.Seconds(), requestTenant(r))
+    }
+
+    rows, err := db.Query(sqlQuery, args...)
+    if err != nil {
+        log.Println("Error querying heatmap:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query heatmap")
+        return
+    }
+    defer rows.Close()
+
+    collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+    for rows.Next() {
+        var row, col, count int
+        if err := rows.Scan(&row, &col, &count); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan heatmap")
+            return
+        }
+        collection.Features = append(collection.Features, newPolygonFeature(cellPolygon(row, col, resolution),
+            map[string]interface{}{
+                "cell":  strconv.Itoa(row) + ":" + strconv.Itoa(col),
+                "count": count,
+            }))
+    }
+    if err = rows.Err(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to read heatmap")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/geo+json")
+    json.NewEncoder(w).Encode(collection)
+}
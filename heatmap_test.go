@@ -0,0 +1,51 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestHeatmapRejectsNonFiniteValues(t *testing.T) {
+    setAuth(t, false)
+    tests := []struct {
+        name  string
+        query string
+    }{
+        {"NaN resolution", "bbox=106.7,-6.3,106.9,-6.1&resolution=NaN"},
+        {"infinite resolution", "bbox=106.7,-6.3,106.9,-6.1&resolution=Inf"},
+        {"NaN in bbox", "bbox=NaN,-6.3,106.9,-6.1"},
+        {"infinite bbox", "bbox=-Inf,-6.3,%2BInf,-6.1"},
+        {"zero resolution", "bbox=106.7,-6.3,106.9,-6.1&resolution=0"},
+        {"too many cells", "bbox=106.7,-6.3,106.9,-6.1&resolution=0.00001"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            // The handler must answer before touching the database
+            mockDB(t)
+            w := httptest.NewRecorder()
+            getHeatmap(w, httptest.NewRequest(http.MethodGet, "/v1/analytics/heatmap?"+test.query, nil))
+            if w.Code != http.StatusBadRequest {
+                t.Fatalf("got status %d, want 400: %s", w.Code, w.Body)
+            }
+        })
+    }
+}
+
+func TestCellPolygon(t *testing.T) {
+    polygon := cellPolygon(-621, 10680, 0.01)
+    ring := polygon[0]
+    if len(ring) != 5 || ring[0] != ring[4] {
+        t.Fatalf("got %v, want a closed ring of four corners", ring)
+    }
+    const epsilon = 1e-9
+    if d := ring[0][0] - 106.80; d > epsilon || d < -epsilon {
+        t.Errorf("got min longitude %v, want 106.80", ring[0][0])
+    }
+    if d := ring[0][1] + 6.21; d > epsilon || d < -epsilon {
+        t.Errorf("got min latitude %v, want -6.21", ring[0][1])
+    }
+    if d := ring[2][0] - 106.81; d > epsilon || d < -epsilon {
+        t.Errorf("got max longitude %v, want 106.81", ring[2][0])
+    }
+}
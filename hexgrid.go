@@ -0,0 +1,394 @@
+//go:build cgo
+
+// The H3 grid binds the C library through cgo; hexgrid_nocgo.go stands in
+// for it in builds without cgo.
+
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+    "github.com/uber/h3-go/v4"
+)
+
+const (
+    // defaultHexResolution is used by the H3 heatmap when no resolution is given
+    defaultHexResolution = 8
+    // hexStorageResolution is the H3 resolution stored on locations and place
+    // coverings (edge about 66 m). Coarser resolutions are derived by taking
+    // parents of stored cells, so every resolution nests consistently.
+    hexStorageResolution = 10
+    // maxNeighbourRing bounds k for neighbour queries
+    maxNeighbourRing = 5
+)
+
+// errInvalidCell is returned for malformed H3 cell IDs
+var errInvalidCell = errors.New("invalid H3 cell")
+
+// hexCell returns the storage-resolution H3 cell of a point, or NULL when the
+// point cannot be indexed
+func hexCell(latitude, longitude float64) sql.NullInt64 {
+    cell, err := h3.LatLngToCell(h3.NewLatLng(latitude, longitude), hexStorageResolution)
+    if err != nil {
+        return sql.NullInt64{}
+    }
+    return sql.NullInt64{Int64: int64(cell), Valid: true}
+}
+
+// hexParent returns the ancestor of a stored cell at a coarser resolution
+func hexParent(cell int64, resolution int) (h3.Cell, error) {
+    c := h3.Cell(cell)
+    if resolution >= c.Resolution() {
+        return c, nil
+    }
+    return c.Parent(resolution)
+}
+
+// parseHexCell parses an H3 cell ID in its hexadecimal string form
+func parseHexCell(value string) (h3.Cell, error) {
+    cell := h3.Cell(h3.IndexFromString(value))
+    if !cell.IsValid() {
+        return 0, errInvalidCell
+    }
+    return cell, nil
+}
+
+// parseHexResolution reads an H3 resolution between 0 and hexStorageResolution
+func parseHexResolution(value string, def int) (int, error) {
+    if value == "" {
+        return def, nil
+    }
+    resolution, err := strconv.Atoi(value)
+    if err != nil || resolution < 0 || resolution > hexStorageResolution {
+        return 0, errors.New("resolution must be between 0 and " + strconv.Itoa(hexStorageResolution))
+    }
+    return resolution, nil
+}
+
+// hexPolygon converts a GeoJSON polygon geometry into an H3 polygon
+func hexPolygon(geometry GeoJSONGeometry) (h3.GeoPolygon, bool) {
+    if geometry.Type != "Polygon" || len(geometry.Coordinates) == 0 {
+        return h3.GeoPolygon{}, false
+    }
+    toLoop := func(ring [][]float64) h3.GeoLoop {
+        var loop h3.GeoLoop
+        for _, coord := range ring {
+            if len(coord) >= 2 {
+                loop = append(loop, h3.NewLatLng(coord[1], coord[0]))
+            }
+        }
+        return loop
+    }
+    polygon := h3.GeoPolygon{GeoLoop: toLoop(geometry.Coordinates[0])}
+    for _, hole := range geometry.Coordinates[1:] {
+        polygon.Holes = append(polygon.Holes, toLoop(hole))
+    }
+    return polygon, len(polygon.GeoLoop) >= 3
+}
+
+// coverPlace precomputes the storage-resolution cells whose centres lie
+// inside a place's polygon, replacing any previous covering
+func coverPlace(placeID int, polygonData []byte) error {
+    var geometry GeoJSONGeometry
+    if err := json.Unmarshal(polygonData, &geometry); err != nil {
+        return err
+    }
+
+    var cells []int64
+    if polygon, ok := hexPolygon(geometry); ok {
+        covering, err := h3.PolygonToCells(polygon, hexStorageResolution)
+        if err != nil {
+            return err
+        }
+        for _, cell := range covering {
+            cells = append(cells, int64(cell))
+        }
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("DELETE FROM place_cells WHERE place_id = $1", placeID); err != nil {
+        return err
+    }
+    if len(cells) > 0 {
+        _, err := tx.Exec(`INSERT INTO place_cells (place_id, cell)
+            SELECT $1, UNNEST($2::BIGINT[])`, placeID, pq.Array(cells))
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// coverUncoveredPlaces computes coverings for places that do not have one yet,
+// e.g. places created before cell coverings existed
+func coverUncoveredPlaces() {
+    rows, err := db.Query(`SELECT place_id, polygon FROM places p
+        WHERE NOT EXISTS (SELECT 1 FROM place_cells c WHERE c.place_id = p.place_id)`)
+    if err != nil {
+        log.Println("Error querying places without coverings:", err)
+        return
+    }
+
+    type uncovered struct {
+        placeID int
+        polygon []byte
+    }
+    var places []uncovered
+    for rows.Next() {
+        var place uncovered
+        if err := rows.Scan(&place.placeID, &place.polygon); err != nil {
+            log.Println("Error scanning place:", err)
+            continue
+        }
+        places = append(places, place)
+    }
+    rows.Close()
+
+    for _, place := range places {
+        if err := coverPlace(place.placeID, place.polygon); err != nil {
+            log.Printf("Failed to cover Place ID %d: %v\n", place.placeID, err)
+        }
+    }
+}
+
+// getPlaceCells handles GET /place/{id}/cells?resolution=. It returns the
+// place's precomputed covering rolled up to the requested resolution.
+func getPlaceCells(w http.ResponseWriter, r *http.Request) {
+    placeID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
+        return
+    }
+    resolution, err := parseHexResolution(r.URL.Query().Get("resolution"), hexStorageResolution)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    if !requirePlace(w, r, placeID) {
+        return
+    }
+
+    rows, err := db.Query("SELECT cell FROM place_cells WHERE place_id = $1", placeID)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to query place cells")
+        return
+    }
+    defer rows.Close()
+
+    seen := make(map[h3.Cell]bool)
+    cells := []string{}
+    for rows.Next() {
+        var stored int64
+        if err := rows.Scan(&stored); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan place cell")
+            return
+        }
+        cell, err := hexParent(stored, resolution)
+        if err != nil || seen[cell] {
+            continue
+        }
+        seen[cell] = true
+        cells = append(cells, cell.String())
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "place_id":   placeID,
+        "resolution": resolution,
+        "cells":      cells,
+    })
+}
+
+// hexNeighbourhood returns the storage-resolution cells inside a cell and its
+// neighbours up to k rings away
+func hexNeighbourhood(origin h3.Cell, k int) ([]int64, error) {
+    ring, err := origin.GridDisk(k)
+    if err != nil {
+        return nil, err
+    }
+    var stored []int64
+    for _, cell := range ring {
+        children, err := cell.Children(hexStorageResolution)
+        if err != nil {
+            return nil, err
+        }
+        for _, child := range children {
+            stored = append(stored, int64(child))
+        }
+    }
+    return stored, nil
+}
+
+// getCellVehicles handles GET /cells/{cell}/vehicles?k=. It lists the vehicles
+// that are not offline inside the cell and its neighbours up to k rings away.
+func getCellVehicles(w http.ResponseWriter, r *http.Request) {
+    origin, err := parseHexCell(mux.Vars(r)["cell"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    if origin.Resolution() > hexStorageResolution || origin.Resolution() < hexStorageResolution-3 {
+        writeError(w, r, http.StatusBadRequest, "Cell resolution must be between "+strconv.Itoa(hexStorageResolution-3)+
+            " and "+strconv.Itoa(hexStorageResolution))
+        return
+    }
+
+    k := 0
+    if value := r.URL.Query().Get("k"); value != "" {
+        k, err = strconv.Atoi(value)
+        if err != nil || k < 0 || k > maxNeighbourRing {
+            writeError(w, r, http.StatusBadRequest, "k must be between 0 and "+strconv.Itoa(maxNeighbourRing))
+            return
+        }
+    }
+
+    stored, err := hexNeighbourhood(origin, k)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Failed to compute neighbours")
+        return
+    }
+
+    rows, err := db.Query(`SELECT taxi_id, longitude, latitude, COALESCE(fleet, ''), tenant, `+vehicleAgeSQL+`
+        FROM taxi_location
+        WHERE h3_cell = ANY($1) AND updated_at >= CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'
+        AND `+tenantClause("tenant", 3),
+        pq.Array(stored), offlineAfter.Seconds(), requestTenant(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to query taxi locations")
+        return
+    }
+    defer rows.Close()
+
+    taxis := []TaxiLocation{}
+    for rows.Next() {
+        var taxi TaxiLocation
+        var age sql.NullFloat64
+        if err := rows.Scan(&taxi.TaxiID, &taxi.Longitude, &taxi.Latitude, &taxi.Fleet, &taxi.Tenant, &age); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan taxi location")
+            return
+        }
+        taxi.Status = statusFromAge(age)
+        taxis = append(taxis, taxi)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(taxis)
+}
+
+// hexBoundaryPolygon returns the outline of an H3 cell as GeoJSON coordinates
+func hexBoundaryPolygon(cell h3.Cell) (GeoJSONGeometry, error) {
+    boundary, err := cell.Boundary()
+    if err != nil {
+        return GeoJSONGeometry{}, err
+    }
+    var ring [][]float64
+    for _, vertex := range boundary {
+        ring = append(ring, []float64{vertex.Lng, vertex.Lat})
+    }
+    if len(ring) > 0 {
+        ring = append(ring, ring[0])
+    }
+    return GeoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{ring}}, nil
+}
+
+// getHexHeatmap serves the H3 variant of the heatmap. Distinct vehicles are
+// counted per stored cell and rolled up to the requested resolution, so a
+// vehicle seen in several child cells counts once in their parent.
+func getHexHeatmap(w http.ResponseWriter, r *http.Request, bbox []float64) {
+    resolution, err := parseHexResolution(r.URL.Query().Get("resolution"), defaultHexResolution)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    historical := r.URL.Query().Get("from") != "" || r.URL.Query().Get("to") != ""
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    var sqlQuery string
+    args := []interface{}{bbox[0], bbox[1], bbox[2], bbox[3]}
+    if historical {
+        sqlQuery = `SELECT DISTINCT h3_cell, tenant, taxi_id FROM location_history
+            WHERE longitude >= $1 AND latitude >= $2 AND longitude <= $3 AND latitude <= $4
+            AND h3_cell IS NOT NULL AND device_time >= $5 AND device_time < $6
+            AND ` + tenantClause("tenant", 7)
+        args = append(args, from, to, requestTenant(r))
+    } else {
+        sqlQuery = `SELECT h3_cell, tenant, taxi_id FROM taxi_location
+            WHERE longitude >= $1 AND latitude >= $2 AND longitude <= $3 AND latitude <= $4
+            AND h3_cell IS NOT NULL AND updated_at >= CURRENT_TIMESTAMP - $5 * INTERVAL '1 second'
+            AND ` + tenantClause("tenant", 6)
+        args = append(args, offlineAfter.Seconds(), requestTenant(r))
+    }
+
+    rows, err := db.Query(sqlQuery, args...)
+    if err != nil {
+        log.Println("Error querying hex heatmap:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query heatmap")
+        return
+    }
+    defer rows.Close()
+
+    // Taxi IDs are only unique within a tenant
+    type vehicleKey struct{ tenant, taxiID string }
+    vehicles := make(map[h3.Cell]map[vehicleKey]bool)
+    for rows.Next() {
+        var stored int64
+        var key vehicleKey
+        if err := rows.Scan(&stored, &key.tenant, &key.taxiID); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan heatmap")
+            return
+        }
+        cell, err := hexParent(stored, resolution)
+        if err != nil {
+            continue
+        }
+        if vehicles[cell] == nil {
+            vehicles[cell] = make(map[vehicleKey]bool)
+        }
+        vehicles[cell][key] = true
+    }
+    if err = rows.Err(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to read heatmap")
+        return
+    }
+    if len(vehicles) > maxHeatmapCells {
+        writeError(w, r, http.StatusBadRequest, "Too many cells; use a coarser resolution or a smaller bbox")
+        return
+    }
+
+    collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+    for cell, taxis := range vehicles {
+        geometry, err := hexBoundaryPolygon(cell)
+        if err != nil {
+            continue
+        }
+        collection.Features = append(collection.Features, GeoJSONFeature{
+            Type:     "Feature",
+            Geometry: geometry,
+            Properties: map[string]interface{}{
+                "cell":       cell.String(),
+                "resolution": resolution,
+                "count":      len(taxis),
+            },
+        })
+    }
+
+    w.Header().Set("Content-Type", "application/geo+json")
+    json.NewEncoder(w).Encode(collection)
+}
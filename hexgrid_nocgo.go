@@ -0,0 +1,43 @@
+//go:build !cgo
+
+package main
+
+import (
+    "database/sql"
+    "net/http"
+)
+
+// Without cgo the H3 library is not available. Locations and places are
+// stored without cells and the H3 endpoints answer 501, while everything
+// else works as usual.
+
+// hexUnavailable is the error message of the H3 endpoints without cgo
+const hexUnavailable = "H3 cells are not available in this build"
+
+// hexCell returns NULL, as no cell can be computed without H3
+func hexCell(latitude, longitude float64) sql.NullInt64 {
+    return sql.NullInt64{}
+}
+
+// coverPlace leaves places without a cell covering
+func coverPlace(placeID int, polygonData []byte) error {
+    return nil
+}
+
+// coverUncoveredPlaces has no coverings to compute
+func coverUncoveredPlaces() {}
+
+// getPlaceCells answers 501
+func getPlaceCells(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusNotImplemented, hexUnavailable)
+}
+
+// getCellVehicles answers 501
+func getCellVehicles(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusNotImplemented, hexUnavailable)
+}
+
+// getHexHeatmap answers 501
+func getHexHeatmap(w http.ResponseWriter, r *http.Request, bbox []float64) {
+    writeError(w, r, http.StatusNotImplemented, hexUnavailable)
+}
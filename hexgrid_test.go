@@ -0,0 +1,162 @@
+//go:build cgo
+
+package main
+
+import (
+    "math"
+    "testing"
+
+    "github.com/uber/h3-go/v4"
+)
+
+func TestHexCell(t *testing.T) {
+    stored := hexCell(-6.205, 106.805)
+    if !stored.Valid {
+        t.Fatal("no cell for a valid point")
+    }
+    cell := h3.Cell(stored.Int64)
+    if !cell.IsValid() || cell.Resolution() != hexStorageResolution {
+        t.Fatalf("got cell %s at resolution %d, want a valid cell at %d", cell, cell.Resolution(), hexStorageResolution)
+    }
+    if got := hexCell(math.NaN(), 106.805); got.Valid {
+        t.Fatalf("got cell %d for NaN", got.Int64)
+    }
+
+    // Rolled up parents are the cells of the point at the coarser resolution
+    for resolution := 0; resolution <= hexStorageResolution; resolution++ {
+        parent, err := hexParent(stored.Int64, resolution)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want, _ := h3.LatLngToCell(h3.NewLatLng(-6.205, 106.805), resolution)
+        if parent != want {
+            t.Fatalf("resolution %d: got parent %s, want %s", resolution, parent, want)
+        }
+    }
+    // Finer resolutions than stored keep the stored cell
+    if parent, _ := hexParent(stored.Int64, hexStorageResolution+2); parent != cell {
+        t.Fatalf("got %s, want the stored cell %s", parent, cell)
+    }
+}
+
+func TestParseHexCell(t *testing.T) {
+    cell, _ := h3.LatLngToCell(h3.NewLatLng(-6.205, 106.805), 9)
+    if parsed, err := parseHexCell(cell.String()); err != nil || parsed != cell {
+        t.Fatalf("got %s, %v, want %s", parsed, err, cell)
+    }
+    for _, value := range []string{"", "zz", "0", "8a2a1072b59ffff0"} {
+        if _, err := parseHexCell(value); err != errInvalidCell {
+            t.Fatalf("%q: got %v, want errInvalidCell", value, err)
+        }
+    }
+}
+
+func TestParseHexResolution(t *testing.T) {
+    tests := []struct {
+        value string
+        want  int
+        err   bool
+    }{
+        {"", defaultHexResolution, false},
+        {"0", 0, false},
+        {"10", 10, false},
+        {"11", 0, true},
+        {"-1", 0, true},
+        {"x", 0, true},
+    }
+    for _, test := range tests {
+        got, err := parseHexResolution(test.value, defaultHexResolution)
+        if (err != nil) != test.err || got != test.want {
+            t.Fatalf("%q: got %d, %v, want %d (error %v)", test.value, got, err, test.want, test.err)
+        }
+    }
+}
+
+func TestHexNeighbourhood(t *testing.T) {
+    origin, _ := h3.LatLngToCell(h3.NewLatLng(-6.205, 106.805), hexStorageResolution)
+    pentagons, _ := h3.Pentagons(hexStorageResolution)
+    coarse, _ := origin.Parent(hexStorageResolution - 1)
+
+    tests := []struct {
+        name   string
+        origin h3.Cell
+        k      int
+        cells  int
+    }{
+        {"the cell alone", origin, 0, 1},
+        {"first ring", origin, 1, 7},
+        {"second ring", origin, 2, 19},
+        {"pentagon has five neighbours", pentagons[0], 1, 6},
+        {"coarser cell expands to its children", coarse, 0, 7},
+        {"coarser cell and ring", coarse, 1, 49},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            stored, err := hexNeighbourhood(test.origin, test.k)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(stored) != test.cells {
+                t.Fatalf("got %d cells, want %d", len(stored), test.cells)
+            }
+            seen := make(map[int64]bool)
+            for _, value := range stored {
+                cell := h3.Cell(value)
+                if seen[value] || cell.Resolution() != hexStorageResolution {
+                    t.Fatalf("got duplicate or coarse cell %s", cell)
+                }
+                seen[value] = true
+                parent, _ := hexParent(value, test.origin.Resolution())
+                if distance, err := test.origin.GridDistance(parent); err != nil || distance > test.k {
+                    t.Fatalf("cell %s is %d rings away, want at most %d", cell, distance, test.k)
+                }
+            }
+        })
+    }
+}
+
+func TestHexBoundaryPolygon(t *testing.T) {
+    cell, _ := h3.LatLngToCell(h3.NewLatLng(-6.205, 106.805), hexStorageResolution)
+    geometry, err := hexBoundaryPolygon(cell)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ring := geometry.Coordinates[0]
+    if geometry.Type != "Polygon" || len(ring) != 7 {
+        t.Fatalf("got a %s with %d vertices, want a closed hexagon", geometry.Type, len(ring))
+    }
+    if first, last := ring[0], ring[len(ring)-1]; first[0] != last[0] || first[1] != last[1] {
+        t.Fatal("the ring is not closed")
+    }
+    // Vertices are longitude, latitude pairs around the point
+    for _, vertex := range ring {
+        if math.Abs(vertex[0]-106.805) > 0.01 || math.Abs(vertex[1]+6.205) > 0.01 {
+            t.Fatalf("vertex %v is far from the cell", vertex)
+        }
+    }
+}
+
+func TestHexPolygonCovering(t *testing.T) {
+    polygon, ok := hexPolygon(GeoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{
+        {{106.8, -6.2}, {106.81, -6.2}, {106.81, -6.21}, {106.8, -6.21}, {106.8, -6.2}},
+    }})
+    if !ok {
+        t.Fatal("a valid polygon was refused")
+    }
+    covering, err := h3.PolygonToCells(polygon, hexStorageResolution)
+    if err != nil || len(covering) == 0 {
+        t.Fatalf("got %d cells, %v", len(covering), err)
+    }
+    inside := h3.Cell(hexCell(-6.205, 106.805).Int64)
+    found := false
+    for _, cell := range covering {
+        found = found || cell == inside
+    }
+    if !found {
+        t.Fatalf("the covering misses the cell %s at the centre of the place", inside)
+    }
+
+    if _, ok := hexPolygon(GeoJSONGeometry{Type: "Point"}); ok {
+        t.Fatal("a point was accepted as a polygon")
+    }
+}
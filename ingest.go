@@ -0,0 +1,394 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+)
+
+const (
+    // maxBatchItems caps how many locations one batch request may carry
+    maxBatchItems = 10000
+    // batchChunkSize is the number of rows written per multi-row upsert
+    batchChunkSize = 500
+)
+
+// Batch item statuses
+const (
+    BatchAccepted = "accepted"
+    BatchRejected = "rejected"
+)
+
+// BatchItemResult reports what happened to one location of a batch
+type BatchItemResult struct {
+    Index    int    `json:"index"`
+    TaxiID   string `json:"taxi_id,omitempty"`
+    Status   string `json:"status"`
+    Decision string `json:"decision,omitempty"` // applied, duplicate or archived for stored items
+    Reason   string `json:"reason,omitempty"`
+}
+
+// BatchResponse is returned by the batch ingestion endpoint
+type BatchResponse struct {
+    Accepted int               `json:"accepted"`
+    Rejected int               `json:"rejected"`
+    Results  []BatchItemResult `json:"results"`
+}
+
+// validateLocation checks that a location is well formed. Coordinates that are
+// well formed but implausible are handled by the plausibility filter instead.
+func validateLocation(location TaxiLocation) error {
+    if strings.TrimSpace(location.TaxiID) == "" {
+        return errors.New("taxi_id is required")
+    }
+    if math.IsNaN(location.Latitude) || math.IsNaN(location.Longitude) ||
+        math.IsInf(location.Latitude, 0) || math.IsInf(location.Longitude, 0) {
+        return errors.New("coordinates must be finite numbers")
+    }
+    if location.Timestamp != nil && location.Timestamp.After(time.Now().Add(maxClockSkew)) {
+        return errors.New("timestamp is in the future")
+    }
+    return nil
+}
+
+// decodeBatch reads a batch body either as a JSON array or as NDJSON (one
+// location per line). Array elements and NDJSON lines that fail to decode
+// are returned as per-item errors instead of failing the whole batch.
+func decodeBatch(r *http.Request) ([]TaxiLocation, map[int]error, error) {
+    reader := bufio.NewReader(r.Body)
+    itemErrors := make(map[int]error)
+
+    // Peek at the first non-space byte to tell a JSON array from NDJSON
+    var first byte
+    for {
+        b, err := reader.ReadByte()
+        if err != nil {
+            return nil, nil, errors.New("empty batch")
+        }
+        if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+            first = b
+            reader.UnreadByte()
+            break
+        }
+    }
+
+    if first == '[' {
+        var items []json.RawMessage
+        if err := json.NewDecoder(reader).Decode(&items); err != nil {
+            return nil, nil, err
+        }
+        if len(items) > maxBatchItems {
+            return nil, nil, fmt.Errorf("batch exceeds %d items", maxBatchItems)
+        }
+        locations := make([]TaxiLocation, len(items))
+        for i, item := range items {
+            if err := json.Unmarshal(item, &locations[i]); err != nil {
+                locations[i] = TaxiLocation{}
+                itemErrors[i] = errors.New("invalid JSON")
+            }
+        }
+        return locations, itemErrors, nil
+    }
+
+    var locations []TaxiLocation
+    scanner := bufio.NewScanner(reader)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        line := bytes.TrimSpace(scanner.Bytes())
+        if len(line) == 0 {
+            continue
+        }
+        if len(locations) >= maxBatchItems {
+            return nil, nil, fmt.Errorf("batch exceeds %d items", maxBatchItems)
+        }
+        var location TaxiLocation
+        if err := json.Unmarshal(line, &location); err != nil {
+            itemErrors[len(locations)] = errors.New("invalid JSON")
+        }
+        locations = append(locations, location)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, nil, err
+    }
+    return locations, itemErrors, nil
+}
+
+// ingestLocationBatch handles POST /locations/batch. The body is a JSON array
+// of TaxiLocation or NDJSON; valid items are written with multi-row upserts
+// and every item gets an accepted/rejected result in the response. Items that
+// are duplicates, older than the stored fix or conflict with it are rejected
+// with the decision taken for them.
+func ingestLocationBatch(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)
+    locations, itemErrors, err := decodeBatch(r)
+    if err != nil {
+        writePayloadError(w, r, err)
+        return
+    }
+
+    response, err := ingestLocations(writeTenant(r), locations, itemErrors)
+    if err != nil {
+        log.Println("Failed to load previous fixes:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to load previous locations")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// ingestLocations validates, screens and stores a batch of a tenant's
+// locations and reports the outcome of each item. itemErrors holds the items
+// that already failed to decode. Each taxi's fixes are screened in
+// device-time order, every fix against the one before it, and the fixes that
+// pass are stored together so every in-order fix reaches location_history.
+// The only error returned is failing to load the stored fixes, before
+// anything was written.
+func ingestLocations(tenant string, locations []TaxiLocation, itemErrors map[int]error) (BatchResponse, error) {
+    response := BatchResponse{Results: make([]BatchItemResult, len(locations))}
+
+    // Validate items and group them per taxi
+    times := make([]time.Time, len(locations))
+    fixes := make(map[string][]int)
+    var taxiIDs []string
+    for i := range locations {
+        locations[i].Tenant = tenant
+        location := locations[i]
+        response.Results[i] = BatchItemResult{Index: i, TaxiID: location.TaxiID}
+        if err, ok := itemErrors[i]; ok {
+            response.Results[i].Status, response.Results[i].Reason = BatchRejected, err.Error()
+            continue
+        }
+        if err := validateLocation(location); err != nil {
+            response.Results[i].Status, response.Results[i].Reason = BatchRejected, err.Error()
+            continue
+        }
+        times[i] = deviceTime(location)
+        response.Results[i].Status = BatchAccepted
+        if _, ok := fixes[location.TaxiID]; !ok {
+            taxiIDs = append(taxiIDs, location.TaxiID)
+        }
+        fixes[location.TaxiID] = append(fixes[location.TaxiID], i)
+    }
+    for _, indexes := range fixes {
+        sort.SliceStable(indexes, func(a, b int) bool { return times[indexes[a]].Before(times[indexes[b]]) })
+    }
+
+    previous, err := loadPreviousFixes(tenant, taxiIDs)
+    if err != nil {
+        return response, err
+    }
+
+    var pending []int
+    smoothed := make([]*smoothedFix, len(locations))
+    for _, taxiID := range taxiIDs {
+        stored := previous[taxiID]
+        indexes := fixes[taxiID]
+        for n, i := range indexes {
+            // Compare repeats of a device time with the first fix at that time
+            first := n
+            for first > 0 && times[indexes[first-1]].Equal(times[i]) {
+                first--
+            }
+            if first < n {
+                rejectRepeated(&response.Results[i], locations[i], times[i], locations[indexes[first]])
+                continue
+            }
+            result := &response.Results[i]
+            if reason := screenLocation(locations[i], times[i], previous[taxiID]); reason != "" {
+                result.Status, result.Decision, result.Reason = BatchRejected, DecisionQuarantined, reason
+                if err := quarantineLocation(locations[i], times[i], reason); err != nil {
+                    result.Decision, result.Reason = "", "storage error"
+                }
+                previous[taxiID].noteQuarantined(locations[i], times[i], reason)
+                continue
+            }
+            if stored != nil && stored.Time.Valid && !times[i].After(stored.Time.Time) {
+                decision, reason, err := resolveStale(locations[i], times[i], stored.Time, stored.Longitude, stored.Latitude)
+                rejectUnapplied(result, decision, reason, err)
+                continue
+            }
+            smoothed[i] = smoothLocation(locations[i], times[i], previous[taxiID])
+            previous[taxiID] = appliedFix(locations[i], times[i], smoothed[i], previous[taxiID])
+            pending = append(pending, i)
+        }
+    }
+    storeFixes(locations, times, smoothed, pending, &response)
+
+    for _, result := range response.Results {
+        if result.Status == BatchAccepted {
+            response.Accepted++
+        } else {
+            response.Rejected++
+        }
+    }
+    return response, nil
+}
+
+// storeFixes writes the screened fixes, ordered per taxi by device time, with
+// one set-based upsert per chunk. A fix whose taxi was meanwhile moved on by
+// a newer fix is resolved against the stored one instead.
+func storeFixes(locations []TaxiLocation, times []time.Time, smoothed []*smoothedFix, indexes []int, response *BatchResponse) {
+    for start := 0; start < len(indexes); start += batchChunkSize {
+        end := start + batchChunkSize
+        if end > len(indexes) {
+            end = len(indexes)
+        }
+        chunk := indexes[start:end]
+        applied, err := upsertLocations(locations, times, smoothed, chunk)
+        if err != nil {
+            log.Println("Batch upsert failed:", err)
+            for _, i := range chunk {
+                response.Results[i].Status = BatchRejected
+                response.Results[i].Reason = "storage error"
+            }
+            continue
+        }
+        for _, i := range chunk {
+            location := locations[i]
+            if applied[i] {
+                response.Results[i].Decision = DecisionApplied
+                events.Publish(Event{
+                    Type:      EventVehiclePosition,
+                    Tenant:    location.Tenant,
+                    TaxiID:    location.TaxiID,
+                    Longitude: location.Longitude,
+                    Latitude:  location.Latitude,
+                    Timestamp: times[i],
+                })
+                continue
+            }
+            decision, reason, err := resolveUnapplied(location, times[i])
+            rejectUnapplied(&response.Results[i], decision, reason, err)
+        }
+    }
+}
+
+// rejectUnapplied records the decision taken for a fix that was not applied
+func rejectUnapplied(result *BatchItemResult, decision, reason string, err error) {
+    result.Status = BatchRejected
+    if err != nil {
+        result.Decision, result.Reason = "", "storage error"
+        return
+    }
+    result.Decision, result.Reason = decision, reason
+}
+
+// appliedFix returns the stored state of a taxi after a fix was applied
+func appliedFix(location TaxiLocation, timestamp time.Time, smoothed *smoothedFix, before *previousFix) *previousFix {
+    fix := &previousFix{
+        Longitude: location.Longitude,
+        Latitude:  location.Latitude,
+        Time:      sql.NullTime{Time: timestamp, Valid: true},
+        Fleet:     sql.NullString{String: location.Fleet, Valid: location.Fleet != ""},
+    }
+    if location.Fleet == "" && before != nil {
+        fix.Fleet = before.Fleet
+    }
+    if smoothed != nil {
+        fix.Smoothed = nullSmoothedFix{smoothedFix: *smoothed, Valid: true}
+    }
+    return fix
+}
+
+// rejectRepeated marks a batch item carrying the same device time as an
+// earlier item for the same taxi as a duplicate, or archives it as a
+// conflicting fix when its position differs
+func rejectRepeated(result *BatchItemResult, location TaxiLocation, timestamp time.Time, earlier TaxiLocation) {
+    result.Status = BatchRejected
+    if location.Longitude == earlier.Longitude && location.Latitude == earlier.Latitude {
+        result.Decision, result.Reason = DecisionDuplicate, "identical to another item in the batch"
+        return
+    }
+
+    result.Decision, result.Reason = DecisionArchived, "conflicts with another item in the batch at the same time"
+    if err := archiveLocation(location, timestamp, result.Reason); err != nil {
+        result.Decision, result.Reason = "", "storage error"
+    }
+}
+
+// upsertLocations writes the selected fixes with a single set-based statement
+// and returns the indexes of the fixes that were applied. indexes must list
+// each taxi's fixes in device-time order. Every taxi's stored position moves
+// to its latest fix unless the stored device time is not older, and all the
+// taxi's fixes are then appended to location_history in order. The raw
+// position is always stored; smoothed holds the filtered position per index,
+// or nil for taxis without smoothing.
+func upsertLocations(locations []TaxiLocation, times []time.Time, smoothed []*smoothedFix, indexes []int) (map[int]bool, error) {
+    const columns = 11
+    var query strings.Builder
+    args := make([]interface{}, 0, len(indexes)*columns)
+
+    query.WriteString(`WITH incoming (item, taxi_id, longitude, latitude, device_time, fleet,
+        smoothed_longitude, smoothed_latitude, smoothed_variance, h3_cell, tenant, ord) AS (VALUES `)
+    for n, i := range indexes {
+        if n > 0 {
+            query.WriteString(", ")
+        }
+        p := n * columns
+        fmt.Fprintf(&query, "($%d::int, $%d::varchar, $%d::float8, $%d::float8, $%d::timestamptz, NULLIF($%d::varchar, ''), "+
+            "$%d::float8, $%d::float8, $%d::float8, $%d::bigint, $%d::varchar, %d)",
+            p+1, p+2, p+3, p+4, p+5, p+6, p+7, p+8, p+9, p+10, p+11, n)
+
+        // The cell follows the position used for geofencing
+        var smoothedLongitude, smoothedLatitude, smoothedVariance sql.NullFloat64
+        cell := hexCell(locations[i].Latitude, locations[i].Longitude)
+        if fix := smoothed[i]; fix != nil {
+            smoothedLongitude = sql.NullFloat64{Float64: fix.Longitude, Valid: true}
+            smoothedLatitude = sql.NullFloat64{Float64: fix.Latitude, Valid: true}
+            smoothedVariance = sql.NullFloat64{Float64: fix.Variance, Valid: true}
+            cell = hexCell(fix.Latitude, fix.Longitude)
+        }
+        args = append(args, i, locations[i].TaxiID, locations[i].Longitude, locations[i].Latitude, times[i],
+            locations[i].Fleet, smoothedLongitude, smoothedLatitude, smoothedVariance, cell, locations[i].Tenant)
+    }
+    query.WriteString(`),
+    latest AS (SELECT DISTINCT ON (tenant, taxi_id) *,
+            (SELECT f.fleet FROM incoming f WHERE f.tenant = i.tenant AND f.taxi_id = i.taxi_id AND f.fleet IS NOT NULL
+                ORDER BY f.ord DESC LIMIT 1) AS last_fleet
+        FROM incoming i ORDER BY tenant, taxi_id, ord DESC),
+    applied AS (INSERT INTO taxi_location (taxi_id, longitude, latitude, updated_at, device_time, fleet,
+            smoothed_longitude, smoothed_latitude, smoothed_variance, h3_cell, tenant)
+        SELECT taxi_id, longitude, latitude, CURRENT_TIMESTAMP, device_time, last_fleet,
+            smoothed_longitude, smoothed_latitude, smoothed_variance, h3_cell, tenant
+        FROM latest
+        ON CONFLICT (tenant, taxi_id) DO UPDATE
+        SET longitude = EXCLUDED.longitude, latitude = EXCLUDED.latitude, updated_at = CURRENT_TIMESTAMP,
+            device_time = EXCLUDED.device_time, offline_since = NULL,
+            fleet = COALESCE(EXCLUDED.fleet, taxi_location.fleet),
+            smoothed_longitude = EXCLUDED.smoothed_longitude, smoothed_latitude = EXCLUDED.smoothed_latitude,
+            smoothed_variance = EXCLUDED.smoothed_variance, h3_cell = EXCLUDED.h3_cell
+        WHERE taxi_location.device_time IS NULL OR taxi_location.device_time < EXCLUDED.device_time
+        RETURNING tenant, taxi_id),
+    history AS (INSERT INTO location_history
+            (taxi_id, longitude, latitude, smoothed_longitude, smoothed_latitude, device_time, h3_cell, tenant)
+        SELECT i.taxi_id, i.longitude, i.latitude, i.smoothed_longitude, i.smoothed_latitude, i.device_time, i.h3_cell, i.tenant
+        FROM incoming i JOIN applied a ON a.tenant = i.tenant AND a.taxi_id = i.taxi_id
+        ORDER BY i.ord)
+    SELECT i.item FROM incoming i JOIN applied a ON a.tenant = i.tenant AND a.taxi_id = i.taxi_id`)
+
+    rows, err := db.Query(query.String(), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := make(map[int]bool)
+    for rows.Next() {
+        var item int
+        if err := rows.Scan(&item); err != nil {
+            return nil, err
+        }
+        applied[item] = true
+    }
+    return applied, rows.Err()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+// upsertArgs returns the arguments upsertLocations binds for an unsmoothed
+// fix of the default tenant, matching only the item, taxi and device time
+func upsertArgs(item int, taxiID string, at time.Time) []driver.Value {
+    anyArg := sqlmock.AnyArg()
+    return []driver.Value{item, taxiID, anyArg, anyArg, at, anyArg, anyArg, anyArg, anyArg, anyArg, defaultTenant}
+}
+
+func TestDecodeBatch(t *testing.T) {
+    tests := []struct {
+        name   string
+        body   string
+        items  int
+        errors []int
+        err    bool
+    }{
+        {"array", `[{"taxi_id":"a"},{"taxi_id":"b"}]`, 2, nil, false},
+        {"malformed array element", `[{"taxi_id":"a"},{"taxi_id":5},"x",{"taxi_id":"b"}]`, 4, []int{1, 2}, false},
+        {"malformed array", `[{"taxi_id":"a"},`, 0, nil, true},
+        {"ndjson", "{\"taxi_id\":\"a\"}\n\n{\"taxi_id\":\"b\"}\n", 2, nil, false},
+        {"malformed ndjson line", "{\"taxi_id\":\"a\"}\n{\"taxi_id\":\n{\"taxi_id\":\"b\"}\n", 3, []int{1}, false},
+        {"empty", "  \n", 0, nil, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodPost, "/v1/locations/batch", strings.NewReader(test.body))
+            locations, itemErrors, err := decodeBatch(r)
+            if (err != nil) != test.err {
+                t.Fatalf("got error %v, want error %v", err, test.err)
+            }
+            if len(locations) != test.items || len(itemErrors) != len(test.errors) {
+                t.Fatalf("got %d items and errors %v, want %d items and errors at %v", len(locations), itemErrors, test.items, test.errors)
+            }
+            for _, i := range test.errors {
+                if itemErrors[i] == nil {
+                    t.Fatalf("item %d decoded, want an error", i)
+                }
+            }
+        })
+    }
+}
+
+func TestIngestLocationBatch(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+    // t1's three fixes arrive out of order around a malformed element and
+    // are stored oldest first together with t2's, in a single statement
+    body := `[
+        {"taxi_id":"t1","longitude":106.802,"latitude":-6.2,"timestamp":"2026-03-01T08:02:00Z"},
+        {"taxi_id":"t2","longitude":106.9,"latitude":-6.1,"timestamp":"2026-03-01T08:00:00Z"},
+        {"taxi_id":"t3","longitude":"east"},
+        {"taxi_id":"t1","longitude":106.801,"latitude":-6.2,"timestamp":"2026-03-01T08:01:00Z"},
+        {"taxi_id":"t1","longitude":106.8,"latitude":-6.2,"timestamp":"2026-03-01T08:00:00Z"}
+    ]`
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").
+        WithArgs(`{"t1","t2"}`, defaultTenant, speedReason, reanchorAfter).
+        WillReturnRows(sqlmock.NewRows(previousFixColumns))
+    var args []driver.Value
+    args = append(args, upsertArgs(4, "t1", start)...)
+    args = append(args, upsertArgs(3, "t1", start.Add(time.Minute))...)
+    args = append(args, upsertArgs(0, "t1", start.Add(2*time.Minute))...)
+    args = append(args, upsertArgs(1, "t2", start)...)
+    mock.ExpectQuery("WITH incoming").WithArgs(args...).
+        WillReturnRows(sqlmock.NewRows([]string{"item"}).AddRow(4).AddRow(3).AddRow(0).AddRow(1))
+
+    w := httptest.NewRecorder()
+    ingestLocationBatch(w, httptest.NewRequest(http.MethodPost, "/v1/locations/batch", strings.NewReader(body)))
+    if w.Code != http.StatusOK {
+        t.Fatalf("got status %d: %s", w.Code, w.Body)
+    }
+    var response BatchResponse
+    if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+        t.Fatal(err)
+    }
+    if response.Accepted != 4 || response.Rejected != 1 {
+        t.Fatalf("got %d accepted and %d rejected, want 4 and 1", response.Accepted, response.Rejected)
+    }
+    for i, result := range response.Results {
+        if i == 2 {
+            if result.Status != BatchRejected || result.Reason != "invalid JSON" {
+                t.Fatalf("item 2: got %+v, want rejected as invalid JSON", result)
+            }
+            continue
+        }
+        if result.Status != BatchAccepted || result.Decision != DecisionApplied {
+            t.Fatalf("item %d: got %+v, want applied", i, result)
+        }
+    }
+}
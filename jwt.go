@@ -0,0 +1,395 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Back-office roles carried in identity provider tokens
+const (
+    RoleOperator     = "operator"
+    RoleFleetManager = "fleet_manager"
+    RoleAuditor      = "auditor"
+    RoleAdmin        = "admin"
+)
+
+// roleScopes maps each role to the API scopes it grants. Operators run the
+// parking sites and their geofences, fleet managers own the taxi register and
+// auditors only read, including the audit log.
+var roleScopes = map[string][]string{
+    RoleOperator:     {ScopeRead, ScopePlacesAdmin, ScopeMappingAdmin},
+    RoleFleetManager: {ScopeRead, ScopeTaxisAdmin},
+    RoleAuditor:      {ScopeRead, ScopeAuditRead},
+    RoleAdmin:        {ScopeAdmin},
+    RoleSuperAdmin:   {ScopeAdmin, ScopeAllTenants},
+}
+
+// Bearer token settings. JWT_JWKS is a JWKS file path or http(s) URL; bearer
+// tokens are rejected while it is unset. Once it is set, JWT_ISSUER and
+// JWT_AUDIENCE are required so tokens minted for other services are refused,
+// see checkJWTConfig. JWT_ROLES_CLAIM is a dotted path to
+// the roles array, e.g. "realm_access.roles" for Keycloak, and
+// JWT_TENANT_CLAIM the claim naming the user's tenant.
+var (
+    jwksSource     = os.Getenv("JWT_JWKS")
+    jwtIssuer      = os.Getenv("JWT_ISSUER")
+    jwtAudience    = os.Getenv("JWT_AUDIENCE")
+    jwtRolesClaim  = envString("JWT_ROLES_CLAIM", "roles")
+    jwtTenantClaim = envString("JWT_TENANT_CLAIM", "tenant")
+    jwksRefresh    = envDuration("JWKS_REFRESH", 10*time.Minute)
+)
+
+// jwtLeeway tolerates clock drift between us and the identity provider
+const jwtLeeway = time.Minute
+
+var (
+    errJWTUnscoped    = errors.New("JWT_ISSUER and JWT_AUDIENCE must be set when JWT_JWKS is")
+    errBearerDisabled = errors.New("bearer tokens are not configured")
+    errMalformedToken = errors.New("malformed token")
+    errTokenSignature = errors.New("invalid token signature")
+    errTokenExpired   = errors.New("token expired")
+)
+
+// jwks caches the identity provider's signing keys by key ID
+var jwks = &jwksCache{}
+
+// After a failed JWKS load the provider is left alone for jwksMinBackoff,
+// doubling with every further failure up to jwksMaxBackoff
+const (
+    jwksMinBackoff = time.Second
+    jwksMaxBackoff = time.Minute
+)
+
+type jwksCache struct {
+    mu      sync.Mutex
+    keys    map[string]crypto.PublicKey
+    fetched time.Time     // last successful load
+    failed  time.Time     // last failed load
+    backoff time.Duration // wait after failed before loading again
+    err     error         // error of the last load, nil once one succeeds
+    loading chan struct{} // closed when the load in progress ends
+}
+
+// key returns the signing key with the given ID. The set is reloaded when it
+// is older than JWKS_REFRESH, or when an unknown key ID shows up after the
+// provider rotated keys, at most once a minute so bad tokens cannot hammer it.
+// Loads happen outside the lock, one at a time; callers holding a cached key
+// keep using it meanwhile and the others wait for the result.
+func (c *jwksCache) key(kid string) (crypto.PublicKey, error) {
+    for {
+        c.mu.Lock()
+        key, ok := c.keys[kid]
+        if !c.stale(ok, time.Now()) {
+            err := c.err
+            c.mu.Unlock()
+            if ok {
+                return key, nil
+            }
+            if err != nil {
+                return nil, err
+            }
+            return nil, fmt.Errorf("unknown key ID %q", kid)
+        }
+        if loading := c.loading; loading != nil {
+            c.mu.Unlock()
+            if ok {
+                return key, nil
+            }
+            <-loading
+            continue
+        }
+        loading := make(chan struct{})
+        c.loading = loading
+        c.mu.Unlock()
+
+        keys, err := loadJWKS(jwksSource)
+
+        c.mu.Lock()
+        if err != nil {
+            // Keep serving cached keys while the provider is unreachable
+            c.failed, c.err = time.Now(), err
+            c.backoff = min(max(2*c.backoff, jwksMinBackoff), jwksMaxBackoff)
+        } else {
+            c.keys, c.fetched, c.err, c.backoff = keys, time.Now(), nil, 0
+        }
+        c.loading = nil
+        close(loading)
+        c.mu.Unlock()
+    }
+}
+
+// stale reports whether the set must be reloaded to answer for a key that
+// is cached (ok) or not. Callers hold c.mu.
+func (c *jwksCache) stale(ok bool, now time.Time) bool {
+    if now.Before(c.failed.Add(c.backoff)) {
+        return false
+    }
+    age := now.Sub(c.fetched)
+    if ok {
+        return age >= jwksRefresh
+    }
+    return age >= time.Minute || c.err != nil
+}
+
+// jsonWebKey is the subset of RFC 7517 needed for RSA and EC signing keys
+type jsonWebKey struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+    Crv string `json:"crv"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+}
+
+// loadJWKS reads a key set from a file path or an http(s) URL
+func loadJWKS(source string) (map[string]crypto.PublicKey, error) {
+    var body []byte
+    var err error
+    if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+        client := http.Client{Timeout: 10 * time.Second}
+        resp, err := client.Get(source)
+        if err != nil {
+            return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+        }
+        body, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+        if err != nil {
+            return nil, err
+        }
+    } else if body, err = os.ReadFile(source); err != nil {
+        return nil, err
+    }
+
+    var set struct {
+        Keys []jsonWebKey `json:"keys"`
+    }
+    if err := json.Unmarshal(body, &set); err != nil {
+        return nil, fmt.Errorf("parsing JWKS: %w", err)
+    }
+
+    keys := make(map[string]crypto.PublicKey)
+    for _, jwk := range set.Keys {
+        if jwk.Use != "" && jwk.Use != "sig" {
+            continue
+        }
+        key, err := jwk.publicKey()
+        if err != nil {
+            return nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+        }
+        keys[jwk.Kid] = key
+    }
+    return keys, nil
+}
+
+// publicKey decodes an RSA or P-256 key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+    switch k.Kty {
+    case "RSA":
+        n, err := base64.RawURLEncoding.DecodeString(k.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := base64.RawURLEncoding.DecodeString(k.E)
+        if err != nil {
+            return nil, err
+        }
+        exponent := new(big.Int).SetBytes(e)
+        if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+            return nil, errors.New("RSA exponent too large")
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+    case "EC":
+        if k.Crv != "P-256" {
+            return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+        }
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := base64.RawURLEncoding.DecodeString(k.Y)
+        if err != nil {
+            return nil, err
+        }
+        key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        if !key.Curve.IsOnCurve(key.X, key.Y) {
+            return nil, errors.New("EC point is not on the curve")
+        }
+        return key, nil
+    default:
+        return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+    }
+}
+
+// checkJWTConfig refuses bearer token settings that would accept tokens of
+// any issuer or audience
+func checkJWTConfig() error {
+    if jwksSource != "" && (jwtIssuer == "" || jwtAudience == "") {
+        return errJWTUnscoped
+    }
+    return nil
+}
+
+// verifyJWT checks an RS256 or ES256 token against the JWKS, validates its
+// expiry, issuer and audience and returns its claims
+func verifyJWT(token string) (map[string]interface{}, error) {
+    if jwksSource == "" {
+        return nil, errBearerDisabled
+    }
+    if err := checkJWTConfig(); err != nil {
+        return nil, err
+    }
+
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errMalformedToken
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, errMalformedToken
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errMalformedToken
+    }
+
+    key, err := jwks.key(header.Kid)
+    if err != nil {
+        return nil, err
+    }
+    digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    switch key := key.(type) {
+    case *rsa.PublicKey:
+        if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+            return nil, errTokenSignature
+        }
+    case *ecdsa.PublicKey:
+        // JWS encodes ES256 signatures as the raw 32-byte r and s values
+        if header.Alg != "ES256" || len(signature) != 64 ||
+            !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+            return nil, errTokenSignature
+        }
+    default:
+        return nil, errTokenSignature
+    }
+
+    var claims map[string]interface{}
+    if err := decodeSegment(parts[1], &claims); err != nil {
+        return nil, errMalformedToken
+    }
+
+    now := time.Now()
+    exp, ok := claims["exp"].(float64)
+    if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+        return nil, errTokenExpired
+    }
+    if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+        return nil, errors.New("token not yet valid")
+    }
+    if claims["iss"] != jwtIssuer {
+        return nil, errors.New("unexpected token issuer")
+    }
+    if !containsClaim(claims["aud"], jwtAudience) {
+        return nil, errors.New("unexpected token audience")
+    }
+    return claims, nil
+}
+
+// decodeSegment decodes one base64url JSON part of a token
+func decodeSegment(segment string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// containsClaim reports whether a string or string array claim holds value
+func containsClaim(claim interface{}, value string) bool {
+    switch claim := claim.(type) {
+    case string:
+        return claim == value
+    case []interface{}:
+        for _, item := range claim {
+            if item == value {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// tokenRoles returns the known roles found at JWT_ROLES_CLAIM
+func tokenRoles(claims map[string]interface{}) []string {
+    var claim interface{} = claims
+    for _, name := range strings.Split(jwtRolesClaim, ".") {
+        object, ok := claim.(map[string]interface{})
+        if !ok {
+            return nil
+        }
+        claim = object[name]
+    }
+
+    var roles []string
+    switch claim := claim.(type) {
+    case string:
+        roles = strings.Fields(claim)
+    case []interface{}:
+        for _, item := range claim {
+            if role, ok := item.(string); ok {
+                roles = append(roles, role)
+            }
+        }
+    }
+
+    known := roles[:0]
+    for _, role := range roles {
+        if _, ok := roleScopes[role]; ok {
+            known = append(known, role)
+        }
+    }
+    return known
+}
+
+// bearerPrincipal authenticates a back-office user from a bearer token
+func bearerPrincipal(token string) (*Principal, error) {
+    claims, err := verifyJWT(token)
+    if err != nil {
+        return nil, err
+    }
+    subject, _ := claims["sub"].(string)
+    if subject == "" {
+        return nil, errors.New("token has no subject")
+    }
+
+    principal := &Principal{Subject: "user:" + subject, Roles: tokenRoles(claims)}
+    principal.Tenant, _ = claims[jwtTenantClaim].(string)
+    for _, role := range principal.Roles {
+        principal.Scopes = append(principal.Scopes, roleScopes[role]...)
+    }
+    if principal.Tenant == "" && !principal.CrossTenant() {
+        return nil, errors.New("token has no tenant")
+    }
+    return principal, nil
+}
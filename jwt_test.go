@@ -0,0 +1,258 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// jwksStub is an identity provider serving a key set over HTTP
+type jwksStub struct {
+    rsaKey  *rsa.PrivateKey
+    ecKey   *ecdsa.PrivateKey
+    fail    atomic.Bool
+    fetches atomic.Int32
+}
+
+// newJWKSStub serves the keys "rsa" and "ec" and points the JWT settings at
+// them for the duration of a test, with an empty key cache
+func newJWKSStub(t *testing.T) *jwksStub {
+    t.Helper()
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stub := &jwksStub{rsaKey: rsaKey, ecKey: ecKey}
+
+    encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+    set, _ := json.Marshal(map[string][]jsonWebKey{"keys": {
+        {Kty: "RSA", Kid: "rsa", Use: "sig", N: encode(rsaKey.N.Bytes()), E: encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+        {Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(ecKey.X.FillBytes(make([]byte, 32))), Y: encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+    }})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        stub.fetches.Add(1)
+        if stub.fail.Load() {
+            http.Error(w, "unavailable", http.StatusServiceUnavailable)
+            return
+        }
+        w.Write(set)
+    }))
+
+    previousSource, previousIssuer, previousAudience, previousCache := jwksSource, jwtIssuer, jwtAudience, jwks
+    jwksSource, jwtIssuer, jwtAudience, jwks = server.URL, "https://id.example.com", "parking", &jwksCache{}
+    t.Cleanup(func() {
+        server.Close()
+        jwksSource, jwtIssuer, jwtAudience, jwks = previousSource, previousIssuer, previousAudience, previousCache
+    })
+    return stub
+}
+
+// sign returns a token over header and claims signed for alg: RS256 and
+// ES256 with the stub's keys, anything else with an empty signature
+func (s *jwksStub) sign(t *testing.T, header, claims map[string]interface{}) string {
+    t.Helper()
+    encode := func(v interface{}) string {
+        data, _ := json.Marshal(v)
+        return base64.RawURLEncoding.EncodeToString(data)
+    }
+    input := encode(header) + "." + encode(claims)
+    digest := sha256.Sum256([]byte(input))
+
+    var signature []byte
+    switch header["alg"] {
+    case "RS256":
+        var err error
+        signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+        if err != nil {
+            t.Fatal(err)
+        }
+    case "ES256":
+        r, sig, err := ecdsa.Sign(rand.Reader, s.ecKey, digest[:])
+        if err != nil {
+            t.Fatal(err)
+        }
+        signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+    }
+    return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims returns claims the stub's settings accept
+func validClaims() map[string]interface{} {
+    return map[string]interface{}{
+        "sub":    "u1",
+        "iss":    "https://id.example.com",
+        "aud":    []string{"parking", "other"},
+        "exp":    time.Now().Add(time.Hour).Unix(),
+        "tenant": "acme",
+        "roles":  []string{RoleOperator},
+    }
+}
+
+func TestVerifyJWT(t *testing.T) {
+    stub := newJWKSStub(t)
+    with := func(name string, value interface{}) map[string]interface{} {
+        claims := validClaims()
+        claims[name] = value
+        return claims
+    }
+    rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+
+    tests := []struct {
+        name    string
+        header  map[string]interface{}
+        claims  map[string]interface{}
+        tamper  bool
+        wantErr string
+    }{
+        {"valid RS256", rs256, validClaims(), false, ""},
+        {"valid ES256", map[string]interface{}{"alg": "ES256", "kid": "ec"}, validClaims(), false, ""},
+        {"bad signature", rs256, validClaims(), true, errTokenSignature.Error()},
+        {"expired", rs256, with("exp", time.Now().Add(-time.Hour).Unix()), false, errTokenExpired.Error()},
+        {"within leeway", rs256, with("exp", time.Now().Add(-jwtLeeway/2).Unix()), false, ""},
+        {"no expiry", rs256, with("exp", nil), false, errTokenExpired.Error()},
+        {"not yet valid", rs256, with("nbf", time.Now().Add(time.Hour).Unix()), false, "token not yet valid"},
+        {"wrong audience", rs256, with("aud", "billing"), false, "unexpected token audience"},
+        {"wrong issuer", rs256, with("iss", "https://evil.example.com"), false, "unexpected token issuer"},
+        {"unknown kid", map[string]interface{}{"alg": "RS256", "kid": "gone"}, validClaims(), false, `unknown key ID "gone"`},
+        {"alg none", map[string]interface{}{"alg": "none", "kid": "rsa"}, validClaims(), false, errTokenSignature.Error()},
+        {"alg mismatch", map[string]interface{}{"alg": "ES256", "kid": "rsa"}, validClaims(), false, errTokenSignature.Error()},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            token := stub.sign(t, test.header, test.claims)
+            if test.tamper {
+                parts := strings.Split(token, ".")
+                token = parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2]
+            }
+            claims, err := verifyJWT(token)
+            if test.wantErr == "" {
+                if err != nil {
+                    t.Fatalf("got %v, want a valid token", err)
+                }
+                if claims["sub"] != "u1" {
+                    t.Fatalf("got claims %v", claims)
+                }
+                return
+            }
+            if err == nil || err.Error() != test.wantErr {
+                t.Fatalf("got %v, want %q", err, test.wantErr)
+            }
+        })
+    }
+
+    // Every token above, including the unknown key ID, was served by one load
+    if fetches := stub.fetches.Load(); fetches != 1 {
+        t.Errorf("fetched the key set %d times, want 1", fetches)
+    }
+}
+
+func TestJWKSBacksOffAfterFailure(t *testing.T) {
+    stub := newJWKSStub(t)
+    stub.fail.Store(true)
+    token := stub.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, validClaims())
+
+    for i := 0; i < 5; i++ {
+        if _, err := verifyJWT(token); err == nil {
+            t.Fatal("verified a token while the key set is unavailable")
+        }
+    }
+    if fetches := stub.fetches.Load(); fetches != 1 {
+        t.Fatalf("fetched the key set %d times during the backoff, want 1", fetches)
+    }
+
+    // The provider recovers; the next load after the backoff succeeds
+    stub.fail.Store(false)
+    jwks.mu.Lock()
+    jwks.failed = time.Now().Add(-jwks.backoff)
+    jwks.mu.Unlock()
+    if _, err := verifyJWT(token); err != nil {
+        t.Fatalf("got %v after the provider recovered", err)
+    }
+    if fetches := stub.fetches.Load(); fetches != 2 {
+        t.Fatalf("fetched the key set %d times, want 2", fetches)
+    }
+}
+
+func TestJWKSServesCachedKeysWhileUnavailable(t *testing.T) {
+    stub := newJWKSStub(t)
+    token := stub.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, validClaims())
+    if _, err := verifyJWT(token); err != nil {
+        t.Fatal(err)
+    }
+
+    // The cached set expires while the provider is down
+    stub.fail.Store(true)
+    jwks.mu.Lock()
+    jwks.fetched = time.Now().Add(-jwksRefresh)
+    jwks.mu.Unlock()
+    for i := 0; i < 3; i++ {
+        if _, err := verifyJWT(token); err != nil {
+            t.Fatalf("got %v, want the cached key", err)
+        }
+    }
+    if fetches := stub.fetches.Load(); fetches != 2 {
+        t.Fatalf("fetched the key set %d times, want 2", fetches)
+    }
+}
+
+func TestJWTRequiresIssuerAndAudience(t *testing.T) {
+    stub := newJWKSStub(t)
+    token := stub.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, validClaims())
+
+    tests := []struct {
+        name, source, issuer, audience string
+        wantErr                        error
+    }{
+        {"bearer tokens disabled", "", "", "", nil},
+        {"fully configured", "jwks.json", "https://id.example.com", "parking", nil},
+        {"no issuer", "jwks.json", "", "parking", errJWTUnscoped},
+        {"no audience", "jwks.json", "https://id.example.com", "", errJWTUnscoped},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            source, issuer, audience := jwksSource, jwtIssuer, jwtAudience
+            defer func() { jwksSource, jwtIssuer, jwtAudience = source, issuer, audience }()
+
+            jwksSource, jwtIssuer, jwtAudience = test.source, test.issuer, test.audience
+            if err := checkJWTConfig(); err != test.wantErr {
+                t.Fatalf("got %v, want %v", err, test.wantErr)
+            }
+            if test.wantErr == nil {
+                return
+            }
+            // Tokens are refused even if the check at startup was bypassed
+            jwksSource = source
+            if _, err := verifyJWT(token); err != test.wantErr {
+                t.Fatalf("verified a token with %v, want %v", err, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestBearerRejectionHidesReason(t *testing.T) {
+    stub := newJWKSStub(t)
+    claims := validClaims()
+    claims["aud"] = "billing"
+    token := stub.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims)
+
+    _, status, err := resolveCredentials(token, "")
+    if status != http.StatusUnauthorized || err == nil || err.Error() != "Invalid bearer token" {
+        t.Fatalf("got %d, %v, want 401 without the reason", status, err)
+    }
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Request limits. Every credential may make RATE_LIMIT_RPS requests per
+// second on average with bursts of up to RATE_LIMIT_BURST, and each device
+// using it DEVICE_RATE_LIMIT_RPS with bursts of DEVICE_RATE_LIMIT_BURST. The
+// credential default leaves room for a fleet of about 1000 devices sharing one
+// key and reporting every 5 seconds; the device limit is what keeps a single
+// device in check. Before credentials are checked every address is held to
+// IP_RATE_LIMIT_RPS with bursts of IP_RATE_LIMIT_BURST. That limit only guards
+// the API key lookup against floods, so its default is generous enough for a
+// carrier NAT address in front of a whole fleet; raise it further rather than
+// lower it if devices share few addresses. JSON bodies are capped at
+// MAX_BODY_BYTES, batch uploads at MAX_BATCH_BODY_BYTES.
+var (
+    rateLimitRPS         = envFloat("RATE_LIMIT_RPS", 200)
+    rateLimitBurst       = envFloat("RATE_LIMIT_BURST", 400)
+    deviceRateLimitRPS   = envFloat("DEVICE_RATE_LIMIT_RPS", 2)
+    deviceRateLimitBurst = envFloat("DEVICE_RATE_LIMIT_BURST", 5)
+    ipRateLimitRPS       = envFloat("IP_RATE_LIMIT_RPS", 1000)
+    ipRateLimitBurst     = envFloat("IP_RATE_LIMIT_BURST", 2000)
+    maxBodyBytes         = envInt("MAX_BODY_BYTES", 1<<20)
+    maxBatchBodyBytes    = envInt("MAX_BATCH_BODY_BYTES", 16<<20)
+    // trustForwardedFor makes the limiter key anonymous clients by the first
+    // X-Forwarded-For address; only enable it behind a proxy that sets it
+    trustForwardedFor = envString("TRUST_FORWARDED_FOR", "") == "true"
+)
+
+// rateLimitIdle is how long an untouched bucket is kept before it is swept
+const rateLimitIdle = 10 * time.Minute
+
+// tokenBucket holds the tokens one client has left
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client key
+type rateLimiter struct {
+    mutex     sync.Mutex
+    rate      float64
+    burst     float64
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter refilling rate tokens per second up to burst
+func newRateLimiter(rate, burst float64) *rateLimiter {
+    return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Process-wide rate limiters for credentials, the devices sharing a
+// credential and client addresses
+var (
+    limiter       = newRateLimiter(rateLimitRPS, rateLimitBurst)
+    deviceLimiter = newRateLimiter(deviceRateLimitRPS, deviceRateLimitBurst)
+    ipLimiter     = newRateLimiter(ipRateLimitRPS, ipRateLimitBurst)
+)
+
+// Allow takes a token from the key's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if now.Sub(l.lastSweep) > rateLimitIdle {
+        for k, bucket := range l.buckets {
+            if now.Sub(bucket.last) > rateLimitIdle {
+                delete(l.buckets, k)
+            }
+        }
+        l.lastSweep = now
+    }
+
+    bucket, ok := l.buckets[key]
+    if !ok {
+        bucket = &tokenBucket{tokens: l.burst, last: now}
+        l.buckets[key] = bucket
+    }
+    bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+    bucket.last = now
+
+    if bucket.tokens < 1 {
+        return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+    }
+    bucket.tokens--
+    return true, 0
+}
+
+// allowClient charges a request to its credential's bucket and, when it names
+// a device, also to that device's narrower bucket so one device cannot exhaust
+// a key shared by a fleet. The device comes from the client, so it only ever
+// adds a limit: a new device ID never yields fresh credential tokens.
+func allowClient(principal *Principal, ip, device string, now time.Time) (bool, time.Duration) {
+    key := limiterKey(principal, ip)
+    if device != "" {
+        if allowed, wait := deviceLimiter.Allow(key+"/device:"+device, now); !allowed {
+            return false, wait
+        }
+    }
+    return limiter.Allow(key, now)
+}
+
+// limiterKey identifies the client a request is charged to: its API key or
+// user, or its IP address when anonymous
+func limiterKey(principal *Principal, ip string) string {
+    if principal == nil {
+        return "ip:" + ip
+    }
+    if principal.KeyID != 0 {
+        return "key:" + strconv.Itoa(principal.KeyID)
+    }
+    return principal.Subject
+}
+
+// clientIP returns the address of the client that sent a request
+func clientIP(r *http.Request) string {
+    if trustForwardedFor {
+        if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+            return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// limitAddress is router middleware that rate limits each client address
+// before authenticate runs, so floods of bad or missing credentials are
+// refused without an API key lookup each
+func limitAddress(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if allowed, wait := ipLimiter.Allow(clientIP(r), time.Now()); !allowed {
+            writeRateLimited(w, r, wait)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// rateLimit is router middleware that answers 429 with Retry-After once a
+// client has used up its bucket. It runs after authenticate so requests are
+// charged to their credentials rather than to a shared NAT address.
+func rateLimit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        allowed, wait := allowClient(principalFrom(r.Context()), clientIP(r), r.Header.Get("X-Device-ID"), time.Now())
+        if !allowed {
+            writeRateLimited(w, r, wait)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// writeRateLimited answers 429 with the seconds until a token is available
+func writeRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+    retryAfter := int(math.Ceil(wait.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+    writeErrorDetails(w, r, http.StatusTooManyRequests, "Rate limit exceeded", map[string]int{"retry_after_seconds": retryAfter})
+}
+
+// decodeJSON decodes a request body of at most maxBodyBytes into v. On
+// failure it writes a 400, or a 413 for oversized bodies, and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(v)
+    if err == nil {
+        return true
+    }
+    writePayloadError(w, r, err)
+    return false
+}
+
+// writePayloadError answers a request whose body could not be read or decoded
+func writePayloadError(w http.ResponseWriter, r *http.Request, err error) {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        writeErrorDetails(w, r, http.StatusRequestEntityTooLarge, "Request body exceeds "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes",
+            map[string]int64{"limit_bytes": tooLarge.Limit})
+        return
+    }
+    writeErrorDetails(w, r, http.StatusBadRequest, "Invalid request payload", map[string]string{"reason": err.Error()})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+    l := newRateLimiter(2, 3)
+    now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+    // A new client starts with a full burst
+    for i := 0; i < 3; i++ {
+        if allowed, _ := l.Allow("a", now); !allowed {
+            t.Fatalf("request %d of the burst was refused", i+1)
+        }
+    }
+    allowed, wait := l.Allow("a", now)
+    if allowed || wait != 500*time.Millisecond {
+        t.Fatalf("got %v, %v, want a refusal with half a second to wait", allowed, wait)
+    }
+
+    // Tokens come back at the rate, a partial token is not enough
+    if allowed, wait := l.Allow("a", now.Add(250*time.Millisecond)); allowed || wait != 250*time.Millisecond {
+        t.Fatalf("got %v, %v after a quarter second, want 250ms more to wait", allowed, wait)
+    }
+    if allowed, _ := l.Allow("a", now.Add(500*time.Millisecond)); !allowed {
+        t.Fatal("refused once a token had refilled")
+    }
+
+    // Other clients have their own buckets
+    if allowed, _ := l.Allow("b", now); !allowed {
+        t.Fatal("one client's burst limited another")
+    }
+
+    // A long pause refills no more than the burst
+    later := now.Add(time.Hour)
+    for i := 0; i < 3; i++ {
+        if allowed, _ := l.Allow("a", later); !allowed {
+            t.Fatalf("request %d after the pause was refused", i+1)
+        }
+    }
+    if allowed, _ := l.Allow("a", later); allowed {
+        t.Fatal("a long pause refilled more than the burst")
+    }
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+    l := newRateLimiter(1, 1)
+    now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    l.Allow("idle", now)
+    l.Allow("busy", now.Add(rateLimitIdle))
+    l.Allow("busy", now.Add(rateLimitIdle+time.Second))
+
+    if _, ok := l.buckets["idle"]; ok {
+        t.Fatal("kept the bucket of an idle client")
+    }
+    if _, ok := l.buckets["busy"]; !ok {
+        t.Fatal("swept the bucket of an active client")
+    }
+}
+
+func TestRateLimitedRetryAfter(t *testing.T) {
+    setAuth(t, false)
+    previous := ipLimiter
+    ipLimiter = newRateLimiter(0.4, 1)
+    t.Cleanup(func() { ipLimiter = previous })
+
+    handler := limitAddress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    request := func() *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodGet, "/v1/places", nil)
+        r.RemoteAddr = "203.0.113.7:4711"
+        handler.ServeHTTP(w, r)
+        return w
+    }
+    if w := request(); w.Code != http.StatusOK {
+        t.Fatalf("got status %d for the first request", w.Code)
+    }
+
+    // The next token is 2.5 seconds away, rounded up to whole seconds
+    w := request()
+    if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3" {
+        t.Fatalf("got status %d with Retry-After %q, want 429 with 3", w.Code, w.Header().Get("Retry-After"))
+    }
+    var body struct {
+        Details struct {
+            RetryAfterSeconds int `json:"retry_after_seconds"`
+        } `json:"details"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Details.RetryAfterSeconds != 3 {
+        t.Fatalf("got body %s, want retry_after_seconds 3", w.Body)
+    }
+}
+
+func TestAllowClientSharedKey(t *testing.T) {
+    previous, previousDevice := limiter, deviceLimiter
+    limiter, deviceLimiter = newRateLimiter(rateLimitRPS, rateLimitBurst), newRateLimiter(deviceRateLimitRPS, deviceRateLimitBurst)
+    t.Cleanup(func() { limiter, deviceLimiter = previous, previousDevice })
+
+    // A fleet of 1000 devices sharing a key and reporting every 5 seconds
+    // stays within the default limits for a minute
+    principal := &Principal{KeyID: 1, Subject: "key:1"}
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    const devices, interval = 1000, 5 * time.Second
+    for tick := time.Duration(0); tick < time.Minute; tick += interval {
+        for device := 0; device < devices; device++ {
+            // Reports spread evenly over the interval
+            at := start.Add(tick + interval*time.Duration(device)/devices)
+            if allowed, _ := allowClient(principal, "203.0.113.7", "taxi-"+strconv.Itoa(device), at); !allowed {
+                t.Fatalf("device %d was limited at %s", device, at.Sub(start))
+            }
+        }
+    }
+
+    // while one chatty device is held to its own limit
+    for i := 0; ; i++ {
+        if allowed, _ := allowClient(principal, "203.0.113.7", "chatty", start.Add(2*time.Minute)); !allowed {
+            if i != int(deviceRateLimitBurst) {
+                t.Fatalf("chatty device was limited after %d requests, want %v", i, deviceRateLimitBurst)
+            }
+            break
+        }
+    }
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+    "errors"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+const (
+    // liveBufferSize is how many events may queue for one client before new ones are dropped
+    liveBufferSize = 256
+    // liveWriteTimeout disconnects clients that cannot accept a frame in time
+    liveWriteTimeout = 10 * time.Second
+    // livePongTimeout disconnects clients that stop answering pings
+    livePongTimeout = 60 * time.Second
+    livePingPeriod  = livePongTimeout * 9 / 10
+)
+
+// errInvalidBBox is returned for a bounding box that is not four numbers
+var errInvalidBBox = errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+
+// errNotFinite is returned for NaN and infinite query parameters
+var errNotFinite = errors.New("not a finite number")
+
+// liveAllowedOrigins lists the browser origins, e.g. "https://ops.example.com",
+// that may open the live feed besides the service's own
+var liveAllowedOrigins = envList("LIVE_ALLOWED_ORIGINS")
+
+var liveUpgrader = websocket.Upgrader{
+    ReadBufferSize:  1024,
+    WriteBufferSize: 1024,
+    CheckOrigin:     checkLiveOrigin,
+}
+
+// checkLiveOrigin reports whether a WebSocket handshake may proceed. Browsers
+// always send Origin, so a page on another site can only connect, with its
+// visitor's cookies, when its origin is allowed. Requests without Origin come
+// from non-browser clients, which authenticate with their own credentials.
+func checkLiveOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+    u, err := url.Parse(origin)
+    if err != nil || u.Host == "" {
+        return false
+    }
+    if strings.EqualFold(u.Host, r.Host) {
+        return true
+    }
+    for _, allowed := range liveAllowedOrigins {
+        if strings.EqualFold(strings.TrimRight(allowed, "/"), u.Scheme+"://"+u.Host) {
+            return true
+        }
+    }
+    return false
+}
+
+// liveSubscription selects which events a live client receives. An empty
+// subscription receives everything; otherwise an event is delivered when it
+// matches any of the given vehicles, places or the bounding box.
+type liveSubscription struct {
+    BBox     []float64 `json:"bbox,omitempty"` // minLon, minLat, maxLon, maxLat
+    PlaceIDs []int     `json:"place_ids,omitempty"`
+    TaxiIDs  []string  `json:"taxi_ids,omitempty"`
+}
+
+// matches reports whether an event falls inside the subscription
+func (s *liveSubscription) matches(event Event) bool {
+    if len(s.BBox) == 0 && len(s.PlaceIDs) == 0 && len(s.TaxiIDs) == 0 {
+        return true
+    }
+    for _, id := range s.TaxiIDs {
+        if id == event.TaxiID {
+            return true
+        }
+    }
+    for _, id := range s.PlaceIDs {
+        if event.PlaceID != 0 && id == event.PlaceID {
+            return true
+        }
+    }
+    if len(s.BBox) == 4 && event.Type != EventVehicleOffline {
+        return event.Longitude >= s.BBox[0] && event.Latitude >= s.BBox[1] &&
+            event.Longitude <= s.BBox[2] && event.Latitude <= s.BBox[3]
+    }
+    return false
+}
+
+// parseLiveSubscription reads the initial subscription from the query string,
+// e.g. ?bbox=106.7,-6.3,106.9,-6.1&place_id=1,2&taxi_id=T1
+func parseLiveSubscription(r *http.Request) (*liveSubscription, error) {
+    sub := &liveSubscription{}
+    query := r.URL.Query()
+
+    if bbox := query.Get("bbox"); bbox != "" {
+        values, err := parseFloatList(bbox)
+        if err != nil || len(values) != 4 {
+            return nil, errInvalidBBox
+        }
+        sub.BBox = values
+    }
+    for _, part := range splitList(query.Get("place_id")) {
+        id, err := strconv.Atoi(part)
+        if err != nil {
+            return nil, err
+        }
+        sub.PlaceIDs = append(sub.PlaceIDs, id)
+    }
+    sub.TaxiIDs = splitList(query.Get("taxi_id"))
+    return sub, nil
+}
+
+// splitList splits a comma separated query value, ignoring empty items
+func splitList(value string) []string {
+    var items []string
+    for _, part := range strings.Split(value, ",") {
+        if part = strings.TrimSpace(part); part != "" {
+            items = append(items, part)
+        }
+    }
+    return items
+}
+
+// parseFloatList parses a comma separated list of finite numbers
+func parseFloatList(value string) ([]float64, error) {
+    var values []float64
+    for _, part := range splitList(value) {
+        f, err := parseFiniteFloat(part)
+        if err != nil {
+            return nil, err
+        }
+        values = append(values, f)
+    }
+    return values, nil
+}
+
+// liveFeed streams vehicle positions and place assignments over a WebSocket.
+// Clients may replace their subscription at any time by sending a JSON
+// liveSubscription message. Events that arrive while a client's queue is full
+// are dropped, and clients that stall on writes are disconnected. Clients only
+// receive events of their own tenant.
+func liveFeed(w http.ResponseWriter, r *http.Request) {
+    tenant := requestTenant(r)
+    sub, err := parseLiveSubscription(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid subscription")
+        return
+    }
+
+    if !checkLiveOrigin(r) {
+        writeError(w, r, http.StatusForbidden, "Origin not allowed")
+        return
+    }
+
+    conn, err := liveUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        log.Println("WebSocket upgrade failed:", err)
+        return
+    }
+    defer conn.Close()
+
+    feed, unsubscribe := events.Subscribe(liveBufferSize)
+    defer unsubscribe()
+
+    var mutex sync.Mutex
+    done := make(chan struct{})
+
+    // Reader: applies subscription updates and notices disconnects
+    go func() {
+        defer close(done)
+        conn.SetReadLimit(64 * 1024)
+        conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+        conn.SetPongHandler(func(string) error {
+            return conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+        })
+        for {
+            var update liveSubscription
+            if err := conn.ReadJSON(&update); err != nil {
+                if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+                    log.Println("Live client read error:", err)
+                }
+                return
+            }
+            if len(update.BBox) != 0 && len(update.BBox) != 4 {
+                continue
+            }
+            mutex.Lock()
+            sub = &update
+            mutex.Unlock()
+        }
+    }()
+
+    ticker := time.NewTicker(livePingPeriod)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-done:
+            return
+        case event, ok := <-feed:
+            if !ok {
+                return
+            }
+            if tenant != "" && event.Tenant != tenant {
+                continue
+            }
+            mutex.Lock()
+            match := sub.matches(event)
+            mutex.Unlock()
+            if !match {
+                continue
+            }
+            conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+            if err := conn.WriteJSON(event); err != nil {
+                log.Println("Live client write failed:", err)
+                return
+            }
+        case <-ticker.C:
+            conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+            if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// parseFiniteFloat parses a number, rejecting the NaN and infinities that
+// strconv.ParseFloat accepts
+func parseFiniteFloat(value string) (float64, error) {
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        return 0, err
+    }
+    if math.IsNaN(f) || math.IsInf(f, 0) {
+        return 0, errNotFinite
+    }
+    return f, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestLiveFeedChecksOrigin(t *testing.T) {
+    setAuth(t, false)
+    setRateLimits(t)
+    previous := liveAllowedOrigins
+    liveAllowedOrigins = []string{"https://OPS.example.com/"}
+    t.Cleanup(func() { liveAllowedOrigins = previous })
+    server := httptest.NewServer(newRouter())
+    defer server.Close()
+    host := strings.TrimPrefix(server.URL, "http://")
+
+    tests := []struct {
+        name   string
+        origin string
+        status int
+    }{
+        {"no origin", "", http.StatusSwitchingProtocols},
+        {"same origin", "http://" + host, http.StatusSwitchingProtocols},
+        {"allowed origin", "https://ops.example.com", http.StatusSwitchingProtocols},
+        {"allowed host on another scheme", "http://ops.example.com", http.StatusForbidden},
+        {"other origin", "https://evil.example.com", http.StatusForbidden},
+        {"lookalike origin", "https://ops.example.com.evil.example.com", http.StatusForbidden},
+        {"malformed origin", "null", http.StatusForbidden},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            header := http.Header{}
+            if test.origin != "" {
+                header.Set("Origin", test.origin)
+            }
+            conn, response, err := websocket.DefaultDialer.Dial("ws://"+host+apiV1Prefix+"/ws/live", header)
+            if conn != nil {
+                conn.Close()
+            }
+            if response == nil {
+                t.Fatal(err)
+            }
+            if response.StatusCode != test.status {
+                t.Fatalf("got status %d, want %d", response.StatusCode, test.status)
+            }
+            if test.status == http.StatusForbidden {
+                var apiErr APIError
+                if err := json.NewDecoder(response.Body).Decode(&apiErr); err != nil || apiErr.Code != "permission_denied" {
+                    t.Fatalf("got %+v, %v, want the error envelope", apiErr, err)
+                }
+            }
+        })
+    }
+}
@@ -3,13 +3,13 @@ package main
 import (
     "database/sql"
     "encoding/json"
-    "fmt"
     "log"
     "net/http"
     "strconv"
+    "time"
 
     "github.com/gorilla/mux"
-    _ "github.com/lib/pq"
+    "github.com/lib/pq"
     "github.com/paulmach/orb"
     "github.com/paulmach/orb/planar"
     "github.com/robfig/cron/v3"
@@ -20,16 +20,23 @@ var db *sql.DB
 
 // TaxiLocation represents the taxi's geographic location
 type TaxiLocation struct {
-    TaxiID    string  `json:"taxi_id"`
-    Longitude float64 `json:"longitude"`
-    Latitude  float64 `json:"latitude"`
+    TaxiID    string     `json:"taxi_id"`
+    Longitude float64    `json:"longitude"`
+    Latitude  float64    `json:"latitude"`
+    Timestamp *time.Time `json:"timestamp,omitempty"` // Device-reported fix time
+    Accuracy  float64    `json:"accuracy,omitempty"`  // Device-reported accuracy in metres
+    Fleet     string     `json:"fleet,omitempty"`
+    Tenant    string     `json:"tenant,omitempty"` // Set from the caller's credentials, never from the body
+    Status    string     `json:"status,omitempty"` // online, stale or offline; set on reads only
 }
 
 // Place represents a geographical place with a polygon
 type Place struct {
     PlaceID   int             `json:"place_id"`
     PlaceName string          `json:"place_name"`
-    Polygon   json.RawMessage `json:"polygon"` // GeoJSON Geometry
+    Tenant    string          `json:"tenant,omitempty"`
+    Polygon   json.RawMessage `json:"polygon"`              // GeoJSON Geometry
+    DeletedAt *time.Time      `json:"deleted_at,omitempty"` // Set on soft-deleted places
 }
 
 // GeoJSONGeometry represents the geometry part of a GeoJSON object
@@ -41,8 +48,20 @@ type GeoJSONGeometry struct {
 func main() {
     var err error
 
-    // Initialize the Gorilla Mux router
-    router := mux.NewRouter()
+    // Refuse bearer token settings that accept tokens meant for other services
+    if err = checkJWTConfig(); err != nil {
+        log.Fatal(err)
+    }
+
+    // Refuse vehicle freshness thresholds that are out of order
+    if err = checkStatusConfig(); err != nil {
+        log.Fatal(err)
+    }
+
+    // Refuse a raw occupancy retention too short for the hourly rollups
+    if err = checkOccupancyConfig(); err != nil {
+        log.Fatal(err)
+    }
 
     // PostgreSQL connection string
     connStr := "user=root dbname=subagiya1 password=secret host=localhost port=5431 sslmode=disable"
@@ -60,12 +79,98 @@ func main() {
     // Initialize database tables
     initTables()
 
+    // Install the bootstrap admin key, if configured
+    installBootstrapKey()
+
+    // Precompute H3 coverings for places stored before coverings existed
+    coverUncoveredPlaces()
+
+    // Seed the occupancy tracker so the first change stream starts from the stored state
+    refreshOccupancy()
+
+    // Initialize the Gorilla Mux router
+    router := newRouter()
+
+    // Refuse to start when the routes and openapi.json disagree
+    if problems := checkRoutesAgainstSpec(router, apiSpec); len(problems) > 0 {
+        for _, problem := range problems {
+            log.Println("openapi.json:", problem)
+        }
+        log.Fatal("Routes drifted from openapi.json")
+    }
+
+    // Initialize Cron scheduler
+    c := cron.New()
+
+    // Schedule mapTaxiLocations to run every 5 minutes
+    _, err = c.AddFunc("@every 5m", mapTaxiLocations)
+    if err != nil {
+        log.Fatal("Failed to schedule mapping function:", err)
+    }
+
+    // Mark taxis that stopped reporting as offline every minute
+    _, err = c.AddFunc("@every 1m", checkVehicleStatus)
+    if err != nil {
+        log.Fatal("Failed to schedule status check:", err)
+    }
+
+    // Split new location history into trips and stops every 5 minutes
+    _, err = c.AddFunc("@every 5m", segmentTrips)
+    if err != nil {
+        log.Fatal("Failed to schedule trip segmentation:", err)
+    }
+
+    // Snapshot per-place occupancy for the time series
+    _, err = c.AddFunc("@every "+occupancySampleInterval.String(), sampleOccupancy)
+    if err != nil {
+        log.Fatal("Failed to schedule occupancy sampling:", err)
+    }
+
+    // Start the Cron scheduler
+    c.Start()
+    defer c.Stop()
+
+    // Serve the gRPC API alongside REST
+    if grpcAddr != "" && grpcAddr != "off" {
+        go serveGRPC(grpcAddr)
+    }
+
+    log.Println("Server started at :8080")
+    // Start the HTTP server
+    log.Fatal(http.ListenAndServe(":8080", router))
+}
+
+// newRouter returns the REST API with its middleware
+func newRouter() *mux.Router {
+    router := mux.NewRouter()
+
+    // Serve the versioned API and, for existing clients, the same endpoints
+    // on their original unversioned paths
+    registerRoutes(router.PathPrefix(apiV1Prefix).Subrouter())
+    registerRoutes(router)
+    router.NotFoundHandler = withRequestID(http.HandlerFunc(notFound))
+    router.MethodNotAllowedHandler = withRequestID(http.HandlerFunc(methodNotAllowed))
+
+    // Tag every request with an ID, rate limit each address, require
+    // credentials with the route's scope, rate limit each client and reject
+    // requests that do not match openapi.json
+    router.Use(withRequestID)
+    router.Use(limitAddress)
+    router.Use(authenticate)
+    router.Use(rateLimit)
+    router.Use(validateRequest)
+    return router
+}
+
+// registerRoutes registers every endpoint on a router
+func registerRoutes(router *mux.Router) {
     // Register CRUD endpoints for Taxi Locations
     router.HandleFunc("/taxi", createTaxiLocation).Methods("POST")
     router.HandleFunc("/taxi", getAllTaxiLocations).Methods("GET")
     router.HandleFunc("/taxi/{id}", getTaxiLocation).Methods("GET")
     router.HandleFunc("/taxi/{id}", updateTaxiLocationCRUD).Methods("PUT")
     router.HandleFunc("/taxi/{id}", deleteTaxiLocation).Methods("DELETE")
+    router.HandleFunc("/taxi/{id}/trips", getTaxiTrips).Methods("GET")
 
     // Register CRUD endpoints for Places
     router.HandleFunc("/place", createPlace).Methods("POST")
@@ -73,38 +178,54 @@ func main() {
     router.HandleFunc("/place/{id}", getPlace).Methods("GET")
     router.HandleFunc("/place/{id}", updatePlace).Methods("PUT")
     router.HandleFunc("/place/{id}", deletePlace).Methods("DELETE")
+    router.HandleFunc("/place/{id}/restore", restorePlace).Methods("POST")
+    router.HandleFunc("/place/{id}/cells", getPlaceCells).Methods("GET")
+
+    // Register H3 cell queries
+    router.HandleFunc("/cells/{cell}/vehicles", getCellVehicles).Methods("GET")
 
     // Register existing endpoints
     router.HandleFunc("/updateLocation", updateTaxiLocation).Methods("POST")
+    router.HandleFunc("/locations/batch", ingestLocationBatch).Methods("POST")
+    router.HandleFunc("/locations/quarantine", getQuarantinedLocations).Methods("GET")
     router.HandleFunc("/getMapping", getMapping).Methods("GET")
     router.HandleFunc("/triggerMapping", triggerMapping).Methods("GET") // For manual mapping trigger
 
-    // Initialize Cron scheduler
-    c := cron.New()
+    // Register streaming endpoints
+    router.HandleFunc("/ws/live", liveFeed).Methods("GET")
+    router.HandleFunc("/events/occupancy", occupancyEvents).Methods("GET")
 
-    // Schedule mapTaxiLocations to run every 5 minutes
-    _, err = c.AddFunc("@every 5m", mapTaxiLocations)
-    if err != nil {
-        log.Fatal("Failed to schedule mapping function:", err)
-    }
+    // Register analytics endpoints
+    router.HandleFunc("/analytics/places/{id}/dwell", getPlaceDwell).Methods("GET")
+    router.HandleFunc("/analytics/places/{id}/occupancy", getPlaceOccupancy).Methods("GET")
+    router.HandleFunc("/analytics/od", getODMatrix).Methods("GET")
+    router.HandleFunc("/analytics/heatmap", getHeatmap).Methods("GET")
 
-    // Start the Cron scheduler
-    c.Start()
-    defer c.Stop()
+    // Register API key management endpoints
+    router.HandleFunc("/keys", createAPIKey).Methods("POST")
+    router.HandleFunc("/keys", getAPIKeys).Methods("GET")
+    router.HandleFunc("/keys/{id}/rotate", rotateAPIKey).Methods("POST")
+    router.HandleFunc("/keys/{id}", revokeAPIKey).Methods("DELETE")
 
-    log.Println("Server started at :8080")
-    // Start the HTTP server
-    log.Fatal(http.ListenAndServe(":8080", router))
+    // Register the audit log
+    router.HandleFunc("/audit", getAuditLog).Methods("GET")
+
+    // Register the API description
+    router.HandleFunc("/openapi.json", getOpenAPI).Methods("GET")
 }
 
 // initTables creates the necessary database tables if they do not exist
 func initTables() {
     tableCreationQueries := []string{
+        // Taxi IDs are unique within a tenant, so every per-taxi table is
+        // keyed on (tenant, taxi_id)
         `CREATE TABLE IF NOT EXISTS taxi_location (
-            taxi_id VARCHAR PRIMARY KEY,
+            tenant VARCHAR NOT NULL DEFAULT 'default',
+            taxi_id VARCHAR,
             longitude DOUBLE PRECISION,
             latitude DOUBLE PRECISION,
-            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY(tenant, taxi_id)
         )`,
         `CREATE TABLE IF NOT EXISTS places (
             place_id SERIAL PRIMARY KEY,
@@ -113,19 +234,213 @@ func initTables() {
         )`,
         `CREATE TABLE IF NOT EXISTS mapping (
             map_id SERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL DEFAULT 'default',
             taxi_id VARCHAR,
             place_id INTEGER,
             timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            FOREIGN KEY(taxi_id) REFERENCES taxi_location(taxi_id) ON DELETE CASCADE,
+            FOREIGN KEY(tenant, taxi_id) REFERENCES taxi_location(tenant, taxi_id) ON DELETE CASCADE,
             FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE CASCADE
         )`,
         `CREATE TABLE IF NOT EXISTS counters (
+            tenant VARCHAR NOT NULL DEFAULT 'default',
             taxi_id VARCHAR,
             place_id INTEGER,
             counter INTEGER DEFAULT 0,
             last_counted TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            PRIMARY KEY(taxi_id, place_id),
-            FOREIGN KEY(taxi_id) REFERENCES taxi_location(taxi_id) ON DELETE CASCADE,
+            PRIMARY KEY(tenant, taxi_id, place_id),
+            FOREIGN KEY(tenant, taxi_id) REFERENCES taxi_location(tenant, taxi_id) ON DELETE CASCADE,
+            FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE CASCADE
+        )`,
+        // Databases created before tenancy key taxis by taxi_id alone; their
+        // rows all belong to the default tenant
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT 'default'`,
+        `ALTER TABLE mapping ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT 'default'`,
+        `ALTER TABLE counters ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT 'default'`,
+        `DO $$ BEGIN
+            IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'taxi_location_pkey'
+                AND conrelid = 'taxi_location'::regclass AND array_length(conkey, 1) = 1) THEN
+                ALTER TABLE mapping DROP CONSTRAINT IF EXISTS mapping_taxi_id_fkey;
+                ALTER TABLE counters DROP CONSTRAINT IF EXISTS counters_taxi_id_fkey;
+                ALTER TABLE taxi_location DROP CONSTRAINT taxi_location_pkey, ADD PRIMARY KEY (tenant, taxi_id);
+                ALTER TABLE counters DROP CONSTRAINT counters_pkey, ADD PRIMARY KEY (tenant, taxi_id, place_id);
+                ALTER TABLE mapping ADD FOREIGN KEY (tenant, taxi_id)
+                    REFERENCES taxi_location (tenant, taxi_id) ON DELETE CASCADE;
+                ALTER TABLE counters ADD FOREIGN KEY (tenant, taxi_id)
+                    REFERENCES taxi_location (tenant, taxi_id) ON DELETE CASCADE;
+            END IF;
+        END $$`,
+        `CREATE TABLE IF NOT EXISTS mapping_state (
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            place_id INTEGER,
+            processed_at TIMESTAMP,
+            last_history_id BIGINT,
+            PRIMARY KEY(tenant, taxi_id),
+            FOREIGN KEY(tenant, taxi_id) REFERENCES taxi_location(tenant, taxi_id) ON DELETE CASCADE,
+            FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE SET NULL
+        )`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS offline_since TIMESTAMP`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS device_time TIMESTAMPTZ`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS fleet VARCHAR`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS smoothed_longitude DOUBLE PRECISION`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS smoothed_latitude DOUBLE PRECISION`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS smoothed_variance DOUBLE PRECISION`,
+        `ALTER TABLE taxi_location ADD COLUMN IF NOT EXISTS h3_cell BIGINT`,
+        `CREATE INDEX IF NOT EXISTS taxi_location_h3_cell ON taxi_location (h3_cell)`,
+        `CREATE TABLE IF NOT EXISTS location_archive (
+            archive_id SERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            longitude DOUBLE PRECISION,
+            latitude DOUBLE PRECISION,
+            device_time TIMESTAMPTZ,
+            received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            reason VARCHAR
+        )`,
+        `CREATE TABLE IF NOT EXISTS location_quarantine (
+            quarantine_id SERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            longitude DOUBLE PRECISION,
+            latitude DOUBLE PRECISION,
+            device_time TIMESTAMPTZ,
+            reason VARCHAR,
+            received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+        `CREATE TABLE IF NOT EXISTS location_history (
+            history_id BIGSERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            longitude DOUBLE PRECISION,
+            latitude DOUBLE PRECISION,
+            smoothed_longitude DOUBLE PRECISION,
+            smoothed_latitude DOUBLE PRECISION,
+            device_time TIMESTAMPTZ,
+            recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+        `CREATE INDEX IF NOT EXISTS location_history_taxi_time ON location_history (tenant, taxi_id, device_time)`,
+        `ALTER TABLE location_history ADD COLUMN IF NOT EXISTS h3_cell BIGINT`,
+        `CREATE INDEX IF NOT EXISTS location_history_h3_cell ON location_history (h3_cell, device_time)`,
+        `CREATE TABLE IF NOT EXISTS place_cells (
+            place_id INTEGER,
+            cell BIGINT,
+            PRIMARY KEY(place_id, cell),
+            FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE CASCADE
+        )`,
+        `CREATE INDEX IF NOT EXISTS place_cells_cell ON place_cells (cell)`,
+        `CREATE TABLE IF NOT EXISTS api_keys (
+            key_id SERIAL PRIMARY KEY,
+            name VARCHAR,
+            scopes TEXT[],
+            key_hash VARCHAR UNIQUE,
+            previous_hash VARCHAR,
+            previous_expires_at TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            rotated_at TIMESTAMP,
+            revoked_at TIMESTAMP
+        )`,
+        `CREATE INDEX IF NOT EXISTS api_keys_previous_hash ON api_keys (previous_hash)`,
+        // Tenant columns. Tables keyed only by a place (place_cells,
+        // occupancy_*) inherit the tenant of that place.
+        `ALTER TABLE places ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT 'default'`,
+        `ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT 'default'`,
+        `CREATE INDEX IF NOT EXISTS places_tenant ON places (tenant)`,
+        `ALTER TABLE places ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+        // place_outline converts a place's GeoJSON outer ring to a POLYGON so
+        // ?bbox= can test for intersection with the && operator
+        `CREATE OR REPLACE FUNCTION place_outline(geometry JSONB) RETURNS POLYGON AS $$
+            SELECT ('(' || string_agg('(' || (c->>0) || ',' || (c->>1) || ')', ',' ORDER BY n) || ')')::polygon
+            FROM jsonb_array_elements(CASE WHEN geometry->>'type' = 'Polygon'
+                AND jsonb_typeof(geometry->'coordinates'->0) = 'array'
+                THEN geometry->'coordinates'->0 ELSE '[]' END) WITH ORDINALITY AS ring(c, n)
+        $$ LANGUAGE SQL IMMUTABLE`,
+        `CREATE TABLE IF NOT EXISTS audit_log (
+            audit_id BIGSERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL,
+            actor VARCHAR,
+            action VARCHAR,
+            target_type VARCHAR,
+            target_id VARCHAR,
+            before JSONB,
+            after JSONB,
+            request_id VARCHAR,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+        `CREATE INDEX IF NOT EXISTS audit_log_target ON audit_log (target_type, target_id)`,
+        // The trigger stops the service from updating or deleting audit
+        // entries. It does not bind the table's owner, who can drop it; for a
+        // tamper-proof log hand audit_log and the trigger to a separate role
+        // and grant the service user only INSERT and SELECT. The trigger is
+        // therefore created once and never replaced.
+        `DO $$ BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_trigger
+                WHERE tgname = 'audit_log_append_only' AND tgrelid = 'audit_log'::regclass) THEN
+                CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $fn$
+                BEGIN
+                    RAISE EXCEPTION 'audit_log is append-only';
+                END
+                $fn$ LANGUAGE plpgsql;
+                CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+                    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+            END IF;
+        END $$`,
+        `CREATE TABLE IF NOT EXISTS segments (
+            segment_id SERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            kind VARCHAR,
+            start_time TIMESTAMPTZ,
+            end_time TIMESTAMPTZ,
+            start_longitude DOUBLE PRECISION,
+            start_latitude DOUBLE PRECISION,
+            end_longitude DOUBLE PRECISION,
+            end_latitude DOUBLE PRECISION,
+            start_place_id INTEGER,
+            end_place_id INTEGER,
+            distance_meters DOUBLE PRECISION,
+            duration_seconds DOUBLE PRECISION,
+            FOREIGN KEY(tenant, taxi_id) REFERENCES taxi_location(tenant, taxi_id) ON DELETE CASCADE,
+            FOREIGN KEY(start_place_id) REFERENCES places(place_id) ON DELETE SET NULL,
+            FOREIGN KEY(end_place_id) REFERENCES places(place_id) ON DELETE SET NULL
+        )`,
+        `CREATE INDEX IF NOT EXISTS segments_taxi_start ON segments (tenant, taxi_id, start_time)`,
+        `CREATE TABLE IF NOT EXISTS segmentation_state (
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            processed_until TIMESTAMPTZ,
+            last_history_id BIGINT,
+            PRIMARY KEY(tenant, taxi_id),
+            FOREIGN KEY(tenant, taxi_id) REFERENCES taxi_location(tenant, taxi_id) ON DELETE CASCADE
+        )`,
+        `CREATE TABLE IF NOT EXISTS place_visits (
+            visit_id BIGSERIAL PRIMARY KEY,
+            tenant VARCHAR NOT NULL,
+            taxi_id VARCHAR,
+            place_id INTEGER,
+            entered_at TIMESTAMPTZ,
+            left_at TIMESTAMPTZ,
+            FOREIGN KEY(tenant, taxi_id) REFERENCES taxi_location(tenant, taxi_id) ON DELETE CASCADE,
+            FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE CASCADE
+        )`,
+        `CREATE INDEX IF NOT EXISTS place_visits_place_entered ON place_visits (place_id, entered_at)`,
+        `CREATE INDEX IF NOT EXISTS place_visits_taxi_entered ON place_visits (tenant, taxi_id, entered_at)`,
+        `CREATE INDEX IF NOT EXISTS mapping_taxi_timestamp ON mapping (tenant, taxi_id, timestamp)`,
+        `CREATE TABLE IF NOT EXISTS occupancy_samples (
+            place_id INTEGER,
+            sampled_at TIMESTAMPTZ,
+            vehicles INTEGER,
+            PRIMARY KEY(place_id, sampled_at),
+            FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE CASCADE
+        )`,
+        `CREATE TABLE IF NOT EXISTS occupancy_rollups (
+            place_id INTEGER,
+            step VARCHAR,
+            bucket_start TIMESTAMPTZ,
+            min_vehicles INTEGER,
+            avg_vehicles DOUBLE PRECISION,
+            max_vehicles INTEGER,
+            samples INTEGER,
+            PRIMARY KEY(place_id, step, bucket_start),
             FOREIGN KEY(place_id) REFERENCES places(place_id) ON DELETE CASCADE
         )`,
     }
@@ -144,44 +459,106 @@ func initTables() {
 // createTaxiLocation handles the creation of a new taxi location
 func createTaxiLocation(w http.ResponseWriter, r *http.Request) {
     var location TaxiLocation
-    if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &location) {
         return
     }
 
-    _, err := db.Exec(`INSERT INTO taxi_location (taxi_id, longitude, latitude, updated_at) 
-        VALUES ($1, $2, $3, CURRENT_TIMESTAMP) 
-        ON CONFLICT (taxi_id) DO NOTHING`,
-        location.TaxiID, location.Longitude, location.Latitude)
+    tx, err := db.Begin()
     if err != nil {
-        http.Error(w, "Failed to create taxi location", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to create taxi location")
         return
     }
-    w.WriteHeader(http.StatusCreated)
-    fmt.Fprintf(w, "Taxi location created.")
+    defer tx.Rollback()
+
+    tenant := writeTenant(r)
+    var after []byte
+    err = tx.QueryRow(`INSERT INTO taxi_location (taxi_id, longitude, latitude, updated_at, fleet, tenant) 
+        VALUES ($1, $2, $3, CURRENT_TIMESTAMP, NULLIF($4, ''), $5) 
+        ON CONFLICT (tenant, taxi_id) DO NOTHING
+        RETURNING to_jsonb(taxi_location.*)`,
+        location.TaxiID, location.Longitude, location.Latitude, location.Fleet, tenant).Scan(&after)
+    // An existing taxi of the tenant is left untouched
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusConflict, taxiIDUnavailable)
+        return
+    }
+    if err == nil {
+        err = recordAudit(tx, r, tenant, "taxi.create", "taxi", location.TaxiID, nil, after)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create taxi location")
+        return
+    }
+    writeMessage(w, r, http.StatusCreated, "Taxi location created.")
 }
 
-// getAllTaxiLocations retrieves all taxi locations
+// taxiSorts are the ?sort= options of getAllTaxiLocations
+var taxiSorts = map[string]sortOption{
+    "taxi_id":    {Expr: "taxi_id", Type: "VARCHAR", Tiebreak: "taxi_id"},
+    "updated_at": {Expr: "COALESCE(updated_at, TIMESTAMP 'epoch')", Type: "TIMESTAMP", Tiebreak: "taxi_id"},
+}
+
+// getAllTaxiLocations lists taxi locations a page at a time, optionally
+// filtered by ?bbox=, ?taxi_id=, ?place_id= (the place a taxi is mapped to)
+// and ?updated_since=
 func getAllTaxiLocations(w http.ResponseWriter, r *http.Request) {
-    rows, err := db.Query("SELECT taxi_id, longitude, latitude FROM taxi_location")
+    page, err := parsePage(r, taxiSorts, "taxi_id")
     if err != nil {
-        http.Error(w, "Failed to query taxi locations", http.StatusInternalServerError)
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    filters, err := parseListFilters(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    var f sqlFilter
+    f.tenant("tenant", requestTenant(r))
+    if len(filters.BBox) == 4 {
+        f.where("longitude BETWEEN %s AND %s AND latitude BETWEEN %s AND %s",
+            filters.BBox[0], filters.BBox[2], filters.BBox[1], filters.BBox[3])
+    }
+    if len(filters.TaxiIDs) > 0 {
+        f.where("taxi_id = ANY(%s)", pq.Array(filters.TaxiIDs))
+    }
+    if len(filters.PlaceIDs) > 0 {
+        f.where("(tenant, taxi_id) IN (SELECT tenant, taxi_id FROM mapping_state WHERE place_id = ANY(%s))", pq.Array(filters.PlaceIDs))
+    }
+    if filters.UpdatedSince != nil {
+        f.where("updated_at >= %s", *filters.UpdatedSince)
+    }
+    suffix := page.apply(&f)
+
+    rows, err := db.Query("SELECT taxi_id, longitude, latitude, COALESCE(fleet, ''), tenant, "+vehicleAgeSQL+", "+
+        page.sortKeySQL()+" FROM taxi_location"+f.clause()+suffix, f.args...)
+    if err != nil {
+        log.Println("Error querying taxi locations:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query taxi locations")
         return
     }
     defer rows.Close()
 
-    var taxis []TaxiLocation
+    taxis := []TaxiLocation{}
+    var keys [][2]string
     for rows.Next() {
         var taxi TaxiLocation
-        if err := rows.Scan(&taxi.TaxiID, &taxi.Longitude, &taxi.Latitude); err != nil {
-            http.Error(w, "Failed to scan taxi location", http.StatusInternalServerError)
+        var age sql.NullFloat64
+        var key [2]string
+        if err := rows.Scan(&taxi.TaxiID, &taxi.Longitude, &taxi.Latitude, &taxi.Fleet, &taxi.Tenant, &age, &key[0], &key[1]); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan taxi location")
             return
         }
+        taxi.Status = statusFromAge(age)
         taxis = append(taxis, taxi)
+        keys = append(keys, key)
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(taxis)
+    n, next := page.nextCursor(len(taxis), keys)
+    writePage(w, r, taxis[:n], next)
 }
 
 // getTaxiLocation retrieves a single taxi location by ID
@@ -190,14 +567,18 @@ func getTaxiLocation(w http.ResponseWriter, r *http.Request) {
     taxiID := vars["id"]
 
     var taxi TaxiLocation
-    err := db.QueryRow("SELECT taxi_id, longitude, latitude FROM taxi_location WHERE taxi_id = $1", taxiID).Scan(&taxi.TaxiID, &taxi.Longitude, &taxi.Latitude)
+    var age sql.NullFloat64
+    err := db.QueryRow("SELECT taxi_id, longitude, latitude, COALESCE(fleet, ''), tenant, "+vehicleAgeSQL+
+        " FROM taxi_location WHERE taxi_id = $1 AND tenant = $2", taxiID, taxiTenant(r)).
+        Scan(&taxi.TaxiID, &taxi.Longitude, &taxi.Latitude, &taxi.Fleet, &taxi.Tenant, &age)
     if err == sql.ErrNoRows {
-        http.Error(w, "Taxi not found", http.StatusNotFound)
+        writeError(w, r, http.StatusNotFound, "Taxi not found")
         return
     } else if err != nil {
-        http.Error(w, "Failed to query taxi location", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query taxi location")
         return
     }
+    taxi.Status = statusFromAge(age)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(taxi)
@@ -209,30 +590,47 @@ func updateTaxiLocationCRUD(w http.ResponseWriter, r *http.Request) {
     taxiID := vars["id"]
 
     var location TaxiLocation
-    if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &location) {
         return
     }
 
-    res, err := db.Exec(`UPDATE taxi_location SET longitude = $1, latitude = $2, updated_at = CURRENT_TIMESTAMP 
-        WHERE taxi_id = $3`,
-        location.Longitude, location.Latitude, taxiID)
+    tx, err := db.Begin()
     if err != nil {
-        http.Error(w, "Failed to update taxi location", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to update taxi location")
         return
     }
+    defer tx.Rollback()
 
-    rowsAffected, err := res.RowsAffected()
+    tenant := taxiTenant(r)
+    var before, after []byte
+    err = tx.QueryRow("SELECT to_jsonb(taxi_location.*) FROM taxi_location WHERE taxi_id = $1 AND tenant = $2 FOR UPDATE",
+        taxiID, tenant).Scan(&before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "Taxi not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update taxi location")
+        return
+    }
+
+    err = tx.QueryRow(`UPDATE taxi_location SET longitude = $1, latitude = $2, updated_at = CURRENT_TIMESTAMP, offline_since = NULL
+        WHERE taxi_id = $3 AND tenant = $4
+        RETURNING to_jsonb(taxi_location.*)`,
+        location.Longitude, location.Latitude, taxiID, tenant).Scan(&after)
     if err != nil {
-        http.Error(w, "Failed to retrieve update status", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to update taxi location")
+        return
+    }
+    if err := recordAudit(tx, r, tenant, "taxi.update", "taxi", taxiID, before, after); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update taxi location")
         return
     }
-    if rowsAffected == 0 {
-        http.Error(w, "Taxi not found", http.StatusNotFound)
+    if err := tx.Commit(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update taxi location")
         return
     }
 
-    fmt.Fprintf(w, "Taxi location updated.")
+    writeMessage(w, r, http.StatusOK, "Taxi location updated.")
 }
 
 // deleteTaxiLocation deletes a taxi location by ID
@@ -240,23 +638,34 @@ func deleteTaxiLocation(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     taxiID := vars["id"]
 
-    res, err := db.Exec("DELETE FROM taxi_location WHERE taxi_id = $1", taxiID)
+    tx, err := db.Begin()
     if err != nil {
-        http.Error(w, "Failed to delete taxi location", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete taxi location")
         return
     }
+    defer tx.Rollback()
 
-    rowsAffected, err := res.RowsAffected()
-    if err != nil {
-        http.Error(w, "Failed to retrieve delete status", http.StatusInternalServerError)
+    tenant := taxiTenant(r)
+    var before []byte
+    err = tx.QueryRow("DELETE FROM taxi_location WHERE taxi_id = $1 AND tenant = $2 RETURNING to_jsonb(taxi_location.*)",
+        taxiID, tenant).Scan(&before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "Taxi not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete taxi location")
         return
     }
-    if rowsAffected == 0 {
-        http.Error(w, "Taxi not found", http.StatusNotFound)
+    if err := recordAudit(tx, r, tenant, "taxi.delete", "taxi", taxiID, before, nil); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete taxi location")
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete taxi location")
         return
     }
 
-    fmt.Fprintf(w, "Taxi location deleted.")
+    writeMessage(w, r, http.StatusOK, "Taxi location deleted.")
 }
 
 //////////////////////
@@ -266,47 +675,109 @@ func deleteTaxiLocation(w http.ResponseWriter, r *http.Request) {
 // createPlace handles the creation of a new place
 func createPlace(w http.ResponseWriter, r *http.Request) {
     var place Place
-    if err := json.NewDecoder(r.Body).Decode(&place); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &place) {
         return
     }
 
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create place")
+        return
+    }
+    defer tx.Rollback()
+
     var placeID int
-    err := db.QueryRow(`INSERT INTO places (place_name, polygon) 
-        VALUES ($1, $2) RETURNING place_id`,
-        place.PlaceName, place.Polygon).Scan(&placeID)
+    var after []byte
+    place.Tenant = writeTenant(r)
+    err = tx.QueryRow(`INSERT INTO places (place_name, polygon, tenant) 
+        VALUES ($1, $2, $3) RETURNING place_id, to_jsonb(places.*)`,
+        place.PlaceName, place.Polygon, place.Tenant).Scan(&placeID, &after)
     if err != nil {
-        http.Error(w, "Failed to create place", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to create place")
+        return
+    }
+    if err := recordAudit(tx, r, place.Tenant, "place.create", "place", strconv.Itoa(placeID), nil, after); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create place")
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create place")
         return
     }
 
     place.PlaceID = placeID
+    if err := coverPlace(placeID, place.Polygon); err != nil {
+        log.Printf("Failed to cover Place ID %d: %v\n", placeID, err)
+    }
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(place)
 }
 
-// getAllPlaces retrieves all places
+// placeSorts are the ?sort= options of getAllPlaces
+var placeSorts = map[string]sortOption{
+    "place_id": {Expr: "place_id", Type: "INTEGER", Tiebreak: "place_id"},
+    "name":     {Expr: "COALESCE(place_name, '')", Type: "VARCHAR", Tiebreak: "place_id"},
+}
+
+// getAllPlaces lists places a page at a time, optionally filtered by
+// ?place_id=, ?bbox= (places whose polygon intersects the box) and a ?q= name
+// search. ?deleted=true lists soft-deleted places instead.
 func getAllPlaces(w http.ResponseWriter, r *http.Request) {
-    rows, err := db.Query("SELECT place_id, place_name, polygon FROM places")
+    page, err := parsePage(r, placeSorts, "place_id")
     if err != nil {
-        http.Error(w, "Failed to query places", http.StatusInternalServerError)
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    filters, err := parseListFilters(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    var f sqlFilter
+    f.tenant("tenant", requestTenant(r))
+    f.where("(deleted_at IS NOT NULL) = %s", r.URL.Query().Get("deleted") == "true")
+    if len(filters.PlaceIDs) > 0 {
+        f.where("place_id = ANY(%s)", pq.Array(filters.PlaceIDs))
+    }
+    if len(filters.BBox) == 4 {
+        f.where("place_outline(polygon) && polygon(box(point(%s, %s), point(%s, %s)))",
+            filters.BBox[0], filters.BBox[1], filters.BBox[2], filters.BBox[3])
+    }
+    if filters.Name != "" {
+        f.where("place_name ILIKE %s", likePattern(filters.Name))
+    }
+    suffix := page.apply(&f)
+
+    rows, err := db.Query("SELECT place_id, place_name, tenant, polygon, deleted_at, "+page.sortKeySQL()+
+        " FROM places"+f.clause()+suffix, f.args...)
+    if err != nil {
+        log.Println("Error querying places:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query places")
         return
     }
     defer rows.Close()
 
-    var places []Place
+    places := []Place{}
+    var keys [][2]string
     for rows.Next() {
         var place Place
-        if err := rows.Scan(&place.PlaceID, &place.PlaceName, &place.Polygon); err != nil {
-            http.Error(w, "Failed to scan place", http.StatusInternalServerError)
+        var deletedAt sql.NullTime
+        var key [2]string
+        if err := rows.Scan(&place.PlaceID, &place.PlaceName, &place.Tenant, &place.Polygon, &deletedAt, &key[0], &key[1]); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan place")
             return
         }
+        if deletedAt.Valid {
+            place.DeletedAt = &deletedAt.Time
+        }
         places = append(places, place)
+        keys = append(keys, key)
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(places)
+    n, next := page.nextCursor(len(places), keys)
+    writePage(w, r, places[:n], next)
 }
 
 // getPlace retrieves a single place by ID
@@ -315,18 +786,20 @@ func getPlace(w http.ResponseWriter, r *http.Request) {
     idStr := vars["id"]
     placeID, err := strconv.Atoi(idStr)
     if err != nil {
-        http.Error(w, "Invalid place ID", http.StatusBadRequest)
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
         return
     }
 
     var place Place
-    err = db.QueryRow("SELECT place_id, place_name, polygon FROM places WHERE place_id = $1", placeID).
-        Scan(&place.PlaceID, &place.PlaceName, &place.Polygon)
+    err = db.QueryRow("SELECT place_id, place_name, tenant, polygon FROM places WHERE place_id = $1 AND deleted_at IS NULL AND "+
+        tenantClause("tenant", 2),
+        placeID, requestTenant(r)).
+        Scan(&place.PlaceID, &place.PlaceName, &place.Tenant, &place.Polygon)
     if err == sql.ErrNoRows {
-        http.Error(w, "Place not found", http.StatusNotFound)
+        writeError(w, r, http.StatusNotFound, "Place not found")
         return
     } else if err != nil {
-        http.Error(w, "Failed to query place", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query place")
         return
     }
 
@@ -340,156 +813,384 @@ func updatePlace(w http.ResponseWriter, r *http.Request) {
     idStr := vars["id"]
     placeID, err := strconv.Atoi(idStr)
     if err != nil {
-        http.Error(w, "Invalid place ID", http.StatusBadRequest)
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
         return
     }
 
     var place Place
-    if err := json.NewDecoder(r.Body).Decode(&place); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &place) {
         return
     }
 
-    res, err := db.Exec(`UPDATE places SET place_name = $1, polygon = $2 WHERE place_id = $3`,
-        place.PlaceName, place.Polygon, placeID)
+    tx, err := db.Begin()
     if err != nil {
-        http.Error(w, "Failed to update place", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to update place")
         return
     }
+    defer tx.Rollback()
 
-    rowsAffected, err := res.RowsAffected()
+    var tenant string
+    var before, after []byte
+    err = tx.QueryRow("SELECT tenant, to_jsonb(places.*) FROM places WHERE place_id = $1 AND deleted_at IS NULL AND "+
+        tenantClause("tenant", 2)+" FOR UPDATE", placeID, requestTenant(r)).Scan(&tenant, &before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "Place not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update place")
+        return
+    }
+
+    err = tx.QueryRow(`UPDATE places SET place_name = $1, polygon = $2 WHERE place_id = $3 RETURNING to_jsonb(places.*)`,
+        place.PlaceName, place.Polygon, placeID).Scan(&after)
     if err != nil {
-        http.Error(w, "Failed to retrieve update status", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to update place")
+        return
+    }
+    if err := recordAudit(tx, r, tenant, "place.update", "place", idStr, before, after); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update place")
         return
     }
-    if rowsAffected == 0 {
-        http.Error(w, "Place not found", http.StatusNotFound)
+    if err := tx.Commit(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update place")
         return
     }
+    if err := coverPlace(placeID, place.Polygon); err != nil {
+        log.Printf("Failed to cover Place ID %d: %v\n", placeID, err)
+    }
 
-    fmt.Fprintf(w, "Place updated.")
+    writeMessage(w, r, http.StatusOK, "Place updated.")
 }
 
-// deletePlace deletes a place by ID
+// deletePlace deletes a place by ID. By default the place is only marked
+// deleted: it stops capturing taxis but keeps its mappings, counters and
+// history and can be restored. ?hard=true removes it together with them.
 func deletePlace(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     idStr := vars["id"]
     placeID, err := strconv.Atoi(idStr)
     if err != nil {
-        http.Error(w, "Invalid place ID", http.StatusBadRequest)
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
         return
     }
+    hard := r.URL.Query().Get("hard") == "true"
 
-    res, err := db.Exec("DELETE FROM places WHERE place_id = $1", placeID)
+    tx, err := db.Begin()
     if err != nil {
-        http.Error(w, "Failed to delete place", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete place")
         return
     }
+    defer tx.Rollback()
 
-    rowsAffected, err := res.RowsAffected()
+    // A soft-deleted place can still be purged
+    var tenant string
+    var before, after []byte
+    err = tx.QueryRow("SELECT tenant, to_jsonb(places.*) FROM places WHERE place_id = $1 AND (deleted_at IS NULL OR $3) AND "+
+        tenantClause("tenant", 2)+" FOR UPDATE", placeID, requestTenant(r), hard).Scan(&tenant, &before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "Place not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete place")
+        return
+    }
+
+    action := "place.delete"
+    if hard {
+        action = "place.purge"
+        _, err = tx.Exec("DELETE FROM places WHERE place_id = $1", placeID)
+    } else {
+        err = tx.QueryRow("UPDATE places SET deleted_at = CURRENT_TIMESTAMP WHERE place_id = $1 RETURNING to_jsonb(places.*)",
+            placeID).Scan(&after)
+        // Vehicles inside the place are released as if it had been removed
+        if err == nil {
+            _, err = tx.Exec("UPDATE mapping_state SET place_id = NULL WHERE place_id = $1", placeID)
+        }
+        if err == nil {
+            _, err = tx.Exec("UPDATE place_visits SET left_at = CURRENT_TIMESTAMP WHERE place_id = $1 AND left_at IS NULL", placeID)
+        }
+    }
+    if err == nil {
+        err = recordAudit(tx, r, tenant, action, "place", idStr, before, after)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to delete place")
+        return
+    }
+    refreshOccupancy()
+
+    writeMessage(w, r, http.StatusOK, "Place deleted.")
+}
+
+// restorePlace handles POST /place/{id}/restore, undoing a soft delete
+func restorePlace(w http.ResponseWriter, r *http.Request) {
+    idStr := mux.Vars(r)["id"]
+    placeID, err := strconv.Atoi(idStr)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
+        return
+    }
+
+    tx, err := db.Begin()
     if err != nil {
-        http.Error(w, "Failed to retrieve delete status", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to restore place")
         return
     }
-    if rowsAffected == 0 {
-        http.Error(w, "Place not found", http.StatusNotFound)
+    defer tx.Rollback()
+
+    var tenant string
+    var before, after []byte
+    err = tx.QueryRow("SELECT tenant, to_jsonb(places.*) FROM places WHERE place_id = $1 AND deleted_at IS NOT NULL AND "+
+        tenantClause("tenant", 2)+" FOR UPDATE", placeID, requestTenant(r)).Scan(&tenant, &before)
+    if err == sql.ErrNoRows {
+        writeError(w, r, http.StatusNotFound, "Deleted place not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to restore place")
         return
     }
 
-    fmt.Fprintf(w, "Place deleted.")
+    err = tx.QueryRow("UPDATE places SET deleted_at = NULL WHERE place_id = $1 RETURNING to_jsonb(places.*)", placeID).Scan(&after)
+    if err == nil {
+        err = recordAudit(tx, r, tenant, "place.restore", "place", idStr, before, after)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to restore place")
+        return
+    }
+
+    writeMessage(w, r, http.StatusOK, "Place restored.")
 }
 
 //////////////////////
 // Existing Functions
 //////////////////////
 
-// updateTaxiLocation handles updating a taxi location via the /updateLocation endpoint
+// updateTaxiLocation handles updating a taxi location via the /updateLocation endpoint.
+// The response reports whether the location was applied, ignored as a duplicate
+// or archived because it is older than the stored one.
 func updateTaxiLocation(w http.ResponseWriter, r *http.Request) {
     var location TaxiLocation
-    if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !decodeJSON(w, r, &location) {
         return
     }
-
-    res, err := db.Exec(`INSERT INTO taxi_location (taxi_id, longitude, latitude, updated_at) 
-        VALUES ($1, $2, $3, CURRENT_TIMESTAMP) 
-        ON CONFLICT (taxi_id) DO UPDATE 
-        SET longitude = EXCLUDED.longitude, latitude = EXCLUDED.latitude, updated_at = CURRENT_TIMESTAMP`,
-        location.TaxiID, location.Longitude, location.Latitude)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    location.Tenant = writeTenant(r)
+    if err := validateLocation(location); err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
         return
     }
 
-    rowsAffected, err := res.RowsAffected()
+    decision, err := storeLocation(location)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        log.Printf("Failed to store location for Taxi ID %s: %v\n", location.TaxiID, err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to store location")
         return
     }
-    if rowsAffected == 0 {
-        http.Error(w, "Taxi not found", http.StatusNotFound)
-        return
+
+    if decision.Decision == DecisionApplied {
+        events.Publish(Event{
+            Type:      EventVehiclePosition,
+            Tenant:    location.Tenant,
+            TaxiID:    location.TaxiID,
+            Longitude: location.Longitude,
+            Latitude:  location.Latitude,
+            Timestamp: decision.Timestamp,
+        })
     }
 
-    fmt.Fprintf(w, "Taxi location updated.")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(decision)
 }
 
-// mapTaxiLocations assigns taxis to places based on their current locations
+// mapTaxiLocations assigns taxis to places based on their location history.
+// Only taxis whose taxi_location.updated_at is newer than the watermark kept in
+// mapping_state are processed. Every history point reported since the last
+// run is replayed in order, so visits open and close at the device time of
+// the fix that crossed the boundary rather than at the time of the run. A
+// visit is only counted when a taxi enters a place it was not already in.
+// Offline taxis are skipped and taxis of fleets with smoothing enabled are
+// placed by their smoothed position. A taxi is only matched against the
+// places of its own tenant.
 func mapTaxiLocations() {
-    rows, err := db.Query("SELECT taxi_id, longitude, latitude FROM taxi_location")
+    rows, err := db.Query(`SELECT t.taxi_id, t.tenant, COALESCE(t.smoothed_longitude, t.longitude),
+        COALESCE(t.smoothed_latitude, t.latitude), t.updated_at, COALESCE(t.device_time, t.updated_at::timestamptz),
+        s.place_id, s.last_history_id
+        FROM taxi_location t
+        LEFT JOIN mapping_state s ON s.tenant = t.tenant AND s.taxi_id = t.taxi_id
+        WHERE (s.taxi_id IS NULL OR s.processed_at IS NULL OR t.updated_at > s.processed_at)
+        AND t.updated_at >= CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'`,
+        offlineAfter.Seconds())
     if err != nil {
         log.Println("Error querying taxi locations:", err)
         return
     }
-    defer rows.Close()
 
+    type pendingTaxi struct {
+        taxiID        string
+        tenant        string
+        longitude     float64
+        latitude      float64
+        updatedAt     time.Time
+        fixedAt       time.Time
+        lastPlace     sql.NullInt64
+        lastHistoryID sql.NullInt64
+    }
+
+    // Collect the batch first so the queries below do not compete with this cursor for a connection
+    var pending []pendingTaxi
     for rows.Next() {
-        var taxiID string
-        var longitude, latitude float64
-        if err := rows.Scan(&taxiID, &longitude, &latitude); err != nil {
+        var taxi pendingTaxi
+        err := rows.Scan(&taxi.taxiID, &taxi.tenant, &taxi.longitude, &taxi.latitude, &taxi.updatedAt, &taxi.fixedAt,
+            &taxi.lastPlace, &taxi.lastHistoryID)
+        if err != nil {
             log.Println("Error scanning taxi location:", err)
             continue
         }
+        pending = append(pending, taxi)
+    }
+    if err = rows.Err(); err != nil {
+        log.Println("Row iteration error:", err)
+    }
+    rows.Close()
+
+    log.Printf("Mapping %d moved or new taxis\n", len(pending))
+
+    // Places are loaded once per tenant and run
+    shapes := make(map[string][]placeShape)
+    for _, taxi := range pending {
+        places, ok := shapes[taxi.tenant]
+        if !ok {
+            places, err = loadPlaceShapes(taxi.tenant)
+            if err != nil {
+                // Leave the watermark untouched so the taxi is retried on the next run
+                log.Printf("Failed to resolve place for Taxi ID %s: %v\n", taxi.taxiID, err)
+                continue
+            }
+            shapes[taxi.tenant] = places
+        }
 
-        log.Printf("Processing Taxi ID %s at (%f, %f)\n", taxiID, longitude, latitude)
-        placeID, err := findPlace(longitude, latitude)
+        points, err := newHistoryPoints(taxi.tenant, taxi.taxiID, taxi.lastHistoryID)
         if err != nil {
-            log.Printf("No matching place found for Taxi ID %s at (%f, %f): %v\n", taxiID, longitude, latitude, err)
+            log.Printf("Failed to load location history of Taxi ID %s: %v\n", taxi.taxiID, err)
             continue
         }
-        log.Printf("Mapping Taxi ID %s to Place ID %d\n", taxiID, placeID)
-        updateMappingAndCounter(taxiID, placeID)
+        if len(points) == 0 {
+            // The taxi moved without a history row, e.g. through PUT /taxi/{id}
+            points = []historyPoint{{longitude: taxi.longitude, latitude: taxi.latitude, at: taxi.fixedAt}}
+        }
+
+        log.Printf("Processing %d positions of Taxi ID %s\n", len(points), taxi.taxiID)
+        currentPlace := taxi.lastPlace
+        lastHistoryID := taxi.lastHistoryID
+        for _, point := range points {
+            var place sql.NullInt64
+            if placeID, ok := placeContaining(places, point.longitude, point.latitude); ok {
+                place = sql.NullInt64{Int64: int64(placeID), Valid: true}
+            }
+            if place != currentPlace {
+                recordPlaceTransition(taxi.tenant, taxi.taxiID, currentPlace, place, point.at)
+                if place.Valid {
+                    log.Printf("Mapping Taxi ID %s to Place ID %d\n", taxi.taxiID, place.Int64)
+                    updateMappingAndCounter(taxi.tenant, taxi.taxiID, int(place.Int64))
+                    events.Publish(Event{
+                        Type:      EventPlaceAssigned,
+                        Tenant:    taxi.tenant,
+                        TaxiID:    taxi.taxiID,
+                        PlaceID:   int(place.Int64),
+                        Longitude: point.longitude,
+                        Latitude:  point.latitude,
+                        Timestamp: point.at,
+                    })
+                }
+                currentPlace = place
+            }
+            if point.historyID != 0 {
+                lastHistoryID = sql.NullInt64{Int64: point.historyID, Valid: true}
+            }
+        }
+
+        _, err = db.Exec(`INSERT INTO mapping_state (tenant, taxi_id, place_id, processed_at, last_history_id)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (tenant, taxi_id) DO UPDATE
+            SET place_id = EXCLUDED.place_id, processed_at = EXCLUDED.processed_at,
+                last_history_id = EXCLUDED.last_history_id`,
+            taxi.tenant, taxi.taxiID, currentPlace, taxi.updatedAt, lastHistoryID)
+        if err != nil {
+            log.Printf("Failed to store mapping state for Taxi ID %s: %v\n", taxi.taxiID, err)
+        }
     }
 
-    if err = rows.Err(); err != nil {
-        log.Println("Row iteration error:", err)
+    refreshOccupancy()
+}
+
+// historyPoint is one position replayed by mapTaxiLocations
+type historyPoint struct {
+    historyID int64
+    longitude float64
+    latitude  float64
+    at        time.Time
+}
+
+// newHistoryPoints returns the positions a taxi reported after the history row
+// afterID, oldest first. A taxi that was never replayed (afterID NULL) starts
+// from its latest position rather than its whole history.
+func newHistoryPoints(tenant, taxiID string, afterID sql.NullInt64) ([]historyPoint, error) {
+    rows, err := db.Query(`SELECT history_id, COALESCE(smoothed_longitude, longitude),
+        COALESCE(smoothed_latitude, latitude), device_time
+        FROM location_history
+        WHERE tenant = $1 AND taxi_id = $2
+        AND history_id > COALESCE($3, (SELECT MAX(history_id) - 1 FROM location_history WHERE tenant = $1 AND taxi_id = $2))
+        ORDER BY history_id`, tenant, taxiID, afterID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var points []historyPoint
+    for rows.Next() {
+        var point historyPoint
+        if err := rows.Scan(&point.historyID, &point.longitude, &point.latitude, &point.at); err != nil {
+            return nil, err
+        }
+        points = append(points, point)
     }
+    return points, rows.Err()
 }
 
-// findPlace determines which place a given point belongs to
-func findPlace(longitude, latitude float64) (int, error) {
-    rows, err := db.Query("SELECT place_id, polygon FROM places")
+// placeShape is a place's outer ring, ready for point-in-polygon tests
+type placeShape struct {
+    placeID int
+    polygon orb.Polygon
+}
+
+// loadPlaceShapes returns the polygons of a tenant's live places
+func loadPlaceShapes(tenant string) ([]placeShape, error) {
+    rows, err := db.Query("SELECT place_id, polygon FROM places WHERE tenant = $1 AND deleted_at IS NULL", tenant)
     if err != nil {
         log.Println("Error querying places:", err)
-        return 0, err
+        return nil, err
     }
     defer rows.Close()
 
-    point := orb.Point{longitude, latitude}
-    log.Printf("Checking point (%f, %f)\n", longitude, latitude) // Debug: show point being checked
-
+    var places []placeShape
     for rows.Next() {
         var placeID int
         var polygonData []byte
         if err := rows.Scan(&placeID, &polygonData); err != nil {
             log.Println("Error scanning place data:", err)
-            return 0, err
+            return nil, err
         }
 
         var geometry GeoJSONGeometry
         if err := json.Unmarshal(polygonData, &geometry); err != nil {
             log.Println("Error unmarshalling GeoJSON Geometry:", err)
-            return 0, err
+            return nil, err
         }
 
         if geometry.Type != "Polygon" {
@@ -510,24 +1211,26 @@ func findPlace(longitude, latitude float64) (int, error) {
                 ring = append(ring, orb.Point{coord[0], coord[1]})
             }
         }
+        places = append(places, placeShape{placeID: placeID, polygon: orb.Polygon{ring}})
+    }
+    return places, rows.Err()
+}
 
-        polygon := orb.Polygon{ring}
-        if planar.PolygonContains(polygon, point) {
-            log.Printf("Match found: Point (%f, %f) is within Place ID %d\n", longitude, latitude, placeID)
-            return placeID, nil
-        } else {
-            log.Printf("Point (%f, %f) is NOT within Place ID %d\n", longitude, latitude, placeID)
+// placeContaining returns the first of places that contains a point
+func placeContaining(places []placeShape, longitude, latitude float64) (int, bool) {
+    point := orb.Point{longitude, latitude}
+    for _, place := range places {
+        if planar.PolygonContains(place.polygon, point) {
+            return place.placeID, true
         }
     }
-
-    log.Println("No matching place found")
-    return 0, fmt.Errorf("no matching place found")
+    return 0, false
 }
 
-// updateMappingAndCounter updates the mapping and counter tables
-func updateMappingAndCounter(taxiID string, placeID int) {
+// updateMappingAndCounter records a visit of a taxi to a place in the mapping and counter tables
+func updateMappingAndCounter(tenant, taxiID string, placeID int) {
     // Insert into mapping table
-    _, err := db.Exec("INSERT INTO mapping (taxi_id, place_id) VALUES ($1, $2)", taxiID, placeID)
+    _, err := db.Exec("INSERT INTO mapping (taxi_id, place_id, tenant) VALUES ($1, $2, $3)", taxiID, placeID, tenant)
     if err != nil {
         log.Println("Mapping insertion failed:", err)
         // Optionally, handle duplicate mappings or other specific errors here
@@ -535,10 +1238,10 @@ func updateMappingAndCounter(taxiID string, placeID int) {
 
     // Update or insert into counters table
     var count int
-    err = db.QueryRow("SELECT counter FROM counters WHERE taxi_id = $1 AND place_id = $2", taxiID, placeID).Scan(&count)
+    err = db.QueryRow("SELECT counter FROM counters WHERE tenant = $1 AND taxi_id = $2 AND place_id = $3", tenant, taxiID, placeID).Scan(&count)
     if err == sql.ErrNoRows {
         // Insert new counter
-        _, err = db.Exec("INSERT INTO counters (taxi_id, place_id, counter, last_counted) VALUES ($1, $2, 1, CURRENT_TIMESTAMP)", taxiID, placeID)
+        _, err = db.Exec("INSERT INTO counters (taxi_id, place_id, counter, last_counted, tenant) VALUES ($1, $2, 1, CURRENT_TIMESTAMP, $3)", taxiID, placeID, tenant)
         if err != nil {
             log.Println("Failed to insert new counter:", err)
         } else {
@@ -548,7 +1251,7 @@ func updateMappingAndCounter(taxiID string, placeID int) {
         log.Println("Counter query failed:", err)
     } else {
         // Update existing counter
-        _, err = db.Exec("UPDATE counters SET counter = counter + 1, last_counted = CURRENT_TIMESTAMP WHERE taxi_id = $1 AND place_id = $2", taxiID, placeID)
+        _, err = db.Exec("UPDATE counters SET counter = counter + 1, last_counted = CURRENT_TIMESTAMP WHERE tenant = $1 AND taxi_id = $2 AND place_id = $3", tenant, taxiID, placeID)
         if err != nil {
             log.Println("Failed to update counter:", err)
         } else {
@@ -559,54 +1262,103 @@ func updateMappingAndCounter(taxiID string, placeID int) {
 
 // triggerMapping manually triggers the mapTaxiLocations function via HTTP request
 func triggerMapping(w http.ResponseWriter, r *http.Request) {
+    // A run that cannot be audited is not started
+    if err := recordAudit(db, r, writeTenant(r), "mapping.trigger", "mapping", "", nil, nil); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to trigger mapping")
+        return
+    }
     go mapTaxiLocations() // Run in a separate goroutine to prevent blocking
-    fmt.Fprintf(w, "Mapping process triggered manually.")
+    writeMessage(w, r, http.StatusOK, "Mapping process triggered manually.")
+}
+
+// mappingSorts are the ?sort= options of getMapping
+var mappingSorts = map[string]sortOption{
+    "map_id":    {Expr: "m.map_id", Type: "INTEGER", Tiebreak: "m.map_id"},
+    "timestamp": {Expr: "COALESCE(m.timestamp, TIMESTAMP 'epoch')", Type: "TIMESTAMP", Tiebreak: "m.map_id"},
 }
 
-// getMapping retrieves current mappings with counters
+// getMapping lists mappings with their counters a page at a time, optionally
+// filtered by ?bbox= (the taxi's current position), ?taxi_id=, ?place_id=,
+// ?updated_since= and a ?q= place name search
 func getMapping(w http.ResponseWriter, r *http.Request) {
+    page, err := parsePage(r, mappingSorts, "map_id")
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    filters, err := parseListFilters(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    var f sqlFilter
+    f.tenant("m.tenant", requestTenant(r))
+    if len(filters.BBox) == 4 {
+        f.where("(m.tenant, m.taxi_id) IN (SELECT tenant, taxi_id FROM taxi_location WHERE longitude BETWEEN %s AND %s AND latitude BETWEEN %s AND %s)",
+            filters.BBox[0], filters.BBox[2], filters.BBox[1], filters.BBox[3])
+    }
+    if len(filters.TaxiIDs) > 0 {
+        f.where("m.taxi_id = ANY(%s)", pq.Array(filters.TaxiIDs))
+    }
+    if len(filters.PlaceIDs) > 0 {
+        f.where("m.place_id = ANY(%s)", pq.Array(filters.PlaceIDs))
+    }
+    if filters.UpdatedSince != nil {
+        f.where("m.timestamp >= %s", *filters.UpdatedSince)
+    }
+    if filters.Name != "" {
+        f.where("p.place_name ILIKE %s", likePattern(filters.Name))
+    }
+    suffix := page.apply(&f)
+
     query := `
-        SELECT m.taxi_id, p.place_name, c.counter 
+        SELECT m.taxi_id, m.place_id, p.place_name, c.counter, m.timestamp, ` + page.sortKeySQL() + `
         FROM mapping m 
         JOIN places p ON m.place_id = p.place_id 
-        JOIN counters c ON m.taxi_id = c.taxi_id AND m.place_id = c.place_id
-    `
-    rows, err := db.Query(query)
+        JOIN counters c ON m.tenant = c.tenant AND m.taxi_id = c.taxi_id AND m.place_id = c.place_id` + f.clause() + suffix
+    rows, err := db.Query(query, f.args...)
     if err != nil {
-        http.Error(w, "Failed to query mappings: "+err.Error(), http.StatusInternalServerError)
+        log.Println("Error querying mappings:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query mappings")
         return
     }
     defer rows.Close()
 
-    var mappings []map[string]interface{}
-    count := 0
+    // An empty result is an empty array rather than null
+    mappings := []map[string]interface{}{}
+    var keys [][2]string
     for rows.Next() {
-        var taxiID, placeName string
-        var counter int
-        if err := rows.Scan(&taxiID, &placeName, &counter); err != nil {
-            http.Error(w, "Failed to scan mapping: "+err.Error(), http.StatusInternalServerError)
+        var taxiID string
+        var placeID, counter int
+        var placeName sql.NullString
+        var timestamp sql.NullTime
+        var key [2]string
+        if err := rows.Scan(&taxiID, &placeID, &placeName, &counter, &timestamp, &key[0], &key[1]); err != nil {
+            log.Println("Error scanning mapping:", err)
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan mapping")
             return
         }
-        mappings = append(mappings, map[string]interface{}{
-            "taxi_id": taxiID,
-            "place":   placeName,
-            "counter": counter,
-        })
-        count++
+        mapping := map[string]interface{}{
+            "taxi_id":  taxiID,
+            "place_id": placeID,
+            "place":    placeName.String,
+            "counter":  counter,
+        }
+        if timestamp.Valid {
+            mapping["timestamp"] = timestamp.Time
+        }
+        mappings = append(mappings, mapping)
+        keys = append(keys, key)
     }
 
-    log.Printf("Fetched %d mappings\n", count)
-
     if err = rows.Err(); err != nil {
-        http.Error(w, "Row iteration error: "+err.Error(), http.StatusInternalServerError)
+        log.Println("Row iteration error:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to read mappings")
         return
     }
 
-    // If no mappings found, return an empty array instead of null
-    w.Header().Set("Content-Type", "application/json")
-    if count == 0 {
-        json.NewEncoder(w).Encode([]map[string]interface{}{})
-        return
-    }
-    json.NewEncoder(w).Encode(mappings)
+    n, next := page.nextCursor(len(mappings), keys)
+    log.Printf("Fetched %d mappings\n", n)
+    writePage(w, r, mappings[:n], next)
 }
\ No newline at end of file
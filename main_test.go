@@ -0,0 +1,172 @@
+package main
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+// mockDB replaces the global database with a sqlmock one for the duration of
+// a test and fails the test if an expected query never ran
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+    t.Helper()
+    conn, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := db
+    db = conn
+    t.Cleanup(func() {
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Error(err)
+        }
+        db = previous
+        conn.Close()
+    })
+    return mock
+}
+
+// setAuth switches authentication on or off for the duration of a test
+func setAuth(t *testing.T, enabled bool) {
+    previous := authEnabled
+    authEnabled = enabled
+    t.Cleanup(func() { authEnabled = previous })
+}
+
+// setRateLimits lifts the rate limits for the duration of a test
+func setRateLimits(t *testing.T) {
+    previous, previousDevice, previousIP := limiter, deviceLimiter, ipLimiter
+    limiter, deviceLimiter, ipLimiter = newRateLimiter(1e6, 1e6), newRateLimiter(1e6, 1e6), newRateLimiter(1e6, 1e6)
+    t.Cleanup(func() { limiter, deviceLimiter, ipLimiter = previous, previousDevice, previousIP })
+}
+
+// expectAPIKey answers the next API key lookup with a key of tenant holding scopes
+func expectAPIKey(mock sqlmock.Sqlmock, keyID int, tenant string, scopes ...string) {
+    mock.ExpectQuery("FROM api_keys").
+        WillReturnRows(sqlmock.NewRows([]string{"key_id", "name", "tenant", "scopes"}).
+            AddRow(keyID, "test", tenant, "{"+strings.Join(scopes, ",")+"}"))
+}
+
+func TestListBBoxFilters(t *testing.T) {
+    setAuth(t, false)
+    tests := []struct {
+        name    string
+        handler http.HandlerFunc
+        url     string
+        query   string
+        args    []driver.Value
+    }{
+        {"places", getAllPlaces, "/v1/places?bbox=106.7,-6.3,106.9,-6.1",
+            `place_outline\(polygon\) && polygon\(box\(point\(\$3, \$4\), point\(\$5, \$6\)\)\)`,
+            []driver.Value{"", false, 106.7, -6.3, 106.9, -6.1, sqlmock.AnyArg()}},
+        {"mappings", getMapping, "/v1/getMapping?bbox=106.7,-6.3,106.9,-6.1",
+            `\(m.tenant, m.taxi_id\) IN \(SELECT tenant, taxi_id FROM taxi_location WHERE longitude BETWEEN \$2 AND \$3 AND latitude BETWEEN \$4 AND \$5\)`,
+            []driver.Value{"", 106.7, 106.9, -6.3, -6.1, sqlmock.AnyArg()}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectQuery(test.query).WithArgs(test.args...).
+                WillReturnRows(sqlmock.NewRows([]string{"id"}))
+            w := httptest.NewRecorder()
+            test.handler(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+            if w.Code != http.StatusOK {
+                t.Fatalf("got status %d: %s", w.Code, w.Body)
+            }
+        })
+    }
+
+    w := httptest.NewRecorder()
+    getAllPlaces(w, httptest.NewRequest(http.MethodGet, "/v1/places?bbox=1,2,3", nil))
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("got status %d for a malformed bbox, want 400", w.Code)
+    }
+}
+
+func TestTenantsShareTaxiID(t *testing.T) {
+    mock := mockDB(t)
+    snapshot := []byte(`{"taxi_id":"T1"}`)
+    tenants := []string{"acme", "globex"}
+
+    for _, tenant := range tenants {
+        principal := &Principal{Tenant: tenant, Scopes: []string{ScopeAdmin}}
+
+        // Both tenants create a taxi with the same ID
+        mock.ExpectBegin()
+        mock.ExpectQuery(`INSERT INTO taxi_location .* ON CONFLICT \(tenant, taxi_id\) DO NOTHING`).
+            WithArgs("T1", 106.8, -6.2, "", tenant).
+            WillReturnRows(sqlmock.NewRows([]string{"after"}).AddRow(snapshot))
+        mock.ExpectExec("INSERT INTO audit_log").WillReturnResult(sqlmock.NewResult(1, 1))
+        mock.ExpectCommit()
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPost, "/v1/taxi", strings.NewReader(`{"taxi_id":"T1","longitude":106.8,"latitude":-6.2}`))
+        createTaxiLocation(w, withPrincipal(r, principal))
+        if w.Code != http.StatusCreated {
+            t.Fatalf("%s: got status %d creating T1: %s", tenant, w.Code, w.Body)
+        }
+
+        // and reads back its own
+        mock.ExpectQuery("FROM taxi_location WHERE taxi_id = \\$1 AND tenant = \\$2").WithArgs("T1", tenant).
+            WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "longitude", "latitude", "fleet", "tenant", "age"}).
+                AddRow("T1", 106.8, -6.2, "", tenant, 0.0))
+        w = httptest.NewRecorder()
+        r = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/taxi/T1", nil), map[string]string{"id": "T1"})
+        getTaxiLocation(w, withPrincipal(r, principal))
+        if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tenant":"`+tenant+`"`) {
+            t.Fatalf("%s: got status %d reading T1: %s", tenant, w.Code, w.Body)
+        }
+    }
+
+    // A fix for one tenant's T1 is applied to that taxi alone, not refused
+    // because the other tenant holds the same ID
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").WithArgs(sqlmock.AnyArg(), "globex", speedReason, reanchorAfter).
+        WillReturnRows(sqlmock.NewRows(previousFixColumns))
+    mock.ExpectQuery(`WITH incoming .* ON CONFLICT \(tenant, taxi_id\) DO UPDATE`).
+        WillReturnRows(sqlmock.NewRows([]string{"item"}).AddRow(0))
+    decision, err := storeLocation(TaxiLocation{TaxiID: "T1", Longitude: 106.81, Latitude: -6.21, Tenant: "globex"})
+    if err != nil || decision.Decision != DecisionApplied {
+        t.Fatalf("got %+v, %v, want the fix applied", decision, err)
+    }
+}
+
+func TestMapTaxiLocationsReplaysHistory(t *testing.T) {
+    mock := mockDB(t)
+    entered := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    left := entered.Add(7 * time.Minute)
+    updated := left.Add(2 * time.Minute)
+
+    // The taxi was last seen outside every place and drove through place 5
+    // between two mapping runs
+    mock.ExpectQuery("FROM taxi_location t").
+        WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "tenant", "longitude", "latitude", "updated_at",
+            "fixed_at", "place_id", "last_history_id"}).
+            AddRow("t1", "acme", 10.0, 10.0, updated, left, nil, 10))
+    mock.ExpectQuery("SELECT place_id, polygon FROM places").WithArgs("acme").
+        WillReturnRows(sqlmock.NewRows([]string{"place_id", "polygon"}).
+            AddRow(5, `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]}`))
+    mock.ExpectQuery("FROM location_history").WithArgs("acme", "t1", sql.NullInt64{Int64: 10, Valid: true}).
+        WillReturnRows(sqlmock.NewRows([]string{"history_id", "longitude", "latitude", "device_time"}).
+            AddRow(11, 0.5, 0.5, entered).
+            AddRow(12, 10.0, 10.0, left))
+    mock.ExpectExec("INSERT INTO place_visits").WithArgs("acme", "t1", sql.NullInt64{Int64: 5, Valid: true}, entered).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectExec("INSERT INTO mapping").WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectQuery("SELECT counter FROM counters").WillReturnError(sql.ErrNoRows)
+    mock.ExpectExec("INSERT INTO counters").WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectExec("UPDATE place_visits SET left_at").WithArgs("acme", "t1", sql.NullInt64{Int64: 5, Valid: true}, left).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO mapping_state").
+        WithArgs("acme", "t1", sql.NullInt64{}, updated, sql.NullInt64{Int64: 12, Valid: true}).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectQuery("FROM mapping_state s").
+        WillReturnRows(sqlmock.NewRows([]string{"place_id", "tenant", "count"}))
+
+    mapTaxiLocations()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    // occupancyReplaySize is how many occupancy changes are kept for Last-Event-ID resume
+    occupancyReplaySize = 1000
+    // occupancyHeartbeat keeps idle SSE connections open through proxies
+    occupancyHeartbeat = 15 * time.Second
+)
+
+// OccupancyUpdate reports the number of vehicles currently inside a place
+type OccupancyUpdate struct {
+    ID        uint64    `json:"id"`
+    Tenant    string    `json:"tenant"`
+    PlaceID   int       `json:"place_id"`
+    Occupancy int       `json:"occupancy"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// occupancyTracker remembers the last known occupancy per place, keeps a short
+// replay buffer of changes and notifies subscribers when a place changes
+type occupancyTracker struct {
+    mutex       sync.Mutex
+    current     map[int]int
+    tenants     map[int]string // tenant of every place seen so far
+    history     []OccupancyUpdate
+    epoch       uint64 // first ID issued by this tracker
+    nextID      uint64
+    subscribers map[chan OccupancyUpdate]struct{}
+}
+
+// occupancy is the process-wide occupancy tracker
+var occupancy = newOccupancyTracker(occupancyEpoch(time.Now()))
+
+// occupancyEpoch returns the first event ID of a process started at start.
+// IDs count up from the start time in milliseconds times 1000, so IDs from an
+// earlier process sort below all of this one's unless it issued more than
+// 1000 updates a millisecond, and they stay exact in JSON numbers.
+func occupancyEpoch(start time.Time) uint64 {
+    return uint64(start.UnixMilli()) * 1000
+}
+
+// newOccupancyTracker returns an empty tracker whose event IDs start at epoch
+func newOccupancyTracker(epoch uint64) *occupancyTracker {
+    return &occupancyTracker{
+        current:     make(map[int]int),
+        tenants:     make(map[int]string),
+        epoch:       epoch,
+        nextID:      epoch,
+        subscribers: make(map[chan OccupancyUpdate]struct{}),
+    }
+}
+
+// Record compares fresh per-place counts with the previous ones and publishes
+// an update for every place whose occupancy changed. Places missing from
+// counts are treated as empty. tenants names the tenant of each counted place.
+func (t *occupancyTracker) Record(counts map[int]int, tenants map[int]string) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    for placeID, tenant := range tenants {
+        t.tenants[placeID] = tenant
+    }
+
+    now := time.Now()
+    var changes []OccupancyUpdate
+    for placeID, count := range counts {
+        if previous, ok := t.current[placeID]; !ok || previous != count {
+            changes = append(changes, OccupancyUpdate{PlaceID: placeID, Occupancy: count})
+        }
+    }
+    for placeID, previous := range t.current {
+        if _, ok := counts[placeID]; !ok && previous != 0 {
+            changes = append(changes, OccupancyUpdate{PlaceID: placeID, Occupancy: 0})
+        }
+    }
+
+    for _, change := range changes {
+        change.ID = t.nextID
+        change.Tenant = t.tenants[change.PlaceID]
+        change.Timestamp = now
+        t.nextID++
+
+        if change.Occupancy == 0 {
+            delete(t.current, change.PlaceID)
+        } else {
+            t.current[change.PlaceID] = change.Occupancy
+        }
+
+        t.history = append(t.history, change)
+        if len(t.history) > occupancyReplaySize {
+            t.history = t.history[len(t.history)-occupancyReplaySize:]
+        }
+
+        for ch := range t.subscribers {
+            select {
+            case ch <- change:
+            default:
+                // The subscriber fell behind; closing its stream makes the
+                // client reconnect and resume from the replay buffer
+                delete(t.subscribers, ch)
+                close(ch)
+            }
+        }
+    }
+}
+
+// Subscribe returns the updates a client has missed since lastID together
+// with a channel of future updates. When lastID is zero, already evicted from
+// the replay buffer or was issued by another process the client receives a
+// snapshot of every occupied place instead.
+func (t *occupancyTracker) Subscribe(lastID uint64) ([]OccupancyUpdate, <-chan OccupancyUpdate, func()) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    var replay []OccupancyUpdate
+    if lastID >= t.epoch && lastID < t.nextID && len(t.history) > 0 && lastID >= t.history[0].ID-1 {
+        for _, update := range t.history {
+            if update.ID > lastID {
+                replay = append(replay, update)
+            }
+        }
+    } else {
+        now := time.Now()
+        for placeID, count := range t.current {
+            replay = append(replay, OccupancyUpdate{ID: t.nextID - 1, Tenant: t.tenants[placeID], PlaceID: placeID,
+                Occupancy: count, Timestamp: now})
+        }
+    }
+
+    ch := make(chan OccupancyUpdate, 64)
+    t.subscribers[ch] = struct{}{}
+    return replay, ch, func() {
+        t.mutex.Lock()
+        defer t.mutex.Unlock()
+        if _, ok := t.subscribers[ch]; ok {
+            delete(t.subscribers, ch)
+            close(ch)
+        }
+    }
+}
+
+// refreshOccupancy counts the vehicles currently mapped to each place and
+// records the result with the occupancy tracker
+func refreshOccupancy() {
+    rows, err := db.Query(`SELECT s.place_id, p.tenant, COUNT(*) FROM mapping_state s
+        JOIN places p ON p.place_id = s.place_id
+        GROUP BY s.place_id, p.tenant`)
+    if err != nil {
+        log.Println("Error querying occupancy:", err)
+        return
+    }
+    defer rows.Close()
+
+    counts := make(map[int]int)
+    tenants := make(map[int]string)
+    for rows.Next() {
+        var placeID, count int
+        var tenant string
+        if err := rows.Scan(&placeID, &tenant, &count); err != nil {
+            log.Println("Error scanning occupancy:", err)
+            return
+        }
+        counts[placeID] = count
+        tenants[placeID] = tenant
+    }
+    if err = rows.Err(); err != nil {
+        log.Println("Row iteration error:", err)
+        return
+    }
+
+    occupancy.Record(counts, tenants)
+}
+
+// occupancyEvents streams per-place occupancy changes as Server-Sent Events.
+// Clients resume after a reconnect by sending the Last-Event-ID header and only
+// see the places of their own tenant.
+func occupancyEvents(w http.ResponseWriter, r *http.Request) {
+    tenant := requestTenant(r)
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeError(w, r, http.StatusInternalServerError, "Streaming unsupported")
+        return
+    }
+
+    var lastID uint64
+    if header := r.Header.Get("Last-Event-ID"); header != "" {
+        id, err := strconv.ParseUint(header, 10, 64)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, "Invalid Last-Event-ID")
+            return
+        }
+        lastID = id
+    }
+
+    replay, updates, unsubscribe := occupancy.Subscribe(lastID)
+    defer unsubscribe()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+
+    for _, update := range replay {
+        if tenant == "" || update.Tenant == tenant {
+            writeOccupancyEvent(w, update)
+        }
+    }
+    flusher.Flush()
+
+    heartbeat := time.NewTicker(occupancyHeartbeat)
+    defer heartbeat.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case update, ok := <-updates:
+            if !ok {
+                return
+            }
+            if tenant != "" && update.Tenant != tenant {
+                continue
+            }
+            writeOccupancyEvent(w, update)
+            flusher.Flush()
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": keep-alive\n\n")
+            flusher.Flush()
+        }
+    }
+}
+
+// writeOccupancyEvent writes a single SSE frame
+func writeOccupancyEvent(w http.ResponseWriter, update OccupancyUpdate) {
+    data, err := json.Marshal(update)
+    if err != nil {
+        log.Println("Failed to encode occupancy update:", err)
+        return
+    }
+    fmt.Fprintf(w, "id: %d\nevent: occupancy\ndata: %s\n\n", update.ID, data)
+}
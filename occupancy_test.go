@@ -0,0 +1,116 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// setOccupancy replaces the process-wide tracker for the duration of a test
+func setOccupancy(t *testing.T, tracker *occupancyTracker) {
+    previous := occupancy
+    occupancy = tracker
+    t.Cleanup(func() { occupancy = previous })
+}
+
+// occupancyIDs returns the IDs of updates
+func occupancyIDs(updates []OccupancyUpdate) []uint64 {
+    var ids []uint64
+    for _, update := range updates {
+        ids = append(ids, update.ID)
+    }
+    return ids
+}
+
+func TestOccupancyReplay(t *testing.T) {
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    epoch := occupancyEpoch(start)
+
+    // An earlier process issued many more IDs than this one has so far
+    earlier := newOccupancyTracker(occupancyEpoch(start.Add(-time.Hour)))
+    for i := 1; i <= 50; i++ {
+        earlier.Record(map[int]int{1: i}, map[int]string{1: "acme"})
+    }
+
+    tracker := newOccupancyTracker(epoch)
+    tracker.Record(map[int]int{1: 1}, map[int]string{1: "acme"})
+    tracker.Record(map[int]int{1: 1, 2: 2}, map[int]string{2: "acme"})
+    tracker.Record(map[int]int{1: 3, 2: 2}, nil)
+
+    tests := []struct {
+        name       string
+        lastID     uint64
+        replay     []uint64 // IDs replayed, nil for a snapshot
+        snapshotOf int      // places in the snapshot
+    }{
+        {"new client", 0, nil, 2},
+        {"resume after the first update", epoch, []uint64{epoch + 1, epoch + 2}, 0},
+        {"resume after the last update", epoch + 2, []uint64{}, 0},
+        {"ID from an earlier process", earlier.nextID - 1, nil, 2},
+        {"ID from the future", epoch + 10, nil, 2},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            replay, _, unsubscribe := tracker.Subscribe(test.lastID)
+            defer unsubscribe()
+
+            if test.replay == nil {
+                if len(replay) != test.snapshotOf {
+                    t.Fatalf("got %v, want a snapshot of %d places", replay, test.snapshotOf)
+                }
+                for _, update := range replay {
+                    if update.ID != epoch+2 {
+                        t.Errorf("snapshot of place %d has ID %d, want the latest ID %d", update.PlaceID, update.ID, epoch+2)
+                    }
+                }
+                return
+            }
+            if got := occupancyIDs(replay); fmt.Sprint(got) != fmt.Sprint(test.replay) {
+                t.Fatalf("replayed %v, want %v", got, test.replay)
+            }
+        })
+    }
+}
+
+func TestOccupancyReplayEvicted(t *testing.T) {
+    epoch := occupancyEpoch(time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC))
+    tracker := newOccupancyTracker(epoch)
+    for i := 1; i <= occupancyReplaySize+10; i++ {
+        tracker.Record(map[int]int{1: i}, map[int]string{1: "acme"})
+    }
+
+    replay, _, unsubscribe := tracker.Subscribe(epoch + 5)
+    defer unsubscribe()
+    if len(replay) != 1 || replay[0].Occupancy != occupancyReplaySize+10 {
+        t.Fatalf("got %v, want a snapshot once the ID left the replay buffer", replay)
+    }
+}
+
+func TestOccupancyEventsAfterRestart(t *testing.T) {
+    setAuth(t, false)
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    tracker := newOccupancyTracker(occupancyEpoch(start))
+    tracker.Record(map[int]int{1: 2, 2: 1}, map[int]string{1: "acme", 2: "globex"})
+    tracker.Record(map[int]int{1: 3, 2: 1}, nil)
+    setOccupancy(t, tracker)
+
+    // The client last saw ID 1 from a process that started before this one
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    r := httptest.NewRequest(http.MethodGet, "/v1/events/occupancy?tenant=acme", nil).WithContext(ctx)
+    r.Header.Set("Last-Event-ID", "1")
+    w := httptest.NewRecorder()
+    occupancyEvents(w, r)
+
+    body := w.Body.String()
+    want := "id: " + strconv.FormatUint(tracker.nextID-1, 10) + "\nevent: occupancy\n"
+    if w.Code != http.StatusOK || strings.Count(body, "event: occupancy") != 1 || !strings.HasPrefix(body, want) ||
+        !strings.Contains(body, `"place_id":1,"occupancy":3`) {
+        t.Fatalf("got status %d: %q, want a snapshot of acme's place 1", w.Code, body)
+    }
+}
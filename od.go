@@ -0,0 +1,128 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/csv"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// ODFlow counts the moves of vehicles from one place to the next place they visited
+type ODFlow struct {
+    OriginPlaceID      int        `json:"origin_place_id"`
+    OriginPlace        string     `json:"origin_place"`
+    DestinationPlaceID int        `json:"destination_place_id"`
+    DestinationPlace   string     `json:"destination_place"`
+    Bucket             *time.Time `json:"bucket,omitempty"`
+    Trips              int        `json:"trips"`
+    Vehicles           int        `json:"vehicles"`
+}
+
+// getODMatrix handles GET /analytics/od. Each consecutive pair of place visits
+// of a vehicle is one move from origin to destination; moves are counted by
+// the device time they entered the destination within ?from= and ?to=
+// (default the last 24 hours), optionally per ?bucket=hour or day and
+// restricted to one ?fleet=.
+// ?format=csv returns the matrix as CSV instead of JSON.
+func getODMatrix(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    if query.Get("from") == "" {
+        from = to.Add(-24 * time.Hour)
+    }
+
+    bucket := query.Get("bucket")
+    if bucket != "" && bucket != "hour" && bucket != "day" {
+        writeError(w, r, http.StatusBadRequest, "Invalid bucket")
+        return
+    }
+
+    format := query.Get("format")
+    if format == "" {
+        format = "json"
+    }
+    if format != "json" && format != "csv" {
+        writeError(w, r, http.StatusBadRequest, "Invalid format")
+        return
+    }
+
+    rows, err := db.Query(`SELECT v.origin, op.place_name, v.place_id, dp.place_name,
+            date_trunc(NULLIF($4::text, ''), v.entered_at) AS bucket,
+            COUNT(*), COUNT(DISTINCT (v.tenant, v.taxi_id))
+        FROM (SELECT tenant, taxi_id, place_id, entered_at,
+                LAG(place_id) OVER (PARTITION BY tenant, taxi_id ORDER BY entered_at, visit_id) AS origin
+            FROM place_visits
+            WHERE entered_at < $2 AND `+tenantClause("tenant", 5)+`) v
+        JOIN places op ON op.place_id = v.origin
+        JOIN places dp ON dp.place_id = v.place_id
+        LEFT JOIN taxi_location t ON t.tenant = v.tenant AND t.taxi_id = v.taxi_id
+        WHERE v.entered_at >= $1 AND ($3::text = '' OR t.fleet = $3::text)
+        GROUP BY v.origin, op.place_name, v.place_id, dp.place_name, bucket
+        ORDER BY bucket, COUNT(*) DESC`,
+        from, to, query.Get("fleet"), bucket, requestTenant(r))
+    if err != nil {
+        log.Println("Error querying OD matrix:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query OD matrix")
+        return
+    }
+    defer rows.Close()
+
+    flows := []ODFlow{}
+    for rows.Next() {
+        var flow ODFlow
+        var bucketStart sql.NullTime
+        if err := rows.Scan(&flow.OriginPlaceID, &flow.OriginPlace, &flow.DestinationPlaceID, &flow.DestinationPlace,
+            &bucketStart, &flow.Trips, &flow.Vehicles); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan OD matrix")
+            return
+        }
+        if bucketStart.Valid {
+            flow.Bucket = &bucketStart.Time
+        }
+        flows = append(flows, flow)
+    }
+    if err = rows.Err(); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to read OD matrix")
+        return
+    }
+
+    if format == "csv" {
+        writeODCSV(w, flows)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(flows)
+}
+
+// writeODCSV writes OD flows as CSV with a header row
+func writeODCSV(w http.ResponseWriter, flows []ODFlow) {
+    w.Header().Set("Content-Type", "text/csv")
+    w.Header().Set("Content-Disposition", `attachment; filename="od_matrix.csv"`)
+
+    out := csv.NewWriter(w)
+    out.Write([]string{"bucket", "origin_place_id", "origin_place", "destination_place_id", "destination_place", "trips", "vehicles"})
+    for _, flow := range flows {
+        bucket := ""
+        if flow.Bucket != nil {
+            bucket = flow.Bucket.Format(time.RFC3339)
+        }
+        out.Write([]string{
+            bucket,
+            strconv.Itoa(flow.OriginPlaceID),
+            flow.OriginPlace,
+            strconv.Itoa(flow.DestinationPlaceID),
+            flow.DestinationPlace,
+            strconv.Itoa(flow.Trips),
+            strconv.Itoa(flow.Vehicles),
+        })
+    }
+    out.Flush()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestODMatrixUsesVisitTimes(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    bucket := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+    // Moves are ordered and bucketed by when the vehicle entered each place,
+    // not by when the mapping job happened to record it
+    mock.ExpectQuery(`date_trunc\(NULLIF\(\$4::text, ''\), v.entered_at\) .* `+
+        `LAG\(place_id\) OVER \(PARTITION BY tenant, taxi_id ORDER BY entered_at, visit_id\) .* FROM place_visits`).
+        WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "", "hour", "").
+        WillReturnRows(sqlmock.NewRows([]string{"origin", "origin_name", "place_id", "place_name", "bucket", "trips", "vehicles"}).
+            AddRow(1, "Gambir", 2, "Senen", bucket, 4, 3))
+
+    w := httptest.NewRecorder()
+    getODMatrix(w, httptest.NewRequest(http.MethodGet, "/v1/analytics/od?bucket=hour&format=csv", nil))
+    if w.Code != http.StatusOK {
+        t.Fatalf("got status %d: %s", w.Code, w.Body)
+    }
+    want := "bucket,origin_place_id,origin_place,destination_place_id,destination_place,trips,vehicles\n" +
+        "2026-03-01T08:00:00Z,1,Gambir,2,Senen,4,3\n"
+    if w.Body.String() != want {
+        t.Fatalf("got %q, want %q", w.Body, want)
+    }
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+    "bytes"
+    _ "embed"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// openAPIDocument is the OpenAPI 3 description of every route, served at
+// /openapi.json and used to validate requests
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// apiSpec is the parsed openAPIDocument
+var apiSpec = mustLoadOpenAPISpec(openAPIDocument)
+
+// validateResponses makes validateRequest also check the bodies of /v1
+// responses against the spec, logging every mismatch. It buffers each
+// response, so it is meant for staging and load tests rather than production.
+var validateResponses = envString("OPENAPI_VALIDATE_RESPONSES", "") == "true"
+
+// openAPISchema is the subset of JSON Schema used by openapi.json
+type openAPISchema struct {
+    Ref              string                    `json:"$ref"`
+    Type             string                    `json:"type"`
+    Format           string                    `json:"format"`
+    Enum             []interface{}             `json:"enum"`
+    Required         []string                  `json:"required"`
+    Properties       map[string]*openAPISchema `json:"properties"`
+    Items            *openAPISchema            `json:"items"`
+    AllOf            []*openAPISchema          `json:"allOf"`
+    Minimum          *float64                  `json:"minimum"`
+    Maximum          *float64                  `json:"maximum"`
+    ExclusiveMinimum bool                      `json:"exclusiveMinimum"`
+    MinLength        *int                      `json:"minLength"`
+    MinItems         *int                      `json:"minItems"`
+    MaxItems         *int                      `json:"maxItems"`
+    Nullable         bool                      `json:"nullable"`
+}
+
+// openAPIParameter is a path, query or header parameter of an operation
+type openAPIParameter struct {
+    Ref      string         `json:"$ref"`
+    Name     string         `json:"name"`
+    In       string         `json:"in"`
+    Required bool           `json:"required"`
+    Schema   *openAPISchema `json:"schema"`
+}
+
+// openAPIMediaType describes a body of one content type
+type openAPIMediaType struct {
+    Schema *openAPISchema `json:"schema"`
+}
+
+// openAPIBody is a request body or a response
+type openAPIBody struct {
+    Ref     string                      `json:"$ref"`
+    Content map[string]openAPIMediaType `json:"content"`
+}
+
+// openAPIOperation is one method of a path
+type openAPIOperation struct {
+    Parameters    []*openAPIParameter     `json:"parameters"`
+    RequestBody   *openAPIBody            `json:"requestBody"`
+    Responses     map[string]*openAPIBody `json:"responses"`
+    Security      *[]map[string][]string  `json:"security"`
+    RequiredScope string                  `json:"x-required-scope"`
+}
+
+// openAPISpec holds the parts of the document needed at runtime
+type openAPISpec struct {
+    Paths      map[string]map[string]json.RawMessage `json:"paths"`
+    Components struct {
+        Schemas    map[string]*openAPISchema    `json:"schemas"`
+        Parameters map[string]*openAPIParameter `json:"parameters"`
+        Responses  map[string]*openAPIBody      `json:"responses"`
+    } `json:"components"`
+
+    // operations is keyed like routeScopes, e.g. "GET /taxi/{id}"
+    operations map[string]*openAPIOperation
+}
+
+// mustLoadOpenAPISpec parses the embedded document; it is part of the
+// binary, so a broken document is a build mistake
+func mustLoadOpenAPISpec(data []byte) *openAPISpec {
+    spec, err := loadOpenAPISpec(data)
+    if err != nil {
+        log.Fatal("Invalid openapi.json: ", err)
+    }
+    return spec
+}
+
+// loadOpenAPISpec parses an OpenAPI document and resolves the references of
+// its parameters and responses
+func loadOpenAPISpec(data []byte) (*openAPISpec, error) {
+    var spec openAPISpec
+    if err := json.Unmarshal(data, &spec); err != nil {
+        return nil, err
+    }
+    spec.operations = make(map[string]*openAPIOperation)
+
+    for path, item := range spec.Paths {
+        var shared []*openAPIParameter
+        if raw, ok := item["parameters"]; ok {
+            if err := json.Unmarshal(raw, &shared); err != nil {
+                return nil, fmt.Errorf("%s: %v", path, err)
+            }
+        }
+        for method, raw := range item {
+            if method == "parameters" {
+                continue
+            }
+            var operation openAPIOperation
+            if err := json.Unmarshal(raw, &operation); err != nil {
+                return nil, fmt.Errorf("%s %s: %v", method, path, err)
+            }
+            operation.Parameters = append(append([]*openAPIParameter{}, shared...), operation.Parameters...)
+            for i, parameter := range operation.Parameters {
+                if parameter.Ref != "" {
+                    resolved, ok := spec.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+                    if !ok {
+                        return nil, fmt.Errorf("%s %s: unknown parameter %s", method, path, parameter.Ref)
+                    }
+                    operation.Parameters[i] = resolved
+                }
+            }
+            for status, response := range operation.Responses {
+                if response.Ref != "" {
+                    resolved, ok := spec.Components.Responses[strings.TrimPrefix(response.Ref, "#/components/responses/")]
+                    if !ok {
+                        return nil, fmt.Errorf("%s %s: unknown response %s", method, path, response.Ref)
+                    }
+                    operation.Responses[status] = resolved
+                }
+            }
+            spec.operations[strings.ToUpper(method)+" "+path] = &operation
+        }
+    }
+
+    // Every schema reference must resolve, or validation would fail at request time
+    var problems []string
+    var check func(schema *openAPISchema)
+    check = func(schema *openAPISchema) {
+        if schema == nil {
+            return
+        }
+        if schema.Ref != "" && spec.schema(schema) == nil {
+            problems = append(problems, "unknown schema "+schema.Ref)
+        }
+        for _, property := range schema.Properties {
+            check(property)
+        }
+        for _, part := range schema.AllOf {
+            check(part)
+        }
+        check(schema.Items)
+    }
+    for _, schema := range spec.Components.Schemas {
+        check(schema)
+    }
+    for _, operation := range spec.operations {
+        for _, parameter := range operation.Parameters {
+            check(parameter.Schema)
+        }
+        for _, body := range append([]*openAPIBody{operation.RequestBody}, responseBodies(operation)...) {
+            if body != nil {
+                for _, media := range body.Content {
+                    check(media.Schema)
+                }
+            }
+        }
+    }
+    if len(problems) > 0 {
+        return nil, errors.New(strings.Join(problems, "; "))
+    }
+    return &spec, nil
+}
+
+// responseBodies lists an operation's responses
+func responseBodies(operation *openAPIOperation) []*openAPIBody {
+    var bodies []*openAPIBody
+    for _, response := range operation.Responses {
+        bodies = append(bodies, response)
+    }
+    return bodies
+}
+
+// schema follows a schema reference, returning nil for unknown ones
+func (s *openAPISpec) schema(schema *openAPISchema) *openAPISchema {
+    for schema != nil && schema.Ref != "" {
+        schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+    }
+    return schema
+}
+
+// getOpenAPI serves the OpenAPI document describing this API
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(openAPIDocument)
+}
+
+// checkRoutesAgainstSpec compares the registered routes with the document:
+// every route must be documented, every documented operation must exist, and
+// the scope and public access each operation declares must match what
+// authenticate enforces. It returns one line per mismatch.
+func checkRoutesAgainstSpec(router *mux.Router, spec *openAPISpec) []string {
+    var problems []string
+    registered := make(map[string]bool)
+    router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+        template, err := route.GetPathTemplate()
+        methods, methodsErr := route.GetMethods()
+        if err != nil || methodsErr != nil || route.GetHandler() == nil {
+            return nil
+        }
+        for _, method := range methods {
+            registered[method+" "+strings.TrimPrefix(template, apiV1Prefix)] = true
+        }
+        return nil
+    })
+
+    for key := range registered {
+        if spec.operations[key] == nil {
+            problems = append(problems, key+" is not documented")
+        }
+    }
+    for key, operation := range spec.operations {
+        if !registered[key] {
+            problems = append(problems, key+" is documented but not registered")
+            continue
+        }
+        public := operation.Security != nil && len(*operation.Security) == 0
+        if public != publicRoutes[key] {
+            problems = append(problems, key+" disagrees about requiring credentials")
+        }
+        method := key[:strings.Index(key, " ")]
+        if scope := scopeForRoute(key, method); !public && operation.RequiredScope != scope {
+            problems = append(problems, fmt.Sprintf("%s documents scope %q but requires %q", key, operation.RequiredScope, scope))
+        }
+    }
+    sort.Strings(problems)
+    return problems
+}
+
+// validateRequest is router middleware that rejects requests whose
+// parameters or JSON body do not match the operation in openapi.json. It also
+// logs handlers answering with a success status the document does not list
+// and, with OPENAPI_VALIDATE_RESPONSES, /v1 bodies that do not match it.
+func validateRequest(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        key := routeKey(r)
+        operation := apiSpec.operations[key]
+        if operation == nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        violations := apiSpec.checkParameters(operation, r)
+        violations = append(violations, apiSpec.checkRequestBody(operation, r)...)
+        if len(violations) > 0 && isLegacyRequest(r) {
+            writeError(w, r, http.StatusBadRequest, "Request does not match the API specification: "+strings.Join(violations, "; "))
+            return
+        } else if len(violations) > 0 {
+            writeErrorDetails(w, r, http.StatusBadRequest, "Request does not match the API specification",
+                map[string][]string{"violations": violations})
+            return
+        }
+
+        // Streams need the underlying writer's Flusher and Hijacker
+        if operation.streams() {
+            next.ServeHTTP(w, r)
+            return
+        }
+        recorder := &specRecorder{ResponseWriter: w}
+        if validateResponses && !isLegacyRequest(r) {
+            recorder.body = &bytes.Buffer{}
+        }
+        next.ServeHTTP(recorder, r)
+        for _, violation := range apiSpec.checkResponse(operation, recorder) {
+            log.Printf("Response of %s drifted from openapi.json: %s\n", key, violation)
+        }
+    })
+}
+
+// routeKey names the route a request matched like routeScopes, without the
+// /v1 prefix, or returns "" when no route matched
+func routeKey(r *http.Request) string {
+    if route := mux.CurrentRoute(r); route != nil {
+        if template, err := route.GetPathTemplate(); err == nil {
+            return r.Method + " " + strings.TrimPrefix(template, apiV1Prefix)
+        }
+    }
+    return ""
+}
+
+// streams reports whether an operation upgrades the connection or streams events
+func (o *openAPIOperation) streams() bool {
+    for status, response := range o.Responses {
+        if status == "101" {
+            return true
+        }
+        if _, ok := response.Content["text/event-stream"]; ok {
+            return true
+        }
+    }
+    return false
+}
+
+// checkParameters validates the path, query and header parameters of a request
+func (s *openAPISpec) checkParameters(operation *openAPIOperation, r *http.Request) []string {
+    var violations []string
+    query := r.URL.Query()
+    for _, parameter := range operation.Parameters {
+        var value string
+        var present bool
+        switch parameter.In {
+        case "path":
+            value, present = mux.Vars(r)[parameter.Name]
+        case "query":
+            value, present = query.Get(parameter.Name), query.Has(parameter.Name)
+        case "header":
+            value = r.Header.Get(parameter.Name)
+            present = value != ""
+        }
+        name := parameter.In + " parameter " + parameter.Name
+        if !present {
+            if parameter.Required {
+                violations = append(violations, name+" is required")
+            }
+            continue
+        }
+
+        schema := s.schema(parameter.Schema)
+        if schema.Type != "array" {
+            violations = append(violations, s.checkValue(parseParameter(value, schema), schema, name)...)
+            continue
+        }
+        // Arrays are comma separated (style form, explode false)
+        var items []interface{}
+        for _, item := range splitList(value) {
+            items = append(items, parseParameter(item, s.schema(schema.Items)))
+        }
+        violations = append(violations, s.checkValue(items, schema, name)...)
+    }
+    return violations
+}
+
+// parseParameter converts a parameter to the JSON type its schema expects,
+// leaving values that do not parse as strings so checkValue reports them
+func parseParameter(value string, schema *openAPISchema) interface{} {
+    switch schema.Type {
+    case "integer", "number":
+        if f, err := strconv.ParseFloat(value, 64); err == nil {
+            return f
+        }
+    case "boolean":
+        if b, err := strconv.ParseBool(value); err == nil {
+            return b
+        }
+    }
+    return value
+}
+
+// checkRequestBody validates a JSON request body. Bodies that are not JSON,
+// such as NDJSON batches, or that exceed MAX_BODY_BYTES are left to the
+// handler, which reports decoding errors and size limits itself.
+func (s *openAPISpec) checkRequestBody(operation *openAPIOperation, r *http.Request) []string {
+    if operation.RequestBody == nil || r.Body == nil {
+        return nil
+    }
+    media, ok := operation.RequestBody.Content["application/json"]
+    if !ok {
+        return nil
+    }
+
+    data, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+    r.Body = struct {
+        io.Reader
+        io.Closer
+    }{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+    if err != nil || len(data) == 0 || int64(len(data)) > maxBodyBytes {
+        return nil
+    }
+    var body interface{}
+    if json.Unmarshal(data, &body) != nil {
+        return nil
+    }
+    return s.checkValue(body, media.Schema, "body")
+}
+
+// specRecorder remembers the status of a response and, when body is set, its content
+type specRecorder struct {
+    http.ResponseWriter
+    status int
+    body   *bytes.Buffer
+}
+
+// WriteHeader records the status before passing it on
+func (s *specRecorder) WriteHeader(status int) {
+    if s.status == 0 {
+        s.status = status
+    }
+    s.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body before passing it on
+func (s *specRecorder) Write(data []byte) (int, error) {
+    if s.status == 0 {
+        s.status = http.StatusOK
+    }
+    if s.body != nil {
+        s.body.Write(data)
+    }
+    return s.ResponseWriter.Write(data)
+}
+
+// checkResponse compares a recorded response with the operation's responses.
+// Error statuses fall under the default response.
+func (s *openAPISpec) checkResponse(operation *openAPIOperation, recorder *specRecorder) []string {
+    status := recorder.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    response, ok := operation.Responses[strconv.Itoa(status)]
+    if !ok {
+        if status < http.StatusBadRequest {
+            return []string{"undocumented status " + strconv.Itoa(status)}
+        }
+        response = operation.Responses["default"]
+    }
+    if response == nil || len(response.Content) == 0 {
+        return nil
+    }
+
+    contentType := strings.TrimSpace(strings.Split(recorder.Header().Get("Content-Type"), ";")[0])
+    media, ok := response.Content[contentType]
+    if !ok {
+        return []string{"undocumented content type " + contentType + " for status " + strconv.Itoa(status)}
+    }
+    if recorder.body == nil || !strings.HasSuffix(contentType, "json") {
+        return nil
+    }
+    var body interface{}
+    if err := json.Unmarshal(recorder.body.Bytes(), &body); err != nil {
+        return []string{"body is not JSON: " + err.Error()}
+    }
+    return s.checkValue(body, media.Schema, "body")
+}
+
+// checkValue validates a decoded JSON value against a schema, naming each
+// mismatch by its path from name
+func (s *openAPISpec) checkValue(value interface{}, schema *openAPISchema, name string) []string {
+    schema = s.schema(schema)
+    if schema == nil {
+        return nil
+    }
+    var violations []string
+    for _, part := range schema.AllOf {
+        violations = append(violations, s.checkValue(value, part, name)...)
+    }
+    if value == nil {
+        if schema.Type != "" && !schema.Nullable {
+            violations = append(violations, name+" must not be null")
+        }
+        return violations
+    }
+
+    switch schema.Type {
+    case "object":
+        object, ok := value.(map[string]interface{})
+        if !ok {
+            return append(violations, name+" must be an object")
+        }
+        for _, property := range schema.Required {
+            if _, ok := object[property]; !ok {
+                violations = append(violations, name+"."+property+" is required")
+            }
+        }
+        for property, propertySchema := range schema.Properties {
+            if propertyValue, ok := object[property]; ok {
+                violations = append(violations, s.checkValue(propertyValue, propertySchema, name+"."+property)...)
+            }
+        }
+    case "array":
+        items, ok := value.([]interface{})
+        if !ok {
+            return append(violations, name+" must be an array")
+        }
+        if schema.MinItems != nil && len(items) < *schema.MinItems {
+            violations = append(violations, fmt.Sprintf("%s must have at least %d items", name, *schema.MinItems))
+        }
+        if schema.MaxItems != nil && len(items) > *schema.MaxItems {
+            violations = append(violations, fmt.Sprintf("%s must have at most %d items", name, *schema.MaxItems))
+        }
+        for i, item := range items {
+            violations = append(violations, s.checkValue(item, schema.Items, fmt.Sprintf("%s[%d]", name, i))...)
+        }
+    case "string":
+        text, ok := value.(string)
+        if !ok {
+            return append(violations, name+" must be a string")
+        }
+        if schema.MinLength != nil && len(text) < *schema.MinLength {
+            violations = append(violations, fmt.Sprintf("%s must be at least %d characters", name, *schema.MinLength))
+        }
+        if schema.Format == "date-time" {
+            if _, err := time.Parse(time.RFC3339, text); err != nil {
+                violations = append(violations, name+" must be an RFC 3339 time")
+            }
+        }
+    case "integer", "number":
+        number, ok := value.(float64)
+        if !ok || (schema.Type == "integer" && number != math.Trunc(number)) {
+            if schema.Type == "integer" {
+                return append(violations, name+" must be an integer")
+            }
+            return append(violations, name+" must be a number")
+        }
+        if schema.Minimum != nil && schema.ExclusiveMinimum && number <= *schema.Minimum {
+            violations = append(violations, fmt.Sprintf("%s must be greater than %g", name, *schema.Minimum))
+        } else if schema.Minimum != nil && number < *schema.Minimum {
+            violations = append(violations, fmt.Sprintf("%s is below the minimum of %g", name, *schema.Minimum))
+        }
+        if schema.Maximum != nil && number > *schema.Maximum {
+            violations = append(violations, fmt.Sprintf("%s is above the maximum of %g", name, *schema.Maximum))
+        }
+    case "boolean":
+        if _, ok := value.(bool); !ok {
+            return append(violations, name+" must be a boolean")
+        }
+    }
+
+    if len(schema.Enum) > 0 {
+        allowed := false
+        for _, option := range schema.Enum {
+            if option == value {
+                allowed = true
+            }
+        }
+        if !allowed {
+            violations = append(violations, fmt.Sprintf("%s must be one of %v", name, schema.Enum))
+        }
+    }
+    return violations
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "time"
+)
+
+// Decisions taken for an incoming location update
+const (
+    DecisionApplied   = "applied"
+    DecisionDuplicate = "duplicate"
+    DecisionArchived  = "archived"
+    DecisionRejected  = "rejected"
+)
+
+// taxiIDUnavailable is the reason given when a taxi ID is already in use
+// within the caller's tenant
+const taxiIDUnavailable = "taxi_id is not available"
+
+// maxClockSkew bounds how far ahead of the server clock a device timestamp may be
+const maxClockSkew = 5 * time.Minute
+
+// LocationDecision tells a device what happened to the location it sent
+type LocationDecision struct {
+    TaxiID    string    `json:"taxi_id"`
+    Decision  string    `json:"decision"`
+    Reason    string    `json:"reason,omitempty"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// deviceTime returns the time a location was recorded by the device, falling
+// back to the server clock for devices that do not report one
+func deviceTime(location TaxiLocation) time.Time {
+    if location.Timestamp != nil && !location.Timestamp.IsZero() {
+        return location.Timestamp.UTC()
+    }
+    return time.Now().UTC()
+}
+
+// storeLocation upserts a location unless the stored one is at least as recent.
+// Retransmissions of the stored fix are reported as duplicates, older fixes
+// are moved to location_archive and implausible fixes to location_quarantine
+// instead of overwriting the current position.
+func storeLocation(location TaxiLocation) (LocationDecision, error) {
+    timestamp := deviceTime(location)
+    decision := LocationDecision{TaxiID: location.TaxiID, Decision: DecisionApplied, Timestamp: timestamp}
+
+    previous, err := loadPreviousFixes(location.Tenant, []string{location.TaxiID})
+    if err != nil {
+        return decision, err
+    }
+    previousFix := previous[location.TaxiID]
+    if reason := screenLocation(location, timestamp, previousFix); reason != "" {
+        decision.Decision, decision.Reason = DecisionQuarantined, reason
+        return decision, quarantineLocation(location, timestamp, reason)
+    }
+
+    smoothed := []*smoothedFix{smoothLocation(location, timestamp, previousFix)}
+    applied, err := upsertLocations([]TaxiLocation{location}, []time.Time{timestamp}, smoothed, []int{0})
+    if err != nil {
+        return decision, err
+    }
+    if !applied[0] {
+        decision.Decision, decision.Reason, err = resolveUnapplied(location, timestamp)
+    }
+    return decision, err
+}
+
+// resolveUnapplied classifies a location the upsert refused to apply against
+// the stored fix, see resolveStale
+func resolveUnapplied(location TaxiLocation, timestamp time.Time) (string, string, error) {
+    var stored sql.NullTime
+    var longitude, latitude float64
+    err := db.QueryRow("SELECT device_time, longitude, latitude FROM taxi_location WHERE tenant = $1 AND taxi_id = $2",
+        location.Tenant, location.TaxiID).Scan(&stored, &longitude, &latitude)
+    if err != nil {
+        return "", "", err
+    }
+    return resolveStale(location, timestamp, stored, longitude, latitude)
+}
+
+// resolveStale classifies a location that is not newer than the stored fix:
+// an exact retransmission of the stored fix is a duplicate, a different
+// position at the stored fix's time is archived as a conflict, and anything
+// else is older than the stored fix and gets archived
+func resolveStale(location TaxiLocation, timestamp time.Time, stored sql.NullTime, longitude, latitude float64) (string, string, error) {
+    reason := "older than the stored location"
+    if stored.Valid && stored.Time.Equal(timestamp) {
+        if longitude == location.Longitude && latitude == location.Latitude {
+            return DecisionDuplicate, "identical to the stored location", nil
+        }
+        reason = "conflicts with the stored location at the same time"
+    }
+    if err := archiveLocation(location, timestamp, reason); err != nil {
+        return "", "", err
+    }
+    return DecisionArchived, reason, nil
+}
+
+// archiveLocation keeps a location that arrived out of order for later analysis
+func archiveLocation(location TaxiLocation, timestamp time.Time, reason string) error {
+    _, err := db.Exec(`INSERT INTO location_archive (taxi_id, longitude, latitude, device_time, reason, tenant)
+        VALUES ($1, $2, $3, $4, $5, $6)`,
+        location.TaxiID, location.Longitude, location.Latitude, timestamp, reason, location.Tenant)
+    if err != nil {
+        log.Printf("Failed to archive location for Taxi ID %s: %v\n", location.TaxiID, err)
+    }
+    return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStoreLocation(t *testing.T) {
+    stored := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name      string
+        timestamp time.Time
+        longitude float64
+        applied   bool
+        archive   bool
+        decision  string
+        reason    string
+    }{
+        {"newer", stored.Add(time.Minute), 106.801, true, false, DecisionApplied, ""},
+        {"late", stored.Add(-time.Minute), 106.799, false, true, DecisionArchived, "older than the stored location"},
+        {"duplicate", stored, 106.8, false, false, DecisionDuplicate, "identical to the stored location"},
+        {"conflict", stored, 106.801, false, true, DecisionArchived, "conflicts with the stored location at the same time"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectQuery("WHERE t.taxi_id = ANY").WillReturnRows(sqlmock.NewRows(previousFixColumns))
+            applied := sqlmock.NewRows([]string{"item"})
+            if test.applied {
+                applied.AddRow(0)
+            }
+            mock.ExpectQuery("WITH incoming").WithArgs(upsertArgs(0, "t1", test.timestamp)...).WillReturnRows(applied)
+            if !test.applied {
+                mock.ExpectQuery("SELECT device_time, longitude, latitude FROM taxi_location").
+                    WithArgs(defaultTenant, "t1").
+                    WillReturnRows(sqlmock.NewRows([]string{"device_time", "longitude", "latitude"}).AddRow(stored, 106.8, -6.2))
+            }
+            if test.archive {
+                mock.ExpectExec("INSERT INTO location_archive").
+                    WithArgs("t1", test.longitude, -6.2, test.timestamp, test.reason, defaultTenant).
+                    WillReturnResult(sqlmock.NewResult(1, 1))
+            }
+
+            timestamp := test.timestamp
+            decision, err := storeLocation(TaxiLocation{TaxiID: "t1", Longitude: test.longitude, Latitude: -6.2,
+                Timestamp: &timestamp, Tenant: defaultTenant})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if decision.Decision != test.decision || decision.Reason != test.reason {
+                t.Fatalf("got %s (%s), want %s (%s)", decision.Decision, decision.Reason, test.decision, test.reason)
+            }
+        })
+    }
+}
+
+func TestIngestLateDuplicateAndNewerFixes(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    stored := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    fix := func(taxiID string, longitude float64, at time.Time) string {
+        return fmt.Sprintf(`{"taxi_id":"%s","longitude":%g,"latitude":-6.2,"timestamp":"%s"}`, taxiID, longitude, at.Format(time.RFC3339))
+    }
+    body := "[" + strings.Join([]string{
+        fix("t1", 106.801, stored.Add(time.Minute)),   // 0: newer
+        fix("t1", 106.799, stored.Add(-time.Minute)),  // 1: late
+        fix("t1", 106.8, stored),                      // 2: retransmission of the stored fix
+        fix("t1", 106.805, stored),                    // 3: same time as 2, elsewhere
+        fix("t1", 106.801, stored.Add(time.Minute)),   // 4: repeat of 0
+        fix("t1", 106.802, stored.Add(2*time.Minute)), // 5: newer still
+        fix("t2", 106.9, stored),                      // 6: overtaken by a concurrent writer
+    }, ",") + "]"
+
+    mock.ExpectQuery("WHERE t.taxi_id = ANY").
+        WillReturnRows(sqlmock.NewRows(previousFixColumns).
+            AddRow("t1", 106.8, -6.2, stored, nil, nil, nil, nil, nil, nil, nil))
+    // Late and conflicting fixes are archived without reaching the upsert
+    mock.ExpectExec("INSERT INTO location_archive").
+        WithArgs("t1", 106.799, -6.2, stored.Add(-time.Minute), "older than the stored location", defaultTenant).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectExec("INSERT INTO location_archive").
+        WithArgs("t1", 106.805, -6.2, stored, "conflicts with another item in the batch at the same time", defaultTenant).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    // Both newer t1 fixes are stored in order in one statement with t2's
+    var args []driver.Value
+    args = append(args, upsertArgs(0, "t1", stored.Add(time.Minute))...)
+    args = append(args, upsertArgs(5, "t1", stored.Add(2*time.Minute))...)
+    args = append(args, upsertArgs(6, "t2", stored)...)
+    mock.ExpectQuery("WITH incoming").WithArgs(args...).
+        WillReturnRows(sqlmock.NewRows([]string{"item"}).AddRow(0).AddRow(5))
+    mock.ExpectQuery("SELECT device_time, longitude, latitude FROM taxi_location").WithArgs(defaultTenant, "t2").
+        WillReturnRows(sqlmock.NewRows([]string{"device_time", "longitude", "latitude"}).AddRow(stored.Add(time.Hour), 106.9, -6.2))
+    mock.ExpectExec("INSERT INTO location_archive").
+        WithArgs("t2", 106.9, -6.2, stored, "older than the stored location", defaultTenant).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+
+    w := httptest.NewRecorder()
+    ingestLocationBatch(w, httptest.NewRequest(http.MethodPost, "/v1/locations/batch", strings.NewReader(body)))
+    var response BatchResponse
+    if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+        t.Fatalf("got status %d, %v", w.Code, err)
+    }
+
+    want := []struct {
+        status   string
+        decision string
+    }{
+        {BatchAccepted, DecisionApplied},
+        {BatchRejected, DecisionArchived},
+        {BatchRejected, DecisionDuplicate},
+        {BatchRejected, DecisionArchived},
+        {BatchRejected, DecisionDuplicate},
+        {BatchAccepted, DecisionApplied},
+        {BatchRejected, DecisionArchived},
+    }
+    for i, result := range response.Results {
+        if result.Status != want[i].status || result.Decision != want[i].decision {
+            t.Errorf("item %d: got %s %s (%s), want %s %s", i, result.Status, result.Decision, result.Reason,
+                want[i].status, want[i].decision)
+        }
+    }
+    if response.Accepted != 2 || response.Rejected != 5 {
+        t.Fatalf("got %d accepted and %d rejected, want 2 and 5", response.Accepted, response.Rejected)
+    }
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // defaultPageSize applies to versioned list endpoints called without ?limit=
+    defaultPageSize = 100
+    maxPageSize     = 1000
+)
+
+var (
+    errInvalidLimit  = errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+    errInvalidCursor = errors.New("invalid cursor")
+    errInvalidSort   = errors.New("invalid sort")
+
+    errInvalidPlaceID      = errors.New("place_id must be a list of integers")
+    errInvalidUpdatedSince = errors.New("updated_since must be an RFC 3339 time")
+)
+
+// sortOption is a sort order offered by a list endpoint. Rows are ordered by
+// Expr and then by the unique Tiebreak column, so keyset pagination over the
+// pair never skips or repeats a row.
+type sortOption struct {
+    Expr     string // SQL expression to order by
+    Type     string // SQL type of Expr, used to decode cursor keys
+    Tiebreak string // unique column breaking ties
+    Desc     bool
+}
+
+// pageCursor marks where the previous page ended
+type pageCursor struct {
+    Sort     string `json:"s"`
+    Key      string `json:"k"`
+    Tiebreak string `json:"t"`
+}
+
+// pageRequest is a parsed ?limit=, ?sort= and ?cursor=. Limit 0 means unbounded.
+type pageRequest struct {
+    Limit    int
+    SortName string
+    Sort     sortOption
+    After    *pageCursor
+}
+
+// parsePage reads the paging parameters of a list endpoint. ?sort= takes one
+// of the endpoint's option names, prefixed with "-" for descending order.
+// Legacy paths stay unbounded unless ?limit= is given.
+func parsePage(r *http.Request, sorts map[string]sortOption, defaultSort string) (pageRequest, error) {
+    query := r.URL.Query()
+    page := pageRequest{SortName: defaultSort}
+    if !isLegacyRequest(r) {
+        page.Limit = defaultPageSize
+    }
+    if value := query.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit < 1 || limit > maxPageSize {
+            return page, errInvalidLimit
+        }
+        page.Limit = limit
+    }
+
+    if value := query.Get("sort"); value != "" {
+        page.SortName = value
+    }
+    sort, ok := sorts[strings.TrimPrefix(page.SortName, "-")]
+    if !ok {
+        return page, errInvalidSort
+    }
+    sort.Desc = strings.HasPrefix(page.SortName, "-")
+    page.Sort = sort
+
+    if value := query.Get("cursor"); value != "" {
+        data, err := base64.RawURLEncoding.DecodeString(value)
+        if err != nil {
+            return page, errInvalidCursor
+        }
+        var cursor pageCursor
+        if err := json.Unmarshal(data, &cursor); err != nil || cursor.Sort != page.SortName {
+            return page, errInvalidCursor
+        }
+        page.After = &cursor
+    }
+    return page, nil
+}
+
+// sqlFilter collects the conditions and arguments of a dynamically filtered query
+type sqlFilter struct {
+    conditions []string
+    args       []interface{}
+}
+
+// arg adds an argument and returns its placeholder
+func (f *sqlFilter) arg(value interface{}) string {
+    f.args = append(f.args, value)
+    return "$" + strconv.Itoa(len(f.args))
+}
+
+// where adds a condition; %s verbs are replaced by placeholders for values
+func (f *sqlFilter) where(condition string, values ...interface{}) {
+    placeholders := make([]interface{}, len(values))
+    for i, value := range values {
+        placeholders[i] = f.arg(value)
+    }
+    f.conditions = append(f.conditions, fmt.Sprintf(condition, placeholders...))
+}
+
+// tenant restricts column to the tenant, or to nothing for cross-tenant reads
+func (f *sqlFilter) tenant(column, tenant string) {
+    f.arg(tenant)
+    f.conditions = append(f.conditions, tenantClause(column, len(f.args)))
+}
+
+// clause returns the WHERE clause, or nothing without conditions
+func (f *sqlFilter) clause() string {
+    if len(f.conditions) == 0 {
+        return ""
+    }
+    return " WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+// apply adds the page's keyset condition to a filter and returns the
+// ORDER BY and LIMIT suffix of the query. The query must select
+// page.sortKeySQL() and page.Sort.Tiebreak as text so cursors can be built.
+func (p pageRequest) apply(f *sqlFilter) string {
+    direction, comparison := "ASC", ">"
+    if p.Sort.Desc {
+        direction, comparison = "DESC", "<"
+    }
+    if p.After != nil {
+        f.where("("+p.Sort.Expr+", "+p.Sort.Tiebreak+") "+comparison+" (CAST(%s AS "+p.Sort.Type+"), %s)",
+            p.After.Key, p.After.Tiebreak)
+    }
+    suffix := " ORDER BY " + p.Sort.Expr + " " + direction + ", " + p.Sort.Tiebreak + " " + direction
+    if p.Limit > 0 {
+        // One extra row tells whether another page follows
+        suffix += " LIMIT " + f.arg(p.Limit+1)
+    }
+    return suffix
+}
+
+// sortKeySQL selects the sort key and tiebreak of a row as text
+func (p pageRequest) sortKeySQL() string {
+    return "(" + p.Sort.Expr + ")::text, (" + p.Sort.Tiebreak + ")::text"
+}
+
+// nextCursor trims the extra row fetched by apply and returns the cursor of
+// the following page, or "" on the last page. keys holds the sort key and
+// tiebreak of every fetched row.
+func (p pageRequest) nextCursor(rows int, keys [][2]string) (int, string) {
+    if p.Limit == 0 || rows <= p.Limit {
+        return rows, ""
+    }
+    last := keys[p.Limit-1]
+    data, _ := json.Marshal(pageCursor{Sort: p.SortName, Key: last[0], Tiebreak: last[1]})
+    return p.Limit, base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Page is the response of a versioned list endpoint
+type Page struct {
+    Items      interface{} `json:"items"`
+    NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// writePage answers a list request. Legacy paths keep returning a bare array
+// and report the next cursor in the X-Next-Cursor header.
+func writePage(w http.ResponseWriter, r *http.Request, items interface{}, next string) {
+    w.Header().Set("Content-Type", "application/json")
+    if isLegacyRequest(r) {
+        if next != "" {
+            w.Header().Set("X-Next-Cursor", next)
+        }
+        json.NewEncoder(w).Encode(items)
+        return
+    }
+    json.NewEncoder(w).Encode(Page{Items: items, NextCursor: next})
+}
+
+// listFilters are the filters shared by list endpoints. Unlike a live
+// subscription, every given filter must match.
+type listFilters struct {
+    BBox         []float64 // minLon, minLat, maxLon, maxLat
+    PlaceIDs     []int
+    TaxiIDs      []string
+    UpdatedSince *time.Time
+    Name         string // case-insensitive substring of the place name
+}
+
+// parseListFilters reads ?bbox=, ?place_id=, ?taxi_id=, ?updated_since= and ?q=
+func parseListFilters(r *http.Request) (listFilters, error) {
+    var filters listFilters
+    query := r.URL.Query()
+
+    if bbox := query.Get("bbox"); bbox != "" {
+        values, err := parseFloatList(bbox)
+        if err != nil || len(values) != 4 || values[0] > values[2] || values[1] > values[3] {
+            return filters, errInvalidBBox
+        }
+        filters.BBox = values
+    }
+    for _, part := range splitList(query.Get("place_id")) {
+        id, err := strconv.Atoi(part)
+        if err != nil {
+            return filters, errInvalidPlaceID
+        }
+        filters.PlaceIDs = append(filters.PlaceIDs, id)
+    }
+    filters.TaxiIDs = splitList(query.Get("taxi_id"))
+    if value := query.Get("updated_since"); value != "" {
+        t, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            return filters, errInvalidUpdatedSince
+        }
+        filters.UpdatedSince = &t
+    }
+    filters.Name = strings.TrimSpace(query.Get("q"))
+    return filters, nil
+}
+
+// likePattern matches value as a literal substring in ILIKE
+func likePattern(value string) string {
+    return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value) + "%"
+}
@@ -0,0 +1,700 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: parking.proto
+
+// The gRPC API of service-parking. It shares storage, plausibility filtering,
+// tenancy and credentials with the REST API; see grpc.go.
+
+package parkingpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Location struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	TaxiId    string                 `protobuf:"bytes,1,opt,name=taxi_id,json=taxiId,proto3" json:"taxi_id,omitempty"`
+	Longitude float64                `protobuf:"fixed64,2,opt,name=longitude,proto3" json:"longitude,omitempty"`
+	Latitude  float64                `protobuf:"fixed64,3,opt,name=latitude,proto3" json:"latitude,omitempty"`
+	// Device-reported fix time; the server clock is used when unset
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Device-reported accuracy in metres
+	Accuracy      float64 `protobuf:"fixed64,5,opt,name=accuracy,proto3" json:"accuracy,omitempty"`
+	Fleet         string  `protobuf:"bytes,6,opt,name=fleet,proto3" json:"fleet,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Location) Reset() {
+	*x = Location{}
+	mi := &file_parking_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Location) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Location) ProtoMessage() {}
+
+func (x *Location) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Location.ProtoReflect.Descriptor instead.
+func (*Location) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Location) GetTaxiId() string {
+	if x != nil {
+		return x.TaxiId
+	}
+	return ""
+}
+
+func (x *Location) GetLongitude() float64 {
+	if x != nil {
+		return x.Longitude
+	}
+	return 0
+}
+
+func (x *Location) GetLatitude() float64 {
+	if x != nil {
+		return x.Latitude
+	}
+	return 0
+}
+
+func (x *Location) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Location) GetAccuracy() float64 {
+	if x != nil {
+		return x.Accuracy
+	}
+	return 0
+}
+
+func (x *Location) GetFleet() string {
+	if x != nil {
+		return x.Fleet
+	}
+	return ""
+}
+
+type LocationResult struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Position of the location in the stream, counting from 0
+	Index  int64  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	TaxiId string `protobuf:"bytes,2,opt,name=taxi_id,json=taxiId,proto3" json:"taxi_id,omitempty"`
+	// applied, duplicate, archived, quarantined or rejected
+	Decision      string `protobuf:"bytes,3,opt,name=decision,proto3" json:"decision,omitempty"`
+	Reason        string `protobuf:"bytes,4,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LocationResult) Reset() {
+	*x = LocationResult{}
+	mi := &file_parking_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LocationResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LocationResult) ProtoMessage() {}
+
+func (x *LocationResult) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LocationResult.ProtoReflect.Descriptor instead.
+func (*LocationResult) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LocationResult) GetIndex() int64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *LocationResult) GetTaxiId() string {
+	if x != nil {
+		return x.TaxiId
+	}
+	return ""
+}
+
+func (x *LocationResult) GetDecision() string {
+	if x != nil {
+		return x.Decision
+	}
+	return ""
+}
+
+func (x *LocationResult) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+type ReportLocationsResponse struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Accepted int64                  `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Rejected int64                  `protobuf:"varint,2,opt,name=rejected,proto3" json:"rejected,omitempty"`
+	// The rejected locations, up to the first 10000
+	Rejections    []*LocationResult `protobuf:"bytes,3,rep,name=rejections,proto3" json:"rejections,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReportLocationsResponse) Reset() {
+	*x = ReportLocationsResponse{}
+	mi := &file_parking_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReportLocationsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReportLocationsResponse) ProtoMessage() {}
+
+func (x *ReportLocationsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReportLocationsResponse.ProtoReflect.Descriptor instead.
+func (*ReportLocationsResponse) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ReportLocationsResponse) GetAccepted() int64 {
+	if x != nil {
+		return x.Accepted
+	}
+	return 0
+}
+
+func (x *ReportLocationsResponse) GetRejected() int64 {
+	if x != nil {
+		return x.Rejected
+	}
+	return 0
+}
+
+func (x *ReportLocationsResponse) GetRejections() []*LocationResult {
+	if x != nil {
+		return x.Rejections
+	}
+	return nil
+}
+
+type WatchPlaceRequest struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	PlaceId int32                  `protobuf:"varint,1,opt,name=place_id,json=placeId,proto3" json:"place_id,omitempty"`
+	// id of the last update received before reconnecting
+	LastEventId   uint64 `protobuf:"varint,2,opt,name=last_event_id,json=lastEventId,proto3" json:"last_event_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchPlaceRequest) Reset() {
+	*x = WatchPlaceRequest{}
+	mi := &file_parking_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchPlaceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchPlaceRequest) ProtoMessage() {}
+
+func (x *WatchPlaceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchPlaceRequest.ProtoReflect.Descriptor instead.
+func (*WatchPlaceRequest) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *WatchPlaceRequest) GetPlaceId() int32 {
+	if x != nil {
+		return x.PlaceId
+	}
+	return 0
+}
+
+func (x *WatchPlaceRequest) GetLastEventId() uint64 {
+	if x != nil {
+		return x.LastEventId
+	}
+	return 0
+}
+
+type OccupancyUpdate struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	PlaceId       int32                  `protobuf:"varint,2,opt,name=place_id,json=placeId,proto3" json:"place_id,omitempty"`
+	Occupancy     int32                  `protobuf:"varint,3,opt,name=occupancy,proto3" json:"occupancy,omitempty"`
+	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OccupancyUpdate) Reset() {
+	*x = OccupancyUpdate{}
+	mi := &file_parking_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OccupancyUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OccupancyUpdate) ProtoMessage() {}
+
+func (x *OccupancyUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OccupancyUpdate.ProtoReflect.Descriptor instead.
+func (*OccupancyUpdate) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *OccupancyUpdate) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *OccupancyUpdate) GetPlaceId() int32 {
+	if x != nil {
+		return x.PlaceId
+	}
+	return 0
+}
+
+func (x *OccupancyUpdate) GetOccupancy() int32 {
+	if x != nil {
+		return x.Occupancy
+	}
+	return 0
+}
+
+func (x *OccupancyUpdate) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+type BoundingBox struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MinLon        float64                `protobuf:"fixed64,1,opt,name=min_lon,json=minLon,proto3" json:"min_lon,omitempty"`
+	MinLat        float64                `protobuf:"fixed64,2,opt,name=min_lat,json=minLat,proto3" json:"min_lat,omitempty"`
+	MaxLon        float64                `protobuf:"fixed64,3,opt,name=max_lon,json=maxLon,proto3" json:"max_lon,omitempty"`
+	MaxLat        float64                `protobuf:"fixed64,4,opt,name=max_lat,json=maxLat,proto3" json:"max_lat,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BoundingBox) Reset() {
+	*x = BoundingBox{}
+	mi := &file_parking_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BoundingBox) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BoundingBox) ProtoMessage() {}
+
+func (x *BoundingBox) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BoundingBox.ProtoReflect.Descriptor instead.
+func (*BoundingBox) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *BoundingBox) GetMinLon() float64 {
+	if x != nil {
+		return x.MinLon
+	}
+	return 0
+}
+
+func (x *BoundingBox) GetMinLat() float64 {
+	if x != nil {
+		return x.MinLat
+	}
+	return 0
+}
+
+func (x *BoundingBox) GetMaxLon() float64 {
+	if x != nil {
+		return x.MaxLon
+	}
+	return 0
+}
+
+func (x *BoundingBox) GetMaxLat() float64 {
+	if x != nil {
+		return x.MaxLat
+	}
+	return 0
+}
+
+// An empty request receives every event; otherwise an event is delivered
+// when it matches any of the vehicles, places or the bounding box.
+type WatchVehiclesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Bbox          *BoundingBox           `protobuf:"bytes,1,opt,name=bbox,proto3" json:"bbox,omitempty"`
+	PlaceIds      []int32                `protobuf:"varint,2,rep,packed,name=place_ids,json=placeIds,proto3" json:"place_ids,omitempty"`
+	TaxiIds       []string               `protobuf:"bytes,3,rep,name=taxi_ids,json=taxiIds,proto3" json:"taxi_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchVehiclesRequest) Reset() {
+	*x = WatchVehiclesRequest{}
+	mi := &file_parking_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchVehiclesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchVehiclesRequest) ProtoMessage() {}
+
+func (x *WatchVehiclesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchVehiclesRequest.ProtoReflect.Descriptor instead.
+func (*WatchVehiclesRequest) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *WatchVehiclesRequest) GetBbox() *BoundingBox {
+	if x != nil {
+		return x.Bbox
+	}
+	return nil
+}
+
+func (x *WatchVehiclesRequest) GetPlaceIds() []int32 {
+	if x != nil {
+		return x.PlaceIds
+	}
+	return nil
+}
+
+func (x *WatchVehiclesRequest) GetTaxiIds() []string {
+	if x != nil {
+		return x.TaxiIds
+	}
+	return nil
+}
+
+type VehicleEvent struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// vehicle.position, place.assigned or vehicle.offline
+	Type          string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	TaxiId        string                 `protobuf:"bytes,2,opt,name=taxi_id,json=taxiId,proto3" json:"taxi_id,omitempty"`
+	PlaceId       int32                  `protobuf:"varint,3,opt,name=place_id,json=placeId,proto3" json:"place_id,omitempty"`
+	Longitude     float64                `protobuf:"fixed64,4,opt,name=longitude,proto3" json:"longitude,omitempty"`
+	Latitude      float64                `protobuf:"fixed64,5,opt,name=latitude,proto3" json:"latitude,omitempty"`
+	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VehicleEvent) Reset() {
+	*x = VehicleEvent{}
+	mi := &file_parking_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VehicleEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VehicleEvent) ProtoMessage() {}
+
+func (x *VehicleEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_parking_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VehicleEvent.ProtoReflect.Descriptor instead.
+func (*VehicleEvent) Descriptor() ([]byte, []int) {
+	return file_parking_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *VehicleEvent) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *VehicleEvent) GetTaxiId() string {
+	if x != nil {
+		return x.TaxiId
+	}
+	return ""
+}
+
+func (x *VehicleEvent) GetPlaceId() int32 {
+	if x != nil {
+		return x.PlaceId
+	}
+	return 0
+}
+
+func (x *VehicleEvent) GetLongitude() float64 {
+	if x != nil {
+		return x.Longitude
+	}
+	return 0
+}
+
+func (x *VehicleEvent) GetLatitude() float64 {
+	if x != nil {
+		return x.Latitude
+	}
+	return 0
+}
+
+func (x *VehicleEvent) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+var File_parking_proto protoreflect.FileDescriptor
+
+const file_parking_proto_rawDesc = "" +
+	"\n" +
+	"\rparking.proto\x12\n" +
+	"parking.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xc9\x01\n" +
+	"\bLocation\x12\x17\n" +
+	"\ataxi_id\x18\x01 \x01(\tR\x06taxiId\x12\x1c\n" +
+	"\tlongitude\x18\x02 \x01(\x01R\tlongitude\x12\x1a\n" +
+	"\blatitude\x18\x03 \x01(\x01R\blatitude\x128\n" +
+	"\ttimestamp\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12\x1a\n" +
+	"\baccuracy\x18\x05 \x01(\x01R\baccuracy\x12\x14\n" +
+	"\x05fleet\x18\x06 \x01(\tR\x05fleet\"s\n" +
+	"\x0eLocationResult\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x03R\x05index\x12\x17\n" +
+	"\ataxi_id\x18\x02 \x01(\tR\x06taxiId\x12\x1a\n" +
+	"\bdecision\x18\x03 \x01(\tR\bdecision\x12\x16\n" +
+	"\x06reason\x18\x04 \x01(\tR\x06reason\"\x8d\x01\n" +
+	"\x17ReportLocationsResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\x03R\baccepted\x12\x1a\n" +
+	"\brejected\x18\x02 \x01(\x03R\brejected\x12:\n" +
+	"\n" +
+	"rejections\x18\x03 \x03(\v2\x1a.parking.v1.LocationResultR\n" +
+	"rejections\"R\n" +
+	"\x11WatchPlaceRequest\x12\x19\n" +
+	"\bplace_id\x18\x01 \x01(\x05R\aplaceId\x12\"\n" +
+	"\rlast_event_id\x18\x02 \x01(\x04R\vlastEventId\"\x94\x01\n" +
+	"\x0fOccupancyUpdate\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x19\n" +
+	"\bplace_id\x18\x02 \x01(\x05R\aplaceId\x12\x1c\n" +
+	"\toccupancy\x18\x03 \x01(\x05R\toccupancy\x128\n" +
+	"\ttimestamp\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\"q\n" +
+	"\vBoundingBox\x12\x17\n" +
+	"\amin_lon\x18\x01 \x01(\x01R\x06minLon\x12\x17\n" +
+	"\amin_lat\x18\x02 \x01(\x01R\x06minLat\x12\x17\n" +
+	"\amax_lon\x18\x03 \x01(\x01R\x06maxLon\x12\x17\n" +
+	"\amax_lat\x18\x04 \x01(\x01R\x06maxLat\"{\n" +
+	"\x14WatchVehiclesRequest\x12+\n" +
+	"\x04bbox\x18\x01 \x01(\v2\x17.parking.v1.BoundingBoxR\x04bbox\x12\x1b\n" +
+	"\tplace_ids\x18\x02 \x03(\x05R\bplaceIds\x12\x19\n" +
+	"\btaxi_ids\x18\x03 \x03(\tR\ataxiIds\"\xca\x01\n" +
+	"\fVehicleEvent\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x17\n" +
+	"\ataxi_id\x18\x02 \x01(\tR\x06taxiId\x12\x19\n" +
+	"\bplace_id\x18\x03 \x01(\x05R\aplaceId\x12\x1c\n" +
+	"\tlongitude\x18\x04 \x01(\x01R\tlongitude\x12\x1a\n" +
+	"\blatitude\x18\x05 \x01(\x01R\blatitude\x128\n" +
+	"\ttimestamp\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp2\xf4\x01\n" +
+	"\aParking\x12N\n" +
+	"\x0fReportLocations\x12\x14.parking.v1.Location\x1a#.parking.v1.ReportLocationsResponse(\x01\x12J\n" +
+	"\n" +
+	"WatchPlace\x12\x1d.parking.v1.WatchPlaceRequest\x1a\x1b.parking.v1.OccupancyUpdate0\x01\x12M\n" +
+	"\rWatchVehicles\x12 .parking.v1.WatchVehiclesRequest\x1a\x18.parking.v1.VehicleEvent0\x01B0Z.github.com/SangBejoo/service-parking/parkingpbb\x06proto3"
+
+var (
+	file_parking_proto_rawDescOnce sync.Once
+	file_parking_proto_rawDescData []byte
+)
+
+func file_parking_proto_rawDescGZIP() []byte {
+	file_parking_proto_rawDescOnce.Do(func() {
+		file_parking_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_parking_proto_rawDesc), len(file_parking_proto_rawDesc)))
+	})
+	return file_parking_proto_rawDescData
+}
+
+var file_parking_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_parking_proto_goTypes = []any{
+	(*Location)(nil),                // 0: parking.v1.Location
+	(*LocationResult)(nil),          // 1: parking.v1.LocationResult
+	(*ReportLocationsResponse)(nil), // 2: parking.v1.ReportLocationsResponse
+	(*WatchPlaceRequest)(nil),       // 3: parking.v1.WatchPlaceRequest
+	(*OccupancyUpdate)(nil),         // 4: parking.v1.OccupancyUpdate
+	(*BoundingBox)(nil),             // 5: parking.v1.BoundingBox
+	(*WatchVehiclesRequest)(nil),    // 6: parking.v1.WatchVehiclesRequest
+	(*VehicleEvent)(nil),            // 7: parking.v1.VehicleEvent
+	(*timestamppb.Timestamp)(nil),   // 8: google.protobuf.Timestamp
+}
+var file_parking_proto_depIdxs = []int32{
+	8, // 0: parking.v1.Location.timestamp:type_name -> google.protobuf.Timestamp
+	1, // 1: parking.v1.ReportLocationsResponse.rejections:type_name -> parking.v1.LocationResult
+	8, // 2: parking.v1.OccupancyUpdate.timestamp:type_name -> google.protobuf.Timestamp
+	5, // 3: parking.v1.WatchVehiclesRequest.bbox:type_name -> parking.v1.BoundingBox
+	8, // 4: parking.v1.VehicleEvent.timestamp:type_name -> google.protobuf.Timestamp
+	0, // 5: parking.v1.Parking.ReportLocations:input_type -> parking.v1.Location
+	3, // 6: parking.v1.Parking.WatchPlace:input_type -> parking.v1.WatchPlaceRequest
+	6, // 7: parking.v1.Parking.WatchVehicles:input_type -> parking.v1.WatchVehiclesRequest
+	2, // 8: parking.v1.Parking.ReportLocations:output_type -> parking.v1.ReportLocationsResponse
+	4, // 9: parking.v1.Parking.WatchPlace:output_type -> parking.v1.OccupancyUpdate
+	7, // 10: parking.v1.Parking.WatchVehicles:output_type -> parking.v1.VehicleEvent
+	8, // [8:11] is the sub-list for method output_type
+	5, // [5:8] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_parking_proto_init() }
+func file_parking_proto_init() {
+	if File_parking_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_parking_proto_rawDesc), len(file_parking_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_parking_proto_goTypes,
+		DependencyIndexes: file_parking_proto_depIdxs,
+		MessageInfos:      file_parking_proto_msgTypes,
+	}.Build()
+	File_parking_proto = out.File
+	file_parking_proto_goTypes = nil
+	file_parking_proto_depIdxs = nil
+}
@@ -0,0 +1,213 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: parking.proto
+
+// The gRPC API of service-parking. It shares storage, plausibility filtering,
+// tenancy and credentials with the REST API; see grpc.go.
+
+package parkingpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Parking_ReportLocations_FullMethodName = "/parking.v1.Parking/ReportLocations"
+	Parking_WatchPlace_FullMethodName      = "/parking.v1.Parking/WatchPlace"
+	Parking_WatchVehicles_FullMethodName   = "/parking.v1.Parking/WatchVehicles"
+)
+
+// ParkingClient is the client API for Parking service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ParkingClient interface {
+	// ReportLocations ingests a stream of device locations. Locations are
+	// stored in micro-batches as they arrive, like POST /locations/batch, and
+	// the response summarises the whole stream when the client closes it.
+	ReportLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Location, ReportLocationsResponse], error)
+	// WatchPlace streams the occupancy of one place, starting with its current
+	// occupancy or, after a reconnect, the changes missed since last_event_id.
+	WatchPlace(ctx context.Context, in *WatchPlaceRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[OccupancyUpdate], error)
+	// WatchVehicles streams live vehicle positions, place assignments and
+	// vehicles going offline, filtered like the /ws/live subscription.
+	WatchVehicles(ctx context.Context, in *WatchVehiclesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[VehicleEvent], error)
+}
+
+type parkingClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewParkingClient(cc grpc.ClientConnInterface) ParkingClient {
+	return &parkingClient{cc}
+}
+
+func (c *parkingClient) ReportLocations(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Location, ReportLocationsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Parking_ServiceDesc.Streams[0], Parking_ReportLocations_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Location, ReportLocationsResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parking_ReportLocationsClient = grpc.ClientStreamingClient[Location, ReportLocationsResponse]
+
+func (c *parkingClient) WatchPlace(ctx context.Context, in *WatchPlaceRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[OccupancyUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Parking_ServiceDesc.Streams[1], Parking_WatchPlace_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchPlaceRequest, OccupancyUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parking_WatchPlaceClient = grpc.ServerStreamingClient[OccupancyUpdate]
+
+func (c *parkingClient) WatchVehicles(ctx context.Context, in *WatchVehiclesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[VehicleEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Parking_ServiceDesc.Streams[2], Parking_WatchVehicles_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchVehiclesRequest, VehicleEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parking_WatchVehiclesClient = grpc.ServerStreamingClient[VehicleEvent]
+
+// ParkingServer is the server API for Parking service.
+// All implementations must embed UnimplementedParkingServer
+// for forward compatibility.
+type ParkingServer interface {
+	// ReportLocations ingests a stream of device locations. Locations are
+	// stored in micro-batches as they arrive, like POST /locations/batch, and
+	// the response summarises the whole stream when the client closes it.
+	ReportLocations(grpc.ClientStreamingServer[Location, ReportLocationsResponse]) error
+	// WatchPlace streams the occupancy of one place, starting with its current
+	// occupancy or, after a reconnect, the changes missed since last_event_id.
+	WatchPlace(*WatchPlaceRequest, grpc.ServerStreamingServer[OccupancyUpdate]) error
+	// WatchVehicles streams live vehicle positions, place assignments and
+	// vehicles going offline, filtered like the /ws/live subscription.
+	WatchVehicles(*WatchVehiclesRequest, grpc.ServerStreamingServer[VehicleEvent]) error
+	mustEmbedUnimplementedParkingServer()
+}
+
+// UnimplementedParkingServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedParkingServer struct{}
+
+func (UnimplementedParkingServer) ReportLocations(grpc.ClientStreamingServer[Location, ReportLocationsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ReportLocations not implemented")
+}
+func (UnimplementedParkingServer) WatchPlace(*WatchPlaceRequest, grpc.ServerStreamingServer[OccupancyUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPlace not implemented")
+}
+func (UnimplementedParkingServer) WatchVehicles(*WatchVehiclesRequest, grpc.ServerStreamingServer[VehicleEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchVehicles not implemented")
+}
+func (UnimplementedParkingServer) mustEmbedUnimplementedParkingServer() {}
+func (UnimplementedParkingServer) testEmbeddedByValue()                 {}
+
+// UnsafeParkingServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ParkingServer will
+// result in compilation errors.
+type UnsafeParkingServer interface {
+	mustEmbedUnimplementedParkingServer()
+}
+
+func RegisterParkingServer(s grpc.ServiceRegistrar, srv ParkingServer) {
+	// If the following call pancis, it indicates UnimplementedParkingServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Parking_ServiceDesc, srv)
+}
+
+func _Parking_ReportLocations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ParkingServer).ReportLocations(&grpc.GenericServerStream[Location, ReportLocationsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parking_ReportLocationsServer = grpc.ClientStreamingServer[Location, ReportLocationsResponse]
+
+func _Parking_WatchPlace_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPlaceRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ParkingServer).WatchPlace(m, &grpc.GenericServerStream[WatchPlaceRequest, OccupancyUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parking_WatchPlaceServer = grpc.ServerStreamingServer[OccupancyUpdate]
+
+func _Parking_WatchVehicles_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchVehiclesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ParkingServer).WatchVehicles(m, &grpc.GenericServerStream[WatchVehiclesRequest, VehicleEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parking_WatchVehiclesServer = grpc.ServerStreamingServer[VehicleEvent]
+
+// Parking_ServiceDesc is the grpc.ServiceDesc for Parking service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Parking_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "parking.v1.Parking",
+	HandlerType: (*ParkingServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ReportLocations",
+			Handler:       _Parking_ReportLocations_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "WatchPlace",
+			Handler:       _Parking_WatchPlace_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchVehicles",
+			Handler:       _Parking_WatchVehicles_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "parking.proto",
+}
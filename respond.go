@@ -0,0 +1,86 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+)
+
+// apiV1Prefix is the path prefix of the versioned API. The same handlers are
+// also served without it for existing clients; on those legacy paths errors
+// and messages keep their historical plain-text form.
+const apiV1Prefix = "/v1"
+
+// isLegacyRequest reports whether a request came in on an unversioned path
+func isLegacyRequest(r *http.Request) bool {
+    return r.URL.Path != apiV1Prefix && !strings.HasPrefix(r.URL.Path, apiV1Prefix+"/")
+}
+
+// APIError is the JSON error envelope of the versioned API
+type APIError struct {
+    Code      string      `json:"code"`
+    Message   string      `json:"message"`
+    Details   interface{} `json:"details,omitempty"`
+    RequestID string      `json:"request_id"`
+}
+
+// errorCodes names the machine-readable code reported for each HTTP status
+var errorCodes = map[int]string{
+    http.StatusBadRequest:            "invalid_argument",
+    http.StatusUnauthorized:          "unauthenticated",
+    http.StatusForbidden:             "permission_denied",
+    http.StatusNotFound:              "not_found",
+    http.StatusMethodNotAllowed:      "method_not_allowed",
+    http.StatusConflict:              "conflict",
+    http.StatusRequestEntityTooLarge: "payload_too_large",
+    http.StatusTooManyRequests:       "rate_limited",
+    http.StatusInternalServerError:   "internal",
+    http.StatusNotImplemented:        "unimplemented",
+    http.StatusServiceUnavailable:    "unavailable",
+}
+
+// writeError answers a request with an error. Messages must be safe to show
+// to clients; log the underlying error instead of passing it through.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+    writeErrorDetails(w, r, status, message, nil)
+}
+
+// writeErrorDetails answers with an error carrying structured details, which
+// only the versioned API reports
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, message string, details interface{}) {
+    if isLegacyRequest(r) {
+        http.Error(w, message, status)
+        return
+    }
+
+    code, ok := errorCodes[status]
+    if !ok {
+        code = "error"
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(APIError{Code: code, Message: message, Details: details, RequestID: requestIDFrom(r.Context())})
+}
+
+// writeMessage answers a request that has no resource to return, as
+// {"message": ...} on the versioned API and as plain text on legacy paths
+func writeMessage(w http.ResponseWriter, r *http.Request, status int, message string) {
+    if isLegacyRequest(r) {
+        w.WriteHeader(status)
+        w.Write([]byte(message))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// notFound and methodNotAllowed answer requests that match no route
+func notFound(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusNotFound, "Not found")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "database/sql"
+    "math"
+    "time"
+)
+
+// smoothingFleets lists the fleets whose positions are smoothed before
+// geofencing, e.g. SMOOTHING_FLEETS=bluebird,express. "*" enables all fleets.
+var smoothingFleets = envList("SMOOTHING_FLEETS")
+
+const (
+    // smoothingSpeedNoise is how fast, in m/s, the true position is assumed to drift between fixes
+    smoothingSpeedNoise = 3.0
+    // defaultAccuracy is assumed for fixes that do not report an accuracy, in metres
+    defaultAccuracy = 15.0
+    // minAccuracy stops overconfident receivers from pinning the filter
+    minAccuracy = 1.0
+    // smoothingResetAfter restarts the filter from the new fix after a gap
+    // in reporting, when the old state says nothing about the taxi's position
+    smoothingResetAfter = 10 * time.Minute
+)
+
+// smoothedFix is the filtered position of a taxi and the filter's variance in square metres
+type smoothedFix struct {
+    Longitude float64
+    Latitude  float64
+    Variance  float64
+}
+
+// smoothingEnabled reports whether a fleet has smoothing switched on
+func smoothingEnabled(fleet string) bool {
+    for _, f := range smoothingFleets {
+        if f == "*" || (fleet != "" && f == fleet) {
+            return true
+        }
+    }
+    return false
+}
+
+// smoothLocation feeds a fix into the taxi's Kalman filter and returns the
+// smoothed position, or nil when the taxi's fleet does not use smoothing.
+// The filter treats latitude and longitude independently with a variance
+// that grows with the time since the previous fix and shrinks with every
+// accurate measurement. The filter starts over after smoothingResetAfter
+// without fixes.
+func smoothLocation(location TaxiLocation, timestamp time.Time, previous *previousFix) *smoothedFix {
+    fleet := location.Fleet
+    if fleet == "" && previous != nil {
+        fleet = previous.Fleet.String
+    }
+    if !smoothingEnabled(fleet) {
+        return nil
+    }
+
+    accuracy := defaultAccuracy
+    if location.Accuracy > 0 {
+        accuracy = math.Max(location.Accuracy, minAccuracy)
+    }
+    measurementVariance := accuracy * accuracy
+
+    if previous == nil || !previous.Smoothed.Valid || !previous.Time.Valid ||
+        timestamp.Sub(previous.Time.Time) >= smoothingResetAfter {
+        return &smoothedFix{Longitude: location.Longitude, Latitude: location.Latitude, Variance: measurementVariance}
+    }
+
+    state := previous.Smoothed.smoothedFix
+    if elapsed := timestamp.Sub(previous.Time.Time).Seconds(); elapsed > 0 {
+        state.Variance += elapsed * smoothingSpeedNoise * smoothingSpeedNoise
+    }
+
+    gain := state.Variance / (state.Variance + measurementVariance)
+    state.Longitude += gain * (location.Longitude - state.Longitude)
+    state.Latitude += gain * (location.Latitude - state.Latitude)
+    state.Variance = (1 - gain) * state.Variance
+    return &state
+}
+
+// nullSmoothedFix is a smoothedFix read from nullable columns
+type nullSmoothedFix struct {
+    smoothedFix
+    Valid bool
+}
+
+// scan fills a nullSmoothedFix from the three nullable smoothing columns
+func (n *nullSmoothedFix) scan(longitude, latitude, variance sql.NullFloat64) {
+    n.Valid = longitude.Valid && latitude.Valid && variance.Valid
+    n.smoothedFix = smoothedFix{Longitude: longitude.Float64, Latitude: latitude.Float64, Variance: variance.Float64}
+}
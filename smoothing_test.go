@@ -0,0 +1,109 @@
+package main
+
+import (
+    "database/sql"
+    "math"
+    "testing"
+    "time"
+)
+
+// setSmoothingFleets enables smoothing for fleets for the duration of a test
+func setSmoothingFleets(t *testing.T, fleets ...string) {
+    previous := smoothingFleets
+    smoothingFleets = fleets
+    t.Cleanup(func() { smoothingFleets = previous })
+}
+
+// afterFix returns the previousFix the next fix is filtered against
+func afterFix(fleet string, at time.Time, smoothed *smoothedFix) *previousFix {
+    previous := &previousFix{Fleet: sql.NullString{String: fleet, Valid: fleet != ""}, Time: sql.NullTime{Time: at, Valid: true}}
+    if smoothed != nil {
+        previous.Smoothed = nullSmoothedFix{smoothedFix: *smoothed, Valid: true}
+    }
+    return previous
+}
+
+func TestSmoothingEnabledFleets(t *testing.T) {
+    setSmoothingFleets(t, "bluebird")
+    at := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name     string
+        fleet    string
+        previous *previousFix
+        want     bool
+    }{
+        {"configured fleet", "bluebird", nil, true},
+        {"other fleet", "express", nil, false},
+        {"no fleet", "", nil, false},
+        {"fleet of the stored fix", "", afterFix("bluebird", at, nil), true},
+        {"reported fleet wins", "express", afterFix("bluebird", at, nil), false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            location := TaxiLocation{TaxiID: "t1", Longitude: 106.8, Latitude: -6.2, Fleet: test.fleet}
+            smoothed := smoothLocation(location, at.Add(10*time.Second), test.previous)
+            if (smoothed != nil) != test.want {
+                t.Fatalf("got %+v, want smoothing %v", smoothed, test.want)
+            }
+        })
+    }
+
+    setSmoothingFleets(t, "*")
+    if smoothLocation(TaxiLocation{TaxiID: "t1", Longitude: 106.8, Latitude: -6.2}, at, nil) == nil {
+        t.Fatal("* did not enable smoothing for a taxi without a fleet")
+    }
+}
+
+func TestSmoothLocationConverges(t *testing.T) {
+    setSmoothingFleets(t, "bluebird")
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    // A parked taxi reporting every 10 seconds with about 20 m of jitter
+    const longitude, latitude, jitter = 106.8, -6.2, 0.0002
+
+    var smoothed *smoothedFix
+    var previous *previousFix
+    variance := math.Inf(1)
+    for i := 0; i < 30; i++ {
+        at := start.Add(time.Duration(i) * 10 * time.Second)
+        sign := float64(1 - 2*(i%2))
+        location := TaxiLocation{TaxiID: "t1", Longitude: longitude + sign*jitter, Latitude: latitude - sign*jitter,
+            Fleet: "bluebird", Accuracy: 20}
+        smoothed = smoothLocation(location, at, previous)
+        if i < 5 && smoothed.Variance >= variance {
+            t.Fatalf("fix %d: variance grew from %v to %v while the filter was settling", i, variance, smoothed.Variance)
+        }
+        variance = smoothed.Variance
+        previous = afterFix("bluebird", at, smoothed)
+    }
+
+    if off := math.Abs(smoothed.Longitude - longitude); off > jitter/2 {
+        t.Errorf("smoothed longitude is %v off, want less than half the jitter", off)
+    }
+    if off := math.Abs(smoothed.Latitude - latitude); off > jitter/2 {
+        t.Errorf("smoothed latitude is %v off, want less than half the jitter", off)
+    }
+    if smoothed.Variance >= 20*20 {
+        t.Errorf("settled variance %v is no better than a single fix", smoothed.Variance)
+    }
+}
+
+func TestSmoothLocationResetsAfterGap(t *testing.T) {
+    setSmoothingFleets(t, "bluebird")
+    at := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    state := &smoothedFix{Longitude: 106.8, Latitude: -6.2, Variance: 4}
+    location := TaxiLocation{TaxiID: "t1", Longitude: 106.9, Latitude: -6.3, Fleet: "bluebird", Accuracy: 10}
+
+    // Shortly after the last fix the filter still holds on to its state
+    smoothed := smoothLocation(location, at.Add(10*time.Second), afterFix("bluebird", at, state))
+    if smoothed.Longitude == location.Longitude || smoothed.Latitude == location.Latitude {
+        t.Fatalf("got %+v, want a position between the state and the fix", smoothed)
+    }
+
+    // After the gap it starts over from the new fix
+    smoothed = smoothLocation(location, at.Add(smoothingResetAfter), afterFix("bluebird", at, state))
+    want := smoothedFix{Longitude: location.Longitude, Latitude: location.Latitude, Variance: 100}
+    if *smoothed != want {
+        t.Fatalf("got %+v, want %+v", *smoothed, want)
+    }
+}
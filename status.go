@@ -0,0 +1,80 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "time"
+)
+
+// Vehicle status values reported by the taxi endpoints
+const (
+    StatusOnline  = "online"
+    StatusStale   = "stale"
+    StatusOffline = "offline"
+)
+
+// vehicleAgeSQL selects the age of a taxi's last update in seconds
+const vehicleAgeSQL = "EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - updated_at))"
+
+// vehicleStatus classifies a vehicle by the age of its last location update
+func vehicleStatus(age time.Duration) string {
+    switch {
+    case age < staleAfter:
+        return StatusOnline
+    case age < offlineAfter:
+        return StatusStale
+    default:
+        return StatusOffline
+    }
+}
+
+// statusFromAge converts an age in seconds as selected by vehicleAgeSQL into a status
+func statusFromAge(ageSeconds sql.NullFloat64) string {
+    if !ageSeconds.Valid {
+        return StatusOffline
+    }
+    return vehicleStatus(time.Duration(ageSeconds.Float64 * float64(time.Second)))
+}
+
+// checkVehicleStatus marks taxis that have not reported within offlineAfter as
+// offline, removes them from the place they were mapped to and publishes a
+// vehicle.offline event for each of them
+func checkVehicleStatus() {
+    rows, err := db.Query(`UPDATE taxi_location SET offline_since = CURRENT_TIMESTAMP
+        WHERE offline_since IS NULL AND updated_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+        RETURNING tenant, taxi_id, longitude, latitude`,
+        offlineAfter.Seconds())
+    if err != nil {
+        log.Println("Error marking offline taxis:", err)
+        return
+    }
+
+    var offline []Event
+    for rows.Next() {
+        event := Event{Type: EventVehicleOffline}
+        if err := rows.Scan(&event.Tenant, &event.TaxiID, &event.Longitude, &event.Latitude); err != nil {
+            log.Println("Error scanning offline taxi:", err)
+            continue
+        }
+        offline = append(offline, event)
+    }
+    if err = rows.Err(); err != nil {
+        log.Println("Row iteration error:", err)
+    }
+    rows.Close()
+
+    for _, event := range offline {
+        // An offline taxi no longer occupies the place it was last seen in
+        _, err := db.Exec("UPDATE mapping_state SET place_id = NULL WHERE tenant = $1 AND taxi_id = $2", event.Tenant, event.TaxiID)
+        if err != nil {
+            log.Printf("Failed to clear place for offline Taxi ID %s: %v\n", event.TaxiID, err)
+        }
+        closeOpenVisits(event.Tenant, event.TaxiID)
+        log.Printf("Taxi ID %s went offline\n", event.TaxiID)
+        events.Publish(event)
+    }
+
+    if len(offline) > 0 {
+        refreshOccupancy()
+    }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "database/sql"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestVehicleStatusTransitions(t *testing.T) {
+    tests := []struct {
+        name string
+        age  sql.NullFloat64
+        want string
+    }{
+        {"just reported", sql.NullFloat64{Float64: 0, Valid: true}, StatusOnline},
+        {"just before stale", sql.NullFloat64{Float64: staleAfter.Seconds() - 1, Valid: true}, StatusOnline},
+        {"stale", sql.NullFloat64{Float64: staleAfter.Seconds(), Valid: true}, StatusStale},
+        {"just before offline", sql.NullFloat64{Float64: offlineAfter.Seconds() - 1, Valid: true}, StatusStale},
+        {"offline", sql.NullFloat64{Float64: offlineAfter.Seconds(), Valid: true}, StatusOffline},
+        {"never reported", sql.NullFloat64{}, StatusOffline},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if got := statusFromAge(test.age); got != test.want {
+                t.Fatalf("got %s, want %s", got, test.want)
+            }
+        })
+    }
+}
+
+func TestCheckStatusConfig(t *testing.T) {
+    previousStale, previousOffline := staleAfter, offlineAfter
+    t.Cleanup(func() { staleAfter, offlineAfter = previousStale, previousOffline })
+
+    tests := []struct {
+        stale, offline time.Duration
+        valid          bool
+    }{
+        {10 * time.Minute, time.Hour, true},
+        {time.Hour, time.Hour, false},
+        {2 * time.Hour, time.Hour, false},
+    }
+    for _, test := range tests {
+        staleAfter, offlineAfter = test.stale, test.offline
+        if err := checkStatusConfig(); (err == nil) != test.valid {
+            t.Errorf("stale after %s, offline after %s: got %v, want valid %v", test.stale, test.offline, err, test.valid)
+        }
+    }
+}
+
+func TestCheckVehicleStatus(t *testing.T) {
+    mock := mockDB(t)
+    updates, unsubscribe := events.Subscribe(8)
+    defer unsubscribe()
+
+    // Two taxis have just gone past offlineAfter
+    mock.ExpectQuery(`UPDATE taxi_location SET offline_since = CURRENT_TIMESTAMP WHERE offline_since IS NULL`).
+        WithArgs(offlineAfter.Seconds()).
+        WillReturnRows(sqlmock.NewRows([]string{"tenant", "taxi_id", "longitude", "latitude"}).
+            AddRow("acme", "t1", 106.8, -6.2).
+            AddRow("globex", "t1", 106.9, -6.3))
+    for _, tenant := range []string{"acme", "globex"} {
+        // Each leaves its place and its open visit ends
+        mock.ExpectExec("UPDATE mapping_state SET place_id = NULL").WithArgs(tenant, "t1").
+            WillReturnResult(sqlmock.NewResult(0, 1))
+        mock.ExpectExec("UPDATE place_visits").WithArgs(tenant, "t1").
+            WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    mock.ExpectQuery("FROM mapping_state s").WillReturnRows(sqlmock.NewRows([]string{"place_id", "tenant", "count"}))
+    checkVehicleStatus()
+
+    for _, tenant := range []string{"acme", "globex"} {
+        select {
+        case event := <-updates:
+            if event.Type != EventVehicleOffline || event.Tenant != tenant || event.TaxiID != "t1" {
+                t.Fatalf("got %+v, want %s's t1 going offline", event, tenant)
+            }
+        default:
+            t.Fatalf("no offline event for %s's t1", tenant)
+        }
+    }
+
+    // Taxis already marked offline are not reported again, and occupancy is
+    // left alone when nothing changed
+    mock.ExpectQuery("UPDATE taxi_location SET offline_since").
+        WillReturnRows(sqlmock.NewRows([]string{"tenant", "taxi_id", "longitude", "latitude"}))
+    checkVehicleStatus()
+    select {
+    case event := <-updates:
+        t.Fatalf("got %+v, want no event", event)
+    default:
+    }
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// defaultTenant owns rows written before tenancy existed and writes made
+// without a tenant, e.g. with authentication switched off. It matches the
+// default of the tenant columns.
+const defaultTenant = "default"
+
+// ScopeAllTenants lets a principal act across tenants. Unlike the other
+// scopes it is not implied by ScopeAdmin, so a tenant's own admins stay
+// inside their tenant.
+const ScopeAllTenants = "tenants:all"
+
+// RoleSuperAdmin is the identity provider role that grants ScopeAllTenants
+const RoleSuperAdmin = "super_admin"
+
+// CrossTenant reports whether the principal may act on behalf of any tenant
+func (p *Principal) CrossTenant() bool {
+    for _, s := range p.Scopes {
+        if s == ScopeAllTenants {
+            return true
+        }
+    }
+    return false
+}
+
+// requestTenant returns the tenant a request is confined to. Cross-tenant
+// principals pick a tenant with the X-Tenant header (or ?tenant=) and see
+// every tenant when they do not; everybody else is pinned to their own.
+// An empty result means no tenant restriction.
+func requestTenant(r *http.Request) string {
+    requested := r.Header.Get("X-Tenant")
+    if requested == "" {
+        requested = r.URL.Query().Get("tenant")
+    }
+    return principalTenant(principalFrom(r.Context()), requested)
+}
+
+// principalTenant pins a principal to its own tenant unless it is cross-tenant
+// (or authentication is off), in which case the requested tenant applies
+func principalTenant(principal *Principal, requested string) string {
+    if principal != nil && !principal.CrossTenant() {
+        return principal.Tenant
+    }
+    return requested
+}
+
+// writeTenant returns the tenant that rows created by a request belong to
+func writeTenant(r *http.Request) string {
+    if tenant := requestTenant(r); tenant != "" {
+        return tenant
+    }
+    return defaultTenant
+}
+
+// tenantClause returns a condition restricting column to the tenant bound to
+// placeholder $n, or matching every row when that tenant is empty
+func tenantClause(column string, n int) string {
+    return fmt.Sprintf("($%d::text = '' OR %s = $%d::text)", n, column, n)
+}
+
+// taxiTenant returns the tenant whose taxi a request names by ID. Taxi IDs
+// are only unique within a tenant, so cross-tenant principals address the
+// taxis of the tenant they pick, or of the default tenant.
+func taxiTenant(r *http.Request) string {
+    return writeTenant(r)
+}
+
+// requireTaxi answers 404 and returns false unless the taxi exists in the
+// request's tenant, so other tenants' taxi IDs cannot be probed
+func requireTaxi(w http.ResponseWriter, r *http.Request, taxiID string) bool {
+    var exists bool
+    err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM taxi_location WHERE taxi_id = $1 AND tenant = $2)",
+        taxiID, taxiTenant(r)).Scan(&exists)
+    return respondExists(w, r, err, exists, "Taxi")
+}
+
+// requirePlace answers 404 and returns false unless the place exists in the request's tenant
+func requirePlace(w http.ResponseWriter, r *http.Request, placeID int) bool {
+    exists, err := placeExists(requestTenant(r), placeID)
+    return respondExists(w, r, err, exists, "Place")
+}
+
+// placeExists reports whether a place exists in a tenant
+func placeExists(tenant string, placeID int) (bool, error) {
+    var exists bool
+    err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM places WHERE place_id = $1 AND "+tenantClause("tenant", 2)+")",
+        placeID, tenant).Scan(&exists)
+    return exists, err
+}
+
+// respondExists writes the error response for requireTaxi and requirePlace
+func respondExists(w http.ResponseWriter, r *http.Request, err error, exists bool, kind string) bool {
+    if err != nil && err != sql.ErrNoRows {
+        writeError(w, r, http.StatusInternalServerError, "Failed to query "+strings.ToLower(kind))
+        return false
+    }
+    if !exists {
+        writeError(w, r, http.StatusNotFound, kind+" not found")
+        return false
+    }
+    return true
+}
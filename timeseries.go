@@ -0,0 +1,172 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Occupancy sampling settings. Raw samples older than occupancyRawRetention are
+// pruned; the hourly and daily rollups are kept.
+var (
+    occupancySampleInterval = envDuration("OCCUPANCY_SAMPLE_INTERVAL", 5*time.Minute)
+    occupancyRawRetention   = envDuration("OCCUPANCY_RAW_RETENTION", 7*24*time.Hour)
+)
+
+// checkOccupancyConfig refuses a raw retention too short to rebuild the
+// current hour's rollup from its samples. Daily rollups are built from the
+// hourly ones, so they do not depend on the retention.
+func checkOccupancyConfig() error {
+    if occupancyRawRetention < time.Hour+occupancySampleInterval {
+        return fmt.Errorf("OCCUPANCY_RAW_RETENTION (%s) must be at least an hour longer than OCCUPANCY_SAMPLE_INTERVAL (%s)",
+            occupancyRawRetention, occupancySampleInterval)
+    }
+    return nil
+}
+
+// OccupancyPoint is one point of a place's occupancy time series
+type OccupancyPoint struct {
+    Time    time.Time `json:"time"`
+    Min     int       `json:"min"`
+    Avg     float64   `json:"avg"`
+    Max     int       `json:"max"`
+    Samples int       `json:"samples"`
+}
+
+// OccupancySeries is returned by the occupancy analytics endpoint
+type OccupancySeries struct {
+    PlaceID int              `json:"place_id"`
+    Step    string           `json:"step"`
+    From    time.Time        `json:"from"`
+    To      time.Time        `json:"to"`
+    Points  []OccupancyPoint `json:"points"`
+}
+
+// sampleOccupancy stores how many vehicles are inside every place right now
+// and refreshes the hourly and daily rollups covering this sample
+func sampleOccupancy() {
+    sampledAt := time.Now().UTC().Truncate(time.Second)
+
+    _, err := db.Exec(`INSERT INTO occupancy_samples (place_id, sampled_at, vehicles)
+        SELECT p.place_id, $1, COUNT(s.taxi_id)
+        FROM places p
+        LEFT JOIN mapping_state s ON s.place_id = p.place_id
+        WHERE p.deleted_at IS NULL
+        GROUP BY p.place_id`, sampledAt)
+    if err != nil {
+        log.Println("Failed to sample occupancy:", err)
+        return
+    }
+
+    // The hour is rebuilt from its raw samples
+    _, err = db.Exec(`INSERT INTO occupancy_rollups
+            (place_id, step, bucket_start, min_vehicles, avg_vehicles, max_vehicles, samples)
+        SELECT place_id, 'hour', date_trunc('hour', sampled_at), MIN(vehicles), AVG(vehicles), MAX(vehicles), COUNT(*)
+        FROM occupancy_samples
+        WHERE sampled_at >= date_trunc('hour', $1::timestamptz) AND sampled_at < date_trunc('hour', $1::timestamptz) + INTERVAL '1 hour'
+        GROUP BY place_id, date_trunc('hour', sampled_at)
+        ON CONFLICT (place_id, step, bucket_start) DO UPDATE
+        SET min_vehicles = EXCLUDED.min_vehicles, avg_vehicles = EXCLUDED.avg_vehicles,
+            max_vehicles = EXCLUDED.max_vehicles, samples = EXCLUDED.samples`,
+        sampledAt)
+    if err != nil {
+        log.Println("Failed to roll up occupancy per hour:", err)
+        return
+    }
+
+    // and the day from its hours, weighting each hour by its samples, so
+    // days outlive the raw samples they were built from
+    _, err = db.Exec(`INSERT INTO occupancy_rollups
+            (place_id, step, bucket_start, min_vehicles, avg_vehicles, max_vehicles, samples)
+        SELECT place_id, 'day', date_trunc('day', bucket_start), MIN(min_vehicles),
+            SUM(avg_vehicles * samples) / SUM(samples), MAX(max_vehicles), SUM(samples)
+        FROM occupancy_rollups
+        WHERE step = 'hour'
+            AND bucket_start >= date_trunc('day', $1::timestamptz) AND bucket_start < date_trunc('day', $1::timestamptz) + INTERVAL '1 day'
+        GROUP BY place_id, date_trunc('day', bucket_start)
+        ON CONFLICT (place_id, step, bucket_start) DO UPDATE
+        SET min_vehicles = EXCLUDED.min_vehicles, avg_vehicles = EXCLUDED.avg_vehicles,
+            max_vehicles = EXCLUDED.max_vehicles, samples = EXCLUDED.samples`,
+        sampledAt)
+    if err != nil {
+        log.Println("Failed to roll up occupancy per day:", err)
+    }
+
+    _, err = db.Exec("DELETE FROM occupancy_samples WHERE sampled_at < $1", sampledAt.Add(-occupancyRawRetention))
+    if err != nil {
+        log.Println("Failed to prune occupancy samples:", err)
+    }
+}
+
+// getPlaceOccupancy handles GET /analytics/places/{id}/occupancy. ?step= is
+// raw, hour (default) or day; ?from= and ?to= default to the last 24 hours.
+func getPlaceOccupancy(w http.ResponseWriter, r *http.Request) {
+    placeID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid place ID")
+        return
+    }
+
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    if r.URL.Query().Get("from") == "" {
+        from = to.Add(-24 * time.Hour)
+    }
+
+    step := r.URL.Query().Get("step")
+    if step == "" {
+        step = "hour"
+    }
+
+    var query string
+    var args []interface{}
+    switch step {
+    case "raw":
+        query = `SELECT sampled_at, vehicles, vehicles, vehicles, 1
+            FROM occupancy_samples
+            WHERE place_id = $1 AND sampled_at >= $2 AND sampled_at < $3
+            ORDER BY sampled_at`
+        args = []interface{}{placeID, from, to}
+    case "hour", "day":
+        query = `SELECT bucket_start, min_vehicles, avg_vehicles, max_vehicles, samples
+            FROM occupancy_rollups
+            WHERE place_id = $1 AND bucket_start >= date_trunc($4::text, $2::timestamptz) AND bucket_start < $3 AND step = $4::text
+            ORDER BY bucket_start`
+        args = []interface{}{placeID, from, to, step}
+    default:
+        writeError(w, r, http.StatusBadRequest, "Invalid step")
+        return
+    }
+    if !requirePlace(w, r, placeID) {
+        return
+    }
+
+    rows, err := db.Query(query, args...)
+    if err != nil {
+        log.Println("Error querying occupancy series:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query occupancy")
+        return
+    }
+    defer rows.Close()
+
+    series := OccupancySeries{PlaceID: placeID, Step: step, From: from, To: to, Points: []OccupancyPoint{}}
+    for rows.Next() {
+        var point OccupancyPoint
+        if err := rows.Scan(&point.Time, &point.Min, &point.Avg, &point.Max, &point.Samples); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan occupancy")
+            return
+        }
+        series.Points = append(series.Points, point)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(series)
+}
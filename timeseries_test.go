@@ -0,0 +1,60 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckOccupancyConfig(t *testing.T) {
+    previousInterval, previousRetention := occupancySampleInterval, occupancyRawRetention
+    t.Cleanup(func() { occupancySampleInterval, occupancyRawRetention = previousInterval, previousRetention })
+
+    tests := []struct {
+        interval, retention time.Duration
+        valid               bool
+    }{
+        {5 * time.Minute, 7 * 24 * time.Hour, true},
+        {5 * time.Minute, 2 * time.Hour, true},
+        {5 * time.Minute, time.Hour + 5*time.Minute, true},
+        {5 * time.Minute, time.Hour, false},
+        {5 * time.Minute, 10 * time.Minute, false},
+    }
+    for _, test := range tests {
+        occupancySampleInterval, occupancyRawRetention = test.interval, test.retention
+        if err := checkOccupancyConfig(); (err == nil) != test.valid {
+            t.Errorf("sampling every %s, keeping %s: got %v, want valid %v", test.interval, test.retention, err, test.valid)
+        }
+    }
+}
+
+func TestSampleOccupancyRollsDaysUpFromHours(t *testing.T) {
+    mock := mockDB(t)
+    previousRetention := occupancyRawRetention
+    occupancyRawRetention = 2 * time.Hour
+    t.Cleanup(func() { occupancyRawRetention = previousRetention })
+
+    mock.ExpectExec("INSERT INTO occupancy_samples").WillReturnResult(sqlmock.NewResult(0, 3))
+    mock.ExpectExec(`SELECT place_id, 'hour', date_trunc\('hour', sampled_at\).* FROM occupancy_samples`).
+        WillReturnResult(sqlmock.NewResult(0, 3))
+    // Days come from the hourly rollups, with hours weighted by their samples,
+    // so a retention shorter than a day leaves them intact
+    mock.ExpectExec(`SELECT place_id, 'day', date_trunc\('day', bucket_start\), MIN\(min_vehicles\), ` +
+        `SUM\(avg_vehicles \* samples\) / SUM\(samples\), MAX\(max_vehicles\), SUM\(samples\) ` +
+        `FROM occupancy_rollups WHERE step = 'hour'`).
+        WillReturnResult(sqlmock.NewResult(0, 3))
+    mock.ExpectExec("DELETE FROM occupancy_samples WHERE sampled_at < \\$1").
+        WithArgs(sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(0, 36))
+    sampleOccupancy()
+}
+
+func TestSampleOccupancyKeepsSamplesWhenRollupFails(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectExec("INSERT INTO occupancy_samples").WillReturnResult(sqlmock.NewResult(0, 3))
+    mock.ExpectExec("FROM occupancy_samples").WillReturnError(errors.New("connection reset"))
+    // Neither the day is rebuilt nor are the samples pruned
+    sampleOccupancy()
+}
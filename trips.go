@@ -0,0 +1,378 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+    "github.com/paulmach/orb"
+    "github.com/paulmach/orb/geo"
+)
+
+// Segment kinds
+const (
+    SegmentTrip = "trip"
+    SegmentStop = "stop"
+)
+
+// Segmentation thresholds. A vehicle is stationary while it moves slower than
+// stopSpeedKmh, and a stationary period becomes a stop once it lasts at least
+// minStopDuration; shorter pauses such as traffic lights stay part of the trip.
+var (
+    stopSpeedKmh    = envFloat("STOP_SPEED_KMH", 5)
+    minStopDuration = envDuration("MIN_STOP_DURATION", 3*time.Minute)
+)
+
+// Errors returned for malformed time range parameters
+var (
+    errInvalidFrom = errors.New("from must be an RFC 3339 time")
+    errInvalidTo   = errors.New("to must be an RFC 3339 time")
+)
+
+// Segment is a trip or a stop derived from a vehicle's location history
+type Segment struct {
+    SegmentID       int       `json:"segment_id"`
+    TaxiID          string    `json:"taxi_id"`
+    Kind            string    `json:"kind"`
+    StartTime       time.Time `json:"start_time"`
+    EndTime         time.Time `json:"end_time"`
+    StartLongitude  float64   `json:"start_longitude"`
+    StartLatitude   float64   `json:"start_latitude"`
+    EndLongitude    float64   `json:"end_longitude"`
+    EndLatitude     float64   `json:"end_latitude"`
+    StartPlaceID    *int      `json:"start_place_id,omitempty"`
+    EndPlaceID      *int      `json:"end_place_id,omitempty"`
+    DistanceMeters  float64   `json:"distance_meters"`
+    DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// trackPoint is one position of a vehicle's history
+type trackPoint struct {
+    Longitude float64
+    Latitude  float64
+    Time      time.Time
+}
+
+// segmentTrack splits a time-ordered track into alternating trips and stops.
+// The last segment returned may still be growing and should not be treated
+// as final until later points arrive.
+func segmentTrack(taxiID string, points []trackPoint) []Segment {
+    if len(points) < 2 {
+        return nil
+    }
+
+    // Classify every point by the speed at which it was reached
+    stationary := make([]bool, len(points))
+    for i := 1; i < len(points); i++ {
+        elapsed := points[i].Time.Sub(points[i-1].Time).Hours()
+        meters := pointDistance(points[i-1], points[i])
+        stationary[i] = elapsed <= 0 && meters < 1 || elapsed > 0 && meters/1000/elapsed < stopSpeedKmh
+    }
+    stationary[0] = stationary[1]
+
+    // Stationary runs that are too short to be stops become part of the trip
+    for i := 0; i < len(points); {
+        j := i
+        for j+1 < len(points) && stationary[j+1] == stationary[i] {
+            j++
+        }
+        if stationary[i] && points[j].Time.Sub(points[i].Time) < minStopDuration {
+            for k := i; k <= j; k++ {
+                stationary[k] = false
+            }
+        }
+        i = j + 1
+    }
+
+    // Stops span their stationary points; trips run from the last point of
+    // the previous stop to the first point of the next one
+    var segments []Segment
+    for i := 0; i < len(points); {
+        j := i
+        for j+1 < len(points) && stationary[j+1] == stationary[i] {
+            j++
+        }
+        kind := SegmentStop
+        start, end := i, j
+        if !stationary[i] {
+            kind = SegmentTrip
+            if start > 0 {
+                start--
+            }
+            if end+1 < len(points) {
+                end++
+            }
+        }
+        if end > start {
+            segments = append(segments, newSegment(taxiID, kind, points[start:end+1]))
+        }
+        i = j + 1
+    }
+    return segments
+}
+
+// newSegment summarises the points of one trip or stop
+func newSegment(taxiID, kind string, points []trackPoint) Segment {
+    first, last := points[0], points[len(points)-1]
+    segment := Segment{
+        TaxiID:          taxiID,
+        Kind:            kind,
+        StartTime:       first.Time,
+        EndTime:         last.Time,
+        StartLongitude:  first.Longitude,
+        StartLatitude:   first.Latitude,
+        EndLongitude:    last.Longitude,
+        EndLatitude:     last.Latitude,
+        DurationSeconds: last.Time.Sub(first.Time).Seconds(),
+    }
+    for i := 1; i < len(points); i++ {
+        segment.DistanceMeters += pointDistance(points[i-1], points[i])
+    }
+    return segment
+}
+
+// pointDistance is the great-circle distance between two track points in metres
+func pointDistance(a, b trackPoint) float64 {
+    return geo.DistanceHaversine(orb.Point{a.Longitude, a.Latitude}, orb.Point{b.Longitude, b.Latitude})
+}
+
+// segmentTrips turns new location history into trips and stops. For every
+// taxi with unprocessed history it segments the points recorded since the end
+// of its last closed segment, stores all segments except the still-open last
+// one and advances the taxi's watermark.
+func segmentTrips() {
+    rows, err := db.Query(`SELECT h.taxi_id, h.tenant, MAX(h.history_id), s.processed_until
+        FROM location_history h
+        LEFT JOIN segmentation_state s ON s.tenant = h.tenant AND s.taxi_id = h.taxi_id
+        GROUP BY h.taxi_id, h.tenant, s.processed_until, s.last_history_id
+        HAVING s.last_history_id IS NULL OR MAX(h.history_id) > s.last_history_id`)
+    if err != nil {
+        log.Println("Error querying location history:", err)
+        return
+    }
+
+    type pendingTrack struct {
+        taxiID         string
+        tenant         string
+        lastHistoryID  int64
+        processedUntil sql.NullTime
+    }
+    var pending []pendingTrack
+    for rows.Next() {
+        var track pendingTrack
+        if err := rows.Scan(&track.taxiID, &track.tenant, &track.lastHistoryID, &track.processedUntil); err != nil {
+            log.Println("Error scanning location history:", err)
+            continue
+        }
+        pending = append(pending, track)
+    }
+    if err = rows.Err(); err != nil {
+        log.Println("Row iteration error:", err)
+    }
+    rows.Close()
+
+    // Places are loaded once per tenant rather than per segment
+    places := make(map[string][]placeShape)
+    for _, track := range pending {
+        shapes, ok := places[track.tenant]
+        if !ok {
+            if shapes, err = loadPlaceShapes(track.tenant); err != nil {
+                log.Printf("Failed to load places of tenant %s: %v\n", track.tenant, err)
+                continue
+            }
+            places[track.tenant] = shapes
+        }
+        if err := segmentTaxi(track.tenant, track.taxiID, shapes, track.lastHistoryID, track.processedUntil); err != nil {
+            log.Printf("Failed to segment history of Taxi ID %s: %v\n", track.taxiID, err)
+        }
+    }
+}
+
+// segmentTaxi segments one taxi's history from processedUntil onwards,
+// resolving segment ends against the places of the taxi's tenant
+func segmentTaxi(tenant, taxiID string, places []placeShape, lastHistoryID int64, processedUntil sql.NullTime) error {
+    since := time.Time{}
+    if processedUntil.Valid {
+        since = processedUntil.Time
+    }
+
+    rows, err := db.Query(`SELECT COALESCE(smoothed_longitude, longitude), COALESCE(smoothed_latitude, latitude), device_time
+        FROM location_history
+        WHERE tenant = $1 AND taxi_id = $2 AND device_time >= $3 AND history_id <= $4
+        ORDER BY device_time`,
+        tenant, taxiID, since, lastHistoryID)
+    if err != nil {
+        return err
+    }
+    var points []trackPoint
+    for rows.Next() {
+        var point trackPoint
+        if err := rows.Scan(&point.Longitude, &point.Latitude, &point.Time); err != nil {
+            rows.Close()
+            return err
+        }
+        points = append(points, point)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    segments := segmentTrack(taxiID, points)
+    if len(segments) > 0 {
+        // The last segment is still open
+        segments = segments[:len(segments)-1]
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, segment := range segments {
+        startPlace := placeAt(places, segment.StartLongitude, segment.StartLatitude)
+        endPlace := placeAt(places, segment.EndLongitude, segment.EndLatitude)
+        _, err := tx.Exec(`INSERT INTO segments (tenant, taxi_id, kind, start_time, end_time,
+                start_longitude, start_latitude, end_longitude, end_latitude,
+                start_place_id, end_place_id, distance_meters, duration_seconds)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+            tenant, taxiID, segment.Kind, segment.StartTime, segment.EndTime,
+            segment.StartLongitude, segment.StartLatitude, segment.EndLongitude, segment.EndLatitude,
+            startPlace, endPlace, segment.DistanceMeters, segment.DurationSeconds)
+        if err != nil {
+            return err
+        }
+        processedUntil = sql.NullTime{Time: segment.EndTime, Valid: true}
+    }
+
+    _, err = tx.Exec(`INSERT INTO segmentation_state (tenant, taxi_id, processed_until, last_history_id)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (tenant, taxi_id) DO UPDATE
+        SET processed_until = EXCLUDED.processed_until, last_history_id = EXCLUDED.last_history_id`,
+        tenant, taxiID, processedUntil, lastHistoryID)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// placeAt resolves a point to the ID of the place containing it, or NULL outside every place
+func placeAt(places []placeShape, longitude, latitude float64) sql.NullInt64 {
+    placeID, ok := placeContaining(places, longitude, latitude)
+    if !ok {
+        return sql.NullInt64{}
+    }
+    return sql.NullInt64{Int64: int64(placeID), Valid: true}
+}
+
+// tripSorts are the sort orders offered by getTaxiTrips
+var tripSorts = map[string]sortOption{
+    "start_time": {Expr: "start_time", Type: "TIMESTAMPTZ", Tiebreak: "segment_id"},
+}
+
+// getTaxiTrips lists a taxi's trips a page at a time, newest first.
+// ?kind=stop returns stops and ?kind=all both; ?from= and ?to= (RFC 3339)
+// bound the start time.
+func getTaxiTrips(w http.ResponseWriter, r *http.Request) {
+    taxiID := mux.Vars(r)["id"]
+    query := r.URL.Query()
+
+    kinds := []string{SegmentTrip}
+    switch query.Get("kind") {
+    case "", SegmentTrip:
+    case SegmentStop:
+        kinds = []string{SegmentStop}
+    case "all":
+        kinds = []string{SegmentTrip, SegmentStop}
+    default:
+        writeError(w, r, http.StatusBadRequest, "Invalid kind")
+        return
+    }
+
+    from, to, err := parseTimeRange(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    page, err := parsePage(r, tripSorts, "-start_time")
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    }
+    if !requireTaxi(w, r, taxiID) {
+        return
+    }
+
+    var f sqlFilter
+    f.where("tenant = %s AND taxi_id = %s", taxiTenant(r), taxiID)
+    f.where("kind = ANY(%s)", pq.Array(kinds))
+    f.where("start_time >= %s AND start_time < %s", from, to)
+    suffix := page.apply(&f)
+
+    rows, err := db.Query(`SELECT segment_id, taxi_id, kind, start_time, end_time,
+            start_longitude, start_latitude, end_longitude, end_latitude,
+            start_place_id, end_place_id, distance_meters, duration_seconds, `+page.sortKeySQL()+`
+        FROM segments`+f.clause()+suffix, f.args...)
+    if err != nil {
+        log.Println("Error querying trips:", err)
+        writeError(w, r, http.StatusInternalServerError, "Failed to query trips")
+        return
+    }
+    defer rows.Close()
+
+    segments := []Segment{}
+    var keys [][2]string
+    for rows.Next() {
+        var segment Segment
+        var startPlace, endPlace sql.NullInt64
+        var key [2]string
+        if err := rows.Scan(&segment.SegmentID, &segment.TaxiID, &segment.Kind, &segment.StartTime, &segment.EndTime,
+            &segment.StartLongitude, &segment.StartLatitude, &segment.EndLongitude, &segment.EndLatitude,
+            &startPlace, &endPlace, &segment.DistanceMeters, &segment.DurationSeconds, &key[0], &key[1]); err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to scan trip")
+            return
+        }
+        segment.StartPlaceID = nullIntPtr(startPlace)
+        segment.EndPlaceID = nullIntPtr(endPlace)
+        segments = append(segments, segment)
+        keys = append(keys, key)
+    }
+
+    n, next := page.nextCursor(len(segments), keys)
+    writePage(w, r, segments[:n], next)
+}
+
+// nullIntPtr converts a nullable integer column to an optional JSON field
+func nullIntPtr(n sql.NullInt64) *int {
+    if !n.Valid {
+        return nil
+    }
+    v := int(n.Int64)
+    return &v
+}
+
+// parseTimeRange reads the optional ?from= and ?to= RFC 3339 parameters. The
+// range defaults to everything up to now.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+    from, to := time.Unix(0, 0).UTC(), time.Now().UTC()
+    if value := r.URL.Query().Get("from"); value != "" {
+        t, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            return from, to, errInvalidFrom
+        }
+        from = t
+    }
+    if value := r.URL.Query().Get("to"); value != "" {
+        t, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            return from, to, errInvalidTo
+        }
+        to = t
+    }
+    return from, to, nil
+}
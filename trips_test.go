@@ -0,0 +1,155 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+// metresPerMinute is the longitude step of a vehicle driving east along the
+// equator at 36 km/h, one fix a minute
+const metresPerMinute = 600.0
+
+// track builds a track along the equator starting at start with one fix a
+// minute. moving[i] tells whether fix i+1 moved away from fix i.
+func track(start time.Time, moving ...bool) []trackPoint {
+    step := metresPerMinute / (math.Pi * 6378137 / 180)
+    points := []trackPoint{{Longitude: 106.8, Time: start}}
+    for i, moved := range moving {
+        point := trackPoint{Longitude: points[i].Longitude, Time: start.Add(time.Duration(i+1) * time.Minute)}
+        if moved {
+            point.Longitude += step
+        }
+        points = append(points, point)
+    }
+    return points
+}
+
+func TestSegmentTrack(t *testing.T) {
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    const drive, park = true, false
+
+    // span is the expected kind and start and end minute of a segment
+    type span struct {
+        kind       string
+        start, end int
+    }
+    tests := []struct {
+        name   string
+        points []trackPoint
+        want   []span
+    }{
+        {"no points", nil, nil},
+        {"single point", track(start), nil},
+        {"single trip", track(start, drive, drive, drive, drive), []span{{SegmentTrip, 0, 4}}},
+        {"trip, stop, trip", track(start, drive, drive, drive, park, park, park, park, park, drive, drive, drive),
+            []span{{SegmentTrip, 0, 4}, {SegmentStop, 4, 8}, {SegmentTrip, 8, 11}}},
+        {"short pause stays in the trip", track(start, drive, drive, drive, park, park, drive, drive, drive),
+            []span{{SegmentTrip, 0, 8}}},
+        {"stop then trip", track(start, park, park, park, park, park, drive, drive, drive),
+            []span{{SegmentStop, 0, 5}, {SegmentTrip, 5, 8}}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            segments := segmentTrack("t1", test.points)
+            if len(segments) != len(test.want) {
+                t.Fatalf("got %d segments, want %d: %+v", len(segments), len(test.want), segments)
+            }
+            for i, want := range test.want {
+                segment := segments[i]
+                wantStart, wantEnd := start.Add(time.Duration(want.start)*time.Minute), start.Add(time.Duration(want.end)*time.Minute)
+                if segment.Kind != want.kind || !segment.StartTime.Equal(wantStart) || !segment.EndTime.Equal(wantEnd) {
+                    t.Errorf("segment %d is a %s from %s to %s, want a %s from minute %d to %d",
+                        i, segment.Kind, segment.StartTime, segment.EndTime, want.kind, want.start, want.end)
+                }
+            }
+        })
+    }
+}
+
+func TestSegmentTrackTotals(t *testing.T) {
+    start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+    segments := segmentTrack("t1", track(start, true, true, true, false, false, false, false, false, true, true, true))
+
+    for _, segment := range segments {
+        if want := segment.EndTime.Sub(segment.StartTime).Seconds(); segment.DurationSeconds != want {
+            t.Errorf("%s lasted %v seconds, want %v", segment.Kind, segment.DurationSeconds, want)
+        }
+    }
+    // Both trips drive for three minutes and the stop stands still
+    for i, want := range []float64{3 * metresPerMinute, 0, 3 * metresPerMinute} {
+        if math.Abs(segments[i].DistanceMeters-want) > 1 {
+            t.Errorf("segment %d covered %.1f m, want %.1f m", i, segments[i].DistanceMeters, want)
+        }
+    }
+}
+
+func TestSegmentTripsLoadsPlacesOncePerTenant(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("FROM location_history h").
+        WillReturnRows(sqlmock.NewRows([]string{"taxi_id", "tenant", "last_history_id", "processed_until"}).
+            AddRow("t1", "acme", 10, nil).
+            AddRow("t2", "acme", 20, nil).
+            AddRow("t1", "globex", 30, nil))
+
+    for _, taxi := range []struct {
+        tenant, taxiID string
+        lastHistoryID  int
+    }{{"acme", "t1", 10}, {"acme", "t2", 20}, {"globex", "t1", 30}} {
+        if taxi.taxiID == "t1" {
+            mock.ExpectQuery("SELECT place_id, polygon FROM places").WithArgs(taxi.tenant).
+                WillReturnRows(sqlmock.NewRows([]string{"place_id", "polygon"}))
+        }
+        mock.ExpectQuery("FROM location_history").WithArgs(taxi.tenant, taxi.taxiID, sqlmock.AnyArg(), taxi.lastHistoryID).
+            WillReturnRows(sqlmock.NewRows([]string{"longitude", "latitude", "device_time"}))
+        mock.ExpectBegin()
+        mock.ExpectExec("INSERT INTO segmentation_state").
+            WithArgs(taxi.tenant, taxi.taxiID, nil, taxi.lastHistoryID).
+            WillReturnResult(sqlmock.NewResult(0, 1))
+        mock.ExpectCommit()
+    }
+
+    segmentTrips()
+}
+
+func TestGetTaxiTripsPages(t *testing.T) {
+    setAuth(t, false)
+    mock := mockDB(t)
+    now := time.Now().UTC().Truncate(time.Second)
+    columns := []string{"segment_id", "taxi_id", "kind", "start_time", "end_time",
+        "start_longitude", "start_latitude", "end_longitude", "end_latitude",
+        "start_place_id", "end_place_id", "distance_meters", "duration_seconds", "key", "tiebreak"}
+
+    mock.ExpectQuery("SELECT EXISTS").WithArgs("t1", defaultTenant).
+        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+    // One row more than the page size tells the handler there is a next page
+    mock.ExpectQuery(`FROM segments WHERE .* ORDER BY start_time DESC, segment_id DESC LIMIT \$\d+`).
+        WillReturnRows(sqlmock.NewRows(columns).
+            AddRow(2, "t1", SegmentTrip, now.Add(-time.Hour), now, 106.8, -6.2, 106.81, -6.21, nil, nil, 1500.0, 3600.0,
+                now.Add(-time.Hour).Format(time.RFC3339Nano), "2").
+            AddRow(1, "t1", SegmentTrip, now.Add(-3*time.Hour), now.Add(-2*time.Hour), 106.8, -6.2, 106.81, -6.21, nil, nil, 1500.0, 3600.0,
+                now.Add(-3*time.Hour).Format(time.RFC3339Nano), "1"))
+
+    w := httptest.NewRecorder()
+    r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/taxi/t1/trips?limit=1", nil), map[string]string{"id": "t1"})
+    getTaxiTrips(w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("got status %d: %s", w.Code, w.Body)
+    }
+    var page struct {
+        Items      []Segment `json:"items"`
+        NextCursor string    `json:"next_cursor"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+        t.Fatal(err)
+    }
+    if len(page.Items) != 1 || page.Items[0].SegmentID != 2 || page.NextCursor == "" {
+        t.Fatalf("got %+v, want the newest trip and a next cursor", page)
+    }
+}